@@ -0,0 +1,39 @@
+package globals
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The baseline models are frozen copies of models.OrgTable and
+// models.OrgDomainTable as they were when migration 1 was released. Never
+// edit them; change the schema with a new migration.
+
+type baselineOrg struct {
+	Id            int32               `gorm:"column:id;primaryKey;autoIncrement"`
+	Uid           uuid.UUID           `gorm:"column:uid;type:uuid;not null;index:idx_orgs_uid,unique"`
+	Name          string              `gorm:"column:name;size:64;not null;index:idx_orgs_name,unique"`
+	NameFormatted sql.NullString      `gorm:"column:name_formatted;size:64;"`
+	Slug          string              `gorm:"column:slug;type:string;not null;size:64;index:idx_orgs_slug,unique"`
+	Status        int16               `gorm:"column:status;index:idx_orgs_status"`
+	IsRoot        bool                `gorm:"column:is_root"`
+	CreatedAt     time.Time           `gorm:"column:created_at;autoCreateTime"`
+	UpdatedAt     time.Time           `gorm:"column:updated_at;autoUpdateTime"`
+	Domains       []baselineOrgDomain `gorm:"foreignKey:OrgId;references:Id"`
+}
+
+func (baselineOrg) TableName() string {
+	return "orgs"
+}
+
+type baselineOrgDomain struct {
+	Id     int32  `gorm:"column:id;primaryKey;autoIncrement"`
+	OrgId  int32  `gorm:"column:org_id;index:idx_org_domains_org_id"`
+	Domain string `gorm:"column:domain;size:256;not null;index:idx_org_domains_domain,unique"`
+}
+
+func (baselineOrgDomain) TableName() string {
+	return "org_domains"
+}
@@ -1,23 +1,42 @@
 package globals
 
 import (
-	"github.com/gnomego/apps/gs/models"
 	"github.com/gnomego/apps/gs/validation"
+	"github.com/gnomego/sdk/stores/iam"
 	"gorm.io/gorm"
 )
 
 var db *gorm.DB
 var validiator *validation.GsValidator
 
-func InitDb(d *gorm.DB, migrate bool) {
+// MigrationModule names the gs migrations in schema_migrations.
+const MigrationModule = "gs"
+
+// Migrations are the schema versions of the gs tables. Add a migration for
+// every schema change instead of editing a released one; the baseline
+// creates the frozen models in baseline.go.
+var Migrations = []iam.Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Models:  []interface{}{&baselineOrg{}, &baselineOrgDomain{}},
+	},
+}
+
+func InitDb(d *gorm.DB, migrate bool) error {
 	db = d
 
-	if migrate {
-		db.AutoMigrate(
-			models.OrgTable{},
-			models.OrgDomainTable{})
+	if !migrate {
+		return nil
+	}
+
+	runner, err := iam.NewMigrationRunner(db, MigrationModule, Migrations, nil)
+	if err != nil {
+		return err
 	}
 
+	_, err = runner.Up()
+	return err
 }
 
 func GetDb() *gorm.DB {
@@ -28,6 +47,12 @@ func GetDb() *gorm.DB {
 	return db
 }
 
+// SetValidator sets the validator returned by GetValidator, usually one made
+// by validation.NewGsValidator().RegisterGsValidation().
+func SetValidator(v *validation.GsValidator) {
+	validiator = v
+}
+
 func GetValidator() *validation.GsValidator {
 	if validiator == nil {
 		panic("validator not initialized")
@@ -1,5 +1,7 @@
 package models
 
+import "github.com/gnomego/sdk/stores/iam"
+
 const (
 	STATUS_ACTIVE          = 1
 	STATUS_INACTIVE        = 0
@@ -18,4 +20,21 @@ type PageRequest struct {
 	Size   int      `json:"size" form:"size"`
 	Expand []string `json:"$expand" form:"expand"`
 	Filter []string `json:"$filter" form:"filter"`
+	// OrderBy is a sort like "name,-createdAt".
+	OrderBy string `json:"$orderby" form:"orderby"`
+	// Cursor is the next cursor of the previous page.
+	Cursor string `json:"$cursor" form:"cursor"`
+	Count  bool   `json:"$count" form:"count"`
+}
+
+// PageQuery returns the keyset page the request asks for. Page is ignored;
+// use Cursor to move through a list. Every entry of Filter must match.
+func (r *PageRequest) PageQuery() *iam.PageQuery {
+	return &iam.PageQuery{
+		Size:    r.Size,
+		Cursor:  r.Cursor,
+		Sort:    r.OrderBy,
+		Filters: r.Filter,
+		Total:   r.Count,
+	}
 }
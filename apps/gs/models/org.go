@@ -1,12 +1,14 @@
 package models
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"slices"
 	"strings"
 	"time"
 
+	"github.com/gnomego/sdk/stores/iam"
 	"github.com/gobuffalo/flect"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -101,8 +103,32 @@ func NewOrgRepo(db *gorm.DB) *OrgRepo {
 	}
 }
 
+// WithContext returns a copy of the repo whose queries use ctx.
+func (s *OrgRepo) WithContext(ctx context.Context) *OrgRepo {
+	return &OrgRepo{
+		db: s.db.WithContext(ctx),
+	}
+}
+
+// WithTx returns a copy of the repo that works in the transaction tx.
+func (s *OrgRepo) WithTx(tx *gorm.DB) *OrgRepo {
+	return &OrgRepo{
+		db: tx,
+	}
+}
+
+// Transaction runs fn with a repo on a transaction bound to ctx. It commits
+// when fn returns nil and rolls back otherwise.
+func (s *OrgRepo) Transaction(ctx context.Context, fn func(repo *OrgRepo) error) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(s.WithTx(tx))
+	})
+}
+
+// Create inserts the org. It returns an iam.ConflictError when the name or
+// slug is taken.
 func (s *OrgRepo) Create(org *OrgTable) error {
-	return s.db.Create(org).Error
+	return iam.TranslateError(s.db.Create(org).Error, "orgs")
 }
 
 func (s *OrgRepo) Count() (int64, error) {
@@ -129,6 +155,10 @@ func (os *OrgRepo) FindByUid(uid uuid.UUID, expand ...string) (*OrgTable, error)
 	}
 
 	err := tx.Where("uid = ?", uid).First(org).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, &iam.NotFoundError{Entity: "org"}
+	}
+
 	return org, err
 }
 
@@ -142,9 +172,15 @@ func (os *OrgRepo) FindBySlug(slug string, expand ...string) (*OrgTable, error)
 	}
 
 	err := tx.Where("slug = ?", slug).First(org).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, &iam.NotFoundError{Entity: "org"}
+	}
+
 	return org, err
 }
 
+// FindByName returns the org with the name, compared case insensitively, or
+// nil when there is none.
 func (os *OrgRepo) FindByName(name string, expand ...string) (*OrgTable, error) {
 	org := &OrgTable{}
 
@@ -157,7 +193,7 @@ func (os *OrgRepo) FindByName(name string, expand ...string) (*OrgTable, error)
 		tx = tx.Preload("Domains")
 	}
 
-	r := tx.Where("name = ?", name).First(org)
+	r := tx.Where("name = ?", name).Limit(1).Find(org)
 	if r.Error != nil {
 		return nil, r.Error
 	}
@@ -172,7 +208,7 @@ func (os *OrgRepo) FindByName(name string, expand ...string) (*OrgTable, error)
 func (os *OrgRepo) UpdateName(uid string, name string) error {
 	id, err := uuid.Parse(uid)
 	if err != nil {
-		return fmt.Errorf("invalid uid: %s", uid)
+		return iam.ErrInvalidId
 	}
 
 	n := strings.TrimSpace(name)
@@ -192,7 +228,7 @@ func (os *OrgRepo) UpdateName(uid string, name string) error {
 func (os *OrgRepo) UpdateSlug(uid string, slug string) error {
 	id, err := uuid.Parse(uid)
 	if err != nil {
-		return fmt.Errorf("invalid uid: %s", uid)
+		return iam.ErrInvalidId
 	}
 
 	return os.db.Model(OrgTable{}).Where("uid = ?", id).Update("slug", slug).Error
@@ -206,6 +242,37 @@ func (os *OrgRepo) Delete(org *OrgTable) error {
 	return os.db.Delete(org).Error
 }
 
+// OrgFilter lists the org fields a $filter may use.
+var OrgFilter = iam.Filter{Fields: map[string]iam.FilterField{
+	"id":        {Column: "uid", Type: iam.FilterUuid},
+	"name":      {Column: "name"},
+	"slug":      {Column: "slug"},
+	"status":    {Column: "status", Type: iam.FilterNumber},
+	"root":      {Column: "is_root", Type: iam.FilterBool},
+	"createdAt": {Column: "created_at", Type: iam.FilterTime},
+}}
+
+// OrgPager sorts org lists on name, slug or creation time.
+var OrgPager = iam.Pager{
+	Fields: map[string]string{
+		"name":      "name",
+		"slug":      "slug",
+		"createdAt": "created_at",
+	},
+	Default: []iam.SortField{{Field: "name"}},
+	Filter:  &OrgFilter,
+}
+
+// List returns a page of orgs sorted and paged by q.
+func (os *OrgRepo) List(q *iam.PageQuery, expand ...string) (*iam.PageResult[OrgTable], error) {
+	tx := os.db
+	if slices.Contains(expand, "domains") {
+		tx = tx.Preload("Domains")
+	}
+
+	return iam.Paginate[OrgTable](tx, &OrgPager, q)
+}
+
 func (os *OrgRepo) All() ([]OrgTable, error) {
 	orgs := []OrgTable{}
 	err := os.db.Find(&orgs).Error
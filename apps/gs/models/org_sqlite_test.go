@@ -1,9 +1,13 @@
 package models_test
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/gnomego/apps/gs/models"
+	"github.com/gnomego/sdk/stores/iam"
+	"github.com/google/uuid"
 	assert2 "github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -124,6 +128,20 @@ func TestOrgStore(t *testing.T) {
 	assert.Equal("wwf", one.Name)
 	assert.Equal("WWF", one.NameFormatted.String)
 
+	// a missing name is not an error
+	one, err = repo.FindByName("Missing Org")
+	assert.NoError(err)
+	assert.Nil(one)
+
+	_, err = repo.FindByUid(uuid.New())
+	assert.ErrorIs(err, iam.ErrNotFound)
+
+	assert.ErrorIs(repo.UpdateSlug("not-a-uuid", "x"), iam.ErrInvalidId)
+
+	dup := &models.OrgTable{Slug: "test-org"}
+	dup.SetName("Another Org")
+	assert.ErrorIs(repo.Create(dup), iam.ErrConflict)
+
 	count, err := repo.Count()
 	if err != nil {
 		t.Fatalf("failed to count orgs: %v", err)
@@ -149,4 +167,24 @@ func TestOrgStore(t *testing.T) {
 	}
 
 	assert.Equal(int64(1), count)
+
+	// a failed transaction creates nothing
+	err = repo.Transaction(context.Background(), func(tx *models.OrgRepo) error {
+		org3 := &models.OrgTable{Slug: "test-org-3"}
+		org3.SetName("Test Org 3")
+		err := tx.Create(org3)
+		if err != nil {
+			return err
+		}
+
+		return errors.New("rollback")
+	})
+	assert.Error(err)
+
+	count, err = repo.Count()
+	if err != nil {
+		t.Fatalf("failed to count orgs: %v", err)
+	}
+
+	assert.Equal(int64(1), count)
 }
@@ -0,0 +1,65 @@
+// Package authz guards gs routes with the iam policy engine.
+package authz
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnomego/apps/gs/einfo"
+	"github.com/gnomego/apps/gs/log"
+	"github.com/gnomego/sdk/stores/iam/policy"
+)
+
+// DecisionKey is the context key under which Require stores the decision.
+const DecisionKey = "authz.decision"
+
+// SubjectFunc returns the subject attributes of the user making the request,
+// or false when nobody is signed in.
+type SubjectFunc func(c *gin.Context) (policy.Attributes, bool)
+
+// ResourceFunc describes the resource the request acts on, usually from the
+// route parameters.
+type ResourceFunc func(c *gin.Context) (policy.Resource, error)
+
+// Require lets the request through only when the engine allows action on the
+// resource. Anonymous requests get 401 and denied ones 403. The client IP is
+// passed to the policies as env.ip.
+func Require(engine *policy.Engine, action string, subject SubjectFunc, resource ResourceFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := subject(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, einfo.NewErrorInfo("unauthorized", "Sign in to continue"))
+			return
+		}
+
+		r, err := resource(c)
+		if err != nil {
+			log.Error(err, "failed to describe the resource for %s", action)
+			c.AbortWithStatusJSON(http.StatusBadRequest, einfo.MapWithCode("invalid_resource", err))
+			return
+		}
+
+		decision := engine.Evaluate(&policy.Request{
+			Subject:     s,
+			Action:      action,
+			Resource:    r,
+			Environment: policy.Attributes{"ip": c.ClientIP()},
+		})
+		c.Set(DecisionKey, decision)
+
+		if !decision.Allowed {
+			c.AbortWithStatusJSON(http.StatusForbidden, einfo.NewErrorInfo("forbidden", decision.Reason))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ResourceType describes every request as a resource of type t, with the
+// route parameter named by idParam as its id.
+func ResourceType(t string, idParam string) ResourceFunc {
+	return func(c *gin.Context) (policy.Resource, error) {
+		return policy.Resource{Type: t, Id: c.Param(idParam)}, nil
+	}
+}
@@ -0,0 +1,65 @@
+package authz_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnomego/apps/gs/routes/authz"
+	"github.com/gnomego/sdk/stores/iam/policy"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestRequire(t *testing.T) {
+	assert := assert2.New(t)
+	gin.SetMode(gin.TestMode)
+
+	engine, err := policy.NewEngine(policy.Policy{
+		Id:        "admins-read-reports",
+		Effect:    policy.Allow,
+		Actions:   []string{"report:read"},
+		Resources: []string{"report"},
+		Condition: &policy.Condition{Attr: "subject.roles", Op: policy.OpContains, Value: "admin"},
+	})
+	assert.NoError(err)
+
+	subject := func(c *gin.Context) (policy.Attributes, bool) {
+		roles := c.GetHeader("X-Roles")
+		if roles == "" {
+			return nil, false
+		}
+
+		return policy.Attributes{"roles": []string{roles}}, true
+	}
+
+	r := gin.New()
+	r.GET("/reports/:id",
+		authz.Require(engine, "report:read", subject, authz.ResourceType("report", "id")),
+		func(c *gin.Context) {
+			decision := c.MustGet(authz.DecisionKey).(*policy.Decision)
+			c.String(http.StatusOK, decision.PolicyId)
+		})
+
+	status := func(roles string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/reports/1", nil)
+		if roles != "" {
+			req.Header.Set("X-Roles", roles)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	code, _ := status("")
+	assert.Equal(http.StatusUnauthorized, code)
+
+	code, body := status("viewer")
+	assert.Equal(http.StatusForbidden, code)
+	assert.Contains(body, "no policy allows report:read on report")
+
+	code, body = status("admin")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("admins-read-reports", body)
+}
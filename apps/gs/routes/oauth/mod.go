@@ -0,0 +1,237 @@
+package oauth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnomego/apps/gs/log"
+	iamoauth "github.com/gnomego/sdk/stores/iam/oauth"
+)
+
+// CurrentUserFunc returns the id of the user signed in to gs for the request.
+type CurrentUserFunc func(c *gin.Context) (int32, bool)
+
+type Handlers struct {
+	server      *iamoauth.Server
+	currentUser CurrentUserFunc
+	loginUrl    string
+}
+
+// Register mounts the authorization server endpoints on r. Users that are not
+// signed in are sent to loginUrl with a return_to parameter.
+func Register(r gin.IRouter, server *iamoauth.Server, currentUser CurrentUserFunc, loginUrl string) *Handlers {
+	h := &Handlers{
+		server:      server,
+		currentUser: currentUser,
+		loginUrl:    loginUrl,
+	}
+
+	e := server.Endpoints
+	r.GET("/.well-known/openid-configuration", h.Discovery)
+	r.GET(e.Jwks, h.Jwks)
+	r.GET(e.Authorization, h.Authorize)
+	r.POST(e.Token, h.Token)
+	r.GET(e.UserInfo, h.UserInfo)
+	r.POST(e.UserInfo, h.UserInfo)
+	r.POST(e.Introspection, h.Introspect)
+	r.POST(e.Revocation, h.Revoke)
+
+	return h
+}
+
+func (h *Handlers) Discovery(c *gin.Context) {
+	c.JSON(http.StatusOK, h.server.Metadata())
+}
+
+func (h *Handlers) Jwks(c *gin.Context) {
+	set, err := h.server.Jwks()
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, set)
+}
+
+func (h *Handlers) Authorize(c *gin.Context) {
+	req := &iamoauth.AuthorizeRequest{
+		ResponseType:        c.Query("response_type"),
+		ClientId:            c.Query("client_id"),
+		RedirectUri:         c.Query("redirect_uri"),
+		Scope:               c.Query("scope"),
+		State:               c.Query("state"),
+		Nonce:               c.Query("nonce"),
+		CodeChallenge:       c.Query("code_challenge"),
+		CodeChallengeMethod: c.Query("code_challenge_method"),
+	}
+
+	_, redirectable, err := h.server.ValidateAuthorizeRequest(req)
+	if err != nil {
+		if redirectable {
+			redirectWithError(c, req, err)
+			return
+		}
+
+		writeError(c, err)
+		return
+	}
+
+	userId, ok := h.currentUser(c)
+	if !ok {
+		c.Redirect(http.StatusFound, h.loginUrl+"?return_to="+url.QueryEscape(c.Request.URL.RequestURI()))
+		return
+	}
+
+	code, err := h.server.Authorize(req, userId)
+	if err != nil {
+		redirectWithError(c, req, err)
+		return
+	}
+
+	values := url.Values{}
+	values.Set("code", code)
+	if req.State != "" {
+		values.Set("state", req.State)
+	}
+
+	c.Redirect(http.StatusFound, appendQuery(req.RedirectUri, values))
+}
+
+func (h *Handlers) Token(c *gin.Context) {
+	id, secret := clientCredentials(c)
+	req := &iamoauth.TokenRequest{
+		GrantType:    c.PostForm("grant_type"),
+		ClientId:     id,
+		ClientSecret: secret,
+		Code:         c.PostForm("code"),
+		RedirectUri:  c.PostForm("redirect_uri"),
+		CodeVerifier: c.PostForm("code_verifier"),
+		RefreshToken: c.PostForm("refresh_token"),
+		Scope:        c.PostForm("scope"),
+	}
+
+	res, err := h.server.Token(req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handlers) UserInfo(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		token = c.PostForm("access_token")
+	}
+
+	claims, err := h.server.UserInfo(token)
+	if err != nil {
+		var oerr *iamoauth.Error
+		if errors.As(err, &oerr) {
+			c.Header("WWW-Authenticate", `Bearer error="`+oerr.Code+`"`)
+		}
+
+		writeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, claims)
+}
+
+func (h *Handlers) Introspect(c *gin.Context) {
+	id, secret := clientCredentials(c)
+	client, err := h.server.AuthenticateClient(id, secret)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	res, err := h.server.Introspect(client, c.PostForm("token"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handlers) Revoke(c *gin.Context) {
+	id, secret := clientCredentials(c)
+	client, err := h.server.AuthenticateClient(id, secret)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	err = h.server.Revoke(client, c.PostForm("token"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// clientCredentials reads client_secret_basic credentials, falling back to
+// client_secret_post and then to a bare client_id for public clients.
+func clientCredentials(c *gin.Context) (string, string) {
+	id, secret, ok := c.Request.BasicAuth()
+	if ok {
+		if v, err := url.QueryUnescape(id); err == nil {
+			id = v
+		}
+
+		if v, err := url.QueryUnescape(secret); err == nil {
+			secret = v
+		}
+
+		return id, secret
+	}
+
+	return c.PostForm("client_id"), c.PostForm("client_secret")
+}
+
+func redirectWithError(c *gin.Context, req *iamoauth.AuthorizeRequest, err error) {
+	var oerr *iamoauth.Error
+	if !errors.As(err, &oerr) {
+		log.Error(err, "authorize request failed")
+		oerr = &iamoauth.Error{Code: "server_error"}
+	}
+
+	values := url.Values{}
+	values.Set("error", oerr.Code)
+	if oerr.Description != "" {
+		values.Set("error_description", oerr.Description)
+	}
+
+	if req.State != "" {
+		values.Set("state", req.State)
+	}
+
+	c.Redirect(http.StatusFound, appendQuery(req.RedirectUri, values))
+}
+
+func writeError(c *gin.Context, err error) {
+	var oerr *iamoauth.Error
+	if errors.As(err, &oerr) {
+		c.Header("Cache-Control", "no-store")
+		c.JSON(oerr.Status, oerr)
+		return
+	}
+
+	log.Error(err, "oauth request failed")
+	c.JSON(http.StatusInternalServerError, &iamoauth.Error{Code: "server_error"})
+}
+
+func appendQuery(uri string, values url.Values) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + values.Encode()
+	}
+
+	return uri + "?" + values.Encode()
+}
@@ -0,0 +1,182 @@
+package oauth_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnomego/apps/gs/routes/oauth"
+	"github.com/gnomego/sdk/stores/iam"
+	iamoauth "github.com/gnomego/sdk/stores/iam/oauth"
+	"github.com/gnomego/sdk/stores/iam/oidc"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func postForm(t *testing.T, endpoint string, id string, secret string, form url.Values) map[string]interface{} {
+	req, _ := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(id, secret)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	body := map[string]interface{}{}
+	_ = json.NewDecoder(res.Body).Decode(&body)
+	body["status"] = float64(res.StatusCode)
+	return body
+}
+
+func TestAuthorizationServer(t *testing.T) {
+	assert := assert2.New(t)
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+
+	db, err := gorm.Open(sqlite.Open("file:oauth?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	iamDb := &iam.IamDb{DB: db}
+	assert.NoError(iamDb.MigrateIam())
+
+	user, err := iamDb.NewUser("grace", "grace@test.org")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	secret, client, err := iamDb.RegisterOAuthClient(&iam.NewOAuthClient{
+		Name:           "tool",
+		IsConfidential: true,
+		RedirectUris:   []string{"http://localhost/callback"},
+		GrantTypes:     []string{iam.GrantAuthorizationCode, iam.GrantRefreshToken, iam.GrantClientCredentials},
+	})
+	if err != nil {
+		t.Fatalf("failed to register client: %v", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	server, err := iamoauth.NewServer(iamDb, "http://placeholder", key, "k1", nil)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	router := gin.New()
+	oauth.Register(router, server, func(c *gin.Context) (int32, bool) {
+		return user.Id, true
+	}, "/login")
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	server.Issuer = ts.URL
+
+	provider, err := oidc.Discover(ctx, ts.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to discover: %v", err)
+	}
+
+	rp := oidc.NewClient(provider, "gs", client.ClientId, secret, "http://localhost/callback")
+	authReq := rp.NewAuthRequest()
+
+	noRedirect := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := noRedirect.Get(authReq.Url)
+	if err != nil {
+		t.Fatalf("authorize failed: %v", err)
+	}
+	res.Body.Close()
+
+	loc, _ := url.Parse(res.Header.Get("Location"))
+	identity, err := rp.CompleteAuth(ctx, authReq, loc.Query().Get("state"), loc.Query().Get("code"))
+	if err != nil {
+		t.Fatalf("failed to complete auth: %v", err)
+	}
+
+	assert.Equal(user.Uid.String(), identity.IdToken.Subject)
+	assert.Equal("grace@test.org", identity.UserInfo.Email)
+
+	refreshed, err := rp.Refresh(ctx, identity.Token.RefreshToken)
+	assert.NoError(err)
+	assert.NotEqual(identity.Token.RefreshToken, refreshed.RefreshToken)
+
+	_, err = rp.Refresh(ctx, identity.Token.RefreshToken)
+	assert.Error(err)
+
+	cc := postForm(t, ts.URL+"/oauth2/token", client.ClientId, secret, url.Values{"grant_type": {"client_credentials"}})
+	assert.Equal(float64(200), cc["status"])
+
+	access := cc["access_token"].(string)
+	info := postForm(t, ts.URL+"/oauth2/introspect", client.ClientId, secret, url.Values{"token": {access}})
+	assert.Equal(true, info["active"])
+	assert.Equal(client.ClientId, info["sub"])
+
+	bad := postForm(t, ts.URL+"/oauth2/introspect", client.ClientId, "wrong", url.Values{"token": {access}})
+	assert.Equal(float64(401), bad["status"])
+	assert.Equal("invalid_client", bad["error"])
+
+	revoked := postForm(t, ts.URL+"/oauth2/revoke", client.ClientId, secret, url.Values{"token": {access}})
+	assert.Equal(float64(200), revoked["status"])
+
+	info = postForm(t, ts.URL+"/oauth2/introspect", client.ClientId, secret, url.Values{"token": {access}})
+	assert.Equal(false, info["active"])
+
+	// replaying a code revokes the tokens issued for it
+	res, err = noRedirect.Get(ts.URL + "/oauth2/authorize?response_type=code&scope=openid&client_id=" + client.ClientId + "&redirect_uri=http://localhost/callback")
+	if err != nil {
+		t.Fatalf("authorize failed: %v", err)
+	}
+	res.Body.Close()
+
+	loc, _ = url.Parse(res.Header.Get("Location"))
+	exchange := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {loc.Query().Get("code")},
+		"redirect_uri": {"http://localhost/callback"},
+	}
+	first := postForm(t, ts.URL+"/oauth2/token", client.ClientId, secret, exchange)
+	assert.Equal(float64(200), first["status"])
+
+	replay := postForm(t, ts.URL+"/oauth2/token", client.ClientId, secret, exchange)
+	assert.Equal("invalid_grant", replay["error"])
+
+	info = postForm(t, ts.URL+"/oauth2/introspect", client.ClientId, secret, url.Values{"token": {first["access_token"].(string)}})
+	assert.Equal(false, info["active"])
+
+	stale := postForm(t, ts.URL+"/oauth2/token", client.ClientId, secret, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {first["refresh_token"].(string)},
+	})
+	assert.Equal("invalid_grant", stale["error"])
+
+	// a banned user cannot keep refreshing
+	assert.NoError(db.Model(user).Update("status", iam.UserStatusBanned).Error)
+	banned := postForm(t, ts.URL+"/oauth2/token", client.ClientId, secret, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshed.RefreshToken},
+	})
+	assert.Equal("invalid_grant", banned["error"])
+
+	res, err = noRedirect.Get(ts.URL + "/oauth2/authorize?response_type=code&client_id=" + client.ClientId + "&redirect_uri=http://evil/cb")
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+}
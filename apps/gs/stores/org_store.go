@@ -1,6 +1,8 @@
 package stores
 
 import (
+	"context"
+
 	"github.com/gnomego/apps/gs/einfo"
 	"github.com/gnomego/apps/gs/globals"
 	"github.com/gnomego/apps/gs/log"
@@ -13,7 +15,7 @@ type OrgStore struct {
 
 type NewOrg struct {
 	Name    string   `json:"name" validate:"required,max=64"`
-	Slug    *string  `json:"slug" validate:"max=64"`
+	Slug    *string  `json:"slug" validate:"omitempty,max=64"`
 	Domains []string `json:"domains" validate:"dive,domain,max=256"`
 }
 
@@ -44,6 +46,14 @@ func NewOrgStore() *OrgStore {
 	}
 }
 
+// WithContext returns a copy of the store whose queries use ctx, usually
+// the context of the request.
+func (s *OrgStore) WithContext(ctx context.Context) *OrgStore {
+	return &OrgStore{
+		repo: s.repo.WithContext(ctx),
+	}
+}
+
 func (s *OrgStore) Create(org *NewOrg) *Response[*Org] {
 	response := &Response[*Org]{
 		Ok: true,
@@ -61,13 +71,13 @@ func (s *OrgStore) Create(org *NewOrg) *Response[*Org] {
 	if err != nil {
 		log.Error(err, "error finding org by name %s", org.Name)
 		response.Ok = false
-		response.Error = einfo.Sprintf("failed to find org by name: %v", org.Name)
+		response.Error = einfo.Sprintf("error", "failed to find org by name: %v", org.Name)
 		return response
 	}
 
 	if table != nil {
 		response.Ok = false
-		response.Error = einfo.Sprintf("org with name %s already exists", org.Name)
+		response.Error = einfo.Sprintf("conflict", "org with name %s already exists", org.Name).SetTarget("name")
 		return response
 	}
 
@@ -86,15 +96,44 @@ func (s *OrgStore) Create(org *NewOrg) *Response[*Org] {
 
 	err = s.repo.Create(table)
 	if err != nil {
-		log.Error(err, "error creating org %v", org.Name)
 		response.Ok = false
-		response.Error = einfo.Sprintf("failed to create org: %v", org.Name)
+		response.Error = mapError(err)
+		if response.Error == nil {
+			log.Error(err, "error creating org %v", org.Name)
+			response.Error = einfo.Sprintf("error", "failed to create org: %v", org.Name)
+		}
+
 		return response
 	}
 
+	response.Value = toOrg(table)
+
+	return response
+}
+
+// List returns a page of orgs. Pass the Next cursor of a response as the
+// Cursor of the request for the page after it.
+func (s *OrgStore) List(req *models.PageRequest) *PagedResponse[*Org] {
+	page, err := s.repo.List(req.PageQuery(), req.Expand...)
+	if err != nil {
+		e := mapError(err)
+		if e == nil {
+			log.Error(err, "error listing orgs")
+			e = einfo.NewErrorInfo("error", "failed to list orgs")
+		}
+
+		return &PagedResponse[*Org]{Ok: false, Error: e}
+	}
+
+	return newPagedResponse(page, func(table models.OrgTable) *Org {
+		return toOrg(&table)
+	})
+}
+
+func toOrg(table *models.OrgTable) *Org {
 	status := mapToStatus(table.Status)
 
-	response.Value = &Org{
+	return &Org{
 		Id:      table.Uid.String(),
 		Name:    table.Name,
 		Slug:    table.Slug,
@@ -102,8 +141,6 @@ func (s *OrgStore) Create(org *NewOrg) *Response[*Org] {
 		IsRoot:  table.IsRoot,
 		Domains: table.GetDomains(),
 	}
-
-	return response
 }
 
 func mapToStatus(s int16) string {
@@ -0,0 +1,121 @@
+package stores_test
+
+import (
+	"testing"
+
+	"github.com/gnomego/apps/gs/globals"
+	"github.com/gnomego/apps/gs/models"
+	"github.com/gnomego/apps/gs/stores"
+	"github.com/gnomego/apps/gs/validation"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestOrgStoreCreate(t *testing.T) {
+	assert := assert2.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:TestOrgStoreCreate?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	err = globals.InitDb(db, true)
+	if err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	globals.SetValidator(validation.NewGsValidator().RegisterGsValidation())
+	store := stores.NewOrgStore()
+
+	res := store.Create(&stores.NewOrg{Name: "Acme Corp", Domains: []string{"acme.test"}})
+	if !assert.True(res.Ok, "%v", res.Error) {
+		return
+	}
+
+	assert.Equal("acme corp", res.Value.Name)
+	assert.Equal("acme-corp", res.Value.Slug)
+	assert.Equal([]string{"acme.test"}, res.Value.Domains)
+
+	res = store.Create(&stores.NewOrg{Name: "ACME Corp"})
+	assert.False(res.Ok)
+	assert.Equal("conflict", res.Error.Code)
+
+	// the name is free but the slug is taken
+	slug := "acme-corp"
+	res = store.Create(&stores.NewOrg{Name: "Acme", Slug: &slug})
+	assert.False(res.Ok)
+	assert.Equal("conflict", res.Error.Code)
+	if assert.Len(res.Error.Details, 1) {
+		assert.Equal("slug", *res.Error.Details[0].Target)
+	}
+
+	res = store.Create(&stores.NewOrg{})
+	assert.False(res.Ok)
+	assert.Equal("validation", res.Error.Code)
+}
+
+func TestOrgStoreList(t *testing.T) {
+	assert := assert2.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:TestOrgStoreList?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	err = globals.InitDb(db, true)
+	if err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	globals.SetValidator(validation.NewGsValidator().RegisterGsValidation())
+	store := stores.NewOrgStore()
+
+	for _, name := range []string{"Initech", "Acme", "Umbrella", "Globex", "Hooli"} {
+		res := store.Create(&stores.NewOrg{Name: name})
+		if !res.Ok {
+			t.Fatalf("failed to create org: %v", res.Error)
+		}
+	}
+
+	// the cursor carries the created_at of the last org
+	req := &models.PageRequest{Size: 2, OrderBy: "-createdAt", Count: true}
+	names := []string{}
+	for {
+		res := store.List(req)
+		if !assert.True(res.Ok, "%v", res.Error) {
+			return
+		}
+
+		if req.Cursor == "" {
+			assert.Equal(int64(5), *res.Total)
+		}
+
+		for _, org := range res.Values {
+			names = append(names, org.Name)
+		}
+
+		if res.Next == "" {
+			break
+		}
+
+		req.Cursor = res.Next
+	}
+
+	assert.Equal([]string{"hooli", "globex", "umbrella", "acme", "initech"}, names)
+
+	res := store.List(&models.PageRequest{OrderBy: "status"})
+	assert.False(res.Ok)
+	assert.Equal("validation", res.Error.Code)
+
+	// filters are and-ed together
+	res = store.List(&models.PageRequest{Filter: []string{"startswith(name, 'h') or name eq 'acme'", "root eq false"}})
+	if assert.True(res.Ok, "%v", res.Error) {
+		assert.Len(res.Values, 2)
+	}
+
+	// an entry cannot close its own group to escape the others
+	res = store.List(&models.PageRequest{Filter: []string{"name eq 'acme') or (name ne ''", "root eq true"}})
+	assert.False(res.Ok)
+	assert.Equal("validation", res.Error.Code)
+}
@@ -1,6 +1,11 @@
 package stores
 
-import "github.com/gnomego/apps/gs/einfo"
+import (
+	"errors"
+
+	"github.com/gnomego/apps/gs/einfo"
+	"github.com/gnomego/sdk/stores/iam"
+)
 
 type Response[T any] struct {
 	Value T                `json:"values,omitempty"`
@@ -14,5 +19,65 @@ type PagedResponse[T any] struct {
 	Error  *einfo.ErrorInfo `json:"error,omitempty"`
 	Page   int              `json:"page,omitempty"`
 	Size   int              `json:"size,omitempty"`
-	Total  int              `json:"total,omitempty"`
+	// Total is set when the request asked for a count.
+	Total *int64 `json:"total,omitempty"`
+	// Next is the cursor of the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// newPagedResponse converts a page of tables with fn.
+func newPagedResponse[T any, R any](page *iam.PageResult[T], fn func(T) R) *PagedResponse[R] {
+	values := iam.MapPage(page, fn)
+	return &PagedResponse[R]{
+		Values: values.Items,
+		Ok:     true,
+		Size:   len(values.Items),
+		Total:  values.Total,
+		Next:   values.Next,
+	}
+}
+
+// mapError turns the typed errors of the iam stores into an error info with
+// the code not_found, conflict, invalid_id or validation, and returns nil
+// for other errors, which callers report as internal failures.
+func mapError(err error) *einfo.ErrorInfo {
+	var notFound *iam.NotFoundError
+	var conflict *iam.ConflictError
+	var invalid *iam.ValidationError
+
+	switch {
+	case errors.As(err, &conflict):
+		e := einfo.NewErrorInfo("conflict", conflict.Error())
+		if conflict.Entity != "" {
+			e.SetTarget(conflict.Entity)
+		}
+
+		for _, field := range conflict.Fields {
+			e.AddDetail(einfo.NewErrorInfo("conflict", field+" is taken").SetTarget(field))
+		}
+
+		return e
+	case errors.As(err, &notFound):
+		e := einfo.NewErrorInfo("not_found", notFound.Error())
+		if notFound.Entity != "" {
+			e.SetTarget(notFound.Entity)
+		}
+
+		return e
+	case errors.As(err, &invalid):
+		e := einfo.NewErrorInfo("validation", "One or more validation errors occurred")
+		for _, field := range invalid.Fields {
+			e.AddDetail(einfo.NewErrorInfo(field.Tag, field.Message).SetTarget(field.Field))
+		}
+
+		return e
+	case errors.Is(err, iam.ErrInvalidId):
+		return einfo.NewErrorInfo("invalid_id", err.Error())
+	case errors.Is(err, iam.ErrNotFound):
+		return einfo.NewErrorInfo("not_found", err.Error())
+	case errors.Is(err, iam.ErrConflict):
+		return einfo.NewErrorInfo("conflict", err.Error())
+	default:
+		return nil
+	}
 }
@@ -0,0 +1,44 @@
+package validation
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gnomego/apps/gs/einfo"
+	"github.com/gnomego/sdk/stores/iam"
+)
+
+var passwordMessages = map[string]string{
+	iam.PasswordTooShort:         "{0} must be at least {1} characters long.",
+	iam.PasswordTooLong:          "{0} must be at most {1} characters long.",
+	iam.PasswordRequiresUpper:    "{0} must contain an uppercase letter.",
+	iam.PasswordRequiresLower:    "{0} must contain a lowercase letter.",
+	iam.PasswordRequiresDigit:    "{0} must contain a digit.",
+	iam.PasswordRequiresSymbol:   "{0} must contain a symbol.",
+	iam.PasswordContainsUserInfo: "{0} must not contain your name or email.",
+	iam.PasswordReused:           "{0} must not match any of your last {1} passwords.",
+	iam.PasswordBreached:         "{0} has appeared in a data breach; choose a different one.",
+}
+
+// TranslatePasswordError turns an iam.PasswordPolicyError into a validation
+// ErrorInfo with one detail per violation. It returns nil for other errors.
+func (v *GsValidator) TranslatePasswordError(err error, target string) *einfo.ErrorInfo {
+	policyErr := &iam.PasswordPolicyError{}
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+
+	root := einfo.NewErrorInfo("validation", "One or more validation errors occurred")
+	root.SetTarget(target)
+
+	for _, violation := range policyErr.Violations {
+		message := violation.Message
+		if format, ok := passwordMessages[violation.Code]; ok {
+			message = strings.NewReplacer("{0}", target, "{1}", violation.Param).Replace(format)
+		}
+
+		root.AddDetail(einfo.NewErrorInfo(violation.Code, message).SetTarget(target))
+	}
+
+	return root
+}
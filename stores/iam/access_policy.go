@@ -0,0 +1,70 @@
+package iam
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// AccessPolicyTable stores an attribute based access policy. Document holds
+// the policy as JSON; the policy package defines its format and evaluates it.
+type AccessPolicyTable struct {
+	Id          int32        `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Name        string       `gorm:"column:name;size:128;index:ix_access_policies_name,unique" json:"name"`
+	Description string       `gorm:"column:description;size:1024" json:"description"`
+	Document    string       `gorm:"column:document" json:"document"`
+	Enabled     bool         `gorm:"column:enabled" json:"enabled"`
+	CreatedAt   time.Time    `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt   sql.NullTime `gorm:"column:updated_at" json:"updated_at"`
+}
+
+func (AccessPolicyTable) TableName() string {
+	return "access_policies"
+}
+
+// referencesOrg reports whether a condition of the policy compares an
+// org_id attribute, such as subject.org_id, with one of the org ids.
+func (p *AccessPolicyTable) referencesOrg(orgIds []int32) bool {
+	var doc interface{}
+	if json.Unmarshal([]byte(p.Document), &doc) != nil {
+		return false
+	}
+
+	return conditionsReferenceOrg(doc, orgIds)
+}
+
+func conditionsReferenceOrg(node interface{}, orgIds []int32) bool {
+	switch n := node.(type) {
+	case []interface{}:
+		for _, item := range n {
+			if conditionsReferenceOrg(item, orgIds) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		attr, _ := n["attr"].(string)
+		if attr == "org_id" || strings.HasSuffix(attr, ".org_id") {
+			values, ok := n["value"].([]interface{})
+			if !ok {
+				values = []interface{}{n["value"]}
+			}
+
+			for _, value := range values {
+				for _, id := range orgIds {
+					if number, ok := value.(float64); ok && number == float64(id) {
+						return true
+					}
+				}
+			}
+		}
+
+		for _, child := range n {
+			if conditionsReferenceOrg(child, orgIds) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,392 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ApiKeyAuthStatus int
+
+const (
+	ApiKeyInvalid ApiKeyAuthStatus = iota
+	ApiKeySucceeded
+	ApiKeyLockedOut
+	ApiKeyExpired
+	ApiKeyNotAllowed
+)
+
+func (s ApiKeyAuthStatus) String() string {
+	switch s {
+	case ApiKeySucceeded:
+		return "succeeded"
+	case ApiKeyLockedOut:
+		return "locked_out"
+	case ApiKeyExpired:
+		return "expired"
+	case ApiKeyNotAllowed:
+		return "not_allowed"
+	default:
+		return "invalid"
+	}
+}
+
+type ApiKeyAuthResult struct {
+	Status ApiKeyAuthStatus
+	Key    *UserApiKeyTable
+	User   *UserTable
+}
+
+func (r *ApiKeyAuthResult) Succeeded() bool {
+	return r.Status == ApiKeySucceeded
+}
+
+type ApiKeyOptions struct {
+	// MaxFailedAttempts is the number of consecutive bad secrets presented
+	// for a prefix before that key is locked. Zero disables lockout.
+	MaxFailedAttempts int32
+	// LockoutDuration is how long a locked key stays locked. Zero keeps the
+	// key locked until it is unlocked by an admin.
+	LockoutDuration time.Duration
+}
+
+func DefaultApiKeyOptions() ApiKeyOptions {
+	return ApiKeyOptions{
+		MaxFailedAttempts: 10,
+		LockoutDuration:   15 * time.Minute,
+	}
+}
+
+type ApiKeyStore struct {
+	db      *IamDb
+	Options ApiKeyOptions
+	Now     func() time.Time
+}
+
+func NewApiKeyStore(db *IamDb, options *ApiKeyOptions) *ApiKeyStore {
+	o := DefaultApiKeyOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &ApiKeyStore{
+		db:      db,
+		Options: o,
+		Now:     time.Now,
+	}
+}
+
+// WithTx returns a copy of the store that works in the transaction of tx,
+// see IamDb.WithTx.
+func (s *ApiKeyStore) WithTx(tx *IamDb) *ApiKeyStore {
+	c := *s
+	c.db = tx
+	return &c
+}
+
+// WithContext returns a copy of the store whose queries use ctx.
+func (s *ApiKeyStore) WithContext(ctx context.Context) *ApiKeyStore {
+	return s.WithTx(s.db.WithContext(ctx))
+}
+
+type NewApiKey struct {
+	UserId      int32
+	Name        string
+	Description string
+	// Scopes limits the key to the listed scopes. Leave empty for a key with
+	// the full authority of the user.
+	Scopes       []string
+	OrgId        sql.NullInt32
+	AllowedCidrs []string
+	ExpiresAt    sql.NullTime
+}
+
+// ApiKeyRequest describes the call an api key is being used for so that the
+// key's restrictions can be enforced during authentication.
+type ApiKeyRequest struct {
+	Ip     string
+	OrgId  sql.NullInt32
+	Scopes []string
+}
+
+// Create issues a new api key and returns the full key along with the stored
+// row. The full key cannot be recovered later.
+func (s *ApiKeyStore) Create(newKey *NewApiKey) (string, *UserApiKeyTable, error) {
+	name := strings.TrimSpace(newKey.Name)
+	if name == "" {
+		return "", nil, invalidField("name", "required", "api key name is required")
+	}
+
+	table := &UserApiKeyTable{
+		Uid:         uuid.New(),
+		UserId:      newKey.UserId,
+		OrgId:       newKey.OrgId,
+		Name:        name,
+		Description: newKey.Description,
+		ExpiresAt:   newKey.ExpiresAt,
+		CreatedAt:   s.Now(),
+	}
+
+	table.SetScopes(newKey.Scopes)
+	err := table.SetAllowedCidrs(newKey.AllowedCidrs)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, err := table.Generate()
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = s.db.Create(table).Error
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, table, nil
+}
+
+func (s *ApiKeyStore) Revoke(uid uuid.UUID) error {
+	now := s.Now()
+	res := s.db.Model(&UserApiKeyTable{}).
+		Where("uid = ? AND revoked_at IS NULL", uid).
+		Updates(map[string]interface{}{
+			"revoked_at": now,
+			"updated_at": now,
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return notFound("api key")
+	}
+
+	return nil
+}
+
+func (s *ApiKeyStore) Unlock(uid uuid.UUID) error {
+	res := s.db.Model(&UserApiKeyTable{}).
+		Where("uid = ? AND revoked_at IS NULL", uid).
+		Updates(map[string]interface{}{
+			"is_locked":       false,
+			"locked_at":       nil,
+			"failed_attempts": 0,
+			"last_failed_at":  nil,
+			"updated_at":      s.Now(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return notFound("api key")
+	}
+
+	return nil
+}
+
+// List returns the user's api keys that have not been revoked.
+func (s *ApiKeyStore) List(userId int32) ([]UserApiKeyTable, error) {
+	keys := []UserApiKeyTable{}
+	err := s.db.Where("user_id = ? AND revoked_at IS NULL", userId).
+		Order("created_at").
+		Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Authenticate looks up the key by its prefix and verifies the secret. Bad
+// secrets count against the key and lock it once MaxFailedAttempts is hit.
+// When req is nil only keys without ip, org or scope restrictions succeed,
+// and a key with scopes only succeeds for requests that name their scopes.
+func (s *ApiKeyStore) Authenticate(key string, req *ApiKeyRequest) (*ApiKeyAuthResult, error) {
+	result := &ApiKeyAuthResult{Status: ApiKeyInvalid}
+
+	prefix, secret, err := ParseApiKey(key)
+	if err != nil {
+		return result, nil
+	}
+
+	table := UserApiKeyTable{}
+	res := s.db.Where("prefix = ?", prefix).Limit(1).Find(&table)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 || table.IsRevoked() {
+		return result, nil
+	}
+
+	result.Key = &table
+	now := s.Now()
+
+	expiredLock := false
+	if table.IsLocked {
+		if !s.canUnlock(&table, now) {
+			result.Status = ApiKeyLockedOut
+			return result, nil
+		}
+
+		expiredLock = true
+		table.Reset()
+	}
+
+	if !table.ValidateSecret(secret) {
+		locked, err := s.fail(&table, expiredLock)
+		if err != nil {
+			return nil, err
+		}
+
+		if locked {
+			result.Status = ApiKeyLockedOut
+		}
+
+		return result, nil
+	}
+
+	if table.isExpiredAt(now) {
+		result.Status = ApiKeyExpired
+		return result, nil
+	}
+
+	if !table.allows(req) {
+		result.Status = ApiKeyNotAllowed
+		return result, nil
+	}
+
+	user := UserTable{}
+	err = s.db.Where("id = ?", table.UserId).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+
+	result.User = &user
+	if user.Status == UserStatusInactive || user.Status == UserStatusBanned {
+		result.Status = ApiKeyNotAllowed
+		return result, nil
+	}
+
+	table.Reset()
+	table.LastUsedAt = sql.NullTime{Time: now, Valid: true}
+	table.UpdatedAt = sql.NullTime{Time: now, Valid: true}
+	res = s.db.Model(&UserApiKeyTable{}).
+		Where("id = ? AND revoked_at IS NULL", table.Id).
+		Updates(map[string]interface{}{
+			"is_locked":       false,
+			"locked_at":       nil,
+			"failed_attempts": 0,
+			"last_failed_at":  nil,
+			"last_used_at":    now,
+			"updated_at":      now,
+		})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	// revoked since it was read
+	if res.RowsAffected == 0 {
+		result.Status = ApiKeyInvalid
+		result.User = nil
+		return result, nil
+	}
+
+	result.Status = ApiKeySucceeded
+	return result, nil
+}
+
+func (apiKey *UserApiKeyTable) allows(req *ApiKeyRequest) bool {
+	if req == nil {
+		req = &ApiKeyRequest{}
+	}
+
+	if !apiKey.IsIpAllowed(req.Ip) {
+		return false
+	}
+
+	if apiKey.OrgId.Valid && (!req.OrgId.Valid || req.OrgId.Int32 != apiKey.OrgId.Int32) {
+		return false
+	}
+
+	if len(req.Scopes) == 0 && len(apiKey.GetScopes()) > 0 {
+		return false
+	}
+
+	for _, scope := range req.Scopes {
+		if !apiKey.HasScope(scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *ApiKeyStore) canUnlock(table *UserApiKeyTable, now time.Time) bool {
+	if s.Options.LockoutDuration <= 0 || !table.LockedAt.Valid {
+		return false
+	}
+
+	return !table.LockedAt.Time.Add(s.Options.LockoutDuration).After(now)
+}
+
+// fail counts a bad secret against the key in the database, so parallel
+// attempts cannot overwrite each other's count, and locks the key once the
+// stored count reaches MaxFailedAttempts. expiredLock clears a lock whose
+// duration has passed first. Revoked keys are left alone.
+func (s *ApiKeyStore) fail(table *UserApiKeyTable, expiredLock bool) (bool, error) {
+	now := s.Now()
+	locked := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if expiredLock {
+			err := tx.Model(&UserApiKeyTable{}).
+				Where("id = ? AND is_locked = ? AND locked_at <= ?", table.Id, true, now.Add(-s.Options.LockoutDuration)).
+				Updates(map[string]interface{}{"is_locked": false, "locked_at": nil, "failed_attempts": 0}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		res := tx.Model(&UserApiKeyTable{}).
+			Where("id = ? AND revoked_at IS NULL", table.Id).
+			Updates(map[string]interface{}{
+				"failed_attempts": gorm.Expr("failed_attempts + 1"),
+				"last_failed_at":  now,
+				"updated_at":      now,
+			})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		stored := UserApiKeyTable{}
+		err := tx.Select("failed_attempts", "is_locked").Where("id = ?", table.Id).First(&stored).Error
+		if err != nil {
+			return err
+		}
+
+		table.FailureCount = stored.FailureCount
+		table.LastFailureAt = sql.NullTime{Time: now, Valid: true}
+		locked = stored.IsLocked
+		if locked || s.Options.MaxFailedAttempts <= 0 || stored.FailureCount < s.Options.MaxFailedAttempts {
+			return nil
+		}
+
+		locked = true
+		table.IsLocked = true
+		table.LockedAt = sql.NullTime{Time: now, Valid: true}
+		return tx.Model(&UserApiKeyTable{}).
+			Where("id = ? AND is_locked = ?", table.Id, false).
+			Updates(map[string]interface{}{"is_locked": true, "locked_at": now}).Error
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return locked, nil
+}
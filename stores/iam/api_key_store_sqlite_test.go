@@ -0,0 +1,215 @@
+package iam_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestApiKeyStore(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUser("dave", "dave@test.org")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	now := time.Now()
+	store := iam.NewApiKeyStore(db, &iam.ApiKeyOptions{
+		MaxFailedAttempts: 2,
+		LockoutDuration:   time.Minute,
+	})
+	store.Now = func() time.Time { return now }
+
+	key, table, err := store.Create(&iam.NewApiKey{UserId: user.Id, Name: "deploy"})
+	if err != nil {
+		t.Fatalf("failed to create api key: %v", err)
+	}
+
+	assert.NotEmpty(table.Prefix)
+	assert.NotContains(table.Key, key)
+
+	res, err := store.Authenticate(key, nil)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+	assert.Equal(user.Id, res.User.Id)
+	assert.True(res.Key.LastUsedAt.Valid)
+
+	res, err = store.Authenticate("garbage", nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyInvalid, res.Status)
+
+	res, err = store.Authenticate(table.Prefix+".wrong", nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyInvalid, res.Status)
+
+	res, err = store.Authenticate(table.Prefix+".wrong", nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyLockedOut, res.Status)
+
+	res, err = store.Authenticate(key, nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyLockedOut, res.Status)
+
+	now = now.Add(2 * time.Minute)
+	res, err = store.Authenticate(key, nil)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+
+	expired, _, err := store.Create(&iam.NewApiKey{
+		UserId:    user.Id,
+		Name:      "old",
+		ExpiresAt: sql.NullTime{Time: now.Add(-time.Second), Valid: true},
+	})
+	assert.NoError(err)
+
+	res, err = store.Authenticate(expired, nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyExpired, res.Status)
+
+	keys, err := store.List(user.Id)
+	assert.NoError(err)
+	assert.Len(keys, 2)
+
+	assert.NoError(store.Revoke(table.Uid))
+	res, err = store.Authenticate(key, nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyInvalid, res.Status)
+
+	keys, err = store.List(user.Id)
+	assert.NoError(err)
+	assert.Len(keys, 1)
+}
+
+func TestApiKeyStoreConcurrentChanges(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUser("frank", "frank@test.org")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	store := iam.NewApiKeyStore(db, &iam.ApiKeyOptions{MaxFailedAttempts: 3})
+	key, table, err := store.Create(&iam.NewApiKey{UserId: user.Id, Name: "deploy"})
+	assert.NoError(err)
+
+	// race runs between Authenticate reading the key and writing it back
+	var race func()
+	err = db.Callback().Query().After("gorm:query").Register("test:race", func(tx *gorm.DB) {
+		if tx.Statement.Table == "user_api_keys" && race != nil {
+			r := race
+			race = nil
+			r()
+		}
+	})
+	assert.NoError(err)
+
+	// bad attempts made in parallel all count
+	race = func() {
+		assert.NoError(db.Exec("UPDATE user_api_keys SET failed_attempts = failed_attempts + 2 WHERE id = ?", table.Id).Error)
+	}
+	res, err := store.Authenticate(table.Prefix+".wrong", nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyLockedOut, res.Status)
+
+	assert.NoError(store.Unlock(table.Uid))
+
+	// a key revoked meanwhile stays revoked
+	race = func() { assert.NoError(store.Revoke(table.Uid)) }
+	res, err = store.Authenticate(key, nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyInvalid, res.Status)
+
+	res, err = store.Authenticate(key, nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyInvalid, res.Status)
+	assert.ErrorIs(store.Unlock(table.Uid), iam.ErrNotFound)
+}
+
+func TestScopedApiKey(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUser("erin", "erin@test.org")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	orgId := sql.NullInt32{Int32: 7, Valid: true}
+	store := iam.NewApiKeyStore(db, nil)
+
+	_, _, err = store.Create(&iam.NewApiKey{UserId: user.Id})
+	assert.Error(err)
+
+	_, _, err = store.Create(&iam.NewApiKey{UserId: user.Id, Name: "ci", AllowedCidrs: []string{"nope"}})
+	assert.Error(err)
+
+	key, table, err := store.Create(&iam.NewApiKey{
+		UserId:       user.Id,
+		Name:         "ci",
+		Scopes:       []string{"artifacts:publish", "artifacts:publish"},
+		OrgId:        orgId,
+		AllowedCidrs: []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create api key: %v", err)
+	}
+
+	assert.Equal([]string{"artifacts:publish"}, table.GetScopes())
+
+	req := &iam.ApiKeyRequest{Ip: "10.1.2.3", OrgId: orgId, Scopes: []string{"artifacts:publish"}}
+	res, err := store.Authenticate(key, req)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+
+	res, err = store.Authenticate(key, nil)
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyNotAllowed, res.Status)
+
+	res, err = store.Authenticate(key, &iam.ApiKeyRequest{Ip: "10.2.0.1", OrgId: orgId})
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyNotAllowed, res.Status)
+
+	res, err = store.Authenticate(key, &iam.ApiKeyRequest{Ip: "10.1.0.1", OrgId: sql.NullInt32{Int32: 8, Valid: true}})
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyNotAllowed, res.Status)
+
+	res, err = store.Authenticate(key, &iam.ApiKeyRequest{Ip: "10.1.0.1", OrgId: orgId, Scopes: []string{"users:write"}})
+	assert.NoError(err)
+	assert.Equal(iam.ApiKeyNotAllowed, res.Status)
+
+	// a key restricted by scopes alone still needs the request to name them
+	scoped, _, err := store.Create(&iam.NewApiKey{UserId: user.Id, Name: "deploy", Scopes: []string{"artifacts:publish"}})
+	assert.NoError(err)
+	for _, req := range []*iam.ApiKeyRequest{nil, {}, {Ip: "10.1.0.1"}} {
+		res, err = store.Authenticate(scoped, req)
+		assert.NoError(err)
+		assert.Equal(iam.ApiKeyNotAllowed, res.Status)
+	}
+
+	res, err = store.Authenticate(scoped, &iam.ApiKeyRequest{Scopes: []string{"artifacts:publish"}})
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+
+	auth := &iam.UserAuthorization{
+		UserId: user.Id,
+		Roles:  []string{"admin"},
+		Claims: []iam.Claim{
+			{Name: "artifacts", Value: "publish"},
+			{Name: "artifacts", Value: "delete"},
+			{Name: "users", Value: "write"},
+		},
+	}
+
+	restricted := table.RestrictAuthorization(auth)
+	assert.True(restricted.HasClaim("artifacts", "publish"))
+	assert.False(restricted.HasClaim("artifacts", "delete"))
+	assert.False(restricted.HasClaim("users"))
+	assert.False(restricted.HasRole("admin"))
+}
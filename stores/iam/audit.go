@@ -0,0 +1,108 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrAuditImmutable = errors.New("audit events cannot be changed or deleted")
+
+// AuditEventTable is one entry of the append-only audit log. Action is
+// "<table>.create", "<table>.update" or "<table>.delete" for data changes,
+// e.g. users.update, and "login.<status>" for sign ins. Changes holds the
+// changed columns as JSON, see AuditChange. When hash chaining is enabled
+// Hash covers the event and PrevHash, the hash of the event before it.
+type AuditEventTable struct {
+	Id         int64         `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid        uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_audit_events_uid,unique" json:"uid"`
+	OccurredAt time.Time     `gorm:"column:occurred_at;index:ix_audit_events_occurred_at" json:"occurredAt"`
+	ActorId    sql.NullInt32 `gorm:"column:actor_id;index:ix_audit_events_actor_id" json:"actorId"`
+	OrgId      sql.NullInt32 `gorm:"column:org_id;index:ix_audit_events_org_id" json:"orgId"`
+	Action     string        `gorm:"column:action;size:64;index:ix_audit_events_action" json:"action"`
+	TargetType string        `gorm:"column:target_type;size:64;index:ix_audit_events_target,priority:1" json:"targetType"`
+	TargetId   string        `gorm:"column:target_id;size:128;index:ix_audit_events_target,priority:2" json:"targetId"`
+	Changes    string        `gorm:"column:changes" json:"changes"`
+	Ip         string        `gorm:"column:ip;size:45" json:"ip"`
+	RequestId  string        `gorm:"column:request_id;size:128" json:"requestId"`
+	PrevHash   string        `gorm:"column:prev_hash;size:64" json:"prevHash"`
+	Hash       string        `gorm:"column:hash;size:64" json:"hash"`
+}
+
+func (AuditEventTable) TableName() string {
+	return "audit_events"
+}
+
+// AuditChainTable is the single row that holds the hash of the newest
+// chained event. Writers lock it until they commit, so the events of
+// concurrent transactions, even from different processes, extend the chain
+// one after another instead of forking it.
+type AuditChainTable struct {
+	Id   int32  `gorm:"column:id;primary_key" json:"id"`
+	Hash string `gorm:"column:hash;size:64" json:"hash"`
+}
+
+func (AuditChainTable) TableName() string {
+	return "audit_chain"
+}
+
+func (AuditEventTable) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditImmutable
+}
+
+func (AuditEventTable) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditImmutable
+}
+
+// GetChanges decodes Changes. Secret columns only show that they changed.
+func (e *AuditEventTable) GetChanges() (map[string]AuditChange, error) {
+	changes := map[string]AuditChange{}
+	if e.Changes == "" {
+		return changes, nil
+	}
+
+	err := json.Unmarshal([]byte(e.Changes), &changes)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// AuditChange is the old and new value of a column. Old is nil for
+// created rows and New is nil for deleted ones.
+type AuditChange struct {
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// AuditActor is who performs the changes made with a context, as recorded
+// in the audit log. Attach it with WithAuditActor and pass the context to
+// gorm with db.WithContext.
+type AuditActor struct {
+	UserId    sql.NullInt32
+	OrgId     sql.NullInt32
+	Ip        string
+	RequestId string
+}
+
+type auditActorKey struct{}
+
+func WithAuditActor(ctx context.Context, actor AuditActor) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// AuditActorFrom returns the actor of the context, or the zero actor.
+func AuditActorFrom(ctx context.Context) AuditActor {
+	if ctx == nil {
+		return AuditActor{}
+	}
+
+	actor, _ := ctx.Value(auditActorKey{}).(AuditActor)
+	return actor
+}
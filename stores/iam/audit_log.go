@@ -0,0 +1,778 @@
+package iam
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+var ErrAuditChainBroken = errors.New("the audit log hash chain is broken")
+
+const auditBeforeKey = "iam:audit_before"
+
+const auditRedacted = "[redacted]"
+
+type AuditOptions struct {
+	// HashChain links every event to the one before it by hash, so that
+	// changed, inserted or removed events show up in VerifyChain. Events are
+	// chained in commit order: a transaction that records an event holds the
+	// lock on the audit_chain row until it commits, so writers, including
+	// other processes, queue behind each other.
+	HashChain bool
+	// Tables are the tables whose creates, updates and deletes are recorded.
+	Tables []string
+	// Redacted columns are recorded as changed without their values. An
+	// entry is a column name or table.column.
+	Redacted []string
+	// Ignored columns are left out of update diffs, e.g. bookkeeping that
+	// changes on every sign in. An update that only touches ignored columns
+	// is not recorded.
+	Ignored []string
+	// MaxRows caps the rows of a single update or delete that are recorded.
+	MaxRows int
+}
+
+func DefaultAuditOptions() AuditOptions {
+	return AuditOptions{
+		Tables: []string{
+			"users", "user_passwords", "user_claims", "user_api_keys", "user_login_providers",
+			"roles", "role_claims", "users_roles",
+			"orgs", "org_domains", "org_members", "org_invitations", "org_join_requests",
+			"oauth_clients", "access_policies",
+		},
+		Redacted: []string{
+			"password", "secret_hash", "token_hash", "security_stamp", "challenge_token",
+			"user_api_keys.key",
+		},
+		Ignored: []string{
+			"concurrency_stamp", "updated_at", "last_login_at", "last_login_ip", "last_used_at",
+			"failed_attempts", "last_failed_at", "last_checked_at", "orgs.path",
+		},
+		MaxRows: 1000,
+	}
+}
+
+// AuditLog writes and queries the audit_events table. Installed as a gorm
+// plugin with db.Use it records the changes to the audited tables in the
+// transaction that makes them, attributed to the AuditActor of the context.
+type AuditLog struct {
+	db      *IamDb
+	Options AuditOptions
+	Now     func() time.Time
+}
+
+func NewAuditLog(db *IamDb, options *AuditOptions) *AuditLog {
+	o := DefaultAuditOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &AuditLog{
+		db:      db,
+		Options: o,
+		Now:     time.Now,
+	}
+}
+
+// Record appends an event. Actor, org, IP and request ID default to the
+// AuditActor of ctx.
+func (a *AuditLog) Record(ctx context.Context, event *AuditEventTable) error {
+	return a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return a.record(tx, event)
+	})
+}
+
+// AuditQuery filters the audit log. Zero fields match everything.
+type AuditQuery struct {
+	ActorId    sql.NullInt32
+	OrgId      sql.NullInt32
+	TargetType string
+	TargetId   string
+	// Action matches exactly, or by prefix when it ends in *, e.g. login.*.
+	Action string
+	From   time.Time
+	To     time.Time
+	// BeforeId continues a listing below the last event of the previous page.
+	BeforeId int64
+	// Filter is a filter expression on the fields of AuditFilter, e.g.
+	// "startswith(action, 'login.') and actorId eq 4".
+	Filter string
+	// Limit defaults to 100.
+	Limit int
+}
+
+// Find returns the matching events, newest first.
+func (a *AuditLog) Find(q *AuditQuery) ([]AuditEventTable, error) {
+	if q == nil {
+		q = &AuditQuery{}
+	}
+
+	tx := a.db.Model(&AuditEventTable{})
+	if q.ActorId.Valid {
+		tx = tx.Where("actor_id = ?", q.ActorId.Int32)
+	}
+
+	if q.OrgId.Valid {
+		tx = tx.Where("org_id = ?", q.OrgId.Int32)
+	}
+
+	if q.TargetType != "" {
+		tx = tx.Where("target_type = ?", q.TargetType)
+	}
+
+	if q.TargetId != "" {
+		tx = tx.Where("target_id = ?", q.TargetId)
+	}
+
+	if prefix, ok := strings.CutSuffix(q.Action, "*"); ok {
+		tx = tx.Where("action LIKE ?", prefix+"%")
+	} else if q.Action != "" {
+		tx = tx.Where("action = ?", q.Action)
+	}
+
+	if !q.From.IsZero() {
+		tx = tx.Where("occurred_at >= ?", q.From.UTC())
+	}
+
+	if !q.To.IsZero() {
+		tx = tx.Where("occurred_at < ?", q.To.UTC())
+	}
+
+	if q.BeforeId > 0 {
+		tx = tx.Where("id < ?", q.BeforeId)
+	}
+
+	tx, err := AuditFilter.Apply(tx, q.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	events := []AuditEventTable{}
+	err = tx.Order("id DESC").Limit(limit).Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// ByActor returns what a user did between from and to, newest first.
+func (a *AuditLog) ByActor(userId int32, from time.Time, to time.Time) ([]AuditEventTable, error) {
+	return a.Find(&AuditQuery{ActorId: sql.NullInt32{Int32: userId, Valid: true}, From: from, To: to})
+}
+
+// ByTarget returns what happened to a row, e.g. ("users", "7"), newest first.
+func (a *AuditLog) ByTarget(targetType string, targetId string) ([]AuditEventTable, error) {
+	return a.Find(&AuditQuery{TargetType: targetType, TargetId: targetId})
+}
+
+// VerifyChain recomputes the hash chain. It returns the id of the first
+// event that does not fit the chain and ErrAuditChainBroken, or 0 and nil.
+// Events written before chaining was enabled are skipped.
+func (a *AuditLog) VerifyChain() (int64, error) {
+	broken := int64(0)
+	prev := ""
+	started := false
+	batch := []AuditEventTable{}
+	err := a.db.Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, n int) error {
+		for i := range batch {
+			e := &batch[i]
+			if e.Hash == "" && !started {
+				continue
+			}
+
+			started = true
+			if e.PrevHash != prev || auditHash(e) != e.Hash {
+				broken = e.Id
+				return ErrAuditChainBroken
+			}
+
+			prev = e.Hash
+		}
+
+		return nil
+	}).Error
+	if err != nil {
+		return broken, err
+	}
+
+	return 0, nil
+}
+
+func (a *AuditLog) record(tx *gorm.DB, e *AuditEventTable) error {
+	actor := AuditActorFrom(tx.Statement.Context)
+	if !e.ActorId.Valid {
+		e.ActorId = actor.UserId
+	}
+
+	if !e.OrgId.Valid {
+		e.OrgId = actor.OrgId
+	}
+
+	if e.Ip == "" {
+		e.Ip = actor.Ip
+	}
+
+	if e.RequestId == "" {
+		e.RequestId = actor.RequestId
+	}
+
+	if e.Uid == uuid.Nil {
+		e.Uid = uuid.New()
+	}
+
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = a.Now()
+	}
+
+	// stored times lose everything below microseconds in most databases
+	e.OccurredAt = e.OccurredAt.UTC().Truncate(time.Microsecond)
+	e.PrevHash = ""
+	e.Hash = ""
+
+	if !a.Options.HashChain {
+		return tx.Create(e).Error
+	}
+
+	head, err := a.lockChain(tx)
+	if err != nil {
+		return err
+	}
+
+	e.PrevHash = head.Hash
+	e.Hash = auditHash(e)
+	err = tx.Create(e).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(head).Update("hash", e.Hash).Error
+}
+
+// lockChain locks the chain head for the rest of the transaction of tx and
+// returns it. The no-op update takes a row lock on databases that have
+// them and the write lock on SQLite, which a plain select would not. A
+// missing head, e.g. in a database created by AutoMigrateIam, starts from
+// the newest event.
+func (a *AuditLog) lockChain(tx *gorm.DB) (*AuditChainTable, error) {
+	head := &AuditChainTable{Id: 1}
+	res := tx.Model(head).Update("hash", gorm.Expr("hash"))
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		last := AuditEventTable{}
+		err := tx.Select("hash").Order("id DESC").Limit(1).Find(&last).Error
+		if err != nil {
+			return nil, err
+		}
+
+		// a concurrent first writer makes this fail on the primary key
+		head.Hash = last.Hash
+		return head, tx.Create(head).Error
+	}
+
+	err := tx.Where("id = ?", head.Id).First(head).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return head, nil
+}
+
+func auditHash(e *AuditEventTable) string {
+	fields := []string{
+		e.PrevHash,
+		e.Uid.String(),
+		e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		nullInt32String(e.ActorId),
+		nullInt32String(e.OrgId),
+		e.Action,
+		e.TargetType,
+		e.TargetId,
+		e.Changes,
+		e.Ip,
+		e.RequestId,
+	}
+
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func nullInt32String(n sql.NullInt32) string {
+	if !n.Valid {
+		return ""
+	}
+
+	return strconv.Itoa(int(n.Int32))
+}
+
+// Name and Initialize make the audit log a gorm plugin.
+func (a *AuditLog) Name() string {
+	return "iam:audit"
+}
+
+func (a *AuditLog) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	err := cb.Create().Before("gorm:create").Register("iam:audit_before_create", a.snapshotUpsert)
+	if err != nil {
+		return err
+	}
+
+	err = cb.Create().After("gorm:create").Register("iam:audit_create", a.afterCreate)
+	if err != nil {
+		return err
+	}
+
+	err = cb.Update().Before("gorm:update").Register("iam:audit_before_update", a.snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = cb.Update().After("gorm:update").Register("iam:audit_update", a.afterUpdate)
+	if err != nil {
+		return err
+	}
+
+	err = cb.Delete().Before("gorm:delete").Register("iam:audit_before_delete", a.snapshot)
+	if err != nil {
+		return err
+	}
+
+	return cb.Delete().After("gorm:delete").Register("iam:audit_delete", a.afterDelete)
+}
+
+func (a *AuditLog) audited(stmt *gorm.Statement) bool {
+	return stmt.Schema != nil && stmt.Table != "audit_events" && slices.Contains(a.Options.Tables, stmt.Table)
+}
+
+// session runs the audit queries of a callback in the transaction of the
+// statement being audited.
+func (a *AuditLog) session(tx *gorm.DB) *gorm.DB {
+	return tx.Session(&gorm.Session{NewDB: true, SkipDefaultTransaction: true})
+}
+
+// auditKeys are the columns that identify a row: the primary key, or uid
+// for tables without one.
+func auditKeys(s *schema.Schema) []string {
+	if len(s.PrimaryFieldDBNames) > 0 {
+		return s.PrimaryFieldDBNames
+	}
+
+	if s.LookUpField("uid") != nil {
+		return []string{"uid"}
+	}
+
+	return nil
+}
+
+// createdRows returns the models of a create statement.
+func createdRows(stmt *gorm.Statement) []reflect.Value {
+	rv := reflect.Indirect(stmt.ReflectValue)
+	values := []reflect.Value{}
+	switch rv.Kind() {
+	case reflect.Struct:
+		values = append(values, rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			v := reflect.Indirect(rv.Index(i))
+			if v.Kind() == reflect.Struct {
+				values = append(values, v)
+			}
+		}
+	}
+
+	return values
+}
+
+// modelRow returns the column values of a model and which of them are zero.
+func modelRow(stmt *gorm.Statement, v reflect.Value) (map[string]interface{}, map[string]bool) {
+	row := map[string]interface{}{}
+	zeros := map[string]bool{}
+	for _, f := range stmt.Schema.Fields {
+		if f.DBName == "" {
+			continue
+		}
+
+		value, zero := f.ValueOf(stmt.Context, v)
+		row[f.DBName] = value
+		zeros[f.DBName] = zero
+	}
+
+	return row, zeros
+}
+
+// snapshotUpsert keeps the rows an upsert may run into, found by primary key
+// or a unique index, so that afterCreate can tell created rows from updated
+// ones.
+func (a *AuditLog) snapshotUpsert(tx *gorm.DB) {
+	stmt := tx.Statement
+	stmt.Settings.Delete(auditBeforeKey)
+	if tx.Error != nil || !a.audited(stmt) {
+		return
+	}
+
+	if _, ok := stmt.Clauses["ON CONFLICT"]; !ok {
+		return
+	}
+
+	keys := [][]string{}
+	if len(stmt.Schema.PrimaryFieldDBNames) > 0 {
+		keys = append(keys, stmt.Schema.PrimaryFieldDBNames)
+	}
+
+	for _, idx := range stmt.Schema.ParseIndexes() {
+		if idx.Class != "UNIQUE" {
+			continue
+		}
+
+		columns := []string{}
+		for _, f := range idx.Fields {
+			columns = append(columns, f.DBName)
+		}
+
+		keys = append(keys, columns)
+	}
+
+	existing := []map[string]interface{}{}
+	for _, v := range createdRows(stmt) {
+		row, zeros := modelRow(stmt, v)
+		conflicts := []clause.Expression{}
+		for _, key := range keys {
+			match := []clause.Expression{}
+			for _, c := range key {
+				if zeros[c] {
+					match = nil
+					break
+				}
+
+				match = append(match, clause.Eq{Column: clause.Column{Name: c}, Value: row[c]})
+			}
+
+			if len(match) > 0 {
+				conflicts = append(conflicts, clause.And(match...))
+			}
+		}
+
+		var found map[string]interface{}
+		if len(conflicts) > 0 {
+			rows := []map[string]interface{}{}
+			err := a.session(tx).Table(stmt.Table).Where(clause.Or(conflicts...)).Limit(1).Find(&rows).Error
+			if err != nil {
+				tx.AddError(err)
+				return
+			}
+
+			if len(rows) > 0 {
+				found = rows[0]
+			}
+		}
+
+		existing = append(existing, found)
+	}
+
+	stmt.Settings.Store(auditBeforeKey, existing)
+}
+
+func (a *AuditLog) afterCreate(tx *gorm.DB) {
+	stmt := tx.Statement
+	v, _ := stmt.Settings.LoadAndDelete(auditBeforeKey)
+	if tx.Error != nil || stmt.RowsAffected == 0 || !a.audited(stmt) {
+		return
+	}
+
+	existing, _ := v.([]map[string]interface{})
+	for i, model := range createdRows(stmt) {
+		if i < len(existing) && existing[i] != nil {
+			if !a.recordChange(tx, "update", existing[i]) {
+				return
+			}
+
+			continue
+		}
+
+		row, _ := modelRow(stmt, model)
+		a.recordRow(tx, "create", row, a.diff(stmt.Table, nil, row, false))
+	}
+}
+
+// snapshot keeps the rows an update or delete is about to change, so the
+// after callbacks can diff them.
+func (a *AuditLog) snapshot(tx *gorm.DB) {
+	stmt := tx.Statement
+	stmt.Settings.Delete(auditBeforeKey)
+	if tx.Error != nil || !a.audited(stmt) {
+		return
+	}
+
+	q := a.session(tx).Table(stmt.Table)
+	scoped := false
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok && len(where.Exprs) > 0 {
+			q = q.Clauses(where)
+			scoped = true
+		}
+	}
+
+	// the conditions gorm adds for the primary key of the model
+	rv := reflect.Indirect(stmt.ReflectValue)
+	switch rv.Kind() {
+	case reflect.Struct:
+		for _, f := range stmt.Schema.PrimaryFields {
+			value, zero := f.ValueOf(stmt.Context, rv)
+			if !zero {
+				q = q.Where(clause.Eq{Column: clause.Column{Name: f.DBName}, Value: value})
+				scoped = true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if len(stmt.Schema.PrimaryFields) == 1 && rv.Len() > 0 {
+			f := stmt.Schema.PrimaryFields[0]
+			ids := []interface{}{}
+			for i := 0; i < rv.Len(); i++ {
+				value, zero := f.ValueOf(stmt.Context, reflect.Indirect(rv.Index(i)))
+				if !zero {
+					ids = append(ids, value)
+				}
+			}
+
+			if len(ids) > 0 {
+				q = q.Where(clause.IN{Column: clause.Column{Name: f.DBName}, Values: ids})
+				scoped = true
+			}
+		}
+	}
+
+	// gorm refuses updates and deletes without conditions
+	if !scoped {
+		return
+	}
+
+	rows := []map[string]interface{}{}
+	err := q.Limit(a.Options.MaxRows).Find(&rows).Error
+	if err != nil {
+		tx.AddError(err)
+		return
+	}
+
+	stmt.Settings.Store(auditBeforeKey, rows)
+}
+
+func (a *AuditLog) afterUpdate(tx *gorm.DB) {
+	a.afterChange(tx, "update")
+}
+
+func (a *AuditLog) afterDelete(tx *gorm.DB) {
+	a.afterChange(tx, "delete")
+}
+
+// afterChange reloads the snapshot rows and records what changed. Soft
+// deletes are updates of deleted_at and show up as deletes; clearing it is
+// a restore.
+func (a *AuditLog) afterChange(tx *gorm.DB, action string) {
+	stmt := tx.Statement
+	v, ok := stmt.Settings.LoadAndDelete(auditBeforeKey)
+	if !ok || tx.Error != nil || stmt.RowsAffected == 0 {
+		return
+	}
+
+	for _, old := range v.([]map[string]interface{}) {
+		if !a.recordChange(tx, action, old) {
+			return
+		}
+	}
+}
+
+// recordChange reloads a row kept before a statement and records how it
+// changed. It returns false when the database fails.
+func (a *AuditLog) recordChange(tx *gorm.DB, action string, old map[string]interface{}) bool {
+	stmt := tx.Statement
+	q := a.session(tx).Table(stmt.Table)
+	for _, key := range auditKeys(stmt.Schema) {
+		q = q.Where(clause.Eq{Column: clause.Column{Name: key}, Value: old[key]})
+	}
+
+	rows := []map[string]interface{}{}
+	err := q.Limit(1).Find(&rows).Error
+	if err != nil {
+		tx.AddError(err)
+		return false
+	}
+
+	if len(rows) == 0 {
+		a.recordRow(tx, "delete", old, a.diff(stmt.Table, old, nil, false))
+		return true
+	}
+
+	changes := a.diff(stmt.Table, old, rows[0], true)
+	if len(changes) == 0 {
+		return true
+	}
+
+	if c, ok := changes["deleted_at"]; ok {
+		action = "delete"
+		if c.New == nil {
+			action = "restore"
+		}
+	}
+
+	a.recordRow(tx, action, rows[0], changes)
+	return true
+}
+
+// diff compares two versions of a row; old is nil for created rows and
+// new for deleted ones. Ignored columns are skipped when ignore is set.
+func (a *AuditLog) diff(table string, old map[string]interface{}, new map[string]interface{}, ignore bool) map[string]AuditChange {
+	columns := map[string]bool{}
+	for c := range old {
+		columns[c] = true
+	}
+
+	for c := range new {
+		columns[c] = true
+	}
+
+	changes := map[string]AuditChange{}
+	for c := range columns {
+		if ignore && a.matches(a.Options.Ignored, table, c) {
+			continue
+		}
+
+		o := auditValue(old[c])
+		n := auditValue(new[c])
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+
+		if a.matches(a.Options.Redacted, table, c) {
+			if o != nil {
+				o = auditRedacted
+			}
+
+			if n != nil {
+				n = auditRedacted
+			}
+		}
+
+		changes[c] = AuditChange{Old: o, New: n}
+	}
+
+	return changes
+}
+
+func (a *AuditLog) matches(columns []string, table string, column string) bool {
+	return slices.Contains(columns, column) || slices.Contains(columns, table+"."+column)
+}
+
+func (a *AuditLog) recordRow(tx *gorm.DB, action string, row map[string]interface{}, changes map[string]AuditChange) {
+	stmt := tx.Statement
+	ids := []string{}
+	for _, key := range auditKeys(stmt.Schema) {
+		ids = append(ids, fmt.Sprint(auditValue(row[key])))
+	}
+
+	e := &AuditEventTable{
+		Action:     stmt.Table + "." + action,
+		TargetType: stmt.Table,
+		TargetId:   strings.Join(ids, ":"),
+	}
+
+	org := "org_id"
+	switch stmt.Table {
+	case "orgs":
+		org = "id"
+	case "users":
+		org = "organization_id"
+	}
+
+	if id, ok := auditInt32(row[org]); ok {
+		e.OrgId = sql.NullInt32{Int32: id, Valid: true}
+	}
+
+	if len(changes) > 0 {
+		b, err := json.Marshal(changes)
+		if err != nil {
+			tx.AddError(err)
+			return
+		}
+
+		e.Changes = string(b)
+	}
+
+	err := a.record(a.session(tx), e)
+	if err != nil {
+		tx.AddError(err)
+	}
+}
+
+// auditValue turns column values into plain values that compare and
+// encode the same whether they come from a model or from the database.
+func auditValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || (rv.Kind() == reflect.Pointer && rv.IsNil()) {
+		return nil
+	}
+
+	if valuer, ok := v.(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+
+		v = value
+	}
+
+	switch x := v.(type) {
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case int:
+		return int64(x)
+	case int8:
+		return int64(x)
+	case int16:
+		return int64(x)
+	case int32:
+		return int64(x)
+	}
+
+	return v
+}
+
+func auditInt32(v interface{}) (int32, bool) {
+	switch x := auditValue(v).(type) {
+	case int64:
+		return int32(x), true
+	case float64:
+		return int32(x), true
+	}
+
+	return 0, false
+}
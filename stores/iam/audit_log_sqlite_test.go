@@ -0,0 +1,131 @@
+package iam_test
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	options := iam.DefaultAuditOptions()
+	options.HashChain = true
+	audit := iam.NewAuditLog(db, &options)
+	assert.NoError(db.Use(audit))
+
+	admin, err := db.NewUser("root", "root@test.org")
+	assert.NoError(err)
+
+	ctx := iam.WithAuditActor(context.Background(), iam.AuditActor{
+		UserId:    sql.NullInt32{Int32: admin.Id, Valid: true},
+		Ip:        "10.0.0.1",
+		RequestId: "req-1",
+	})
+	adminDb := db.WithContext(ctx)
+
+	user, err := adminDb.NewUserWithPassword("ada", "ada@test.org", "Secr3t!pass")
+	assert.NoError(err)
+	assert.NoError(adminDb.Model(user).Update("email", "ada@example.org").Error)
+	_, err = adminDb.AddUserClaim(user.Id, "department", "finance")
+	assert.NoError(err)
+
+	id := strconv.Itoa(int(user.Id))
+	events, err := audit.ByTarget("users", id)
+	assert.NoError(err)
+	assert.Len(events, 2)
+	assert.Equal("users.update", events[0].Action)
+	assert.Equal("users.create", events[1].Action)
+	assert.Equal(admin.Id, events[0].ActorId.Int32)
+	assert.Equal("10.0.0.1", events[0].Ip)
+	assert.Equal("req-1", events[0].RequestId)
+
+	changes, err := events[0].GetChanges()
+	assert.NoError(err)
+	assert.Equal(iam.AuditChange{Old: "ada@test.org", New: "ada@example.org"}, changes["email"])
+
+	passwords, err := audit.Find(&iam.AuditQuery{Action: "user_passwords.create"})
+	assert.NoError(err)
+	assert.Len(passwords, 1)
+	changes, err = passwords[0].GetChanges()
+	assert.NoError(err)
+	assert.Equal("[redacted]", changes["password"].New)
+
+	byAdmin, err := audit.ByActor(admin.Id, time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	assert.NoError(err)
+	assert.Len(byAdmin, 4)
+	none, err := audit.ByActor(admin.Id, time.Now().Add(time.Minute), time.Time{})
+	assert.NoError(err)
+	assert.Len(none, 0)
+
+	signIn := iam.NewSignInManager(db, nil)
+	signIn.Audit = audit
+	res, err := signIn.PasswordSignIn("ada", "wrong", nil)
+	assert.NoError(err)
+	assert.False(res.Succeeded())
+	ip := "192.0.2.7"
+	res, err = signIn.PasswordSignIn("ada", "Secr3t!pass", &ip)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+	_, err = signIn.PasswordSignIn("nobody", "wrong", nil)
+	assert.NoError(err)
+
+	logins, err := audit.Find(&iam.AuditQuery{Action: "login.*"})
+	assert.NoError(err)
+	assert.Len(logins, 3)
+	assert.Equal("login.failed", logins[0].Action)
+	assert.Equal("nobody", logins[0].TargetId)
+	assert.Equal("login.succeeded", logins[1].Action)
+	assert.Equal(user.Id, logins[1].ActorId.Int32)
+	assert.Equal(ip, logins[1].Ip)
+	assert.Equal("login.failed", logins[2].Action)
+	assert.False(logins[2].ActorId.Valid)
+
+	// the sign in bookkeeping on users and user_passwords is not recorded
+	events, err = audit.Find(&iam.AuditQuery{TargetType: "users", TargetId: id, Action: "users.*"})
+	assert.NoError(err)
+	assert.Len(events, 2)
+	passwords, err = audit.Find(&iam.AuditQuery{TargetType: "user_passwords"})
+	assert.NoError(err)
+	assert.Len(passwords, 1)
+
+	assert.NoError(adminDb.DeleteUser(user.Id))
+	events, err = audit.ByTarget("users", id)
+	assert.NoError(err)
+	assert.Equal("users.delete", events[0].Action)
+
+	// every writer extends the chain from the shared head, e.g. another
+	// process with its own audit log
+	other := iam.NewAuditLog(db, &options)
+	assert.NoError(other.Record(ctx, &iam.AuditEventTable{Action: "login.succeeded"}))
+	assert.NoError(audit.Record(ctx, &iam.AuditEventTable{Action: "login.failed"}))
+
+	// a missing head starts from the newest event
+	assert.NoError(db.Exec("DELETE FROM audit_chain").Error)
+	assert.NoError(other.Record(ctx, &iam.AuditEventTable{Action: "login.succeeded"}))
+
+	head := iam.AuditChainTable{}
+	assert.NoError(db.First(&head).Error)
+	last, err := audit.Find(&iam.AuditQuery{Limit: 1})
+	assert.NoError(err)
+	assert.Equal(last[0].Hash, head.Hash)
+
+	// events are append-only and tampering breaks the chain
+	broken, err := audit.VerifyChain()
+	assert.NoError(err)
+	assert.Equal(int64(0), broken)
+
+	assert.ErrorIs(db.Delete(&events[0]).Error, iam.ErrAuditImmutable)
+	assert.ErrorIs(db.Model(&events[0]).Update("ip", "127.0.0.1").Error, iam.ErrAuditImmutable)
+
+	assert.NoError(db.Exec("UPDATE audit_events SET ip = ? WHERE id = ?", "127.0.0.1", events[1].Id).Error)
+	broken, err = audit.VerifyChain()
+	assert.ErrorIs(err, iam.ErrAuditChainBroken)
+	assert.Equal(events[1].Id, broken)
+}
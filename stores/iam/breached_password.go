@@ -0,0 +1,78 @@
+package iam
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// BreachedPasswordChecker reports whether a password appears in a list of
+// passwords exposed in data breaches.
+type BreachedPasswordChecker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// RangeFileChecker checks passwords against a local copy of a k-anonymity
+// SHA-1 range set, such as the one served by the Pwned Passwords range API.
+// The set is one file per five character hash prefix, named "<PREFIX>" or
+// "<PREFIX>.txt", with lines of "<35 character suffix>:<count>". Only the
+// prefix file of the password is read.
+type RangeFileChecker struct {
+	FS fs.FS
+	// MinCount ignores hashes seen fewer times than this. Zero and one
+	// both reject every listed hash except padding lines with a count of 0.
+	MinCount int
+}
+
+func NewRangeFileChecker(dir string) *RangeFileChecker {
+	return &RangeFileChecker{FS: os.DirFS(dir)}
+}
+
+func (c *RangeFileChecker) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := c.FS.Open(prefix + ".txt")
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = c.FS.Open(prefix)
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		s, count, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(s, suffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			// a listed hash without a usable count still counts as breached
+			return true, nil
+		}
+
+		min := c.MinCount
+		if min < 1 {
+			min = 1
+		}
+
+		return n >= min, nil
+	}
+
+	return false, scanner.Err()
+}
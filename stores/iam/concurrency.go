@@ -0,0 +1,64 @@
+package iam
+
+import (
+	"slices"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrConcurrencyConflict is returned when a row changed after it was read,
+// so saving would overwrite someone else's changes.
+var ErrConcurrencyConflict error = &ConflictError{Message: "the record was changed by someone else; reload it and try again"}
+
+// updateChecked writes every column of model except the creation time and
+// associations, but only while the row still carries the expected stamp.
+// model must already hold its next stamp. A missing row is reported as
+// gorm.ErrRecordNotFound. Rows written before stamps existed carry NULL,
+// which reads as, and is expected as, the empty stamp.
+func updateChecked(tx *gorm.DB, model interface{}, id int32, expected string) error {
+	q := tx.Model(model)
+	if expected == "" {
+		q = q.Where("COALESCE(concurrency_stamp, '') = ''")
+	} else {
+		q = q.Where("concurrency_stamp = ?", expected)
+	}
+
+	res := q.
+		Select("*").
+		Omit(clause.Associations, "created_at").
+		Updates(model)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
+	var count int64
+	err := tx.Model(model).Where("id = ?", id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return ErrConcurrencyConflict
+}
+
+// writesStamp reports whether the statement that just ran wrote the
+// concurrency_stamp column, so the in-memory copy can track the stored stamp.
+func writesStamp(stmt *gorm.Statement) bool {
+	if slices.Contains(stmt.Omits, "concurrency_stamp") {
+		return false
+	}
+
+	if len(stmt.Selects) == 0 {
+		return true
+	}
+
+	return slices.Contains(stmt.Selects, "*") || slices.Contains(stmt.Selects, "concurrency_stamp")
+}
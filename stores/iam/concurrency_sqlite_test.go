@@ -0,0 +1,129 @@
+package iam_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestUserConcurrency(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUser("nina", "nina@test.org")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	first, _ := db.GetUserById(user.Id)
+	second, _ := db.GetUserById(user.Id)
+
+	first.SetName("nina.first")
+	assert.NoError(first.Save(db))
+
+	second.SetName("nina.second")
+	assert.ErrorIs(second.Save(db), iam.ErrConcurrencyConflict)
+
+	// saving again after a successful save keeps working
+	first.AvatarUrl = sql.NullString{String: "https://example.com/a.png", Valid: true}
+	assert.NoError(first.Save(db))
+
+	stored, _ := db.GetUserById(user.Id)
+	assert.Equal("nina.first", stored.Name)
+	assert.Equal(first.ConcurrencyStamp, stored.ConcurrencyStamp)
+
+	// signing in does not disturb an edit in progress
+	_, err = iam.NewSignInManager(db, nil).PasswordSignIn("nina.first", "x", nil)
+	assert.NoError(err)
+	stored.SetEmail("nina@example.com")
+	assert.NoError(stored.Save(db))
+
+	// rows written before stamps existed can still be saved once
+	for _, legacy := range []interface{}{nil, ""} {
+		assert.NoError(db.Exec("UPDATE users SET concurrency_stamp = ? WHERE id = ?", legacy, user.Id).Error)
+		first, _ = db.GetUserById(user.Id)
+		second, _ = db.GetUserById(user.Id)
+
+		first.SetName("nina.legacy")
+		assert.NoError(first.Save(db))
+		assert.NotEmpty(first.ConcurrencyStamp)
+
+		second.SetName("nina.stale")
+		assert.ErrorIs(second.Save(db), iam.ErrConcurrencyConflict)
+	}
+}
+
+func TestOrgAndRoleConcurrency(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	store := iam.NewOrgStore(db.DB, nil)
+	org := &iam.Org{Name: "Acme", Domains: []string{"acme.test"}}
+	assert.NoError(store.Create(org))
+
+	first, err := store.FindByUid(org.Id)
+	assert.NoError(err)
+	second, err := store.FindByUid(org.Id)
+	assert.NoError(err)
+
+	first.Name = "Acme Corp"
+	first.Domains = []string{"acme.test", "acme.example"}
+	assert.NoError(store.Save(first))
+
+	second.Name = "Acme Inc"
+	err = store.Save(second)
+	assert.ErrorIs(err, iam.ErrConcurrencyConflict)
+	assert.ErrorIs(err, iam.ErrConflict)
+
+	saved, err := store.FindByUid(org.Id, "domains")
+	assert.NoError(err)
+	assert.Equal("Acme Corp", saved.Name)
+	assert.ElementsMatch([]string{"acme.test", "acme.example"}, saved.Domains)
+
+	// single field updates move the stamp too
+	assert.NoError(store.UpdateSlug(org.Id, "acme-corp"))
+	saved.Name = "Acme Two"
+	assert.ErrorIs(store.Save(saved), iam.ErrConcurrencyConflict)
+
+	// so do domain changes, which also check it
+	saved, err = store.FindByUid(org.Id)
+	assert.NoError(err)
+	assert.NoError(store.AddDomain(org.Id, "acme.dev"))
+	saved.Name = "Acme Three"
+	assert.ErrorIs(store.Save(saved), iam.ErrConcurrencyConflict)
+
+	race := true
+	err = db.Callback().Query().After("gorm:query").Register("test:race", func(tx *gorm.DB) {
+		if tx.Statement.Table == "orgs" && race {
+			race = false
+			assert.NoError(store.UpdateName(org.Id, "Acme Four"))
+		}
+	})
+	assert.NoError(err)
+	assert.ErrorIs(store.RemoveDomain(org.Id, "acme.dev"), iam.ErrConcurrencyConflict)
+
+	saved, err = store.FindByUid(org.Id, "domains")
+	assert.NoError(err)
+	assert.Equal("Acme Four", saved.Name)
+	assert.Contains(saved.Domains, "acme.dev")
+
+	role, err := db.NewRole("editor", "", sql.NullInt32{})
+	assert.NoError(err)
+
+	a, _ := db.GetRoleById(role.Id)
+	b, _ := db.GetRoleById(role.Id)
+
+	a.Description = "edits content"
+	assert.NoError(a.Save(db))
+
+	b.Description = "edits everything"
+	assert.ErrorIs(b.Save(db), iam.ErrConcurrencyConflict)
+
+	_, err = db.AddRoleClaim(role.Id, "content", "write")
+	assert.NoError(err)
+	a.Description = "edits and publishes content"
+	assert.ErrorIs(a.Save(db), iam.ErrConcurrencyConflict)
+}
@@ -1,7 +1,39 @@
 package iam
 
-import "gorm.io/gorm"
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
 
 type IamDb struct {
 	*gorm.DB
 }
+
+// NewIamDb wraps db and installs the ErrorTranslation plugin, so that stores
+// report NotFoundError and ConflictError rather than raw driver errors.
+func NewIamDb(db *gorm.DB) (*IamDb, error) {
+	if _, ok := db.Config.Plugins[ErrorTranslation{}.Name()]; !ok {
+		err := db.Use(ErrorTranslation{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &IamDb{DB: db}, nil
+}
+
+// WithContext returns the db bound to ctx, so that cancellation and
+// deadlines reach every query made through it.
+func (db *IamDb) WithContext(ctx context.Context) *IamDb {
+	return &IamDb{DB: db.DB.WithContext(ctx)}
+}
+
+// WithTx runs fn in a transaction bound to ctx. Stores built on tx, or moved
+// onto it with their WithTx method, share the transaction. It commits when
+// fn returns nil and rolls back otherwise; nested calls use savepoints.
+func (db *IamDb) WithTx(ctx context.Context, fn func(tx *IamDb) error) error {
+	return db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&IamDb{DB: tx})
+	})
+}
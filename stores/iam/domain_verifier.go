@@ -0,0 +1,378 @@
+package iam
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"gorm.io/gorm"
+)
+
+var ErrDomainNotVerified = errors.New("the challenge token was not found in DNS or at the well-known URL")
+
+// TxtResolver looks up DNS TXT records. net.Resolver implements it.
+type TxtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type DomainVerificationOptions struct {
+	// RecordName is the label under the domain that holds the TXT record,
+	// e.g. _gnome-challenge.acme.com.
+	RecordName string
+	// TokenPrefix is put in front of the challenge token in the TXT record
+	// and the well-known file.
+	TokenPrefix string
+	// WellKnownPath is the path of the file served by the domain's web site.
+	WellKnownPath string
+	// ReverifyInterval is how often verified domains are checked again.
+	ReverifyInterval time.Duration
+	// MaxFailedChecks is how many re-verifications in a row may fail before
+	// a verified domain loses its status.
+	MaxFailedChecks int32
+	Timeout         time.Duration
+}
+
+func DefaultDomainVerificationOptions() DomainVerificationOptions {
+	return DomainVerificationOptions{
+		RecordName:       "_gnome-challenge",
+		TokenPrefix:      "gnome-domain-verification=",
+		WellKnownPath:    "/.well-known/gnome-domain-verification.txt",
+		ReverifyInterval: 7 * 24 * time.Hour,
+		MaxFailedChecks:  3,
+		Timeout:          10 * time.Second,
+	}
+}
+
+// DomainChallenge tells an org admin how to prove control of a domain: by
+// publishing TxtValue as a TXT record at TxtName, or by serving HttpContent
+// at HttpUrl.
+type DomainChallenge struct {
+	Domain      string `json:"domain"`
+	Status      string `json:"status"`
+	TxtName     string `json:"txtName"`
+	TxtValue    string `json:"txtValue"`
+	HttpUrl     string `json:"httpUrl"`
+	HttpContent string `json:"httpContent"`
+}
+
+// DomainVerifier checks that an org controls the domains it claims and keeps
+// checking verified domains so that lapsed ones are noticed.
+type DomainVerifier struct {
+	db       *IamDb
+	Options  DomainVerificationOptions
+	Resolver TxtResolver
+	Client   *http.Client
+	Now      func() time.Time
+}
+
+func NewDomainVerifier(db *IamDb, options *DomainVerificationOptions) *DomainVerifier {
+	o := DefaultDomainVerificationOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &DomainVerifier{
+		db:       db,
+		Options:  o,
+		Resolver: net.DefaultResolver,
+		Client:   newWellKnownClient(o.Timeout),
+		Now:      time.Now,
+	}
+}
+
+// newWellKnownClient returns a client that only connects to public
+// addresses, so an org cannot point the verifier at internal services by
+// claiming a domain that resolves to one. The address is checked when the
+// connection is made, after DNS resolution.
+func newWellKnownClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublicIp(ip) {
+				return fmt.Errorf("refusing to connect to %s", host)
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+	}
+}
+
+func isPublicIp(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsUnspecified()
+}
+
+// WithTx returns a copy of the verifier that works in the transaction of tx,
+// see IamDb.WithTx.
+func (v *DomainVerifier) WithTx(tx *IamDb) *DomainVerifier {
+	c := *v
+	c.db = tx
+	return &c
+}
+
+// WithContext returns a copy of the verifier whose queries use ctx.
+func (v *DomainVerifier) WithContext(ctx context.Context) *DomainVerifier {
+	return v.WithTx(v.db.WithContext(ctx))
+}
+
+func (v *DomainVerifier) Challenge(orgId int32, domain string) (*DomainChallenge, error) {
+	d, err := v.find(v.db.DB, orgId, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.challenge(d), nil
+}
+
+// RegenerateChallenge replaces the challenge token of a domain that is not
+// verified yet, for example after the old one leaked.
+func (v *DomainVerifier) RegenerateChallenge(orgId int32, domain string) (*DomainChallenge, error) {
+	d, err := v.find(v.db.DB, orgId, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Status == DomainVerified {
+		return nil, &ConflictError{Entity: "org domain", Message: "the domain is already verified"}
+	}
+
+	d.ChallengeToken = uniuri.NewLen(32)
+	err = v.db.Model(d).Update("challenge_token", d.ChallengeToken).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return v.challenge(d), nil
+}
+
+// Verify checks the challenge for the domain. On success the domain is
+// verified for the org and any other org's claim on it stops counting. On
+// failure ErrDomainNotVerified is returned and the domain is marked failed;
+// a verified domain keeps its verification until it has failed
+// MaxFailedChecks checks in a row.
+func (v *DomainVerifier) Verify(ctx context.Context, orgId int32, domain string) (*OrgDomain, error) {
+	d, err := v.find(v.db.DB, orgId, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	method := v.check(ctx, d)
+	now := v.Now()
+	d.LastCheckedAt = sql.NullTime{Time: now, Valid: true}
+
+	if method == "" {
+		// a verified domain only lapses after MaxFailedChecks failures in a
+		// row, like in Reverify, so a single outage does not unverify it
+		d.FailedChecks++
+		if d.Status != DomainVerified || d.FailedChecks >= v.Options.MaxFailedChecks {
+			d.Status = DomainFailed
+			d.VerifiedAt = sql.NullTime{}
+		}
+
+		err = v.db.Model(d).Select("status", "verified_at", "last_checked_at", "failed_checks").Updates(d).Error
+		if err != nil {
+			return nil, err
+		}
+
+		return d, ErrDomainNotVerified
+	}
+
+	d.Status = DomainVerified
+	d.VerifiedBy = method
+	d.VerifiedAt = sql.NullTime{Time: now, Valid: true}
+	d.FailedChecks = 0
+
+	err = v.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(d).
+			Select("status", "verified_by", "verified_at", "last_checked_at", "failed_checks").
+			Updates(d).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&OrgDomain{}).
+			Where("domain = ? AND id <> ? AND status = ?", d.Domain, d.Id, DomainVerified).
+			Updates(map[string]interface{}{
+				"status":      DomainFailed,
+				"verified_at": nil,
+			}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Reverify checks every verified domain whose last check is older than the
+// reverify interval and returns how many of them lost their verification.
+// It is meant to run as a periodic job.
+func (v *DomainVerifier) Reverify(ctx context.Context) (int, error) {
+	now := v.Now()
+	domains := []OrgDomain{}
+	err := v.db.Where("status = ? AND (last_checked_at IS NULL OR last_checked_at < ?)",
+		DomainVerified, now.Add(-v.Options.ReverifyInterval)).
+		Find(&domains).Error
+	if err != nil {
+		return 0, err
+	}
+
+	lapsed := 0
+	for i := range domains {
+		if ctx.Err() != nil {
+			return lapsed, ctx.Err()
+		}
+
+		d := &domains[i]
+		d.LastCheckedAt = sql.NullTime{Time: now, Valid: true}
+
+		if v.check(ctx, d) != "" {
+			d.FailedChecks = 0
+		} else {
+			d.FailedChecks++
+			if d.FailedChecks >= v.Options.MaxFailedChecks {
+				d.Status = DomainFailed
+				d.VerifiedAt = sql.NullTime{}
+				lapsed++
+			}
+		}
+
+		err = v.db.Model(d).Select("status", "verified_at", "last_checked_at", "failed_checks").Updates(d).Error
+		if err != nil {
+			return lapsed, err
+		}
+	}
+
+	return lapsed, nil
+}
+
+// check returns how the domain proved control, or an empty string.
+func (v *DomainVerifier) check(ctx context.Context, d *OrgDomain) string {
+	expected := v.Options.TokenPrefix + d.ChallengeToken
+
+	ctx, cancel := context.WithTimeout(ctx, v.Options.Timeout)
+	defer cancel()
+
+	if v.Resolver != nil {
+		records, err := v.Resolver.LookupTXT(ctx, v.Options.RecordName+"."+d.Domain)
+		if err == nil {
+			for _, record := range records {
+				if strings.TrimSpace(record) == expected {
+					return DomainVerifiedByDns
+				}
+			}
+		}
+	}
+
+	if v.Client != nil && v.checkHttp(ctx, d.Domain, expected) {
+		return DomainVerifiedByHttp
+	}
+
+	return ""
+}
+
+func (v *DomainVerifier) checkHttp(ctx context.Context, domain string, expected string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.wellKnownUrl(domain), nil)
+	if err != nil {
+		return false
+	}
+
+	// redirects may only move within the domain being verified
+	client := *v.Client
+	client.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		if len(via) >= 5 || r.URL.Scheme != "https" || r.URL.Hostname() != domain {
+			return http.ErrUseLastResponse
+		}
+
+		return nil
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(res.Body, 4096))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == expected {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (v *DomainVerifier) wellKnownUrl(domain string) string {
+	return fmt.Sprintf("https://%s%s", domain, v.Options.WellKnownPath)
+}
+
+func (v *DomainVerifier) challenge(d *OrgDomain) *DomainChallenge {
+	status := d.Status
+	if status == "" {
+		status = DomainPending
+	}
+
+	value := v.Options.TokenPrefix + d.ChallengeToken
+	return &DomainChallenge{
+		Domain:      d.Domain,
+		Status:      status,
+		TxtName:     v.Options.RecordName + "." + d.Domain,
+		TxtValue:    value,
+		HttpUrl:     v.wellKnownUrl(d.Domain),
+		HttpContent: value,
+	}
+}
+
+func (v *DomainVerifier) find(tx *gorm.DB, orgId int32, domain string) (*OrgDomain, error) {
+	d := strings.TrimSpace(domain)
+	d = strings.ToLower(d)
+
+	row := &OrgDomain{}
+	res := tx.Where("org_id = ? AND domain = ?", orgId, d).Limit(1).Find(row)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, notFound("org domain")
+	}
+
+	// rows created before verification existed have no token yet
+	if row.ChallengeToken == "" {
+		row.ChallengeToken = uniuri.NewLen(32)
+		err := tx.Model(row).Update("challenge_token", row.ChallengeToken).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return row, nil
+}
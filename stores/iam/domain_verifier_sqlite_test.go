@@ -0,0 +1,164 @@
+package iam_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+type fakeTxtResolver map[string][]string
+
+func (r fakeTxtResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	return records, nil
+}
+
+// wellKnownClient sends every request to server, whatever host it is for.
+func wellKnownClient(server *httptest.Server) *http.Client {
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	transport.TLSClientConfig.ServerName = "example.com"
+	client.Transport = transport
+	return client
+}
+
+func TestDomainVerifier(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+	acme := newTestOrg(t, db, "Acme")
+	squatter := newTestOrg(t, db, "Squatter")
+
+	orgs := iam.NewOrgStore(db.DB, nil)
+	assert.NoError(orgs.AddDomain(acme.Uid.String(), "acme.test"))
+	assert.NoError(orgs.AddDomain(acme.Uid.String(), "acme.example"))
+	assert.NoError(orgs.AddDomain(squatter.Uid.String(), "acme.test"))
+	assert.NoError(orgs.AddDomain(acme.Uid.String(), "Labs.Acme.Example."))
+
+	for _, bad := range []string{"10.0.0.1", "[::1]", "localhost", "acme.test:8443", "acme.test/x", "https://acme.test", "-acme.test", "acme.123"} {
+		assert.ErrorIs(orgs.AddDomain(acme.Uid.String(), bad), iam.ErrValidation, bad)
+	}
+
+	served := map[string]string{}
+	redirects := map[string]string{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if to, ok := redirects[r.Host]; ok {
+			http.Redirect(w, r, to, http.StatusFound)
+			return
+		}
+
+		body, ok := served[r.Host]
+		if !ok || r.URL.Path != "/.well-known/gnome-domain-verification.txt" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	dns := fakeTxtResolver{}
+	verifier := iam.NewDomainVerifier(db, nil)
+	verifier.Resolver = dns
+	verifier.Client = wellKnownClient(server)
+
+	ctx := context.Background()
+	challenge, err := verifier.Challenge(acme.Id, "acme.test")
+	assert.NoError(err)
+	assert.Equal(iam.DomainPending, challenge.Status)
+	assert.Equal("_gnome-challenge.acme.test", challenge.TxtName)
+
+	squatterChallenge, _ := verifier.Challenge(squatter.Id, "acme.test")
+	assert.NotEqual(challenge.TxtValue, squatterChallenge.TxtValue)
+
+	d, err := verifier.Verify(ctx, squatter.Id, "acme.test")
+	assert.ErrorIs(err, iam.ErrDomainNotVerified)
+	assert.Equal(iam.DomainFailed, d.Status)
+
+	dns[challenge.TxtName] = []string{"v=spf1 -all", challenge.TxtValue}
+	d, err = verifier.Verify(ctx, acme.Id, "acme.test")
+	assert.NoError(err)
+	assert.Equal(iam.DomainVerified, d.Status)
+	assert.Equal(iam.DomainVerifiedByDns, d.VerifiedBy)
+
+	// the squatter's token does not verify the domain for them
+	_, err = verifier.Verify(ctx, squatter.Id, "acme.test")
+	assert.ErrorIs(err, iam.ErrDomainNotVerified)
+
+	match, err := iam.NewOrgDomainResolver(db, nil).Resolve("ann@acme.test")
+	assert.NoError(err)
+	assert.Equal(acme.Id, match.Org.Id)
+
+	challenge, err = verifier.RegenerateChallenge(acme.Id, "acme.example")
+	assert.NoError(err)
+	served["acme.example"] = "# gnome\n" + challenge.HttpContent + "\n"
+	d, err = verifier.Verify(ctx, acme.Id, "acme.example")
+	assert.NoError(err)
+	assert.Equal(iam.DomainVerifiedByHttp, d.VerifiedBy)
+
+	_, err = verifier.RegenerateChallenge(acme.Id, "acme.example")
+	assert.Error(err)
+
+	// redirects may not leave the domain, and the default client only
+	// connects to public addresses
+	challenge, _ = verifier.Challenge(acme.Id, "labs.acme.example")
+	served["evil.test"] = challenge.HttpContent
+	redirects["labs.acme.example"] = "https://evil.test/.well-known/gnome-domain-verification.txt"
+	_, err = verifier.Verify(ctx, acme.Id, "labs.acme.example")
+	assert.ErrorIs(err, iam.ErrDomainNotVerified)
+
+	_, err = iam.NewDomainVerifier(db, nil).Client.Get(server.URL)
+	assert.ErrorContains(err, "refusing to connect")
+
+	// re-verification tolerates a few failed checks before the domain lapses
+	delete(dns, "_gnome-challenge.acme.test")
+	later := time.Now()
+	for i := 1; i <= 3; i++ {
+		later = later.Add(8 * 24 * time.Hour)
+		verifier.Now = func() time.Time { return later }
+
+		lapsed, err := verifier.Reverify(ctx)
+		assert.NoError(err)
+		if i < 3 {
+			assert.Equal(0, lapsed)
+		} else {
+			assert.Equal(1, lapsed)
+		}
+	}
+
+	challenge, _ = verifier.Challenge(acme.Id, "acme.test")
+	assert.Equal(iam.DomainFailed, challenge.Status)
+	challenge, _ = verifier.Challenge(acme.Id, "acme.example")
+	assert.Equal(iam.DomainVerified, challenge.Status)
+
+	match, _ = iam.NewOrgDomainResolver(db, nil).Resolve("ann@acme.test")
+	assert.Nil(match)
+
+	// failed checks end an earlier verification only once there are as
+	// many in a row as re-verification tolerates
+	match, _ = iam.NewOrgDomainResolver(db, nil).Resolve("ann@acme.example")
+	assert.NotNil(match)
+	delete(served, "acme.example")
+	for i := 1; i <= 3; i++ {
+		d, err = verifier.Verify(ctx, acme.Id, "acme.example")
+		assert.ErrorIs(err, iam.ErrDomainNotVerified)
+		assert.Equal(i < 3, d.IsVerified())
+		assert.Equal(int32(i), d.FailedChecks)
+	}
+
+	match, _ = iam.NewOrgDomainResolver(db, nil).Resolve("ann@acme.example")
+	assert.Nil(match)
+}
@@ -0,0 +1,264 @@
+package iam
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gobuffalo/flect"
+	"gorm.io/gorm"
+)
+
+// The error kinds every store reports. Check them with errors.Is; the
+// NotFoundError, ConflictError and ValidationError types carry the details.
+var (
+	// ErrNotFound is gorm.ErrRecordNotFound, so lookups that return gorm
+	// errors directly match it too.
+	ErrNotFound = gorm.ErrRecordNotFound
+	// ErrConflict is gorm.ErrDuplicatedKey, which gorm reports for unique
+	// violations when TranslateError is enabled.
+	ErrConflict   = gorm.ErrDuplicatedKey
+	ErrInvalidId  = errors.New("id must be a valid UUID")
+	ErrValidation = errors.New("validation failed")
+)
+
+// NotFoundError reports a missing row of Entity, e.g. "org".
+type NotFoundError struct {
+	Entity  string
+	Message string
+}
+
+func (e *NotFoundError) Error() string {
+	switch {
+	case e.Message != "":
+		return e.Message
+	case e.Entity != "":
+		return e.Entity + " not found"
+	default:
+		return ErrNotFound.Error()
+	}
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return ErrNotFound
+}
+
+func notFound(entity string) error {
+	return &NotFoundError{Entity: entity}
+}
+
+// ConflictError reports a row of Entity that clashes with an existing one
+// on Fields, or on the unique index Constraint when the database only names
+// the index.
+type ConflictError struct {
+	Entity     string
+	Fields     []string
+	Constraint string
+	Message    string
+	// Err is the database error, if any.
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+
+	what := "record"
+	if e.Entity != "" {
+		what = e.Entity
+	}
+
+	switch {
+	case len(e.Fields) > 0:
+		return fmt.Sprintf("a %s with the same %s already exists", what, strings.Join(e.Fields, " or "))
+	case e.Constraint != "":
+		return fmt.Sprintf("a %s that conflicts on %s already exists", what, e.Constraint)
+	default:
+		return fmt.Sprintf("the %s already exists", what)
+	}
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+type FieldError struct {
+	Field string `json:"field"`
+	// Tag is the failed rule, e.g. required or max.
+	Tag     string `json:"tag"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists the fields of an input that are not valid.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		messages = append(messages, f.Message)
+	}
+
+	if len(messages) == 0 {
+		return ErrValidation.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func invalidField(field string, tag string, message string) error {
+	return &ValidationError{Fields: []FieldError{{Field: field, Tag: tag, Message: message}}}
+}
+
+// toValidationError turns the errors of a validator into a ValidationError
+// and returns other errors unchanged.
+func toValidationError(err error) error {
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return err
+	}
+
+	v := &ValidationError{}
+	for _, fe := range errs {
+		v.Fields = append(v.Fields, FieldError{
+			Field:   fe.Field(),
+			Tag:     fe.Tag(),
+			Message: fieldMessage(fe),
+		})
+	}
+
+	return v
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	name := strings.ToLower(flect.Humanize(fe.Field()))
+	switch fe.Tag() {
+	case "required":
+		return name + " is required"
+	case "max":
+		return fmt.Sprintf("%s must be at most %s characters", name, fe.Param())
+	case "min":
+		return fmt.Sprintf("%s must be at least %s characters", name, fe.Param())
+	case "email":
+		return name + " must be a valid email address"
+	case "oneof":
+		return fmt.Sprintf("%s must be one of %s", name, strings.ReplaceAll(fe.Param(), " ", ", "))
+	default:
+		return fmt.Sprintf("%s failed the %s rule", name, fe.Tag())
+	}
+}
+
+var (
+	// UNIQUE constraint failed: users.email, users.name
+	sqliteUnique = regexp.MustCompile(`UNIQUE constraint failed: ([\w., ]+)`)
+	// duplicate key value violates unique constraint "ix_users_email"
+	postgresUnique = regexp.MustCompile(`unique constraint "([^"]+)"`)
+)
+
+// TranslateError maps unique violations reported by sqlite or postgres to a
+// ConflictError and returns other errors unchanged. table names the entity
+// when the error does not.
+func TranslateError(err error, table string) error {
+	if err == nil {
+		return nil
+	}
+
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return err
+	}
+
+	entity := flect.Singularize(table)
+
+	// lib/pq and pgx errors both expose the SQLSTATE
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) && state.SQLState() == "23505" {
+		c := &ConflictError{Entity: entity, Err: err}
+		if m := postgresUnique.FindStringSubmatch(err.Error()); m != nil {
+			c.Constraint = m[1]
+		}
+
+		return c
+	}
+
+	if m := sqliteUnique.FindStringSubmatch(err.Error()); m != nil {
+		c := &ConflictError{Entity: entity, Err: err}
+		for _, column := range strings.Split(m[1], ",") {
+			column = strings.TrimSpace(column)
+			t, field, ok := strings.Cut(column, ".")
+			if ok {
+				c.Entity = flect.Singularize(t)
+				column = field
+			}
+
+			c.Fields = append(c.Fields, column)
+		}
+
+		return c
+	}
+
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return &ConflictError{Entity: entity, Err: err}
+	}
+
+	return err
+}
+
+// ErrorTranslation is a gorm plugin that applies TranslateError to every
+// statement and names the entity of gorm.ErrRecordNotFound errors, so that
+// stores report ConflictError and NotFoundError. NewIamDb installs it.
+type ErrorTranslation struct{}
+
+func (ErrorTranslation) Name() string {
+	return "iam:errors"
+}
+
+func (ErrorTranslation) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	translators := []struct {
+		after    string
+		register func(name string, fn func(*gorm.DB)) error
+	}{
+		{"gorm:create", cb.Create().After("gorm:create").Register},
+		{"gorm:update", cb.Update().After("gorm:update").Register},
+		{"gorm:delete", cb.Delete().After("gorm:delete").Register},
+		{"gorm:query", cb.Query().After("gorm:query").Register},
+		{"gorm:raw", cb.Raw().After("gorm:raw").Register},
+	}
+
+	for _, t := range translators {
+		err := t.register("iam:errors_"+strings.TrimPrefix(t.after, "gorm:"), translateStatementError)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func translateStatementError(tx *gorm.DB) {
+	if tx.Error == nil {
+		return
+	}
+
+	table := tx.Statement.Table
+	var notFound *NotFoundError
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) && !errors.As(tx.Error, &notFound) {
+		tx.Error = &NotFoundError{Entity: flect.Singularize(table)}
+		return
+	}
+
+	tx.Error = TranslateError(tx.Error, table)
+}
@@ -0,0 +1,68 @@
+package iam_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	"github.com/google/uuid"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestStoreErrors(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUser("peter", "peter@initech.test")
+	assert.NoError(err)
+
+	// a unique violation reported by sqlite names the columns
+	err = db.Create(&iam.UserTable{Uid: uuid.New(), Name: "peter2", Email: user.Email}).Error
+	assert.ErrorIs(err, iam.ErrConflict)
+	var conflict *iam.ConflictError
+	if assert.True(errors.As(err, &conflict)) {
+		assert.Equal("user", conflict.Entity)
+		assert.Equal([]string{"email"}, conflict.Fields)
+		assert.Equal("a user with the same email already exists", conflict.Error())
+	}
+
+	_, err = db.NewUser("peter", "other@initech.test")
+	assert.ErrorIs(err, iam.ErrConflict)
+
+	_, err = db.GetUserById(404)
+	assert.ErrorIs(err, iam.ErrNotFound)
+	var notFound *iam.NotFoundError
+	if assert.True(errors.As(err, &notFound)) {
+		assert.Equal("user", notFound.Entity)
+	}
+
+	assert.ErrorIs(db.DeleteUser(404), iam.ErrNotFound)
+
+	orgs := iam.NewOrgStore(db.DB, nil)
+	_, err = orgs.FindByUid("not-a-uuid")
+	assert.ErrorIs(err, iam.ErrInvalidId)
+	_, err = orgs.FindByUid(uuid.NewString())
+	assert.ErrorIs(err, iam.ErrNotFound)
+
+	err = orgs.Create(&iam.Org{Name: "", JoinPolicy: "sometimes"})
+	assert.ErrorIs(err, iam.ErrValidation)
+	var invalid *iam.ValidationError
+	if assert.True(errors.As(err, &invalid)) && assert.Len(invalid.Fields, 2) {
+		assert.Equal("Name", invalid.Fields[0].Field)
+		assert.Equal("required", invalid.Fields[0].Tag)
+		assert.Equal("name is required", invalid.Fields[0].Message)
+		assert.Equal("oneof", invalid.Fields[1].Tag)
+	}
+
+	_, err = db.NewRole("", "", user.OrgId)
+	assert.ErrorIs(err, iam.ErrValidation)
+
+	err = iam.NewMembershipStore(db, nil).RemoveMember(1, user.Id)
+	assert.ErrorIs(err, iam.ErrNotFound)
+	assert.ErrorIs(err, iam.ErrNotMember)
+
+	// errors that are not unique violations pass through
+	other := errors.New("boom")
+	assert.Equal(other, iam.TranslateError(other, "users"))
+	assert.Nil(iam.TranslateError(nil, "users"))
+}
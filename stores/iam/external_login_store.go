@@ -0,0 +1,438 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gnomeco/crypto"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	AccessTokenName  = "access_token"
+	RefreshTokenName = "refresh_token"
+	IdTokenName      = "id_token"
+)
+
+// ErrUserNotAllowed is returned when an inactive or banned user signs in.
+var ErrUserNotAllowed = errors.New("the user is inactive or banned")
+
+// ExternalLogin is an identity asserted by an external provider such as
+// GitHub or a corporate OpenID Connect issuer.
+type ExternalLogin struct {
+	Provider      string
+	Key           string
+	DisplayName   string
+	Name          string
+	Email         string
+	EmailVerified bool
+	Tokens        []ExternalToken
+}
+
+type ExternalToken struct {
+	Name      string
+	Value     string
+	ExpiresAt sql.NullTime
+}
+
+// TokenRefresher exchanges a provider refresh token for a new set of tokens.
+type TokenRefresher func(refreshToken string) ([]ExternalToken, error)
+
+type ExternalLoginOptions struct {
+	// AutoProvision creates a user the first time an unknown login signs in.
+	AutoProvision bool
+	// LinkVerifiedEmail links an unknown login to the existing user with the
+	// same email, but only when the provider has verified that email.
+	LinkVerifiedEmail bool
+}
+
+type ExternalLoginStore struct {
+	db      *IamDb
+	cipher  crypto.SymmetricCipher
+	key     []byte
+	Options ExternalLoginOptions
+	Now     func() time.Time
+}
+
+// NewExternalLoginStore creates a store that encrypts provider tokens with key.
+// When cipher is nil AES-256-CBC is used.
+func NewExternalLoginStore(db *IamDb, key []byte, cipher crypto.SymmetricCipher, options *ExternalLoginOptions) *ExternalLoginStore {
+	if cipher == nil {
+		cipher = crypto.NewAes256CBC()
+	}
+
+	o := ExternalLoginOptions{}
+	if options != nil {
+		o = *options
+	}
+
+	return &ExternalLoginStore{
+		db:      db,
+		cipher:  cipher,
+		key:     key,
+		Options: o,
+		Now:     time.Now,
+	}
+}
+
+// WithTx returns a copy of the store that works in the transaction of tx,
+// see IamDb.WithTx.
+func (s *ExternalLoginStore) WithTx(tx *IamDb) *ExternalLoginStore {
+	c := *s
+	c.db = tx
+	return &c
+}
+
+// WithContext returns a copy of the store whose queries use ctx.
+func (s *ExternalLoginStore) WithContext(ctx context.Context) *ExternalLoginStore {
+	return s.WithTx(s.db.WithContext(ctx))
+}
+
+func (s *ExternalLoginStore) AddLogin(userId int32, login *ExternalLogin) error {
+	provider, key := normalizeLogin(login.Provider, login.Key)
+	if provider == "" {
+		return invalidField("provider", "required", "provider is required")
+	}
+
+	if key == "" {
+		return invalidField("key", "required", "key is required")
+	}
+
+	existing := UserLoginProviderTable{}
+	res := s.db.Where("provider = ? AND key = ?", provider, key).Limit(1).Find(&existing)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected > 0 {
+		if existing.UserId == userId {
+			return nil
+		}
+
+		return &ConflictError{Entity: "login", Message: fmt.Sprintf("the %s login is already linked to another user", provider)}
+	}
+
+	table := UserLoginProviderTable{
+		UserId:    userId,
+		Provider:  provider,
+		Key:       key,
+		CreatedAt: s.Now(),
+	}
+
+	if provider != login.Provider {
+		table.ProviderFormatted = sql.NullString{String: login.Provider, Valid: true}
+	}
+
+	if login.DisplayName != "" {
+		table.DisplayName = sql.NullString{String: login.DisplayName, Valid: true}
+	}
+
+	return s.db.Create(&table).Error
+}
+
+// RemoveLogin unlinks the login and deletes its stored tokens. The last login
+// of a user without a password cannot be removed.
+func (s *ExternalLoginStore) RemoveLogin(userId int32, provider string, key string) error {
+	provider, key = normalizeLogin(provider, key)
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var logins int64
+		err := tx.Model(&UserLoginProviderTable{}).Where("user_id = ?", userId).Count(&logins).Error
+		if err != nil {
+			return err
+		}
+
+		var passwords int64
+		err = tx.Model(&UserPasswordTable{}).Where("user_id = ?", userId).Count(&passwords).Error
+		if err != nil {
+			return err
+		}
+
+		if logins <= 1 && passwords == 0 {
+			return errors.New("cannot remove the only login of a user without a password")
+		}
+
+		res := tx.Where("user_id = ? AND provider = ? AND key = ?", userId, provider, key).
+			Delete(&UserLoginProviderTable{})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return notFound("login")
+		}
+
+		return tx.Where("user_id = ? AND provider = ?", userId, provider).
+			Delete(&UserLoginTokenTable{}).Error
+	})
+}
+
+func (s *ExternalLoginStore) GetLogins(userId int32) ([]UserLoginProviderTable, error) {
+	logins := []UserLoginProviderTable{}
+	err := s.db.Where("user_id = ?", userId).Order("provider").Find(&logins).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return logins, nil
+}
+
+// FindUserByLogin returns the user linked to the provider key, or nil when
+// the login is not linked.
+func (s *ExternalLoginStore) FindUserByLogin(provider string, key string) (*UserTable, error) {
+	provider, key = normalizeLogin(provider, key)
+
+	user := UserTable{}
+	res := s.db.Model(&UserTable{}).
+		Joins("JOIN user_login_providers ON user_login_providers.user_id = users.id").
+		Where("user_login_providers.provider = ? AND user_login_providers.key = ?", provider, key).
+		Limit(1).
+		Find(&user)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &user, nil
+}
+
+// SignIn resolves the user for an external login, linking or provisioning a
+// user according to the store options, and stores the login's tokens. The
+// returned bool is true when a new user was created. Inactive and banned
+// users get ErrUserNotAllowed.
+func (s *ExternalLoginStore) SignIn(login *ExternalLogin) (*UserTable, bool, error) {
+	user, err := s.FindUserByLogin(login.Provider, login.Key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if user != nil && (user.Status == UserStatusInactive || user.Status == UserStatusBanned) {
+		return nil, false, ErrUserNotAllowed
+	}
+
+	created := false
+	if user == nil {
+		user, created, err = s.linkOrProvision(login)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if len(login.Tokens) > 0 {
+		err = s.SetTokens(user.Id, login.Provider, login.Tokens)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return user, created, nil
+}
+
+func (s *ExternalLoginStore) linkOrProvision(login *ExternalLogin) (*UserTable, bool, error) {
+	email := strings.ToLower(strings.TrimSpace(login.Email))
+
+	if email != "" {
+		existing := UserTable{}
+		res := s.db.Where("email = ?", email).Limit(1).Find(&existing)
+		if res.Error != nil {
+			return nil, false, res.Error
+		}
+
+		if res.RowsAffected > 0 {
+			if !s.Options.LinkVerifiedEmail || !login.EmailVerified {
+				return nil, false, &ConflictError{Entity: "user", Fields: []string{"email"}}
+			}
+
+			if existing.Status == UserStatusInactive || existing.Status == UserStatusBanned {
+				return nil, false, ErrUserNotAllowed
+			}
+
+			err := s.AddLogin(existing.Id, login)
+			if err != nil {
+				return nil, false, err
+			}
+
+			return &existing, false, nil
+		}
+	}
+
+	if !s.Options.AutoProvision {
+		return nil, false, &NotFoundError{Entity: "user", Message: "login is not linked to a user"}
+	}
+
+	if email == "" {
+		return nil, false, invalidField("email", "required", "an email is required to provision a user")
+	}
+
+	name, err := s.availableName(login.Name, email)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var user *UserTable
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		txDb := &IamDb{DB: tx}
+		u, err := txDb.newUser(name, login.Email)
+		if err != nil {
+			return err
+		}
+
+		u.EmailVerified = login.EmailVerified
+		err = u.Validate()
+		if err != nil {
+			return err
+		}
+
+		err = tx.Create(u).Error
+		if err != nil {
+			return err
+		}
+
+		txStore := *s
+		txStore.db = txDb
+		err = txStore.AddLogin(u.Id, login)
+		if err != nil {
+			return err
+		}
+
+		user = u
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return user, true, nil
+}
+
+// availableName picks a user name from the login, appending a random suffix
+// when the preferred name is taken.
+func (s *ExternalLoginStore) availableName(name string, email string) (string, error) {
+	n := strings.ToLower(strings.TrimSpace(name))
+	if n == "" {
+		n, _, _ = strings.Cut(email, "@")
+	}
+
+	candidate := n
+	for i := 0; i < 5; i++ {
+		var count int64
+		err := s.db.Model(&UserTable{}).Where("name = ?", candidate).Count(&count).Error
+		if err != nil {
+			return "", err
+		}
+
+		if count == 0 {
+			return candidate, nil
+		}
+
+		candidate = n + "-" + uniuri.NewLenChars(4, apiKeyChars)
+	}
+
+	return "", errors.New("unable to find an available user name")
+}
+
+// SetTokens encrypts and stores the tokens, replacing any existing tokens with
+// the same name for the provider.
+func (s *ExternalLoginStore) SetTokens(userId int32, provider string, tokens []ExternalToken) error {
+	provider, _ = normalizeLogin(provider, "")
+	now := s.Now()
+
+	rows := []UserLoginTokenTable{}
+	for _, token := range tokens {
+		enc, err := s.cipher.Encrypt(s.key, []byte(token.Value))
+		if err != nil {
+			return err
+		}
+
+		rows = append(rows, UserLoginTokenTable{
+			UserId:    userId,
+			Provider:  provider,
+			Name:      token.Name,
+			Token:     base64.StdEncoding.EncodeToString(enc),
+			ExpiresAt: token.ExpiresAt,
+			UpdatedAt: now,
+		})
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "provider"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"token", "expires_at", "updated_at"}),
+	}).Create(&rows).Error
+}
+
+// GetToken decrypts the named provider token. A missing token returns nil.
+func (s *ExternalLoginStore) GetToken(userId int32, provider string, name string) (*ExternalToken, error) {
+	provider, _ = normalizeLogin(provider, "")
+
+	row := UserLoginTokenTable{}
+	res := s.db.Where("user_id = ? AND provider = ? AND name = ?", userId, provider, name).Limit(1).Find(&row)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	enc, err := base64.StdEncoding.DecodeString(row.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.cipher.Decrypt(s.key, enc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExternalToken{
+		Name:      row.Name,
+		Value:     string(value),
+		ExpiresAt: row.ExpiresAt,
+	}, nil
+}
+
+func (s *ExternalLoginStore) RemoveTokens(userId int32, provider string) error {
+	provider, _ = normalizeLogin(provider, "")
+	return s.db.Where("user_id = ? AND provider = ?", userId, provider).Delete(&UserLoginTokenTable{}).Error
+}
+
+// RefreshTokens passes the stored refresh token to refresh and stores the
+// tokens it returns.
+func (s *ExternalLoginStore) RefreshTokens(userId int32, provider string, refresh TokenRefresher) error {
+	token, err := s.GetToken(userId, provider, RefreshTokenName)
+	if err != nil {
+		return err
+	}
+
+	if token == nil {
+		return errors.New("no refresh token is stored for the provider")
+	}
+
+	tokens, err := refresh(token.Value)
+	if err != nil {
+		return err
+	}
+
+	return s.SetTokens(userId, provider, tokens)
+}
+
+func normalizeLogin(provider string, key string) (string, string) {
+	p := strings.TrimSpace(provider)
+	p = strings.ToLower(p)
+
+	return p, strings.TrimSpace(key)
+}
@@ -0,0 +1,131 @@
+package iam_test
+
+import (
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestExternalLoginStore(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	store := iam.NewExternalLoginStore(db, []byte("0123456789abcdef0123456789abcdef"), nil, &iam.ExternalLoginOptions{
+		AutoProvision:     true,
+		LinkVerifiedEmail: true,
+	})
+
+	login := &iam.ExternalLogin{
+		Provider:      "GitHub",
+		Key:           "12345",
+		Name:          "frank",
+		Email:         "frank@test.org",
+		EmailVerified: true,
+		Tokens: []iam.ExternalToken{
+			{Name: iam.AccessTokenName, Value: "access-1"},
+			{Name: iam.RefreshTokenName, Value: "refresh-1"},
+		},
+	}
+
+	user, created, err := store.SignIn(login)
+	if err != nil {
+		t.Fatalf("failed to sign in: %v", err)
+	}
+
+	assert.True(created)
+	assert.Equal("frank", user.Name)
+	assert.True(user.EmailVerified)
+
+	again, created, err := store.SignIn(login)
+	assert.NoError(err)
+	assert.False(created)
+	assert.Equal(user.Id, again.Id)
+
+	found, err := store.FindUserByLogin("github", "12345")
+	assert.NoError(err)
+	assert.Equal(user.Id, found.Id)
+
+	missing, err := store.FindUserByLogin("github", "999")
+	assert.NoError(err)
+	assert.Nil(missing)
+
+	var raw iam.UserLoginTokenTable
+	assert.NoError(db.Where("user_id = ? AND name = ?", user.Id, iam.AccessTokenName).First(&raw).Error)
+	assert.NotContains(raw.Token, "access-1")
+
+	token, err := store.GetToken(user.Id, "github", iam.AccessTokenName)
+	assert.NoError(err)
+	assert.Equal("access-1", token.Value)
+
+	err = store.RefreshTokens(user.Id, "github", func(refreshToken string) ([]iam.ExternalToken, error) {
+		assert.Equal("refresh-1", refreshToken)
+		return []iam.ExternalToken{{Name: iam.AccessTokenName, Value: "access-2"}}, nil
+	})
+	assert.NoError(err)
+
+	token, err = store.GetToken(user.Id, "github", iam.AccessTokenName)
+	assert.NoError(err)
+	assert.Equal("access-2", token.Value)
+
+	linked, created, err := store.SignIn(&iam.ExternalLogin{
+		Provider:      "corp",
+		Key:           "frank@corp",
+		Email:         "Frank@test.org",
+		EmailVerified: true,
+	})
+	assert.NoError(err)
+	assert.False(created)
+	assert.Equal(user.Id, linked.Id)
+
+	_, _, err = store.SignIn(&iam.ExternalLogin{
+		Provider: "other",
+		Key:      "1",
+		Email:    "frank@test.org",
+	})
+	assert.Error(err)
+
+	err = store.AddLogin(user.Id+1, &iam.ExternalLogin{Provider: "github", Key: "12345"})
+	assert.Error(err)
+
+	err = store.AddLogin(user.Id, &iam.ExternalLogin{Provider: "github"})
+	var invalid *iam.ValidationError
+	if assert.ErrorAs(err, &invalid) {
+		assert.Len(invalid.Fields, 1)
+		assert.Equal("key", invalid.Fields[0].Field)
+	}
+
+	// inactive and banned users cannot sign in, whether linked or matched
+	// by email
+	for _, status := range []int8{iam.UserStatusInactive, iam.UserStatusBanned} {
+		assert.NoError(db.Model(user).Update("status", status).Error)
+		_, _, err = store.SignIn(login)
+		assert.ErrorIs(err, iam.ErrUserNotAllowed)
+
+		_, _, err = store.SignIn(&iam.ExternalLogin{Provider: "okta", Key: "frank", Email: "frank@test.org", EmailVerified: true})
+		assert.ErrorIs(err, iam.ErrUserNotAllowed)
+	}
+
+	assert.NoError(db.Model(user).Update("status", iam.UserStatusActive).Error)
+
+	logins, err := store.GetLogins(user.Id)
+	assert.NoError(err)
+	assert.Len(logins, 2)
+
+	assert.NoError(store.RemoveLogin(user.Id, "github", "12345"))
+	assert.Error(store.RemoveLogin(user.Id, "corp", "frank@corp"))
+
+	token, err = store.GetToken(user.Id, "github", iam.AccessTokenName)
+	assert.NoError(err)
+	assert.Nil(token)
+
+	second, created, err := store.SignIn(&iam.ExternalLogin{
+		Provider: "github",
+		Key:      "777",
+		Name:     "frank",
+		Email:    "frank2@test.org",
+	})
+	assert.NoError(err)
+	assert.True(created)
+	assert.NotEqual("frank", second.Name)
+}
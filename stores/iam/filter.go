@@ -0,0 +1,572 @@
+package iam
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// FilterType is the type of a filterable field; literals are checked and
+// converted to it before they reach the database.
+type FilterType int
+
+const (
+	FilterString FilterType = iota
+	FilterNumber
+	FilterBool
+	// FilterTime accepts RFC 3339 timestamps and dates like 2024-05-01.
+	FilterTime
+	FilterUuid
+)
+
+type FilterField struct {
+	Column string
+	Type   FilterType
+	// Nullable fields may be compared with null.
+	Nullable bool
+}
+
+// Filter translates OData style filter expressions on the api fields of one
+// entity into WHERE clauses. The grammar is
+//
+//	expr    = term { "or" term }
+//	term    = factor { "and" factor }
+//	factor  = "not" factor | "(" expr ")" | compare | call
+//	compare = field ("eq" | "ne" | "gt" | "ge" | "lt" | "le") literal
+//	        | field "in" "(" literal { "," literal } ")"
+//	call    = ("startswith" | "contains") "(" field "," string ")"
+//	literal = 'string' | number | true | false | null
+//
+// Strings are quoted with single quotes; a quote inside is doubled. Only the
+// fields listed in Fields may be used, and values are always bound as
+// parameters.
+type Filter struct {
+	Fields map[string]FilterField
+	// MaxLength caps the length of an expression; zero means 1024.
+	MaxLength int
+	// MaxDepth caps the nesting of an expression; zero means 16.
+	MaxDepth int
+}
+
+// OrgFilter filters orgs.
+var OrgFilter = Filter{Fields: map[string]FilterField{
+	"id":         {Column: "uid", Type: FilterUuid},
+	"name":       {Column: "name"},
+	"slug":       {Column: "slug"},
+	"joinPolicy": {Column: "join_policy"},
+}}
+
+// UserFilter filters users.
+var UserFilter = Filter{Fields: map[string]FilterField{
+	"id":            {Column: "uid", Type: FilterUuid},
+	"name":          {Column: "name"},
+	"email":         {Column: "email"},
+	"emailVerified": {Column: "email_verified", Type: FilterBool},
+	"phoneNumber":   {Column: "phone_number", Nullable: true},
+	"status":        {Column: "status", Type: FilterNumber},
+	"lastLoginAt":   {Column: "last_login_at", Type: FilterTime, Nullable: true},
+	"createdAt":     {Column: "created_at", Type: FilterTime},
+}}
+
+// RoleFilter filters roles.
+var RoleFilter = Filter{Fields: map[string]FilterField{
+	"id":          {Column: "uid", Type: FilterUuid},
+	"name":        {Column: "name"},
+	"description": {Column: "description"},
+	"orgId":       {Column: "org_id", Type: FilterNumber, Nullable: true},
+}}
+
+// AuditFilter filters audit events.
+var AuditFilter = Filter{Fields: map[string]FilterField{
+	"id":         {Column: "id", Type: FilterNumber},
+	"occurredAt": {Column: "occurred_at", Type: FilterTime},
+	"actorId":    {Column: "actor_id", Type: FilterNumber, Nullable: true},
+	"orgId":      {Column: "org_id", Type: FilterNumber, Nullable: true},
+	"action":     {Column: "action"},
+	"targetType": {Column: "target_type"},
+	"targetId":   {Column: "target_id"},
+	"ip":         {Column: "ip"},
+	"requestId":  {Column: "request_id"},
+}}
+
+// Apply adds the filter expression to tx. An empty expression leaves tx as
+// is; an invalid one returns a ValidationError on the filter field.
+func (f *Filter) Apply(tx *gorm.DB, filter string) (*gorm.DB, error) {
+	expr, err := f.Parse(filter)
+	if err != nil || expr == nil {
+		return tx, err
+	}
+
+	return tx.Where(expr), nil
+}
+
+// Parse translates the filter expression into a clause, or nil when it is
+// empty.
+func (f *Filter) Parse(filter string) (clause.Expression, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+
+	limit := f.MaxLength
+	if limit <= 0 {
+		limit = 1024
+	}
+
+	if len(filter) > limit {
+		return nil, invalidField("filter", "max", fmt.Sprintf("filter must be at most %d characters", limit))
+	}
+
+	tokens, err := lexFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{filter: f, tokens: tokens, maxDepth: f.MaxDepth}
+	if p.maxDepth <= 0 {
+		p.maxDepth = 16
+	}
+
+	expr, err := p.expr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+
+	return expr, nil
+}
+
+// filterLogic and filterNot always write their parentheses, so the
+// precedence of the expression survives however it is combined.
+type filterLogic struct {
+	op    string
+	left  clause.Expression
+	right clause.Expression
+}
+
+func (e filterLogic) Build(builder clause.Builder) {
+	builder.WriteByte('(')
+	e.left.Build(builder)
+	builder.WriteString(e.op)
+	e.right.Build(builder)
+	builder.WriteByte(')')
+}
+
+type filterNot struct {
+	expr clause.Expression
+}
+
+func (e filterNot) Build(builder clause.Builder) {
+	builder.WriteString("NOT (")
+	e.expr.Build(builder)
+	builder.WriteByte(')')
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOpen
+	tokenClose
+	tokenComma
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lexFilter(s string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{tokenOpen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{tokenClose, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, filterToken{tokenComma, ",", i})
+			i++
+		case c == '\'':
+			start := i
+			value := strings.Builder{}
+			i++
+			for {
+				if i >= len(s) {
+					return nil, invalidField("filter", "syntax", fmt.Sprintf("unterminated string at %d", start))
+				}
+
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						value.WriteByte('\'')
+						i += 2
+						continue
+					}
+
+					i++
+					break
+				}
+
+				value.WriteByte(s[i])
+				i++
+			}
+
+			tokens = append(tokens, filterToken{tokenString, value.String(), start})
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(s) && (s[i] == '.' || (s[i] >= '0' && s[i] <= '9')) {
+				i++
+			}
+
+			tokens = append(tokens, filterToken{tokenNumber, s[start:i], start})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(s) && (s[i] == '_' || unicode.IsLetter(rune(s[i])) || (s[i] >= '0' && s[i] <= '9')) {
+				i++
+			}
+
+			tokens = append(tokens, filterToken{tokenIdent, s[start:i], start})
+		default:
+			return nil, invalidField("filter", "syntax", fmt.Sprintf("unexpected %q at %d", c, i))
+		}
+	}
+
+	return append(tokens, filterToken{kind: tokenEnd, pos: len(s)}), nil
+}
+
+type filterParser struct {
+	filter   *Filter
+	tokens   []filterToken
+	next     int
+	maxDepth int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	t := p.tokens[p.next]
+	if t.kind != tokenEnd {
+		p.next++
+	}
+
+	return t
+}
+
+// keyword reports whether the next token is the keyword and takes it.
+func (p *filterParser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokenIdent && strings.EqualFold(t.text, word) {
+		p.next++
+		return true
+	}
+
+	return false
+}
+
+func (p *filterParser) expect(kind tokenKind, what string) error {
+	t := p.take()
+	if t.kind != kind {
+		return p.errorf(t, "expected %s", what)
+	}
+
+	return nil
+}
+
+func (p *filterParser) errorf(t filterToken, format string, args ...interface{}) error {
+	return invalidField("filter", "syntax", fmt.Sprintf(format, args...)+fmt.Sprintf(" at %d", t.pos))
+}
+
+func (p *filterParser) expr(depth int) (clause.Expression, error) {
+	if depth > p.maxDepth {
+		return nil, invalidField("filter", "max", "filter is nested too deeply")
+	}
+
+	left, err := p.term(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		right, err := p.term(depth)
+		if err != nil {
+			return nil, err
+		}
+
+		left = filterLogic{op: " OR ", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) term(depth int) (clause.Expression, error) {
+	left, err := p.factor(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		right, err := p.factor(depth)
+		if err != nil {
+			return nil, err
+		}
+
+		left = filterLogic{op: " AND ", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) factor(depth int) (clause.Expression, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenOpen:
+		p.next++
+		expr, err := p.expr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.expect(tokenClose, ")")
+		if err != nil {
+			return nil, err
+		}
+
+		return expr, nil
+	case p.keyword("not"):
+		if depth+1 > p.maxDepth {
+			return nil, invalidField("filter", "max", "filter is nested too deeply")
+		}
+
+		expr, err := p.factor(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		return filterNot{expr: expr}, nil
+	case t.kind != tokenIdent:
+		return nil, p.errorf(t, "expected a field")
+	}
+
+	p.next++
+	name := strings.ToLower(t.text)
+	if (name == "startswith" || name == "contains") && p.peek().kind == tokenOpen {
+		return p.call(name)
+	}
+
+	field, err := p.field(t)
+	if err != nil {
+		return nil, err
+	}
+
+	column := clause.Column{Table: clause.CurrentTable, Name: field.Column}
+	op := p.take()
+	if op.kind != tokenIdent {
+		return nil, p.errorf(op, "expected an operator")
+	}
+
+	if strings.EqualFold(op.text, "in") {
+		return p.in(field, column)
+	}
+
+	value, err := p.literal(field)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(op.text) {
+	case "eq":
+		return clause.Eq{Column: column, Value: value}, nil
+	case "ne":
+		return clause.Neq{Column: column, Value: value}, nil
+	}
+
+	if value == nil {
+		return nil, p.errorf(op, "null can only be compared with eq or ne")
+	}
+
+	switch strings.ToLower(op.text) {
+	case "gt":
+		return clause.Gt{Column: column, Value: value}, nil
+	case "ge":
+		return clause.Gte{Column: column, Value: value}, nil
+	case "lt":
+		return clause.Lt{Column: column, Value: value}, nil
+	case "le":
+		return clause.Lte{Column: column, Value: value}, nil
+	default:
+		return nil, p.errorf(op, "unknown operator %q", op.text)
+	}
+}
+
+func (p *filterParser) field(t filterToken) (FilterField, error) {
+	field, ok := p.filter.Fields[t.text]
+	if !ok {
+		return field, p.errorf(t, "cannot filter on %q", t.text)
+	}
+
+	return field, nil
+}
+
+func (p *filterParser) in(field FilterField, column clause.Column) (clause.Expression, error) {
+	err := p.expect(tokenOpen, "(")
+	if err != nil {
+		return nil, err
+	}
+
+	values := []interface{}{}
+	for {
+		value, err := p.literal(field)
+		if err != nil {
+			return nil, err
+		}
+
+		if value == nil {
+			return nil, p.errorf(p.tokens[p.next-1], "null cannot be used with in")
+		}
+
+		values = append(values, value)
+		if p.peek().kind != tokenComma {
+			break
+		}
+
+		p.next++
+	}
+
+	err = p.expect(tokenClose, ")")
+	if err != nil {
+		return nil, err
+	}
+
+	return clause.IN{Column: column, Values: values}, nil
+}
+
+// call parses startswith(field, 'x') and contains(field, 'x') into a LIKE
+// with the wildcards of the value escaped.
+func (p *filterParser) call(name string) (clause.Expression, error) {
+	p.next++
+	t := p.take()
+	if t.kind != tokenIdent {
+		return nil, p.errorf(t, "expected a field")
+	}
+
+	field, err := p.field(t)
+	if err != nil {
+		return nil, err
+	}
+
+	if field.Type != FilterString {
+		return nil, p.errorf(t, "%s only works on text fields", name)
+	}
+
+	err = p.expect(tokenComma, ",")
+	if err != nil {
+		return nil, err
+	}
+
+	value := p.take()
+	if value.kind != tokenString {
+		return nil, p.errorf(value, "expected a string")
+	}
+
+	err = p.expect(tokenClose, ")")
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := likeEscaper.Replace(value.text) + "%"
+	if name == "contains" {
+		pattern = "%" + pattern
+	}
+
+	return clause.Expr{
+		SQL:  "? LIKE ? ESCAPE '\\'",
+		Vars: []interface{}{clause.Column{Table: clause.CurrentTable, Name: field.Column}, pattern},
+	}, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// literal parses the next token as a value of the field's type. null
+// returns nil.
+func (p *filterParser) literal(field FilterField) (interface{}, error) {
+	t := p.take()
+	if t.kind == tokenIdent && strings.EqualFold(t.text, "null") {
+		if !field.Nullable {
+			return nil, p.errorf(t, "the field cannot be null")
+		}
+
+		return nil, nil
+	}
+
+	switch field.Type {
+	case FilterNumber:
+		if t.kind == tokenNumber {
+			if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+				return n, nil
+			}
+
+			if n, err := strconv.ParseFloat(t.text, 64); err == nil {
+				return n, nil
+			}
+		}
+
+		return nil, p.errorf(t, "expected a number")
+	case FilterBool:
+		if t.kind == tokenIdent {
+			switch strings.ToLower(t.text) {
+			case "true":
+				return true, nil
+			case "false":
+				return false, nil
+			}
+		}
+
+		return nil, p.errorf(t, "expected true or false")
+	case FilterTime:
+		if t.kind == tokenString {
+			if v, err := time.Parse(time.RFC3339Nano, t.text); err == nil {
+				return v.UTC(), nil
+			}
+
+			if v, err := time.Parse(time.DateOnly, t.text); err == nil {
+				return v, nil
+			}
+		}
+
+		return nil, p.errorf(t, "expected a timestamp like '2006-01-02T15:04:05Z'")
+	case FilterUuid:
+		if t.kind == tokenString {
+			if v, err := uuid.Parse(t.text); err == nil {
+				return v, nil
+			}
+		}
+
+		return nil, p.errorf(t, "expected a quoted uuid")
+	default:
+		if t.kind != tokenString {
+			return nil, p.errorf(t, "expected a quoted string")
+		}
+
+		return t.text, nil
+	}
+}
@@ -0,0 +1,103 @@
+package iam_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+	store := iam.NewOrgStore(db.DB, nil)
+
+	for _, name := range []string{"Acme", "Acme Labs", "Globex", "Initech", "100% Pure"} {
+		err := store.Create(&iam.Org{Name: name, JoinPolicy: iam.OrgJoinPolicyAuto})
+		if err != nil {
+			t.Fatalf("failed to create org: %v", err)
+		}
+	}
+
+	assert.NoError(store.Create(&iam.Org{Name: "Hooli", JoinPolicy: iam.OrgJoinPolicyBlock}))
+
+	filtered := func(filter string) []string {
+		page, err := store.List(&iam.PageQuery{Filters: []string{filter}})
+		if !assert.NoError(err, filter) {
+			return nil
+		}
+
+		return orgNames(page.Items)
+	}
+
+	assert.Equal([]string{"acme", "acme labs"}, filtered("startswith(name, 'acme')"))
+	assert.Equal([]string{"100% pure"}, filtered("contains(name, '%')"))
+	assert.Equal([]string{"globex", "hooli"}, filtered("name in ('globex', 'hooli', 'umbrella')"))
+	assert.Equal([]string{"hooli"}, filtered("joinPolicy ne 'auto'"))
+	assert.Equal([]string{"globex", "initech"}, filtered("name gt 'acme labs' and not (name eq 'hooli' or joinPolicy eq 'block')"))
+	assert.Equal([]string{"globex"}, filtered("name eq 'globex' or name eq 'initech' and joinPolicy eq 'block'"))
+
+	// values are bound, never spliced into the query
+	assert.Empty(filtered("name eq 'x'' or 1=1 --'"))
+
+	page, err := store.List(&iam.PageQuery{Filters: []string{"startswith(name, 'acme')"}, Size: 1, Total: true})
+	assert.NoError(err)
+	assert.Equal(int64(2), *page.Total)
+	page, err = store.List(&iam.PageQuery{Filters: []string{"startswith(name, 'acme')"}, Cursor: page.Next})
+	assert.NoError(err)
+	assert.Equal([]string{"acme labs"}, orgNames(page.Items))
+
+	for _, bad := range []string{
+		"path eq '/1/'",
+		"name eq",
+		"name eq 'acme",
+		"name like 'acme'",
+		"(name eq 'acme'",
+		"name eq 'acme' name",
+		"name eq null",
+		"id eq 'not-a-uuid'",
+		"contains(id, 'a')",
+		"name eq 1; DROP TABLE orgs",
+	} {
+		_, err := store.List(&iam.PageQuery{Filters: []string{bad}})
+		assert.ErrorIs(err, iam.ErrValidation, bad)
+	}
+
+	user, err := db.NewUser("peter", "peter@initech.test")
+	assert.NoError(err)
+	_, err = db.NewUser("samir", "samir@initech.test")
+	assert.NoError(err)
+
+	tx, err := iam.UserFilter.Apply(db.Model(&iam.UserTable{}), "endswith eq 'x'")
+	assert.ErrorIs(err, iam.ErrValidation)
+	tx, err = iam.UserFilter.Apply(db.Model(&iam.UserTable{}), "lastLoginAt eq null and emailVerified eq false and contains(email, 'initech') and createdAt ge '2000-01-01'")
+	assert.NoError(err)
+	var count int64
+	assert.NoError(tx.Count(&count).Error)
+	assert.Equal(int64(2), count)
+
+	_, err = db.NewRole("admin", "", sql.NullInt32{})
+	assert.NoError(err)
+	roles := []iam.RoleTable{}
+	tx, err = iam.RoleFilter.Apply(db.DB, "orgId eq null and name eq 'admin'")
+	assert.NoError(err)
+	assert.NoError(tx.Find(&roles).Error)
+	assert.Len(roles, 1)
+
+	audit := iam.NewAuditLog(db, nil)
+	ctx := context.Background()
+	assert.NoError(audit.Record(ctx, &iam.AuditEventTable{Action: "login.succeeded", ActorId: sql.NullInt32{Int32: user.Id, Valid: true}}))
+	assert.NoError(audit.Record(ctx, &iam.AuditEventTable{Action: "login.failed"}))
+	assert.NoError(audit.Record(ctx, &iam.AuditEventTable{Action: "users.update", ActorId: sql.NullInt32{Int32: user.Id, Valid: true}}))
+
+	events, err := audit.Find(&iam.AuditQuery{Filter: "startswith(action, 'login.') and actorId ne null"})
+	assert.NoError(err)
+	if assert.Len(events, 1) {
+		assert.Equal("login.succeeded", events[0].Action)
+	}
+
+	_, err = audit.Find(&iam.AuditQuery{Filter: "changes eq ''"})
+	assert.ErrorIs(err, iam.ErrValidation)
+}
@@ -2,6 +2,10 @@ module github.com/gnomego/sdk/stores/iam
 
 go 1.22.0
 
+require github.com/gnomeco/crypto v0.0.0
+
+replace github.com/gnomeco/crypto => ../../crypto
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dchest/uniuri v1.2.0 // indirect
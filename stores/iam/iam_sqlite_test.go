@@ -0,0 +1,39 @@
+package iam_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func init() {
+	iam.SecretHashCost = bcrypt.MinCost
+}
+
+// newIamDb opens a private in-memory database for a single test so that
+// tests do not share rows through the shared cache used by the org tests.
+func newIamDb(t *testing.T) *iam.IamDb {
+	name := strings.ReplaceAll(t.Name(), "/", "_")
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", name)
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	iamDb, err := iam.NewIamDb(db)
+	if err != nil {
+		t.Fatalf("failed to install plugins: %v", err)
+	}
+
+	err = iamDb.MigrateIam()
+	if err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	return iamDb
+}
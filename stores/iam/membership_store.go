@@ -0,0 +1,650 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrAlreadyMember           error = &ConflictError{Entity: "org member", Message: "the user is already a member of the org"}
+	ErrNotMember               error = &NotFoundError{Entity: "org member", Message: "the user is not a member of the org"}
+	ErrLastOwner                     = errors.New("the org must keep at least one owner")
+	ErrInvalidMemberRole       error = invalidField("role", "oneof", "member role must be owner, admin or member")
+	ErrInvitationPending       error = &ConflictError{Entity: "invitation", Message: "an invitation is already pending for this email; resend it instead"}
+	ErrInvitationInvalid             = errors.New("invitation is invalid, expired or already answered")
+	ErrInvitationEmailMismatch       = errors.New("the invitation was sent to a different email address")
+	ErrJoinRequestInvalid            = errors.New("join request does not exist or was already answered")
+)
+
+type MembershipOptions struct {
+	// InvitationLifetime is how long an invitation can be accepted after it
+	// was last sent.
+	InvitationLifetime time.Duration
+}
+
+func DefaultMembershipOptions() MembershipOptions {
+	return MembershipOptions{
+		InvitationLifetime: 7 * 24 * time.Hour,
+	}
+}
+
+// MembershipStore manages which orgs a user belongs to and the invitations
+// used to join them.
+type MembershipStore struct {
+	db      *IamDb
+	Options MembershipOptions
+	Now     func() time.Time
+}
+
+func NewMembershipStore(db *IamDb, options *MembershipOptions) *MembershipStore {
+	o := DefaultMembershipOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &MembershipStore{
+		db:      db,
+		Options: o,
+		Now:     time.Now,
+	}
+}
+
+// WithTx returns a copy of the store that works in the transaction of tx,
+// see IamDb.WithTx.
+func (s *MembershipStore) WithTx(tx *IamDb) *MembershipStore {
+	c := *s
+	c.db = tx
+	return &c
+}
+
+// WithContext returns a copy of the store whose queries use ctx.
+func (s *MembershipStore) WithContext(ctx context.Context) *MembershipStore {
+	return s.WithTx(s.db.WithContext(ctx))
+}
+
+// AddMember makes the user a member of the org. The org becomes the user's
+// primary org when they do not have one yet.
+func (s *MembershipStore) AddMember(orgId int32, userId int32, role string) (*OrgMemberTable, error) {
+	var member *OrgMemberTable
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		member, err = s.addMember(tx, orgId, userId, role)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+// RemoveMember removes the user from the org along with the org roles they
+// were assigned.
+func (s *MembershipStore) RemoveMember(orgId int32, userId int32) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		member, err := s.getMember(tx, orgId, userId)
+		if err != nil {
+			return err
+		}
+
+		if member.Role == OrgMemberRoleOwner {
+			err = ensureOtherOwner(tx, orgId, userId)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Delete(member).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("user_id = ? AND role_id IN (?)", userId,
+			tx.Model(&RoleTable{}).Select("id").Where("org_id = ?", orgId)).
+			Delete(&UserRoleTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&UserTable{}).
+			Where("id = ? AND organization_id = ?", userId, orgId).
+			Updates(map[string]interface{}{
+				"organization_id":   nil,
+				"concurrency_stamp": uuid.NewString(),
+			}).Error
+	})
+}
+
+func (s *MembershipStore) SetMemberRole(orgId int32, userId int32, role string) error {
+	role, err := normalizeMemberRole(role)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		member, err := s.getMember(tx, orgId, userId)
+		if err != nil {
+			return err
+		}
+
+		if member.Role == role {
+			return nil
+		}
+
+		if member.Role == OrgMemberRoleOwner {
+			err = ensureOtherOwner(tx, orgId, userId)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(member).Update("role", role).Error
+	})
+}
+
+// GetMember returns nil when the user is not a member of the org.
+func (s *MembershipStore) GetMember(orgId int32, userId int32) (*OrgMemberTable, error) {
+	member, err := s.getMember(s.db.DB, orgId, userId)
+	if errors.Is(err, ErrNotMember) {
+		return nil, nil
+	}
+
+	return member, err
+}
+
+// EffectiveRole returns the highest role the user holds in the org. Owners
+// and admins of an ancestor org hold the same role in the org. It returns an
+// empty string when the user has no role there.
+func (s *MembershipStore) EffectiveRole(orgId int32, userId int32) (string, error) {
+	lineage, err := orgLineage(s.db.DB, orgId)
+	if err != nil {
+		return "", err
+	}
+
+	members := []OrgMemberTable{}
+	err = s.db.Where("user_id = ? AND org_id IN ?", userId, lineage).Find(&members).Error
+	if err != nil {
+		return "", err
+	}
+
+	role := ""
+	for _, m := range members {
+		if m.OrgId != orgId && m.Role == OrgMemberRoleMember {
+			continue
+		}
+
+		if memberRoleRank(m.Role) > memberRoleRank(role) {
+			role = m.Role
+		}
+	}
+
+	return role, nil
+}
+
+func (s *MembershipStore) IsMember(orgId int32, userId int32) (bool, error) {
+	var count int64
+	err := s.db.Model(&OrgMemberTable{}).Where("org_id = ? AND user_id = ?", orgId, userId).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// GetMembers returns the members of the org with their users loaded.
+func (s *MembershipStore) GetMembers(orgId int32) ([]OrgMemberTable, error) {
+	members := []OrgMemberTable{}
+	err := s.db.Preload("User").
+		Joins("JOIN users ON users.id = org_members.user_id AND users.deleted_at IS NULL").
+		Where("org_members.org_id = ?", orgId).
+		Order("org_members.joined_at").
+		Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// GetUserMemberships returns the orgs the user belongs to.
+func (s *MembershipStore) GetUserMemberships(userId int32) ([]OrgMemberTable, error) {
+	members := []OrgMemberTable{}
+	err := s.db.Preload("Org").
+		Joins("JOIN orgs ON orgs.id = org_members.org_id AND orgs.deleted_at IS NULL").
+		Where("org_members.user_id = ?", userId).
+		Order("org_members.joined_at").
+		Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// Invite creates an invitation for email to join the org and returns the
+// token to send to that address.
+func (s *MembershipStore) Invite(orgId int32, email string, role string, invitedBy sql.NullInt32) (string, *OrgInvitationTable, error) {
+	e := strings.TrimSpace(email)
+	e = strings.ToLower(e)
+	if e == "" {
+		return "", nil, invalidField("email", "required", "email is required")
+	}
+
+	role, err := normalizeMemberRole(role)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := s.Now()
+	token := uniuri.NewLen(48)
+	invitation := &OrgInvitationTable{
+		Uid:        uuid.New(),
+		OrgId:      orgId,
+		Email:      e,
+		Role:       role,
+		Status:     InvitationPending,
+		TokenHash:  hashApiKeySecret(token),
+		InvitedBy:  invitedBy,
+		SentCount:  1,
+		LastSentAt: now,
+		ExpiresAt:  now.Add(s.Options.InvitationLifetime),
+		CreatedAt:  now,
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&OrgMemberTable{}).
+			Joins("JOIN users ON users.id = org_members.user_id").
+			Where("org_members.org_id = ? AND users.email = ?", orgId, e).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return ErrAlreadyMember
+		}
+
+		err = tx.Model(&OrgInvitationTable{}).
+			Where("org_id = ? AND email = ? AND status = ? AND expires_at > ?", orgId, e, InvitationPending, now).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return ErrInvitationPending
+		}
+
+		return tx.Create(invitation).Error
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, invitation, nil
+}
+
+// Resend issues a new token for a pending invitation, even an expired one,
+// and restarts its lifetime. The previous token stops working.
+func (s *MembershipStore) Resend(uid uuid.UUID) (string, *OrgInvitationTable, error) {
+	invitation := &OrgInvitationTable{}
+	res := s.db.Where("uid = ? AND status = ?", uid, InvitationPending).Limit(1).Find(invitation)
+	if res.Error != nil {
+		return "", nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return "", nil, ErrInvitationInvalid
+	}
+
+	now := s.Now()
+	token := uniuri.NewLen(48)
+	invitation.TokenHash = hashApiKeySecret(token)
+	invitation.SentCount++
+	invitation.LastSentAt = now
+	invitation.ExpiresAt = now.Add(s.Options.InvitationLifetime)
+
+	res = s.db.Model(invitation).
+		Where("status = ?", InvitationPending).
+		Select("token_hash", "sent_count", "last_sent_at", "expires_at").
+		Updates(invitation)
+	if res.Error != nil {
+		return "", nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return "", nil, ErrInvitationInvalid
+	}
+
+	return token, invitation, nil
+}
+
+// Revoke cancels a pending invitation.
+func (s *MembershipStore) Revoke(uid uuid.UUID) error {
+	res := s.db.Model(&OrgInvitationTable{}).
+		Where("uid = ? AND status = ?", uid, InvitationPending).
+		Updates(map[string]interface{}{
+			"status":       InvitationRevoked,
+			"responded_at": s.Now(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrInvitationInvalid
+	}
+
+	return nil
+}
+
+// Accept adds the user to the org the invitation is for. The user's email
+// must be the address the invitation was sent to.
+func (s *MembershipStore) Accept(token string, userId int32) (*OrgMemberTable, error) {
+	var member *OrgMemberTable
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		invitation, err := s.findPending(tx, token)
+		if err != nil {
+			return err
+		}
+
+		user := &UserTable{}
+		err = tx.Where("id = ?", userId).First(user).Error
+		if err != nil {
+			return err
+		}
+
+		if user.Email != invitation.Email {
+			return ErrInvitationEmailMismatch
+		}
+
+		err = s.respond(tx, invitation, InvitationAccepted)
+		if err != nil {
+			return err
+		}
+
+		member, err = s.addMember(tx, invitation.OrgId, userId, invitation.Role)
+		if errors.Is(err, ErrAlreadyMember) {
+			member, err = s.getMember(tx, invitation.OrgId, userId)
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+func (s *MembershipStore) Decline(token string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		invitation, err := s.findPending(tx, token)
+		if err != nil {
+			return err
+		}
+
+		return s.respond(tx, invitation, InvitationDeclined)
+	})
+}
+
+// PendingInvitations returns the invitations of the org that can still be
+// accepted.
+func (s *MembershipStore) PendingInvitations(orgId int32) ([]OrgInvitationTable, error) {
+	invitations := []OrgInvitationTable{}
+	err := s.db.Where("org_id = ? AND status = ? AND expires_at > ?", orgId, InvitationPending, s.Now()).
+		Order("created_at").
+		Find(&invitations).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// RequestToJoin files a request for the user to join the org. An existing
+// pending request is returned instead of creating another one.
+func (s *MembershipStore) RequestToJoin(orgId int32, userId int32) (*OrgJoinRequestTable, error) {
+	request := &OrgJoinRequestTable{}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		_, err := s.getMember(tx, orgId, userId)
+		if err == nil {
+			return ErrAlreadyMember
+		}
+
+		if !errors.Is(err, ErrNotMember) {
+			return err
+		}
+
+		res := tx.Where("org_id = ? AND user_id = ? AND status = ?", orgId, userId, JoinRequestPending).
+			Limit(1).
+			Find(request)
+		if res.Error != nil || res.RowsAffected > 0 {
+			return res.Error
+		}
+
+		request = &OrgJoinRequestTable{
+			OrgId:     orgId,
+			UserId:    userId,
+			Status:    JoinRequestPending,
+			CreatedAt: s.Now(),
+		}
+
+		return tx.Create(request).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// PendingJoinRequests returns the unanswered join requests of the org with
+// their users loaded.
+func (s *MembershipStore) PendingJoinRequests(orgId int32) ([]OrgJoinRequestTable, error) {
+	requests := []OrgJoinRequestTable{}
+	err := s.db.Preload("User").
+		Where("org_id = ? AND status = ?", orgId, JoinRequestPending).
+		Order("created_at").
+		Find(&requests).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// ApproveJoinRequest adds the requesting user to the org as a member.
+func (s *MembershipStore) ApproveJoinRequest(id int32, approvedBy sql.NullInt32) (*OrgMemberTable, error) {
+	var member *OrgMemberTable
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		request, err := s.answerJoinRequest(tx, id, JoinRequestApproved, approvedBy)
+		if err != nil {
+			return err
+		}
+
+		member, err = s.addMember(tx, request.OrgId, request.UserId, OrgMemberRoleMember)
+		if errors.Is(err, ErrAlreadyMember) {
+			member, err = s.getMember(tx, request.OrgId, request.UserId)
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+func (s *MembershipStore) RejectJoinRequest(id int32, rejectedBy sql.NullInt32) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		_, err := s.answerJoinRequest(tx, id, JoinRequestRejected, rejectedBy)
+		return err
+	})
+}
+
+func (s *MembershipStore) answerJoinRequest(tx *gorm.DB, id int32, status string, by sql.NullInt32) (*OrgJoinRequestTable, error) {
+	request := &OrgJoinRequestTable{}
+	res := tx.Where("id = ? AND status = ?", id, JoinRequestPending).Limit(1).Find(request)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, ErrJoinRequestInvalid
+	}
+
+	res = tx.Model(request).
+		Where("status = ?", JoinRequestPending).
+		Updates(map[string]interface{}{
+			"status":       status,
+			"responded_by": by,
+			"responded_at": s.Now(),
+		})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, ErrJoinRequestInvalid
+	}
+
+	return request, nil
+}
+
+func (s *MembershipStore) addMember(tx *gorm.DB, orgId int32, userId int32, role string) (*OrgMemberTable, error) {
+	role, err := normalizeMemberRole(role)
+	if err != nil {
+		return nil, err
+	}
+
+	member := &OrgMemberTable{
+		OrgId:    orgId,
+		UserId:   userId,
+		Role:     role,
+		JoinedAt: s.Now(),
+	}
+
+	res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(member)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, ErrAlreadyMember
+	}
+
+	err = tx.Model(&UserTable{}).
+		Where("id = ? AND organization_id IS NULL", userId).
+		Updates(map[string]interface{}{
+			"organization_id":   orgId,
+			"concurrency_stamp": uuid.NewString(),
+		}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+func (s *MembershipStore) getMember(tx *gorm.DB, orgId int32, userId int32) (*OrgMemberTable, error) {
+	member := &OrgMemberTable{}
+	res := tx.Where("org_id = ? AND user_id = ?", orgId, userId).Limit(1).Find(member)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, ErrNotMember
+	}
+
+	return member, nil
+}
+
+func (s *MembershipStore) findPending(tx *gorm.DB, token string) (*OrgInvitationTable, error) {
+	invitation := &OrgInvitationTable{}
+	res := tx.Where("token_hash = ?", hashApiKeySecret(token)).Limit(1).Find(invitation)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 || !invitation.IsPendingAt(s.Now()) {
+		return nil, ErrInvitationInvalid
+	}
+
+	return invitation, nil
+}
+
+// respond records the answer to the invitation, unless someone answered it
+// first.
+func (s *MembershipStore) respond(tx *gorm.DB, invitation *OrgInvitationTable, status string) error {
+	res := tx.Model(invitation).
+		Where("status = ?", InvitationPending).
+		Updates(map[string]interface{}{
+			"status":       status,
+			"responded_at": s.Now(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrInvitationInvalid
+	}
+
+	return nil
+}
+
+func ensureOtherOwner(tx *gorm.DB, orgId int32, userId int32) error {
+	var count int64
+	err := tx.Model(&OrgMemberTable{}).
+		Where("org_id = ? AND role = ? AND user_id <> ?", orgId, OrgMemberRoleOwner, userId).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrLastOwner
+	}
+
+	return nil
+}
+
+func memberRoleRank(role string) int {
+	switch role {
+	case OrgMemberRoleOwner:
+		return 3
+	case OrgMemberRoleAdmin:
+		return 2
+	case OrgMemberRoleMember:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func normalizeMemberRole(role string) (string, error) {
+	r := strings.TrimSpace(role)
+	r = strings.ToLower(r)
+	if r == "" {
+		return OrgMemberRoleMember, nil
+	}
+
+	if !slices.Contains([]string{OrgMemberRoleOwner, OrgMemberRoleAdmin, OrgMemberRoleMember}, r) {
+		return "", ErrInvalidMemberRole
+	}
+
+	return r, nil
+}
@@ -0,0 +1,154 @@
+package iam_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func newTestOrg(t *testing.T, db *iam.IamDb, name string) *iam.OrgTable {
+	org := &iam.Org{Name: name}
+	err := iam.NewOrgStore(db.DB, nil).Create(org)
+	if err != nil {
+		t.Fatalf("failed to create org: %v", err)
+	}
+
+	table := &iam.OrgTable{}
+	err = db.First(table, "uid = ?", org.Id).Error
+	if err != nil {
+		t.Fatalf("failed to load org: %v", err)
+	}
+
+	return table
+}
+
+func TestMembership(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+	acme := newTestOrg(t, db, "Acme")
+	globex := newTestOrg(t, db, "Globex")
+
+	owner, _ := db.NewUser("olga", "olga@test.org")
+	contractor, _ := db.NewUser("carl", "carl@test.org")
+
+	store := iam.NewMembershipStore(db, nil)
+	_, err := store.AddMember(acme.Id, owner.Id, iam.OrgMemberRoleOwner)
+	assert.NoError(err)
+	_, err = store.AddMember(acme.Id, owner.Id, "")
+	assert.ErrorIs(err, iam.ErrAlreadyMember)
+	_, err = store.AddMember(acme.Id, contractor.Id, "guest")
+	assert.ErrorIs(err, iam.ErrInvalidMemberRole)
+
+	_, err = store.AddMember(acme.Id, contractor.Id, "")
+	assert.NoError(err)
+	_, err = store.AddMember(globex.Id, contractor.Id, iam.OrgMemberRoleAdmin)
+	assert.NoError(err)
+
+	memberships, err := store.GetUserMemberships(contractor.Id)
+	assert.NoError(err)
+	assert.Len(memberships, 2)
+	assert.Equal("globex", memberships[1].Org.Name)
+
+	// the first org joined becomes the primary one
+	stored, _ := db.GetUserById(contractor.Id)
+	assert.Equal(acme.Id, stored.OrgId.Int32)
+
+	assert.ErrorIs(store.RemoveMember(acme.Id, owner.Id), iam.ErrLastOwner)
+	assert.ErrorIs(store.SetMemberRole(acme.Id, owner.Id, iam.OrgMemberRoleMember), iam.ErrLastOwner)
+	assert.NoError(store.SetMemberRole(acme.Id, contractor.Id, iam.OrgMemberRoleOwner))
+	assert.NoError(store.SetMemberRole(acme.Id, owner.Id, iam.OrgMemberRoleMember))
+
+	role, err := db.NewRole("acme-billing", "", sql.NullInt32{Int32: acme.Id, Valid: true})
+	assert.NoError(err)
+	assert.NoError(db.AssignRole(owner.Id, role.Id))
+
+	assert.NoError(store.RemoveMember(acme.Id, owner.Id))
+	member, err := store.GetMember(acme.Id, owner.Id)
+	assert.NoError(err)
+	assert.Nil(member)
+
+	roles, err := db.GetUserRoles(owner.Id, sql.NullInt32{Int32: acme.Id, Valid: true})
+	assert.NoError(err)
+	assert.Empty(roles)
+
+	stored, _ = db.GetUserById(owner.Id)
+	assert.False(stored.OrgId.Valid)
+
+	members, err := store.GetMembers(acme.Id)
+	assert.NoError(err)
+	assert.Len(members, 1)
+	assert.Equal("carl", members[0].User.Name)
+}
+
+func TestInvitations(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+	acme := newTestOrg(t, db, "Acme")
+	store := iam.NewMembershipStore(db, nil)
+
+	admin, _ := db.NewUser("ada", "ada@test.org")
+	_, err := store.AddMember(acme.Id, admin.Id, iam.OrgMemberRoleOwner)
+	assert.NoError(err)
+
+	_, _, err = store.Invite(acme.Id, "ada@test.org", "", sql.NullInt32{})
+	assert.ErrorIs(err, iam.ErrAlreadyMember)
+
+	token, invitation, err := store.Invite(acme.Id, " Bea@Test.org ", iam.OrgMemberRoleAdmin, sql.NullInt32{Int32: admin.Id, Valid: true})
+	assert.NoError(err)
+	assert.Equal("bea@test.org", invitation.Email)
+
+	_, _, err = store.Invite(acme.Id, "bea@test.org", "", sql.NullInt32{})
+	assert.ErrorIs(err, iam.ErrInvitationPending)
+
+	pending, err := store.PendingInvitations(acme.Id)
+	assert.NoError(err)
+	assert.Len(pending, 1)
+
+	resent, invitation, err := store.Resend(invitation.Uid)
+	assert.NoError(err)
+	assert.Equal(int32(2), invitation.SentCount)
+
+	bea, _ := db.NewUser("bea", "bea@test.org")
+	other, _ := db.NewUser("eve", "eve@test.org")
+
+	_, err = store.Accept(token, bea.Id)
+	assert.ErrorIs(err, iam.ErrInvitationInvalid)
+	_, err = store.Accept(resent, other.Id)
+	assert.ErrorIs(err, iam.ErrInvitationEmailMismatch)
+
+	member, err := store.Accept(resent, bea.Id)
+	assert.NoError(err)
+	assert.Equal(iam.OrgMemberRoleAdmin, member.Role)
+	_, err = store.Accept(resent, bea.Id)
+	assert.ErrorIs(err, iam.ErrInvitationInvalid)
+
+	token, invitation, err = store.Invite(acme.Id, "eve@test.org", "", sql.NullInt32{})
+	assert.NoError(err)
+	assert.NoError(store.Decline(token))
+	assert.ErrorIs(store.Revoke(invitation.Uid), iam.ErrInvitationInvalid)
+
+	_, invitation, err = store.Invite(acme.Id, "eve@test.org", "", sql.NullInt32{})
+	assert.NoError(err)
+	assert.NoError(store.Revoke(invitation.Uid))
+
+	// expired invitations are no longer pending but can be resent
+	token, invitation, err = store.Invite(acme.Id, "eve@test.org", "", sql.NullInt32{})
+	assert.NoError(err)
+	store.Now = func() time.Time { return time.Now().Add(8 * 24 * time.Hour) }
+	pending, _ = store.PendingInvitations(acme.Id)
+	assert.Empty(pending)
+	_, err = store.Accept(token, other.Id)
+	assert.ErrorIs(err, iam.ErrInvitationInvalid)
+
+	token, _, err = store.Resend(invitation.Uid)
+	assert.NoError(err)
+	_, err = store.Accept(token, other.Id)
+	assert.NoError(err)
+
+	ok, err := store.IsMember(acme.Id, other.Id)
+	assert.NoError(err)
+	assert.True(ok)
+}
@@ -0,0 +1,472 @@
+package iam
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gnomeco/crypto"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrMfaAlreadyEnabled = errors.New("two factor authentication is already enabled")
+	ErrMfaNotEnrolled    = errors.New("no authenticator enrollment is pending")
+	ErrInvalidMfaCode    = errors.New("the code is invalid")
+)
+
+var recoveryCodeChars = []byte("abcdefghjkmnpqrstuvwxyz23456789")
+
+type MfaOptions struct {
+	// Issuer is the name authenticator apps show next to the account.
+	Issuer string
+	// Skew is the number of 30 second steps either side of now that are
+	// still accepted, to allow for clock drift.
+	Skew                   int64
+	RecoveryCodeCount      int
+	RememberDeviceLifetime time.Duration
+}
+
+func DefaultMfaOptions() MfaOptions {
+	return MfaOptions{
+		Issuer:                 "gnome",
+		Skew:                   1,
+		RecoveryCodeCount:      10,
+		RememberDeviceLifetime: 30 * 24 * time.Hour,
+	}
+}
+
+// TotpEnrollment is shown to the user once, usually as a QR code of Uri.
+type TotpEnrollment struct {
+	Secret string
+	Uri    string
+}
+
+type MfaStore struct {
+	db      *IamDb
+	cipher  crypto.SymmetricCipher
+	key     []byte
+	Options MfaOptions
+	Now     func() time.Time
+}
+
+// NewMfaStore creates a store that encrypts authenticator secrets with key.
+// When cipher is nil AES-256-CBC is used.
+func NewMfaStore(db *IamDb, key []byte, cipher crypto.SymmetricCipher, options *MfaOptions) *MfaStore {
+	if cipher == nil {
+		cipher = crypto.NewAes256CBC()
+	}
+
+	o := DefaultMfaOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &MfaStore{
+		db:      db,
+		cipher:  cipher,
+		key:     key,
+		Options: o,
+		Now:     time.Now,
+	}
+}
+
+// WithTx returns a copy of the store that works in the transaction of tx,
+// see IamDb.WithTx.
+func (s *MfaStore) WithTx(tx *IamDb) *MfaStore {
+	c := *s
+	c.db = tx
+	return &c
+}
+
+// WithContext returns a copy of the store whose queries use ctx.
+func (s *MfaStore) WithContext(ctx context.Context) *MfaStore {
+	return s.WithTx(s.db.WithContext(ctx))
+}
+
+// UseWith wires the store into the sign in manager so a valid password is
+// followed by a second factor for enrolled users.
+func (s *MfaStore) UseWith(m *SignInManager) {
+	m.Options.TwoFactorRequired = s.TwoFactorRequired
+	m.Options.VerifyTwoFactor = s.VerifyTwoFactor
+	m.Options.IsDeviceRemembered = s.IsDeviceRemembered
+}
+
+// BeginTotpEnrollment creates a new unconfirmed authenticator secret for the
+// user, replacing any earlier unconfirmed one.
+func (s *MfaStore) BeginTotpEnrollment(userId int32) (*TotpEnrollment, error) {
+	user, err := s.db.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := NewTotpSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := s.cipher.Encrypt(s.key, []byte(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		existing, err := s.authenticator(tx, userId)
+		if err != nil {
+			return err
+		}
+
+		if existing != nil {
+			if existing.IsConfirmed() {
+				return ErrMfaAlreadyEnabled
+			}
+
+			err = tx.Delete(existing).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&UserAuthenticatorTable{
+			Uid:       uuid.New(),
+			UserId:    userId,
+			Secret:    base64.StdEncoding.EncodeToString(enc),
+			CreatedAt: s.Now(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TotpEnrollment{
+		Secret: secret,
+		Uri:    TotpUri(s.Options.Issuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmTotpEnrollment enables two factor authentication once the user has
+// proven the app produces valid codes. The returned recovery codes are only
+// available now; store them nowhere but with the user.
+func (s *MfaStore) ConfirmTotpEnrollment(userId int32, code string) ([]string, error) {
+	var codes []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		a, err := s.authenticator(tx, userId)
+		if err != nil {
+			return err
+		}
+
+		if a == nil || a.IsConfirmed() {
+			return ErrMfaNotEnrolled
+		}
+
+		ok, err := s.checkTotp(tx, a, code)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return ErrInvalidMfaCode
+		}
+
+		a.ConfirmedAt = sql.NullTime{Time: s.Now(), Valid: true}
+		err = tx.Model(a).Select("confirmed_at").Updates(a).Error
+		if err != nil {
+			return err
+		}
+
+		codes, err = s.replaceRecoveryCodes(tx, userId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// IsEnabled reports whether the user has a confirmed authenticator.
+func (s *MfaStore) IsEnabled(userId int32) (bool, error) {
+	a, err := s.authenticator(s.db.DB, userId)
+	if err != nil {
+		return false, err
+	}
+
+	return a != nil && a.IsConfirmed(), nil
+}
+
+func (s *MfaStore) TwoFactorRequired(user *UserTable) (bool, error) {
+	return s.IsEnabled(user.Id)
+}
+
+// VerifyTwoFactor accepts either a current authenticator code or an unused
+// recovery code.
+func (s *MfaStore) VerifyTwoFactor(user *UserTable, code string) (bool, error) {
+	c := strings.TrimSpace(code)
+	if len(c) == TotpDigits {
+		return s.VerifyTotp(user.Id, c)
+	}
+
+	return s.RedeemRecoveryCode(user.Id, c)
+}
+
+// VerifyTotp checks the code against the confirmed authenticator. A code is
+// accepted only once.
+func (s *MfaStore) VerifyTotp(userId int32, code string) (bool, error) {
+	ok := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		a, err := s.authenticator(tx, userId)
+		if err != nil {
+			return err
+		}
+
+		if a == nil || !a.IsConfirmed() {
+			return nil
+		}
+
+		ok, err = s.checkTotp(tx, a, code)
+		return err
+	})
+
+	return ok, err
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes.
+func (s *MfaStore) GenerateRecoveryCodes(userId int32) ([]string, error) {
+	enabled, err := s.IsEnabled(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled {
+		return nil, ErrMfaNotEnrolled
+	}
+
+	var codes []string
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		codes, err = s.replaceRecoveryCodes(tx, userId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (s *MfaStore) RedeemRecoveryCode(userId int32, code string) (bool, error) {
+	hash := hashApiKeySecret(normalizeRecoveryCode(code))
+	res := s.db.Model(&UserRecoveryCodeTable{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userId, hash).
+		Update("used_at", s.Now())
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes, so the user
+// can be prompted to generate more when running low.
+func (s *MfaStore) CountRecoveryCodes(userId int32) (int64, error) {
+	var count int64
+	err := s.db.Model(&UserRecoveryCodeTable{}).
+		Where("user_id = ? AND used_at IS NULL", userId).
+		Count(&count).Error
+
+	return count, err
+}
+
+// RememberDevice returns a token the client keeps to skip the second factor
+// on this device.
+func (s *MfaStore) RememberDevice(userId int32) (string, error) {
+	stamp, err := s.securityStamp(userId)
+	if err != nil {
+		return "", err
+	}
+
+	now := s.Now()
+	secret := uniuri.NewLen(48)
+	device := &UserRememberedDeviceTable{
+		Uid:           uuid.New(),
+		UserId:        userId,
+		TokenHash:     hashApiKeySecret(secret),
+		SecurityStamp: stamp,
+		ExpiresAt:     now.Add(s.Options.RememberDeviceLifetime),
+		CreatedAt:     now,
+	}
+
+	err = s.db.Create(device).Error
+	if err != nil {
+		return "", err
+	}
+
+	return device.Uid.String() + "." + secret, nil
+}
+
+// IsDeviceRemembered reports whether token was issued to the user by
+// RememberDevice and is still valid.
+func (s *MfaStore) IsDeviceRemembered(user *UserTable, token string) (bool, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	uid, err := uuid.Parse(id)
+	if !ok || err != nil || secret == "" {
+		return false, nil
+	}
+
+	device := UserRememberedDeviceTable{}
+	res := s.db.Where("uid = ? AND user_id = ?", uid, user.Id).Limit(1).Find(&device)
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	if res.RowsAffected == 0 || !s.Now().Before(device.ExpiresAt) {
+		return false, nil
+	}
+
+	hash := hashApiKeySecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(device.TokenHash)) != 1 {
+		return false, nil
+	}
+
+	stamp, err := s.securityStamp(user.Id)
+	if err != nil {
+		return false, err
+	}
+
+	return stamp == device.SecurityStamp, nil
+}
+
+func (s *MfaStore) ForgetDevices(userId int32) error {
+	return s.db.Where("user_id = ?", userId).Delete(&UserRememberedDeviceTable{}).Error
+}
+
+// Reset removes the user's authenticator, recovery codes and remembered
+// devices. It is meant for admins helping a user who lost their device.
+func (s *MfaStore) Reset(userId int32) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", userId).Delete(&UserAuthenticatorTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("user_id = ?", userId).Delete(&UserRecoveryCodeTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", userId).Delete(&UserRememberedDeviceTable{}).Error
+	})
+}
+
+// checkTotp accepts codes within the skew window that are newer than the last
+// accepted code, then records the step so the code cannot be replayed.
+func (s *MfaStore) checkTotp(tx *gorm.DB, a *UserAuthenticatorTable, code string) (bool, error) {
+	c := strings.TrimSpace(code)
+	if len(c) != TotpDigits {
+		return false, nil
+	}
+
+	enc, err := base64.StdEncoding.DecodeString(a.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	secret, err := s.cipher.Decrypt(s.key, enc)
+	if err != nil {
+		return false, err
+	}
+
+	key, err := decodeTotpSecret(string(secret))
+	if err != nil {
+		return false, err
+	}
+
+	now := totpStep(s.Now())
+	for step := now - s.Options.Skew; step <= now+s.Options.Skew; step++ {
+		if step <= a.LastUsedStep {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(totpCodeAt(key, step)), []byte(c)) != 1 {
+			continue
+		}
+
+		res := tx.Model(a).
+			Where("last_used_step < ?", step).
+			Update("last_used_step", step)
+		if res.Error != nil {
+			return false, res.Error
+		}
+
+		return res.RowsAffected > 0, nil
+	}
+
+	return false, nil
+}
+
+func (s *MfaStore) replaceRecoveryCodes(tx *gorm.DB, userId int32) ([]string, error) {
+	err := tx.Where("user_id = ?", userId).Delete(&UserRecoveryCodeTable{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.Now()
+	codes := make([]string, s.Options.RecoveryCodeCount)
+	rows := make([]UserRecoveryCodeTable, s.Options.RecoveryCodeCount)
+	for i := range codes {
+		c := uniuri.NewLenChars(10, recoveryCodeChars)
+		codes[i] = c[:5] + "-" + c[5:]
+		rows[i] = UserRecoveryCodeTable{
+			UserId:    userId,
+			CodeHash:  hashApiKeySecret(c),
+			CreatedAt: now,
+		}
+	}
+
+	if len(rows) == 0 {
+		return codes, nil
+	}
+
+	err = tx.Create(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (s *MfaStore) authenticator(tx *gorm.DB, userId int32) (*UserAuthenticatorTable, error) {
+	a := UserAuthenticatorTable{}
+	res := tx.Where("user_id = ?", userId).Limit(1).Find(&a)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &a, nil
+}
+
+func (s *MfaStore) securityStamp(userId int32) (string, error) {
+	pw := UserPasswordTable{}
+	err := s.db.Model(&UserPasswordTable{}).Select("security_stamp").Where("user_id = ?", userId).Limit(1).Find(&pw).Error
+	if err != nil {
+		return "", err
+	}
+
+	return pw.SecurityStamp, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	c := strings.ToLower(code)
+	c = strings.ReplaceAll(c, "-", "")
+	c = strings.ReplaceAll(c, " ", "")
+	return c
+}
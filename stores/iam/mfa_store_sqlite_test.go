@@ -0,0 +1,151 @@
+package iam_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestTotpCode(t *testing.T) {
+	assert := assert2.New(t)
+
+	// RFC 6238 appendix B, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	code, err := iam.TotpCode(secret, time.Unix(59, 0))
+	assert.NoError(err)
+	assert.Equal("287082", code)
+
+	code, err = iam.TotpCode(secret, time.Unix(1111111109, 0))
+	assert.NoError(err)
+	assert.Equal("081804", code)
+
+	uri := iam.TotpUri("gnome", "kate@test.org", secret)
+	assert.True(strings.HasPrefix(uri, "otpauth://totp/gnome:kate@test.org?"))
+}
+
+func TestMfaStore(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUserWithPassword("kate", "kate@test.org", "Secr3t!pass")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	now := time.Now()
+	store := iam.NewMfaStore(db, []byte("01234567890123456789012345678901"), nil, nil)
+	store.Now = func() time.Time { return now }
+
+	manager := iam.NewSignInManager(db, &iam.SignInOptions{MaxFailedAttempts: 3})
+	manager.Now = store.Now
+	store.UseWith(manager)
+
+	res, err := manager.PasswordSignIn("kate", "Secr3t!pass", nil)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+
+	_, err = store.ConfirmTotpEnrollment(user.Id, "123456")
+	assert.ErrorIs(err, iam.ErrMfaNotEnrolled)
+
+	enrollment, err := store.BeginTotpEnrollment(user.Id)
+	assert.NoError(err)
+	assert.Contains(enrollment.Uri, enrollment.Secret)
+
+	enabled, _ := store.IsEnabled(user.Id)
+	assert.False(enabled)
+
+	code, _ := iam.TotpCode(enrollment.Secret, now)
+	codes, err := store.ConfirmTotpEnrollment(user.Id, code)
+	assert.NoError(err)
+	assert.Len(codes, 10)
+
+	enabled, _ = store.IsEnabled(user.Id)
+	assert.True(enabled)
+
+	_, err = store.BeginTotpEnrollment(user.Id)
+	assert.ErrorIs(err, iam.ErrMfaAlreadyEnabled)
+
+	// a code is accepted only once
+	ok, err := store.VerifyTotp(user.Id, code)
+	assert.NoError(err)
+	assert.False(ok)
+
+	res, err = manager.PasswordSignIn("kate", "Secr3t!pass", nil)
+	assert.NoError(err)
+	assert.True(res.RequiresTwoFactor())
+
+	now = now.Add(iam.TotpPeriod * time.Second)
+	code, _ = iam.TotpCode(enrollment.Secret, now)
+	assert.NotEmpty(res.Ticket)
+	ticket := res.Ticket
+
+	// the second factor needs the ticket of the password sign in
+	res, err = manager.TwoFactorSignIn("", code, nil)
+	assert.NoError(err)
+	assert.Equal(iam.SignInFailed, res.Status)
+
+	res, err = manager.TwoFactorSignIn(ticket, code, nil)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+
+	// tickets are single use
+	res, err = manager.TwoFactorSignIn(ticket, codes[0], nil)
+	assert.NoError(err)
+	assert.Equal(iam.SignInFailed, res.Status)
+
+	// recovery codes
+	res, _ = manager.PasswordSignIn("kate", "Secr3t!pass", nil)
+	res, err = manager.TwoFactorSignIn(res.Ticket, strings.ToUpper(codes[0]), nil)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+
+	res, _ = manager.PasswordSignIn("kate", "Secr3t!pass", nil)
+	res, err = manager.TwoFactorSignIn(res.Ticket, codes[0], nil)
+	assert.NoError(err)
+	assert.False(res.Succeeded())
+
+	count, _ := store.CountRecoveryCodes(user.Id)
+	assert.Equal(int64(9), count)
+
+	// remembered devices skip the second factor
+	device, err := store.RememberDevice(user.Id)
+	assert.NoError(err)
+
+	res, err = manager.PasswordSignInFromDevice("kate", "Secr3t!pass", device, nil)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+
+	res, err = manager.PasswordSignInFromDevice("kate", "Secr3t!pass", device+"x", nil)
+	assert.NoError(err)
+	assert.True(res.RequiresTwoFactor())
+
+	// expired tickets are refused
+	ticket = res.Ticket
+	now = now.Add(iam.DefaultSignInOptions().TwoFactorTicketLifetime)
+	res, _ = manager.TwoFactorSignIn(ticket, "000000", nil)
+	assert.Equal(iam.SignInFailed, res.Status)
+	assert.Nil(res.User)
+
+	// wrong codes lock the password
+	res, _ = manager.PasswordSignIn("kate", "Secr3t!pass", nil)
+	ticket = res.Ticket
+	for i := 0; i < 2; i++ {
+		res, _ = manager.TwoFactorSignIn(ticket, "000000", nil)
+		assert.Equal(iam.SignInFailed, res.Status)
+	}
+
+	res, _ = manager.TwoFactorSignIn(ticket, "000000", nil)
+	assert.True(res.IsLockedOut())
+
+	// admin reset
+	assert.NoError(store.Reset(user.Id))
+	enabled, _ = store.IsEnabled(user.Id)
+	assert.False(enabled)
+
+	remembered, err := store.IsDeviceRemembered(user, device)
+	assert.NoError(err)
+	assert.False(remembered)
+}
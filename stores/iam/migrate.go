@@ -1,14 +1,105 @@
 package iam
 
-func (db IamDb) AutoMigrateIam() error {
-	return db.AutoMigrate(&UserTable{},
+import "gorm.io/gorm"
+
+// IamModule names the iam migrations in schema_migrations.
+const IamModule = "iam"
+
+// IamMigrations are the schema versions of the iam store. Add a migration
+// for every schema change instead of editing a released one. The baseline
+// creates the frozen models in migrate_baseline.go, so it creates the same
+// schema however the live models change later; a new column needs its own
+// step, e.g. tx.Migrator().AddColumn, together with the change to the model.
+var IamMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Models:  baselineModels(),
+	},
+	{
+		Version: 2,
+		Name:    "audit_chain",
+		Models:  []interface{}{&auditChainV2{}},
+	},
+	{
+		Version: 3,
+		Name:    "org_members_backfill",
+		// users joined their org through users.organization_id before
+		// org_members existed
+		Up: []string{
+			`INSERT INTO org_members (org_id, user_id, role, joined_at)
+			SELECT users.organization_id, users.id, 'member', users.created_at FROM users
+			WHERE users.organization_id IS NOT NULL
+			AND EXISTS (SELECT 1 FROM orgs WHERE orgs.id = users.organization_id)
+			AND NOT EXISTS (SELECT 1 FROM org_members
+				WHERE org_members.org_id = users.organization_id AND org_members.user_id = users.id)`,
+		},
+		// the backfilled rows cannot be told apart from memberships made
+		// since, so they are kept
+		DownFunc: func(tx *gorm.DB) error { return nil },
+	},
+}
+
+// auditChainV2 is AuditChainTable as created by migration 2.
+type auditChainV2 struct {
+	Id   int32  `gorm:"column:id;primary_key"`
+	Hash string `gorm:"column:hash;size:64"`
+}
+
+func (auditChainV2) TableName() string {
+	return "audit_chain"
+}
+
+// iamTables lists the live models with every table after the tables it
+// refers to.
+func iamTables() []interface{} {
+	return []interface{}{
+		&OrgTable{},
+		&OrgDomain{},
+		&UserTable{},
 		&UserClaimTable{},
 		&UserLoginProviderTable{},
 		&UserPasswordTable{},
 		&UserLoginTokenTable{},
-		&UserClaimTable{},
 		&UserApiKeyTable{},
 		&RoleTable{},
 		&RoleClaimTable{},
-		&UserRoleTable{})
+		&UserRoleTable{},
+		&OAuthClientTable{},
+		&OAuthTokenTable{},
+		&UserSessionTable{},
+		&UserTokenTable{},
+		&UserAuthenticatorTable{},
+		&UserRecoveryCodeTable{},
+		&UserRememberedDeviceTable{},
+		&UserCredentialTable{},
+		&UserPasswordHistoryTable{},
+		&OrgMemberTable{},
+		&OrgInvitationTable{},
+		&OrgJoinRequestTable{},
+		&AccessPolicyTable{},
+		&AuditEventTable{},
+		&AuditChainTable{},
+	}
+}
+
+func NewIamMigrationRunner(db *IamDb, options *MigrationOptions) (*MigrationRunner, error) {
+	return NewMigrationRunner(db.DB, IamModule, IamMigrations, options)
+}
+
+// MigrateIam applies the pending IamMigrations.
+func (db IamDb) MigrateIam() error {
+	runner, err := NewIamMigrationRunner(&db, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = runner.Up()
+	return err
+}
+
+// Deprecated: AutoMigrateIam never drops or renames columns and keeps no
+// record of what ran. Use MigrateIam.
+func (db IamDb) AutoMigrateIam() error {
+	return db.AutoMigrate(iamTables()...)
 }
@@ -0,0 +1,468 @@
+package iam
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// The baseline models are frozen copies of the models as they were when
+// migration 1 was released. Never edit them: change the schema with a new
+// migration and change the live models to match.
+
+// baselineModels lists the tables of migration 1 with every table after the
+// tables it refers to.
+func baselineModels() []interface{} {
+	return []interface{}{
+		&baselineOrg{},
+		&baselineOrgDomain{},
+		&baselineUser{},
+		&baselineUserClaim{},
+		&baselineUserLoginProvider{},
+		&baselineUserPassword{},
+		&baselineUserLoginToken{},
+		&baselineUserApiKey{},
+		&baselineRole{},
+		&baselineRoleClaim{},
+		&baselineUserRole{},
+		&baselineOAuthClient{},
+		&baselineOAuthToken{},
+		&baselineUserSession{},
+		&baselineUserToken{},
+		&baselineUserAuthenticator{},
+		&baselineUserRecoveryCode{},
+		&baselineUserRememberedDevice{},
+		&baselineUserCredential{},
+		&baselineUserPasswordHistory{},
+		&baselineOrgMember{},
+		&baselineOrgInvitation{},
+		&baselineOrgJoinRequest{},
+		&baselineAccessPolicy{},
+		&baselineAuditEvent{},
+	}
+}
+
+type baselineOrg struct {
+	Id               int32               `gorm:"column:id;primaryKey,autoIncrement"`
+	Uid              uuid.UUID           `gorm:"column:uid;type:uuid;index:ix_orgs_uid,unique"`
+	Name             string              `gorm:"column:name;size:64,index:ix_orgs_name,unique"`
+	NameFormatted    sql.NullString      `gorm:"column:name_formatted;size:64"`
+	Slug             string              `gorm:"column:slug;size:64,index:ix_orgs_slug,unique"`
+	ConcurrencyStamp string              `gorm:"column:concurrency_stamp;size:128"`
+	JoinPolicy       string              `gorm:"column:join_policy;size:16"`
+	ParentId         sql.NullInt32       `gorm:"column:parent_id;index:ix_orgs_parent_id"`
+	Path             string              `gorm:"column:path;size:512;index:ix_orgs_path"`
+	Parent           *baselineOrg        `gorm:"foreignKey:ParentId;references:Id"`
+	DeletedAt        gorm.DeletedAt      `gorm:"column:deleted_at;index:ix_orgs_deleted_at"`
+	Domains          []baselineOrgDomain `gorm:"foreignKey:OrgId;references:Id"`
+}
+
+func (baselineOrg) TableName() string {
+	return "orgs"
+}
+
+type baselineOrgDomain struct {
+	Id                int32        `gorm:"column:id;primaryKey;autoIncrement"`
+	OrgId             int32        `gorm:"column:org_id;index:ix_org_domains_org_id_domain,unique,priority:1"`
+	Domain            string       `gorm:"column:domain;size:128;index:ix_org_domains_org_id_domain,unique,priority:2;index:ix_org_domains_domain"`
+	IncludeSubdomains bool         `gorm:"column:include_subdomains"`
+	Status            string       `gorm:"column:status;size:16"`
+	ChallengeToken    string       `gorm:"column:challenge_token;size:64"`
+	VerifiedBy        string       `gorm:"column:verified_by;size:8"`
+	VerifiedAt        sql.NullTime `gorm:"column:verified_at"`
+	LastCheckedAt     sql.NullTime `gorm:"column:last_checked_at"`
+	FailedChecks      int32        `gorm:"column:failed_checks"`
+}
+
+func (baselineOrgDomain) TableName() string {
+	return "org_domains"
+}
+
+type baselineUser struct {
+	Id                  int32                 `gorm:"column:id;primary_key;auto_increment"`
+	Uid                 uuid.UUID             `gorm:"column:uid;type:uuid;index:ix_users_uid,unique"`
+	OrgId               sql.NullInt32         `gorm:"column:organization_id"`
+	Name                string                `gorm:"column:name;size:64;index:ix_users_name,unique"`
+	NameFormatted       sql.NullString        `gorm:"column:name_formatted;size:64"`
+	Email               string                `gorm:"column:email;size:128;index:ix_users_email,unique"`
+	EmailFormatted      sql.NullString        `gorm:"column:email_formatted;size:128"`
+	EmailVerified       bool                  `gorm:"column:email_verified"`
+	PhoneNumber         sql.NullString        `gorm:"column:phone_number;size:16"`
+	PhoneNumberVerified bool                  `gorm:"column:phone_number_verified"`
+	AvatarUrl           sql.NullString        `gorm:"column:avatar_url;size:1048"`
+	Status              int8                  `gorm:"column:status"`
+	LastLoginAt         sql.NullTime          `gorm:"column:last_login_at"`
+	LastLoginIp         sql.NullString        `gorm:"column:last_login_ip;size:45"`
+	ConcurrencyStamp    string                `gorm:"column:concurrency_stamp;size:128"`
+	CreatedAt           time.Time             `gorm:"column:created_at"`
+	UpdatedAt           sql.NullTime          `gorm:"column:updated_at"`
+	DeletedAt           gorm.DeletedAt        `gorm:"column:deleted_at;index:ix_users_deleted_at"`
+	Organization        *baselineOrg          `gorm:"foreignKey:OrgId;references:Id"`
+	Password            *baselineUserPassword `gorm:"foreignKey:UserId;references:Id"`
+	Claims              []baselineUserClaim   `gorm:"foreignKey:UserId;references:Id"`
+	ApiKeys             []baselineUserApiKey  `gorm:"foreignKey:UserId;references:Id"`
+}
+
+func (baselineUser) TableName() string {
+	return "users"
+}
+
+type baselineUserClaim struct {
+	Id        int32     `gorm:"column:id;primary_key;auto_increment"`
+	Uid       uuid.UUID `gorm:"column:uid;type:uuid;index:ix_user_claims_uid,unique"`
+	UserId    int32     `gorm:"column:user_id;index:ix_user_claims_user_id"`
+	Name      string    `gorm:"column:name;size:64;index:ix_user_claims_name"`
+	Value     string    `gorm:"column:value;size:128"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (baselineUserClaim) TableName() string {
+	return "user_claims"
+}
+
+type baselineUserLoginProvider struct {
+	UserId            int32          `gorm:"column:user_id;index:ix_user_logins_user_id"`
+	Provider          string         `gorm:"column:provider;size:64;index:ix_user_logins_provider_key,unique,priority:1"`
+	ProviderFormatted sql.NullString `gorm:"column:provider_formatted;size:64"`
+	Key               string         `gorm:"column:key;size:128;index:ix_user_logins_provider_key,unique,priority:2"`
+	DisplayName       sql.NullString `gorm:"column:display_name;size:128"`
+	CreatedAt         time.Time      `gorm:"column:created_at"`
+}
+
+func (baselineUserLoginProvider) TableName() string {
+	return "user_login_providers"
+}
+
+type baselineUserPassword struct {
+	UserId        int32        `gorm:"column:user_id;index:ix_user_passwords_user_id,unique"`
+	Uid           uuid.UUID    `gorm:"column:uid;type:uuid;index:ix_user_passwords_uid,unique"`
+	Password      string       `gorm:"column:password;size:1024"`
+	IsLocked      bool         `gorm:"column:is_locked"`
+	LockedAt      sql.NullTime `gorm:"column:locked_at"`
+	FailureCount  int32        `gorm:"column:failed_attempts"`
+	LastFailureAt sql.NullTime `gorm:"column:last_failed_at"`
+	SecurityStamp string       `gorm:"column:security_stamp;size:128"`
+	ChangedAt     sql.NullTime `gorm:"column:changed_at"`
+	CreatedAt     time.Time    `gorm:"column:created_at"`
+	UpdatedAt     sql.NullTime `gorm:"column:updated_at"`
+}
+
+func (baselineUserPassword) TableName() string {
+	return "user_passwords"
+}
+
+type baselineUserLoginToken struct {
+	UserId    int32        `gorm:"column:user_id;index:ix_user_login_tokens_user_id_provider_name,unique,priority:1"`
+	Provider  string       `gorm:"column:provider;size:64;index:ix_user_login_tokens_user_id_provider_name,unique,priority:2"`
+	Name      string       `gorm:"column:name;size:64;index:ix_user_login_tokens_user_id_provider_name,unique,priority:3"`
+	Token     string       `gorm:"column:token;size:8192"`
+	ExpiresAt sql.NullTime `gorm:"column:expires_at"`
+	UpdatedAt time.Time    `gorm:"column:updated_at"`
+}
+
+func (baselineUserLoginToken) TableName() string {
+	return "user_login_tokens"
+}
+
+type baselineUserApiKey struct {
+	Id            int32         `gorm:"column:id;primary_key;auto_increment"`
+	Uid           uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_user_api_keys_uid,unique"`
+	UserId        int32         `gorm:"column:user_id;index:ix_user_api_keys_user_id"`
+	OrgId         sql.NullInt32 `gorm:"column:org_id;index:ix_user_api_keys_org_id"`
+	Name          string        `gorm:"column:name;size:64"`
+	Description   string        `gorm:"column:description;size:256"`
+	Scopes        string        `gorm:"column:scopes;size:1024"`
+	AllowedCidrs  string        `gorm:"column:allowed_cidrs;size:1024"`
+	Prefix        string        `gorm:"column:prefix;size:16;index:ix_user_api_keys_prefix,unique"`
+	Key           string        `gorm:"column:key;size:2048"`
+	IsLocked      bool          `gorm:"column:is_locked"`
+	LockedAt      sql.NullTime  `gorm:"column:locked_at"`
+	FailureCount  int32         `gorm:"column:failed_attempts"`
+	LastFailureAt sql.NullTime  `gorm:"column:last_failed_at"`
+	LastUsedAt    sql.NullTime  `gorm:"column:last_used_at"`
+	ExpiresAt     sql.NullTime  `gorm:"column:expires_at"`
+	RevokedAt     sql.NullTime  `gorm:"column:revoked_at"`
+	CreatedAt     time.Time     `gorm:"column:created_at"`
+	UpdatedAt     sql.NullTime  `gorm:"column:updated_at"`
+}
+
+func (baselineUserApiKey) TableName() string {
+	return "user_api_keys"
+}
+
+type baselineRole struct {
+	Id               int32               `gorm:"column:id;primary_key;auto_increment"`
+	Uid              uuid.UUID           `gorm:"column:uid;type:uuid;;index:ix_roles_uid,unique"`
+	OrgId            sql.NullInt32       `gorm:"column:org_id;index:ix_roles_name,unique,priority:1"`
+	Name             string              `gorm:"column:name;size:64;index:ix_roles_name,unique,priority:2"`
+	Description      string              `gorm:"column:description;size:256"`
+	ConcurrencyStamp string              `gorm:"column:concurrency_stamp;size:128"`
+	Org              *baselineOrg        `gorm:"foreignKey:OrgId;references:Id"`
+	Claims           []baselineRoleClaim `gorm:"foreignKey:RoleId;references:Id"`
+}
+
+func (baselineRole) TableName() string {
+	return "roles"
+}
+
+type baselineRoleClaim struct {
+	Id        int32        `gorm:"column:id;primary_key;auto_increment"`
+	Uid       uuid.UUID    `gorm:"column:uid;type:uuid;index:ix_role_claims_uid,unique"`
+	RoleId    int32        `gorm:"column:role_id;index:ix_role_claims_role_id"`
+	Name      string       `gorm:"column:name;size:64;index:ix_role_claims_name"`
+	Value     string       `gorm:"column:value;size:128"`
+	CreatedAt sql.NullTime `gorm:"column:created_at"`
+}
+
+func (baselineRoleClaim) TableName() string {
+	return "role_claims"
+}
+
+type baselineUserRole struct {
+	UserId int32 `gorm:"column:user_id;primaryKey;index:ix_users_roles_user_id"`
+	RoleId int32 `gorm:"column:role_id;primaryKey;index:ix_users_roles_role_id"`
+}
+
+func (baselineUserRole) TableName() string {
+	return "users_roles"
+}
+
+type baselineOAuthClient struct {
+	Id             int32         `gorm:"column:id;primary_key;auto_increment"`
+	Uid            uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_oauth_clients_uid,unique"`
+	ClientId       string        `gorm:"column:client_id;size:64;index:ix_oauth_clients_client_id,unique"`
+	SecretHash     string        `gorm:"column:secret_hash;size:128"`
+	Name           string        `gorm:"column:name;size:64"`
+	OrgId          sql.NullInt32 `gorm:"column:org_id"`
+	IsConfidential bool          `gorm:"column:is_confidential"`
+	RedirectUris   string        `gorm:"column:redirect_uris;size:2048"`
+	GrantTypes     string        `gorm:"column:grant_types;size:256"`
+	Scopes         string        `gorm:"column:scopes;size:1024"`
+	RevokedAt      sql.NullTime  `gorm:"column:revoked_at"`
+	CreatedAt      time.Time     `gorm:"column:created_at"`
+	UpdatedAt      sql.NullTime  `gorm:"column:updated_at"`
+}
+
+func (baselineOAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+type baselineOAuthToken struct {
+	Id            int32         `gorm:"column:id;primary_key;auto_increment"`
+	Uid           uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_oauth_tokens_uid,unique"`
+	TokenHash     string        `gorm:"column:token_hash;size:128;index:ix_oauth_tokens_token_hash,unique"`
+	Kind          string        `gorm:"column:kind;size:16"`
+	ClientId      int32         `gorm:"column:client_id;index:ix_oauth_tokens_client_id"`
+	UserId        sql.NullInt32 `gorm:"column:user_id;index:ix_oauth_tokens_user_id"`
+	ParentId      sql.NullInt32 `gorm:"column:parent_id;index:ix_oauth_tokens_parent_id"`
+	Scopes        string        `gorm:"column:scopes;size:1024"`
+	RedirectUri   string        `gorm:"column:redirect_uri;size:1024"`
+	Nonce         string        `gorm:"column:nonce;size:256"`
+	CodeChallenge string        `gorm:"column:code_challenge;size:128"`
+	ExpiresAt     time.Time     `gorm:"column:expires_at"`
+	UsedAt        sql.NullTime  `gorm:"column:used_at"`
+	RevokedAt     sql.NullTime  `gorm:"column:revoked_at"`
+	CreatedAt     time.Time     `gorm:"column:created_at"`
+}
+
+func (baselineOAuthToken) TableName() string {
+	return "oauth_tokens"
+}
+
+type baselineUserSession struct {
+	Id               int32          `gorm:"column:id;primary_key;auto_increment"`
+	Uid              uuid.UUID      `gorm:"column:uid;type:uuid;index:ix_user_sessions_uid,unique"`
+	UserId           int32          `gorm:"column:user_id;index:ix_user_sessions_user_id"`
+	TokenHash        string         `gorm:"column:token_hash;size:128"`
+	Generation       int32          `gorm:"column:generation"`
+	Device           sql.NullString `gorm:"column:device;size:128"`
+	Ip               sql.NullString `gorm:"column:ip;size:45"`
+	UserAgent        sql.NullString `gorm:"column:user_agent;size:512"`
+	ConcurrencyStamp string         `gorm:"column:concurrency_stamp;size:128"`
+	SecurityStamp    string         `gorm:"column:security_stamp;size:128"`
+	CreatedAt        time.Time      `gorm:"column:created_at"`
+	LastSeenAt       time.Time      `gorm:"column:last_seen_at"`
+	ExpiresAt        time.Time      `gorm:"column:expires_at"`
+	RevokedAt        sql.NullTime   `gorm:"column:revoked_at"`
+	RevokedReason    sql.NullString `gorm:"column:revoked_reason;size:64"`
+}
+
+func (baselineUserSession) TableName() string {
+	return "user_sessions"
+}
+
+type baselineUserToken struct {
+	Id           int32        `gorm:"column:id;primary_key;auto_increment"`
+	Uid          uuid.UUID    `gorm:"column:uid;type:uuid;index:ix_user_tokens_uid,unique"`
+	UserId       int32        `gorm:"column:user_id;index:ix_user_tokens_user_id_purpose,priority:1"`
+	Purpose      string       `gorm:"column:purpose;size:32;index:ix_user_tokens_user_id_purpose,priority:2"`
+	TokenHash    string       `gorm:"column:token_hash;size:128;index:ix_user_tokens_token_hash"`
+	Value        string       `gorm:"column:value;size:128"`
+	FailureCount int32        `gorm:"column:failed_attempts"`
+	ExpiresAt    time.Time    `gorm:"column:expires_at"`
+	UsedAt       sql.NullTime `gorm:"column:used_at"`
+	CreatedAt    time.Time    `gorm:"column:created_at"`
+}
+
+func (baselineUserToken) TableName() string {
+	return "user_tokens"
+}
+
+type baselineUserAuthenticator struct {
+	Id           int32        `gorm:"column:id;primary_key;auto_increment"`
+	Uid          uuid.UUID    `gorm:"column:uid;type:uuid;index:ix_user_authenticators_uid,unique"`
+	UserId       int32        `gorm:"column:user_id;index:ix_user_authenticators_user_id,unique"`
+	Secret       string       `gorm:"column:secret;size:512"`
+	LastUsedStep int64        `gorm:"column:last_used_step"`
+	ConfirmedAt  sql.NullTime `gorm:"column:confirmed_at"`
+	CreatedAt    time.Time    `gorm:"column:created_at"`
+}
+
+func (baselineUserAuthenticator) TableName() string {
+	return "user_authenticators"
+}
+
+type baselineUserRecoveryCode struct {
+	Id        int32        `gorm:"column:id;primary_key;auto_increment"`
+	UserId    int32        `gorm:"column:user_id;index:ix_user_recovery_codes_user_id"`
+	CodeHash  string       `gorm:"column:code_hash;size:128"`
+	UsedAt    sql.NullTime `gorm:"column:used_at"`
+	CreatedAt time.Time    `gorm:"column:created_at"`
+}
+
+func (baselineUserRecoveryCode) TableName() string {
+	return "user_recovery_codes"
+}
+
+type baselineUserRememberedDevice struct {
+	Id            int32     `gorm:"column:id;primary_key;auto_increment"`
+	Uid           uuid.UUID `gorm:"column:uid;type:uuid;index:ix_user_remembered_devices_uid,unique"`
+	UserId        int32     `gorm:"column:user_id;index:ix_user_remembered_devices_user_id"`
+	TokenHash     string    `gorm:"column:token_hash;size:128"`
+	SecurityStamp string    `gorm:"column:security_stamp;size:128"`
+	ExpiresAt     time.Time `gorm:"column:expires_at"`
+	CreatedAt     time.Time `gorm:"column:created_at"`
+}
+
+func (baselineUserRememberedDevice) TableName() string {
+	return "user_remembered_devices"
+}
+
+type baselineUserCredential struct {
+	Id              int32          `gorm:"column:id;primary_key;auto_increment"`
+	Uid             uuid.UUID      `gorm:"column:uid;type:uuid;index:ix_user_credentials_uid,unique"`
+	UserId          int32          `gorm:"column:user_id;index:ix_user_credentials_user_id"`
+	CredentialId    string         `gorm:"column:credential_id;size:1024;index:ix_user_credentials_credential_id,unique"`
+	PublicKey       []byte         `gorm:"column:public_key"`
+	Algorithm       int32          `gorm:"column:algorithm"`
+	SignCount       uint32         `gorm:"column:sign_count"`
+	Transports      string         `gorm:"column:transports;size:256"`
+	Aaguid          uuid.UUID      `gorm:"column:aaguid;type:uuid"`
+	AttestationType string         `gorm:"column:attestation_type;size:32"`
+	BackupEligible  bool           `gorm:"column:backup_eligible"`
+	BackedUp        bool           `gorm:"column:backed_up"`
+	CloneWarning    bool           `gorm:"column:clone_warning"`
+	Name            sql.NullString `gorm:"column:name;size:128"`
+	CreatedAt       time.Time      `gorm:"column:created_at"`
+	LastUsedAt      sql.NullTime   `gorm:"column:last_used_at"`
+}
+
+func (baselineUserCredential) TableName() string {
+	return "user_credentials"
+}
+
+type baselineUserPasswordHistory struct {
+	Id        int32     `gorm:"column:id;primary_key;auto_increment"`
+	UserId    int32     `gorm:"column:user_id;index:ix_user_password_history_user_id"`
+	Password  string    `gorm:"column:password;size:1024"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (baselineUserPasswordHistory) TableName() string {
+	return "user_password_history"
+}
+
+type baselineOrgMember struct {
+	Id       int32         `gorm:"column:id;primary_key;auto_increment"`
+	OrgId    int32         `gorm:"column:org_id;index:ix_org_members_org_id_user_id,unique,priority:1"`
+	UserId   int32         `gorm:"column:user_id;index:ix_org_members_org_id_user_id,unique,priority:2;index:ix_org_members_user_id"`
+	Role     string        `gorm:"column:role;size:32"`
+	JoinedAt time.Time     `gorm:"column:joined_at"`
+	User     *baselineUser `gorm:"foreignKey:UserId;references:Id"`
+	Org      *baselineOrg  `gorm:"foreignKey:OrgId;references:Id"`
+}
+
+func (baselineOrgMember) TableName() string {
+	return "org_members"
+}
+
+type baselineOrgInvitation struct {
+	Id          int32         `gorm:"column:id;primary_key;auto_increment"`
+	Uid         uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_org_invitations_uid,unique"`
+	OrgId       int32         `gorm:"column:org_id;index:ix_org_invitations_org_id_email,priority:1"`
+	Email       string        `gorm:"column:email;size:128;index:ix_org_invitations_org_id_email,priority:2"`
+	Role        string        `gorm:"column:role;size:32"`
+	Status      string        `gorm:"column:status;size:16"`
+	TokenHash   string        `gorm:"column:token_hash;size:128;index:ix_org_invitations_token_hash"`
+	InvitedBy   sql.NullInt32 `gorm:"column:invited_by"`
+	SentCount   int32         `gorm:"column:sent_count"`
+	LastSentAt  time.Time     `gorm:"column:last_sent_at"`
+	ExpiresAt   time.Time     `gorm:"column:expires_at"`
+	RespondedAt sql.NullTime  `gorm:"column:responded_at"`
+	CreatedAt   time.Time     `gorm:"column:created_at"`
+}
+
+func (baselineOrgInvitation) TableName() string {
+	return "org_invitations"
+}
+
+type baselineOrgJoinRequest struct {
+	Id          int32         `gorm:"column:id;primary_key;auto_increment"`
+	OrgId       int32         `gorm:"column:org_id;index:ix_org_join_requests_org_id_status,priority:1"`
+	UserId      int32         `gorm:"column:user_id;index:ix_org_join_requests_user_id"`
+	Status      string        `gorm:"column:status;size:16;index:ix_org_join_requests_org_id_status,priority:2"`
+	RespondedBy sql.NullInt32 `gorm:"column:responded_by"`
+	RespondedAt sql.NullTime  `gorm:"column:responded_at"`
+	CreatedAt   time.Time     `gorm:"column:created_at"`
+	User        *baselineUser `gorm:"foreignKey:UserId;references:Id"`
+}
+
+func (baselineOrgJoinRequest) TableName() string {
+	return "org_join_requests"
+}
+
+type baselineAccessPolicy struct {
+	Id          int32        `gorm:"column:id;primary_key;auto_increment"`
+	Name        string       `gorm:"column:name;size:128;index:ix_access_policies_name,unique"`
+	Description string       `gorm:"column:description;size:1024"`
+	Document    string       `gorm:"column:document"`
+	Enabled     bool         `gorm:"column:enabled"`
+	CreatedAt   time.Time    `gorm:"column:created_at"`
+	UpdatedAt   sql.NullTime `gorm:"column:updated_at"`
+}
+
+func (baselineAccessPolicy) TableName() string {
+	return "access_policies"
+}
+
+type baselineAuditEvent struct {
+	Id         int64         `gorm:"column:id;primary_key;auto_increment"`
+	Uid        uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_audit_events_uid,unique"`
+	OccurredAt time.Time     `gorm:"column:occurred_at;index:ix_audit_events_occurred_at"`
+	ActorId    sql.NullInt32 `gorm:"column:actor_id;index:ix_audit_events_actor_id"`
+	OrgId      sql.NullInt32 `gorm:"column:org_id;index:ix_audit_events_org_id"`
+	Action     string        `gorm:"column:action;size:64;index:ix_audit_events_action"`
+	TargetType string        `gorm:"column:target_type;size:64;index:ix_audit_events_target,priority:1"`
+	TargetId   string        `gorm:"column:target_id;size:128;index:ix_audit_events_target,priority:2"`
+	Changes    string        `gorm:"column:changes"`
+	Ip         string        `gorm:"column:ip;size:45"`
+	RequestId  string        `gorm:"column:request_id;size:128"`
+	PrevHash   string        `gorm:"column:prev_hash;size:64"`
+	Hash       string        `gorm:"column:hash;size:64"`
+}
+
+func (baselineAuditEvent) TableName() string {
+	return "audit_events"
+}
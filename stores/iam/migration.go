@@ -0,0 +1,455 @@
+package iam
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrMigrationLocked       = errors.New("another process is running migrations")
+	ErrMigrationChecksum     = errors.New("an applied migration was changed")
+	ErrUnknownMigration      = errors.New("the database has a migration this build does not know")
+	ErrIrreversibleMigration = errors.New("the migration has no down step")
+)
+
+// Migration is one versioned schema change. Models are created first, then
+// the Up SQL statements run in order and UpFunc runs Go code, for changes
+// that depend on the dialect or move data. Each direction runs in a
+// transaction together with the bookkeeping in schema_migrations.
+//
+// Applied migrations must not change: the checksum of the module, name, SQL
+// and model definitions is stored and compared on every run. Go steps are
+// only covered by their name, so fix a released Go step with a new
+// migration rather than editing it.
+type Migration struct {
+	Version int64
+	Name    string
+	// Models are frozen copies of the models the step creates with
+	// AutoMigrate. Never use the live models here: their table, column and
+	// tag definitions are part of the checksum, and the schema a version
+	// creates must not change when a model does. Without a Down step the
+	// models are dropped in reverse order.
+	Models   []interface{}
+	Up       []string
+	Down     []string
+	UpFunc   func(tx *gorm.DB) error
+	DownFunc func(tx *gorm.DB) error
+}
+
+// Checksum identifies the migration as applied by module.
+func (m *Migration) Checksum(module string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00", module, m.Version, m.Name)
+	for _, model := range m.Models {
+		writeModel(h, model)
+	}
+
+	h.Write([]byte{2})
+	for _, s := range m.Up {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	h.Write([]byte{1})
+	for _, s := range m.Down {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeModel writes the table name and the name, type and gorm tag of every
+// field of model.
+func writeModel(w io.Writer, model interface{}) {
+	t := reflect.Indirect(reflect.ValueOf(model)).Type()
+	if tabler, ok := model.(interface{ TableName() string }); ok {
+		fmt.Fprintf(w, "table %s\x00", tabler.TableName())
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fmt.Fprintf(w, "%s %s %s\x00", f.Name, f.Type.Kind(), f.Tag.Get("gorm"))
+	}
+}
+
+func (m *Migration) String() string {
+	return fmt.Sprintf("%d_%s", m.Version, m.Name)
+}
+
+// SchemaMigrationTable records an applied migration. Each module, such as
+// iam or an app, numbers its own versions.
+type SchemaMigrationTable struct {
+	Module    string    `gorm:"column:module;size:64;primaryKey" json:"module"`
+	Version   int64     `gorm:"column:version;primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `gorm:"column:name;size:256" json:"name"`
+	Checksum  string    `gorm:"column:checksum;size:64" json:"checksum"`
+	AppliedAt time.Time `gorm:"column:applied_at" json:"appliedAt"`
+	// Duration is how long the up step took, in milliseconds.
+	Duration int64 `gorm:"column:duration_ms" json:"durationMs"`
+}
+
+func (SchemaMigrationTable) TableName() string {
+	return "schema_migrations"
+}
+
+// SchemaMigrationLockTable holds at most one row, the lock of the process
+// that is running migrations.
+type SchemaMigrationLockTable struct {
+	Id       int32     `gorm:"column:id;primaryKey;autoIncrement:false" json:"id"`
+	Owner    string    `gorm:"column:owner;size:256" json:"owner"`
+	LockedAt time.Time `gorm:"column:locked_at" json:"lockedAt"`
+}
+
+func (SchemaMigrationLockTable) TableName() string {
+	return "schema_migrations_lock"
+}
+
+const createLockTable = `CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+	id INTEGER PRIMARY KEY,
+	owner VARCHAR(256),
+	locked_at TIMESTAMP
+)`
+
+type MigrationOptions struct {
+	// DryRun reports the migrations that would run without running them.
+	DryRun bool
+	// LockTimeout is how long to wait for another process to finish.
+	LockTimeout time.Duration
+	// StaleLockAfter breaks a lock held longer than this, left behind by a
+	// process that died. Zero never breaks locks.
+	StaleLockAfter time.Duration
+}
+
+func DefaultMigrationOptions() MigrationOptions {
+	return MigrationOptions{
+		LockTimeout:    time.Minute,
+		StaleLockAfter: 30 * time.Minute,
+	}
+}
+
+type MigrationStatus struct {
+	Migration Migration
+	Applied   bool
+	AppliedAt time.Time
+	// Changed is true when the applied checksum differs from the migration.
+	Changed bool
+}
+
+// MigrationRunner applies the migrations of one module in version order and
+// rolls them back.
+type MigrationRunner struct {
+	db         *gorm.DB
+	module     string
+	migrations []Migration
+	Options    MigrationOptions
+	Now        func() time.Time
+}
+
+// NewMigrationRunner returns a runner for the migrations of module. Modules
+// share schema_migrations, so every module sharing a database needs its own
+// name.
+func NewMigrationRunner(db *gorm.DB, module string, migrations []Migration, options *MigrationOptions) (*MigrationRunner, error) {
+	if module == "" {
+		return nil, errors.New("migrations need a module name")
+	}
+
+	o := DefaultMigrationOptions()
+	if options != nil {
+		o = *options
+	}
+
+	sorted := slices.Clone(migrations)
+	slices.SortFunc(sorted, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+
+	for i, m := range sorted {
+		if m.Version <= 0 || m.Name == "" {
+			return nil, fmt.Errorf("migration %s needs a positive version and a name", m.String())
+		}
+
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migration version %d is used twice", m.Version)
+		}
+
+		if len(m.Models) == 0 && len(m.Up) == 0 && m.UpFunc == nil {
+			return nil, fmt.Errorf("migration %s has no up step", m.String())
+		}
+	}
+
+	return &MigrationRunner{
+		db:         db,
+		module:     module,
+		migrations: sorted,
+		Options:    o,
+		Now:        time.Now,
+	}, nil
+}
+
+// Status lists every known migration and whether it is applied.
+func (r *MigrationRunner) Status() ([]MigrationStatus, error) {
+	applied, err := r.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(r.migrations))
+	for _, m := range r.migrations {
+		s := MigrationStatus{Migration: m}
+		if row, ok := applied[m.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = row.AppliedAt
+			s.Changed = row.Checksum != m.Checksum(r.module) || row.Name != m.Name
+		}
+
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+// Up applies every pending migration and returns them.
+func (r *MigrationRunner) Up() ([]Migration, error) {
+	return r.UpTo(0)
+}
+
+// UpTo applies the pending migrations up to and including version; zero
+// means all of them. Pending versions below an applied one still run, so
+// migrations merged from other branches are not skipped.
+func (r *MigrationRunner) UpTo(version int64) ([]Migration, error) {
+	return r.run(func(applied map[int64]SchemaMigrationTable) ([]Migration, error) {
+		pending := []Migration{}
+		for _, m := range r.migrations {
+			if version > 0 && m.Version > version {
+				break
+			}
+
+			if _, ok := applied[m.Version]; !ok {
+				pending = append(pending, m)
+			}
+		}
+
+		return pending, nil
+	}, r.up)
+}
+
+// Down rolls back the last steps applied migrations, newest first, and
+// returns them.
+func (r *MigrationRunner) Down(steps int) ([]Migration, error) {
+	return r.run(func(applied map[int64]SchemaMigrationTable) ([]Migration, error) {
+		rollback := []Migration{}
+		for i := len(r.migrations) - 1; i >= 0 && len(rollback) < steps; i-- {
+			m := r.migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+
+			if len(m.Models) == 0 && len(m.Down) == 0 && m.DownFunc == nil {
+				return nil, fmt.Errorf("%w: %s", ErrIrreversibleMigration, m.String())
+			}
+
+			rollback = append(rollback, m)
+		}
+
+		return rollback, nil
+	}, r.down)
+}
+
+// run verifies the applied migrations under the lock, then runs step for
+// each migration plan selects. A dry run stops after planning.
+func (r *MigrationRunner) run(plan func(map[int64]SchemaMigrationTable) ([]Migration, error), step func(*Migration) error) ([]Migration, error) {
+	if !r.Options.DryRun {
+		// the lock table is created without AutoMigrate, which would alter
+		// it while another process holds the lock; every other change to
+		// the schema waits for the lock
+		err := r.db.Exec(createLockTable).Error
+		if err != nil {
+			return nil, err
+		}
+
+		unlock, err := r.lock()
+		if err != nil {
+			return nil, err
+		}
+
+		defer unlock()
+
+		err = r.db.AutoMigrate(&SchemaMigrationTable{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applied, err := r.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	for version, row := range applied {
+		i := slices.IndexFunc(r.migrations, func(m Migration) bool { return m.Version == version })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s %d_%s", ErrUnknownMigration, r.module, version, row.Name)
+		}
+
+		m := &r.migrations[i]
+		if row.Name != m.Name {
+			return nil, fmt.Errorf("%w: %s %d was applied as %s, not %s", ErrMigrationChecksum, r.module, version, row.Name, m.Name)
+		}
+
+		if row.Checksum != m.Checksum(r.module) {
+			return nil, fmt.Errorf("%w: %s %s", ErrMigrationChecksum, r.module, m.String())
+		}
+	}
+
+	selected, err := plan(applied)
+	if err != nil || r.Options.DryRun {
+		return selected, err
+	}
+
+	done := []Migration{}
+	for i := range selected {
+		err = step(&selected[i])
+		if err != nil {
+			return done, fmt.Errorf("migration %s: %w", selected[i].String(), err)
+		}
+
+		done = append(done, selected[i])
+	}
+
+	return done, nil
+}
+
+func (r *MigrationRunner) up(m *Migration) error {
+	started := r.Now()
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if len(m.Models) > 0 {
+			err := tx.AutoMigrate(m.Models...)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := execMigration(tx, m.Up, m.UpFunc)
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&SchemaMigrationTable{
+			Module:    r.module,
+			Version:   m.Version,
+			Name:      m.Name,
+			Checksum:  m.Checksum(r.module),
+			AppliedAt: r.Now(),
+			Duration:  r.Now().Sub(started).Milliseconds(),
+		}).Error
+	})
+}
+
+func (r *MigrationRunner) down(m *Migration) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		err := execMigration(tx, m.Down, m.DownFunc)
+		if err != nil {
+			return err
+		}
+
+		if len(m.Down) == 0 && m.DownFunc == nil {
+			models := slices.Clone(m.Models)
+			slices.Reverse(models)
+			err = tx.Migrator().DropTable(models...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Where("module = ? AND version = ?", r.module, m.Version).Delete(&SchemaMigrationTable{}).Error
+	})
+}
+
+func execMigration(tx *gorm.DB, statements []string, fn func(*gorm.DB) error) error {
+	for _, s := range statements {
+		err := tx.Exec(s).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if fn != nil {
+		return fn(tx)
+	}
+
+	return nil
+}
+
+func (r *MigrationRunner) applied() (map[int64]SchemaMigrationTable, error) {
+	applied := map[int64]SchemaMigrationTable{}
+	if !r.db.Migrator().HasTable(&SchemaMigrationTable{}) {
+		return applied, nil
+	}
+
+	if !r.db.Migrator().HasColumn(&SchemaMigrationTable{}, "module") {
+		return nil, fmt.Errorf("%w: schema_migrations was created before migrations had modules", ErrUnknownMigration)
+	}
+
+	rows := []SchemaMigrationTable{}
+	err := r.db.Where("module = ?", r.module).Order("version").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+// lock takes the single row of schema_migrations_lock, waiting up to
+// LockTimeout for another process to release it.
+func (r *MigrationRunner) lock() (func(), error) {
+	host, _ := os.Hostname()
+	owner := strings.Join([]string{host, fmt.Sprint(os.Getpid()), uuid.NewString()}, ":")
+	deadline := r.Now().Add(r.Options.LockTimeout)
+
+	for {
+		now := r.Now()
+		if r.Options.StaleLockAfter > 0 {
+			err := r.db.Where("id = 1 AND locked_at < ?", now.Add(-r.Options.StaleLockAfter)).
+				Delete(&SchemaMigrationLockTable{}).Error
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		res := r.db.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&SchemaMigrationLockTable{Id: 1, Owner: owner, LockedAt: now})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+
+		if res.RowsAffected == 1 {
+			return func() {
+				r.db.Where("id = 1 AND owner = ?", owner).Delete(&SchemaMigrationLockTable{})
+			}, nil
+		}
+
+		if !now.Before(deadline) {
+			return nil, ErrMigrationLocked
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+}
@@ -0,0 +1,253 @@
+package iam_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func widgetMigrations() []iam.Migration {
+	return []iam.Migration{
+		{
+			Version: 2,
+			Name:    "widget_colors",
+			Up: []string{
+				"ALTER TABLE widgets ADD COLUMN color TEXT",
+				"UPDATE widgets SET color = 'red'",
+			},
+			Down: []string{"ALTER TABLE widgets DROP COLUMN color"},
+		},
+		{
+			Version: 1,
+			Name:    "widgets",
+			Up: []string{
+				"CREATE TABLE widgets (id INTEGER PRIMARY KEY, name TEXT NOT NULL)",
+				"INSERT INTO widgets (name) VALUES ('first')",
+			},
+			Down: []string{"DROP TABLE widgets"},
+		},
+		{
+			Version: 3,
+			Name:    "widget_count",
+			UpFunc: func(tx *gorm.DB) error {
+				return tx.Exec("INSERT INTO widgets (name, color) VALUES (?, ?)", "second", "blue").Error
+			},
+		},
+	}
+}
+
+func TestMigrationRunner(t *testing.T) {
+	assert := assert2.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:TestMigrationRunner?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	dryRun, err := iam.NewMigrationRunner(db, "widgets", widgetMigrations(), &iam.MigrationOptions{DryRun: true})
+	assert.NoError(err)
+	planned, err := dryRun.Up()
+	assert.NoError(err)
+	assert.Len(planned, 3)
+	assert.Equal(int64(1), planned[0].Version)
+	assert.False(db.Migrator().HasTable("widgets"))
+
+	runner, err := iam.NewMigrationRunner(db, "widgets", widgetMigrations(), nil)
+	assert.NoError(err)
+	applied, err := runner.UpTo(2)
+	assert.NoError(err)
+	assert.Len(applied, 2)
+
+	applied, err = runner.Up()
+	assert.NoError(err)
+	assert.Len(applied, 1)
+	applied, err = runner.Up()
+	assert.NoError(err)
+	assert.Len(applied, 0)
+
+	colors := []string{}
+	assert.NoError(db.Raw("SELECT color FROM widgets ORDER BY id").Scan(&colors).Error)
+	assert.Equal([]string{"red", "blue"}, colors)
+
+	// the Go step has no down step
+	_, err = runner.Down(1)
+	assert.ErrorIs(err, iam.ErrIrreversibleMigration)
+
+	status, err := runner.Status()
+	assert.NoError(err)
+	assert.Len(status, 3)
+	assert.True(status[2].Applied)
+	assert.False(status[0].Changed)
+
+	// released migrations must not change, including their names
+	renamed := widgetMigrations()
+	renamed[2].Name = "widget_total"
+	renamedRunner, err := iam.NewMigrationRunner(db, "widgets", renamed, nil)
+	assert.NoError(err)
+	_, err = renamedRunner.Up()
+	assert.ErrorIs(err, iam.ErrMigrationChecksum)
+
+	changed := widgetMigrations()
+	changed[1].Up[1] = "INSERT INTO widgets (name) VALUES ('renamed')"
+	changedRunner, err := iam.NewMigrationRunner(db, "widgets", changed, nil)
+	assert.NoError(err)
+	_, err = changedRunner.Up()
+	assert.ErrorIs(err, iam.ErrMigrationChecksum)
+
+	unknownRunner, err := iam.NewMigrationRunner(db, "widgets", widgetMigrations()[1:], nil)
+	assert.NoError(err)
+	_, err = unknownRunner.Up()
+	assert.ErrorIs(err, iam.ErrUnknownMigration)
+
+	_, err = iam.NewMigrationRunner(db, "widgets", append(widgetMigrations(), iam.Migration{Version: 1, Name: "again", Up: []string{"SELECT 1"}}), nil)
+	assert.Error(err)
+
+	// another process holds the lock
+	assert.NoError(db.Create(&iam.SchemaMigrationLockTable{Id: 1, Owner: "other", LockedAt: time.Now()}).Error)
+	locked, err := iam.NewMigrationRunner(db, "widgets", widgetMigrations(), &iam.MigrationOptions{StaleLockAfter: time.Hour})
+	assert.NoError(err)
+	_, err = locked.Up()
+	assert.ErrorIs(err, iam.ErrMigrationLocked)
+
+	// until it is stale
+	locked.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = locked.Up()
+	assert.NoError(err)
+
+	var locks int64
+	assert.NoError(db.Model(&iam.SchemaMigrationLockTable{}).Count(&locks).Error)
+	assert.Equal(int64(0), locks)
+}
+
+func TestMigrationLockComesFirst(t *testing.T) {
+	assert := assert2.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:TestMigrationLockComesFirst?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	runner, err := iam.NewMigrationRunner(db, "widgets", widgetMigrations(), &iam.MigrationOptions{})
+	assert.NoError(err)
+	_, err = runner.Up()
+	assert.NoError(err)
+
+	// a second process finds the lock table in place and waits for the
+	// lock before it touches anything else
+	assert.NoError(db.Migrator().DropTable(&iam.SchemaMigrationTable{}))
+	assert.NoError(db.Create(&iam.SchemaMigrationLockTable{Id: 1, Owner: "other", LockedAt: time.Now()}).Error)
+	_, err = runner.Up()
+	assert.ErrorIs(err, iam.ErrMigrationLocked)
+	assert.False(db.Migrator().HasTable(&iam.SchemaMigrationTable{}))
+}
+
+type frozenWidget struct {
+	Id   int32  `gorm:"column:id;primaryKey"`
+	Name string `gorm:"column:name;size:64"`
+}
+
+type editedWidget struct {
+	Id   int32  `gorm:"column:id;primaryKey"`
+	Name string `gorm:"column:name;size:128"`
+}
+
+func TestMigrationModules(t *testing.T) {
+	assert := assert2.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:TestMigrationModules?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	// another module with the same version and name as the iam baseline
+	app := []iam.Migration{{
+		Version: 1,
+		Name:    "baseline",
+		UpFunc: func(tx *gorm.DB) error {
+			return tx.Exec("CREATE TABLE gadgets (id INTEGER PRIMARY KEY)").Error
+		},
+	}}
+	runner, err := iam.NewMigrationRunner(db, "app", app, nil)
+	assert.NoError(err)
+	_, err = runner.Up()
+	assert.NoError(err)
+
+	iamDb := &iam.IamDb{DB: db}
+	assert.NoError(iamDb.MigrateIam())
+	assert.True(db.Migrator().HasTable(&iam.UserTable{}))
+	assert.NotEqual(app[0].Checksum("app"), app[0].Checksum(iam.IamModule))
+
+	_, err = iam.NewMigrationRunner(db, "", app, nil)
+	assert.Error(err)
+
+	// the definitions of frozen models are part of the checksum
+	frozen := iam.Migration{Version: 1, Name: "widgets", Models: []interface{}{&frozenWidget{}}}
+	edited := iam.Migration{Version: 1, Name: "widgets", Models: []interface{}{&editedWidget{}}}
+	assert.NotEqual(frozen.Checksum("app"), edited.Checksum("app"))
+}
+
+func TestMigrateIam(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	// newIamDb has already migrated; running again changes nothing
+	assert.NoError(db.MigrateIam())
+
+	runner, err := iam.NewIamMigrationRunner(db, nil)
+	assert.NoError(err)
+	status, err := runner.Status()
+	assert.NoError(err)
+	assert.True(status[0].Applied)
+	assert.True(db.Migrator().HasTable(&iam.OrgDomain{}))
+	assert.True(db.Migrator().HasTable(&iam.AuditEventTable{}))
+}
+
+func TestMigrateIamBackfillsMembers(t *testing.T) {
+	assert := assert2.New(t)
+	gdb, err := gorm.Open(sqlite.Open("file:backfill?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	db := &iam.IamDb{DB: gdb}
+	runner, err := iam.NewIamMigrationRunner(db, nil)
+	assert.NoError(err)
+	_, err = runner.UpTo(2)
+	assert.NoError(err)
+
+	org := &iam.Org{Name: "Hooli"}
+	assert.NoError(iam.NewOrgStore(gdb, nil).Create(org))
+	table := iam.OrgTable{}
+	assert.NoError(gdb.First(&table, "uid = ?", org.Id).Error)
+
+	for _, name := range []string{"gavin", "jian"} {
+		user, err := db.NewUser(name, name+"@hooli.test")
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+
+		user.OrgId = sql.NullInt32{Int32: table.Id, Valid: true}
+		assert.NoError(user.Save(db))
+	}
+
+	// a membership that already exists is left as it is
+	jian := iam.UserTable{}
+	assert.NoError(gdb.First(&jian, "name = ?", "jian").Error)
+	assert.NoError(gdb.Create(&iam.OrgMemberTable{OrgId: table.Id, UserId: jian.Id, Role: iam.OrgMemberRoleOwner, JoinedAt: time.Now()}).Error)
+
+	_, err = runner.Up()
+	assert.NoError(err)
+
+	members := []iam.OrgMemberTable{}
+	assert.NoError(gdb.Where("org_id = ?", table.Id).Order("user_id").Find(&members).Error)
+	if assert.Len(members, 2) {
+		assert.Equal(iam.OrgMemberRoleMember, members[0].Role)
+		assert.False(members[0].JoinedAt.IsZero())
+		assert.Equal(iam.OrgMemberRoleOwner, members[1].Role)
+	}
+}
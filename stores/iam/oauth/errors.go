@@ -0,0 +1,58 @@
+package oauth
+
+import "net/http"
+
+// Error is an OAuth2 error response as defined by RFC 6749 section 5.2.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	Status      int    `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+
+	return e.Code
+}
+
+func newError(status int, code string, description string) *Error {
+	return &Error{
+		Code:        code,
+		Description: description,
+		Status:      status,
+	}
+}
+
+func ErrInvalidRequest(description string) *Error {
+	return newError(http.StatusBadRequest, "invalid_request", description)
+}
+
+func ErrInvalidClient(description string) *Error {
+	return newError(http.StatusUnauthorized, "invalid_client", description)
+}
+
+func ErrInvalidGrant(description string) *Error {
+	return newError(http.StatusBadRequest, "invalid_grant", description)
+}
+
+func ErrUnauthorizedClient(description string) *Error {
+	return newError(http.StatusBadRequest, "unauthorized_client", description)
+}
+
+func ErrUnsupportedGrantType(description string) *Error {
+	return newError(http.StatusBadRequest, "unsupported_grant_type", description)
+}
+
+func ErrUnsupportedResponseType(description string) *Error {
+	return newError(http.StatusBadRequest, "unsupported_response_type", description)
+}
+
+func ErrInvalidScope(description string) *Error {
+	return newError(http.StatusBadRequest, "invalid_scope", description)
+}
+
+func ErrInvalidToken(description string) *Error {
+	return newError(http.StatusUnauthorized, "invalid_token", description)
+}
@@ -0,0 +1,644 @@
+// Package oauth implements an OAuth2 and OpenID Connect authorization server
+// on top of the iam users, roles and claims.
+package oauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	"github.com/gnomego/sdk/stores/iam/oidc"
+	"gorm.io/gorm"
+)
+
+type Options struct {
+	CodeTTL         time.Duration
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	IdTokenTTL      time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		CodeTTL:         time.Minute,
+		AccessTokenTTL:  time.Hour,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+		IdTokenTTL:      time.Hour,
+	}
+}
+
+// Endpoints are the paths the server is mounted on, relative to the issuer.
+type Endpoints struct {
+	Authorization string
+	Token         string
+	UserInfo      string
+	Jwks          string
+	Introspection string
+	Revocation    string
+}
+
+func DefaultEndpoints() Endpoints {
+	return Endpoints{
+		Authorization: "/oauth2/authorize",
+		Token:         "/oauth2/token",
+		UserInfo:      "/oauth2/userinfo",
+		Jwks:          "/.well-known/jwks.json",
+		Introspection: "/oauth2/introspect",
+		Revocation:    "/oauth2/revoke",
+	}
+}
+
+type Server struct {
+	db        *iam.IamDb
+	Issuer    string
+	Endpoints Endpoints
+	Options   Options
+	Now       func() time.Time
+	key       crypto.Signer
+	keyId     string
+	alg       string
+}
+
+// NewServer creates an authorization server that signs id tokens with key,
+// which must be an RSA or P-256 ECDSA private key.
+func NewServer(db *iam.IamDb, issuer string, key crypto.Signer, keyId string, options *Options) (*Server, error) {
+	alg := ""
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		if k.Curve.Params().Name != "P-256" {
+			return nil, errors.New("oauth: only P-256 ecdsa keys are supported")
+		}
+		alg = "ES256"
+	default:
+		return nil, fmt.Errorf("oauth: unsupported signing key %T", key)
+	}
+
+	o := DefaultOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &Server{
+		db:        db,
+		Issuer:    strings.TrimSuffix(issuer, "/"),
+		Endpoints: DefaultEndpoints(),
+		Options:   o,
+		Now:       time.Now,
+		key:       key,
+		keyId:     keyId,
+		alg:       alg,
+	}, nil
+}
+
+func (s *Server) Metadata() oidc.ProviderMetadata {
+	return oidc.ProviderMetadata{
+		Issuer:                            s.Issuer,
+		AuthorizationEndpoint:             s.Issuer + s.Endpoints.Authorization,
+		TokenEndpoint:                     s.Issuer + s.Endpoints.Token,
+		UserInfoEndpoint:                  s.Issuer + s.Endpoints.UserInfo,
+		JwksUri:                           s.Issuer + s.Endpoints.Jwks,
+		IntrospectionEndpoint:             s.Issuer + s.Endpoints.Introspection,
+		RevocationEndpoint:                s.Issuer + s.Endpoints.Revocation,
+		ScopesSupported:                   []string{"openid", "profile", "email", "roles"},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{iam.GrantAuthorizationCode, iam.GrantClientCredentials, iam.GrantRefreshToken},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  []string{s.alg},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "name", "preferred_username", "email", "email_verified", "roles"},
+	}
+}
+
+func (s *Server) Jwks() (oidc.JSONWebKeySet, error) {
+	jwk, err := oidc.NewJSONWebKey(s.key.Public(), s.keyId, s.alg)
+	if err != nil {
+		return oidc.JSONWebKeySet{}, err
+	}
+
+	return oidc.JSONWebKeySet{Keys: []oidc.JSONWebKey{jwk}}, nil
+}
+
+// AuthenticateClient verifies the client credentials. Public clients
+// authenticate with their client id alone.
+func (s *Server) AuthenticateClient(clientId string, secret string) (*iam.OAuthClientTable, error) {
+	if clientId == "" {
+		return nil, ErrInvalidClient("client_id is required")
+	}
+
+	client, err := s.db.FindOAuthClient(clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if client == nil || !client.ValidateSecret(secret) {
+		return nil, ErrInvalidClient("client authentication failed")
+	}
+
+	return client, nil
+}
+
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientId            string
+	RedirectUri         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// ValidateAuthorizeRequest checks the request before the user is asked to
+// sign in. Errors about the client or redirect uri must be shown to the user
+// rather than redirected, which the returned bool signals.
+func (s *Server) ValidateAuthorizeRequest(req *AuthorizeRequest) (*iam.OAuthClientTable, bool, error) {
+	client, err := s.db.FindOAuthClient(req.ClientId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if client == nil {
+		return nil, false, ErrInvalidClient("unknown client")
+	}
+
+	if !client.AllowsRedirectUri(req.RedirectUri) {
+		return nil, false, ErrInvalidRequest("redirect_uri is not registered for the client")
+	}
+
+	if req.ResponseType != "code" {
+		return client, true, ErrUnsupportedResponseType("only the code response type is supported")
+	}
+
+	if !client.AllowsGrant(iam.GrantAuthorizationCode) {
+		return client, true, ErrUnauthorizedClient("client may not use the authorization code grant")
+	}
+
+	if req.CodeChallenge != "" && req.CodeChallengeMethod != "S256" {
+		return client, true, ErrInvalidRequest("code_challenge_method must be S256")
+	}
+
+	if req.CodeChallenge == "" && !client.IsConfidential {
+		return client, true, ErrInvalidRequest("public clients must use pkce")
+	}
+
+	for _, scope := range strings.Fields(req.Scope) {
+		if !client.AllowsScope(scope) {
+			return client, true, ErrInvalidScope("scope " + scope + " is not allowed")
+		}
+	}
+
+	return client, true, nil
+}
+
+// Authorize issues an authorization code for the signed in user.
+func (s *Server) Authorize(req *AuthorizeRequest, userId int32) (string, error) {
+	client, _, err := s.ValidateAuthorizeRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	code, row := iam.NewOAuthToken(iam.OAuthTokenCode, client.Id, s.Now().Add(s.Options.CodeTTL))
+	row.UserId = sql.NullInt32{Int32: userId, Valid: true}
+	row.Scopes = req.Scope
+	row.RedirectUri = req.RedirectUri
+	row.Nonce = req.Nonce
+	row.CodeChallenge = req.CodeChallenge
+
+	err = s.db.Create(row).Error
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+type TokenRequest struct {
+	GrantType    string
+	ClientId     string
+	ClientSecret string
+	Code         string
+	RedirectUri  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+func (s *Server) Token(req *TokenRequest) (*TokenResponse, error) {
+	client, err := s.AuthenticateClient(req.ClientId, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	if !client.AllowsGrant(req.GrantType) {
+		if req.GrantType != iam.GrantAuthorizationCode && req.GrantType != iam.GrantClientCredentials && req.GrantType != iam.GrantRefreshToken {
+			return nil, ErrUnsupportedGrantType("grant type is not supported")
+		}
+
+		return nil, ErrUnauthorizedClient("client may not use the " + req.GrantType + " grant")
+	}
+
+	switch req.GrantType {
+	case iam.GrantAuthorizationCode:
+		return s.exchangeCode(client, req)
+	case iam.GrantRefreshToken:
+		return s.refresh(client, req)
+	default:
+		return s.clientCredentials(client, req)
+	}
+}
+
+func (s *Server) exchangeCode(client *iam.OAuthClientTable, req *TokenRequest) (*TokenResponse, error) {
+	var res *TokenResponse
+	// cause is returned after the transaction, so that the revocation of a
+	// replayed code commits
+	var cause error
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		code, err := s.findToken(tx, req.Code, iam.OAuthTokenCode)
+		if err != nil {
+			return err
+		}
+
+		if code == nil || code.ClientId != client.Id || !code.IsActiveAt(s.Now()) {
+			return ErrInvalidGrant("authorization code is invalid or expired")
+		}
+
+		if code.UsedAt.Valid {
+			// a replayed code means it leaked, so revoke what it produced
+			cause = ErrInvalidGrant("authorization code was already used")
+			return s.revokeChildren(tx, code.Id)
+		}
+
+		if code.RedirectUri != req.RedirectUri {
+			return ErrInvalidGrant("redirect_uri does not match")
+		}
+
+		if code.CodeChallenge != "" {
+			if subtle.ConstantTimeCompare([]byte(oidc.CodeChallenge(req.CodeVerifier)), []byte(code.CodeChallenge)) != 1 {
+				return ErrInvalidGrant("code_verifier does not match")
+			}
+		}
+
+		used := tx.Model(code).Where("used_at IS NULL").Update("used_at", s.Now())
+		if used.Error != nil {
+			return used.Error
+		}
+
+		// another exchange of the same code won
+		if used.RowsAffected == 0 {
+			return ErrInvalidGrant("authorization code was already used")
+		}
+
+		res, err = s.issue(tx, client, code.UserId, code.Scopes, code.Nonce, code.Id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cause != nil {
+		return nil, cause
+	}
+
+	return res, nil
+}
+
+// refresh rotates the refresh token: the presented token is revoked and a new
+// one is issued alongside the access token.
+func (s *Server) refresh(client *iam.OAuthClientTable, req *TokenRequest) (*TokenResponse, error) {
+	var res *TokenResponse
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		token, err := s.findToken(tx, req.RefreshToken, iam.OAuthTokenRefresh)
+		if err != nil {
+			return err
+		}
+
+		if token == nil || token.ClientId != client.Id || !token.IsActiveAt(s.Now()) {
+			return ErrInvalidGrant("refresh token is invalid or expired")
+		}
+
+		scopes := token.Scopes
+		if req.Scope != "" {
+			granted := strings.Fields(token.Scopes)
+			for _, scope := range strings.Fields(req.Scope) {
+				if !slices.Contains(granted, scope) {
+					return ErrInvalidScope("scope " + scope + " was not granted")
+				}
+			}
+
+			scopes = req.Scope
+		}
+
+		revoked := tx.Model(token).Where("revoked_at IS NULL").Update("revoked_at", s.Now())
+		if revoked.Error != nil {
+			return revoked.Error
+		}
+
+		// another refresh with the same token won
+		if revoked.RowsAffected == 0 {
+			return ErrInvalidGrant("refresh token is invalid or expired")
+		}
+
+		res, err = s.issue(tx, client, token.UserId, scopes, "", token.Id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *Server) clientCredentials(client *iam.OAuthClientTable, req *TokenRequest) (*TokenResponse, error) {
+	if !client.IsConfidential {
+		return nil, ErrUnauthorizedClient("public clients cannot use client credentials")
+	}
+
+	for _, scope := range strings.Fields(req.Scope) {
+		if !client.AllowsScope(scope) {
+			return nil, ErrInvalidScope("scope " + scope + " is not allowed")
+		}
+	}
+
+	var res *TokenResponse
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		res, err = s.issue(tx, client, sql.NullInt32{}, req.Scope, "", 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// issue creates the tokens for a grant. Tokens are only issued to users that
+// still exist and are neither inactive nor banned.
+func (s *Server) issue(tx *gorm.DB, client *iam.OAuthClientTable, userId sql.NullInt32, scopes string, nonce string, parentId int32) (*TokenResponse, error) {
+	if userId.Valid {
+		user := iam.UserTable{}
+		res := tx.Select("id", "status").Where("id = ?", userId.Int32).Limit(1).Find(&user)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+
+		if res.RowsAffected == 0 || user.Status == iam.UserStatusInactive || user.Status == iam.UserStatusBanned {
+			return nil, ErrInvalidGrant("user is not allowed to sign in")
+		}
+	}
+
+	now := s.Now()
+	parent := sql.NullInt32{Int32: parentId, Valid: parentId != 0}
+
+	access, row := iam.NewOAuthToken(iam.OAuthTokenAccess, client.Id, now.Add(s.Options.AccessTokenTTL))
+	row.UserId = userId
+	row.ParentId = parent
+	row.Scopes = scopes
+	err := tx.Create(row).Error
+	if err != nil {
+		return nil, err
+	}
+
+	res := &TokenResponse{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.Options.AccessTokenTTL.Seconds()),
+		Scope:       scopes,
+	}
+
+	if userId.Valid && client.AllowsGrant(iam.GrantRefreshToken) {
+		refresh, row := iam.NewOAuthToken(iam.OAuthTokenRefresh, client.Id, now.Add(s.Options.RefreshTokenTTL))
+		row.UserId = userId
+		row.ParentId = parent
+		row.Scopes = scopes
+		err = tx.Create(row).Error
+		if err != nil {
+			return nil, err
+		}
+
+		res.RefreshToken = refresh
+	}
+
+	if userId.Valid && slices.Contains(strings.Fields(scopes), "openid") {
+		claims, err := s.userClaims(&iam.IamDb{DB: tx}, userId.Int32, scopes)
+		if err != nil {
+			return nil, err
+		}
+
+		claims["iss"] = s.Issuer
+		claims["aud"] = client.ClientId
+		claims["iat"] = now.Unix()
+		claims["exp"] = now.Add(s.Options.IdTokenTTL).Unix()
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+
+		res.IdToken, err = oidc.SignJWT(s.key, s.alg, s.keyId, claims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// userClaims builds the standard claims released for the granted scopes.
+func (s *Server) userClaims(db *iam.IamDb, userId int32, scopes string) (map[string]interface{}, error) {
+	user, err := db.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	granted := strings.Fields(scopes)
+	claims := map[string]interface{}{
+		"sub": user.Uid.String(),
+	}
+
+	if slices.Contains(granted, "profile") {
+		name := user.Name
+		if user.NameFormatted.Valid && user.NameFormatted.String != "" {
+			name = user.NameFormatted.String
+		}
+
+		claims["name"] = name
+		claims["preferred_username"] = user.Name
+	}
+
+	if slices.Contains(granted, "email") {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+
+	if slices.Contains(granted, "roles") {
+		auth, err := db.GetUserAuthorization(userId, user.OrgId)
+		if err != nil {
+			return nil, err
+		}
+
+		claims["roles"] = auth.Roles
+	}
+
+	return claims, nil
+}
+
+func (s *Server) UserInfo(accessToken string) (map[string]interface{}, error) {
+	token, err := s.findToken(s.db.DB, accessToken, iam.OAuthTokenAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil || !token.IsActiveAt(s.Now()) || !token.UserId.Valid {
+		return nil, ErrInvalidToken("access token is invalid or expired")
+	}
+
+	if !slices.Contains(strings.Fields(token.Scopes), "openid") {
+		return nil, newError(http.StatusForbidden, "insufficient_scope", "the openid scope is required")
+	}
+
+	return s.userClaims(s.db, token.UserId.Int32, token.Scopes)
+}
+
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+}
+
+// Introspect describes an access or refresh token to the authenticated
+// client. Tokens of other clients are reported as inactive.
+func (s *Server) Introspect(client *iam.OAuthClientTable, value string) (*Introspection, error) {
+	token, err := s.findToken(s.db.DB, value, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil || token.Kind == iam.OAuthTokenCode || token.ClientId != client.Id || !token.IsActiveAt(s.Now()) {
+		return &Introspection{Active: false}, nil
+	}
+
+	res := &Introspection{
+		Active:    true,
+		Scope:     token.Scopes,
+		ClientId:  client.ClientId,
+		Subject:   client.ClientId,
+		TokenType: token.Kind,
+		ExpiresAt: token.ExpiresAt.Unix(),
+		IssuedAt:  token.CreatedAt.Unix(),
+		Issuer:    s.Issuer,
+	}
+
+	if token.UserId.Valid {
+		user, err := s.db.GetUserById(token.UserId.Int32)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Subject = user.Uid.String()
+	}
+
+	return res, nil
+}
+
+// Revoke revokes an access or refresh token of the client. Revoking a refresh
+// token also revokes the tokens issued from it. Unknown tokens are ignored as
+// required by RFC 7009.
+func (s *Server) Revoke(client *iam.OAuthClientTable, value string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		token, err := s.findToken(tx, value, "")
+		if err != nil {
+			return err
+		}
+
+		if token == nil || token.ClientId != client.Id || token.Kind == iam.OAuthTokenCode {
+			return nil
+		}
+
+		err = tx.Model(token).Update("revoked_at", s.Now()).Error
+		if err != nil {
+			return err
+		}
+
+		if token.Kind == iam.OAuthTokenRefresh {
+			return s.revokeChildren(tx, token.Id)
+		}
+
+		return nil
+	})
+}
+
+// revokeChildren revokes every token descended from parentId, following
+// refresh token rotations.
+func (s *Server) revokeChildren(tx *gorm.DB, parentId int32) error {
+	parents := []int32{parentId}
+	for len(parents) > 0 {
+		children := []int32{}
+		err := tx.Model(&iam.OAuthTokenTable{}).Where("parent_id IN ?", parents).Pluck("id", &children).Error
+		if err != nil {
+			return err
+		}
+
+		if len(children) == 0 {
+			return nil
+		}
+
+		err = tx.Model(&iam.OAuthTokenTable{}).
+			Where("id IN ? AND revoked_at IS NULL", children).
+			Update("revoked_at", s.Now()).Error
+		if err != nil {
+			return err
+		}
+
+		parents = children
+	}
+
+	return nil
+}
+
+func (s *Server) findToken(tx *gorm.DB, value string, kind string) (*iam.OAuthTokenTable, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	token := iam.OAuthTokenTable{}
+	q := tx.Where("token_hash = ?", iam.HashOAuthToken(value))
+	if kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+
+	res := q.Limit(1).Find(&token)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &token, nil
+}
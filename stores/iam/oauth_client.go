@@ -0,0 +1,162 @@
+package iam
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/google/uuid"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+)
+
+// OAuthClientTable is an application registered to use gs as its OAuth2 and
+// OpenID Connect authorization server. Public clients have no secret and must
+// use PKCE.
+type OAuthClientTable struct {
+	Id             int32         `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid            uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_oauth_clients_uid,unique" json:"uid"`
+	ClientId       string        `gorm:"column:client_id;size:64;index:ix_oauth_clients_client_id,unique" json:"clientId"`
+	SecretHash     string        `gorm:"column:secret_hash;size:128" json:"-"`
+	Name           string        `gorm:"column:name;size:64" json:"name"`
+	OrgId          sql.NullInt32 `gorm:"column:org_id" json:"organizationId"`
+	IsConfidential bool          `gorm:"column:is_confidential" json:"isConfidential"`
+	RedirectUris   string        `gorm:"column:redirect_uris;size:2048" json:"redirectUris"`
+	GrantTypes     string        `gorm:"column:grant_types;size:256" json:"grantTypes"`
+	Scopes         string        `gorm:"column:scopes;size:1024" json:"scopes"`
+	RevokedAt      sql.NullTime  `gorm:"column:revoked_at" json:"revokedAt"`
+	CreatedAt      time.Time     `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt      sql.NullTime  `gorm:"column:updated_at" json:"updated_at"`
+}
+
+func (OAuthClientTable) TableName() string {
+	return "oauth_clients"
+}
+
+type NewOAuthClient struct {
+	Name           string
+	OrgId          sql.NullInt32
+	IsConfidential bool
+	RedirectUris   []string
+	GrantTypes     []string
+	Scopes         []string
+}
+
+// RegisterOAuthClient stores a new client and returns its secret. The secret
+// is empty for public clients and cannot be recovered later.
+func (db *IamDb) RegisterOAuthClient(client *NewOAuthClient) (string, *OAuthClientTable, error) {
+	name := strings.TrimSpace(client.Name)
+	if name == "" {
+		return "", nil, invalidField("name", "required", "client name is required")
+	}
+
+	grants := client.GrantTypes
+	if len(grants) == 0 {
+		grants = []string{GrantAuthorizationCode, GrantRefreshToken}
+	}
+
+	for _, g := range grants {
+		if g != GrantAuthorizationCode && g != GrantClientCredentials && g != GrantRefreshToken {
+			return "", nil, invalidField("grantTypes", "oneof", "unsupported grant type "+g)
+		}
+	}
+
+	if slices.Contains(grants, GrantClientCredentials) && !client.IsConfidential {
+		return "", nil, invalidField("grantTypes", "public", "public clients cannot use client credentials")
+	}
+
+	if slices.Contains(grants, GrantAuthorizationCode) && len(client.RedirectUris) == 0 {
+		return "", nil, invalidField("redirectUris", "required", "at least one redirect uri is required")
+	}
+
+	table := &OAuthClientTable{
+		Uid:            uuid.New(),
+		ClientId:       uniuri.NewLenChars(24, apiKeyChars),
+		Name:           name,
+		OrgId:          client.OrgId,
+		IsConfidential: client.IsConfidential,
+		RedirectUris:   strings.Join(client.RedirectUris, " "),
+		GrantTypes:     strings.Join(grants, " "),
+		Scopes:         strings.Join(client.Scopes, " "),
+		CreatedAt:      time.Now(),
+	}
+
+	secret := ""
+	if client.IsConfidential {
+		secret = uniuri.NewLenChars(apiKeySecretLen, apiKeyChars)
+		table.SecretHash = hashApiKeySecret(secret)
+	}
+
+	err := db.Create(table).Error
+	if err != nil {
+		return "", nil, err
+	}
+
+	return secret, table, nil
+}
+
+// FindOAuthClient returns the active client with the client id, or nil.
+func (db *IamDb) FindOAuthClient(clientId string) (*OAuthClientTable, error) {
+	client := OAuthClientTable{}
+	res := db.Where("client_id = ? AND revoked_at IS NULL", clientId).Limit(1).Find(&client)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &client, nil
+}
+
+func (db *IamDb) RevokeOAuthClient(clientId string) error {
+	now := time.Now()
+	return db.Model(&OAuthClientTable{}).Where("client_id = ?", clientId).
+		Updates(map[string]interface{}{"revoked_at": now, "updated_at": now}).Error
+}
+
+func (client *OAuthClientTable) ValidateSecret(secret string) bool {
+	if !client.IsConfidential {
+		return secret == ""
+	}
+
+	hash := hashApiKeySecret(secret)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(client.SecretHash)) == 1
+}
+
+func (client *OAuthClientTable) GetRedirectUris() []string {
+	return strings.Fields(client.RedirectUris)
+}
+
+func (client *OAuthClientTable) GetGrantTypes() []string {
+	return strings.Fields(client.GrantTypes)
+}
+
+func (client *OAuthClientTable) GetScopes() []string {
+	return strings.Fields(client.Scopes)
+}
+
+func (client *OAuthClientTable) AllowsGrant(grant string) bool {
+	return slices.Contains(client.GetGrantTypes(), grant)
+}
+
+// AllowsRedirectUri compares redirect uris exactly, as required by the OAuth2
+// security best practices.
+func (client *OAuthClientTable) AllowsRedirectUri(uri string) bool {
+	return slices.Contains(client.GetRedirectUris(), uri)
+}
+
+// AllowsScope reports whether the client may request scope. Clients without
+// registered scopes may request any scope.
+func (client *OAuthClientTable) AllowsScope(scope string) bool {
+	scopes := client.GetScopes()
+	return len(scopes) == 0 || slices.Contains(scopes, scope)
+}
@@ -0,0 +1,62 @@
+package iam
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/google/uuid"
+)
+
+const (
+	OAuthTokenCode    = "code"
+	OAuthTokenAccess  = "access_token"
+	OAuthTokenRefresh = "refresh_token"
+)
+
+// OAuthTokenTable stores authorization codes, access tokens and refresh tokens
+// issued by the authorization server. Only a hash of each token is kept.
+type OAuthTokenTable struct {
+	Id            int32         `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid           uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_oauth_tokens_uid,unique" json:"uid"`
+	TokenHash     string        `gorm:"column:token_hash;size:128;index:ix_oauth_tokens_token_hash,unique" json:"-"`
+	Kind          string        `gorm:"column:kind;size:16" json:"kind"`
+	ClientId      int32         `gorm:"column:client_id;index:ix_oauth_tokens_client_id" json:"clientId"`
+	UserId        sql.NullInt32 `gorm:"column:user_id;index:ix_oauth_tokens_user_id" json:"userId"`
+	ParentId      sql.NullInt32 `gorm:"column:parent_id;index:ix_oauth_tokens_parent_id" json:"parentId"`
+	Scopes        string        `gorm:"column:scopes;size:1024" json:"scopes"`
+	RedirectUri   string        `gorm:"column:redirect_uri;size:1024" json:"-"`
+	Nonce         string        `gorm:"column:nonce;size:256" json:"-"`
+	CodeChallenge string        `gorm:"column:code_challenge;size:128" json:"-"`
+	ExpiresAt     time.Time     `gorm:"column:expires_at" json:"expiresAt"`
+	UsedAt        sql.NullTime  `gorm:"column:used_at" json:"usedAt"`
+	RevokedAt     sql.NullTime  `gorm:"column:revoked_at" json:"revokedAt"`
+	CreatedAt     time.Time     `gorm:"column:created_at" json:"created_at"`
+}
+
+func (OAuthTokenTable) TableName() string {
+	return "oauth_tokens"
+}
+
+// NewOAuthToken generates a random token value and returns it along with a
+// row holding its hash.
+func NewOAuthToken(kind string, clientId int32, expiresAt time.Time) (string, *OAuthTokenTable) {
+	value := uniuri.NewLen(48)
+	return value, &OAuthTokenTable{
+		Uid:       uuid.New(),
+		TokenHash: HashOAuthToken(value),
+		Kind:      kind,
+		ClientId:  clientId,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+}
+
+func HashOAuthToken(value string) string {
+	return hashApiKeySecret(value)
+}
+
+// IsActiveAt reports whether the token can still be used at now.
+func (t *OAuthTokenTable) IsActiveAt(now time.Time) bool {
+	return !t.RevokedAt.Valid && now.Before(t.ExpiresAt)
+}
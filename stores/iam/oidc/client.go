@@ -0,0 +1,355 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gnomego/sdk/stores/iam"
+)
+
+type Client struct {
+	Provider     *Provider
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+	Scopes       []string
+	// ProviderName is the name identities are linked under in iam, such as
+	// "github" or "corp".
+	ProviderName string
+	Now          func() time.Time
+}
+
+func NewClient(provider *Provider, providerName string, clientId string, clientSecret string, redirectUrl string) *Client {
+	return &Client{
+		Provider:     provider,
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		RedirectUrl:  redirectUrl,
+		Scopes:       []string{"openid", "profile", "email"},
+		ProviderName: providerName,
+		Now:          time.Now,
+	}
+}
+
+// AuthRequest holds the values that must be kept, usually in a short lived
+// cookie, between redirecting the user and handling the callback.
+type AuthRequest struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"codeVerifier"`
+	Url          string `json:"url"`
+}
+
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	Expiry       time.Time
+}
+
+type UserInfo struct {
+	Subject           string                 `json:"sub"`
+	Email             string                 `json:"email,omitempty"`
+	EmailVerified     bool                   `json:"email_verified,omitempty"`
+	Name              string                 `json:"name,omitempty"`
+	PreferredUsername string                 `json:"preferred_username,omitempty"`
+	Picture           string                 `json:"picture,omitempty"`
+	Claims            map[string]interface{} `json:"-"`
+}
+
+// Identity is the verified result of a completed login.
+type Identity struct {
+	IdToken  *IdToken
+	UserInfo *UserInfo
+	Token    *Token
+}
+
+type tokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *tokenError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("oidc: %s: %s", e.Code, e.Description)
+	}
+
+	return "oidc: " + e.Code
+}
+
+// NewAuthRequest creates a state, nonce and PKCE verifier and builds the
+// authorization url the user should be redirected to.
+func (c *Client) NewAuthRequest() *AuthRequest {
+	req := &AuthRequest{
+		State:        uniuri.NewLen(32),
+		Nonce:        uniuri.NewLen(32),
+		CodeVerifier: uniuri.NewLen(64),
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", c.ClientId)
+	q.Set("redirect_uri", c.RedirectUrl)
+	q.Set("scope", strings.Join(c.Scopes, " "))
+	q.Set("state", req.State)
+	q.Set("nonce", req.Nonce)
+	q.Set("code_challenge", CodeChallenge(req.CodeVerifier))
+	q.Set("code_challenge_method", "S256")
+
+	endpoint := c.Provider.Metadata.AuthorizationEndpoint
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+
+	req.Url = endpoint + sep + q.Encode()
+	return req
+}
+
+// CodeChallenge derives the S256 PKCE challenge for verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CompleteAuth handles the callback values, exchanges the code, verifies the
+// id token and loads the user info.
+func (c *Client) CompleteAuth(ctx context.Context, req *AuthRequest, state string, code string) (*Identity, error) {
+	if req == nil || subtle.ConstantTimeCompare([]byte(req.State), []byte(state)) != 1 {
+		return nil, errors.New("oidc: state does not match")
+	}
+
+	if code == "" {
+		return nil, errors.New("oidc: authorization code is missing")
+	}
+
+	token, err := c.Exchange(ctx, code, req.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.IdToken == "" {
+		return nil, errors.New("oidc: token response has no id token")
+	}
+
+	idToken, err := c.VerifyIdToken(ctx, token.IdToken, req.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		IdToken: idToken,
+		Token:   token,
+	}
+
+	if c.Provider.Metadata.UserInfoEndpoint != "" {
+		info, err := c.UserInfo(ctx, token.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.Subject != idToken.Subject {
+			return nil, errors.New("oidc: userinfo subject does not match id token")
+		}
+
+		identity.UserInfo = info
+	}
+
+	return identity, nil
+}
+
+func (c *Client) Exchange(ctx context.Context, code string, codeVerifier string) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.RedirectUrl)
+	form.Set("code_verifier", codeVerifier)
+
+	return c.tokenRequest(ctx, form)
+}
+
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+
+	return c.tokenRequest(ctx, form)
+}
+
+// TokenRefresher adapts Refresh for iam.ExternalLoginStore.RefreshTokens.
+func (c *Client) TokenRefresher(ctx context.Context) iam.TokenRefresher {
+	return func(refreshToken string) ([]iam.ExternalToken, error) {
+		token, err := c.Refresh(ctx, refreshToken)
+		if err != nil {
+			return nil, err
+		}
+
+		if token.RefreshToken == "" {
+			token.RefreshToken = refreshToken
+		}
+
+		return token.ExternalTokens(), nil
+	}
+}
+
+func (c *Client) tokenRequest(ctx context.Context, form url.Values) (*Token, error) {
+	if c.ClientSecret == "" {
+		form.Set("client_id", c.ClientId)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Provider.Metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.ClientId), url.QueryEscape(c.ClientSecret))
+	}
+
+	res, err := c.Provider.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		te := &tokenError{}
+		if json.Unmarshal(body, te) == nil && te.Code != "" {
+			return nil, te
+		}
+
+		return nil, fmt.Errorf("oidc: token request failed with status %d", res.StatusCode)
+	}
+
+	token := &Token{}
+	err = json.Unmarshal(body, token)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid token response: %w", err)
+	}
+
+	if token.AccessToken == "" {
+		return nil, errors.New("oidc: token response has no access token")
+	}
+
+	if token.ExpiresIn > 0 {
+		token.Expiry = c.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+
+	return token, nil
+}
+
+func (c *Client) UserInfo(ctx context.Context, accessToken string) (*UserInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Provider.Metadata.UserInfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.Provider.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: userinfo request failed with status %d", res.StatusCode)
+	}
+
+	info := &UserInfo{}
+	err = json.Unmarshal(body, info)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid userinfo response: %w", err)
+	}
+
+	err = json.Unmarshal(body, &info.Claims)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid userinfo response: %w", err)
+	}
+
+	return info, nil
+}
+
+func (t *Token) ExternalTokens() []iam.ExternalToken {
+	expiry := sql.NullTime{}
+	if !t.Expiry.IsZero() {
+		expiry = sql.NullTime{Time: t.Expiry, Valid: true}
+	}
+
+	tokens := []iam.ExternalToken{
+		{Name: iam.AccessTokenName, Value: t.AccessToken, ExpiresAt: expiry},
+	}
+
+	if t.RefreshToken != "" {
+		tokens = append(tokens, iam.ExternalToken{Name: iam.RefreshTokenName, Value: t.RefreshToken})
+	}
+
+	if t.IdToken != "" {
+		tokens = append(tokens, iam.ExternalToken{Name: iam.IdTokenName, Value: t.IdToken})
+	}
+
+	return tokens
+}
+
+// ExternalLogin maps the identity onto an iam login keyed by the subject.
+// Userinfo values take precedence over the id token claims.
+func (c *Client) ExternalLogin(identity *Identity) *iam.ExternalLogin {
+	id := identity.IdToken
+	login := &iam.ExternalLogin{
+		Provider:      c.ProviderName,
+		Key:           id.Subject,
+		DisplayName:   id.Name,
+		Name:          id.PreferredUsername,
+		Email:         id.Email,
+		EmailVerified: id.EmailVerified,
+	}
+
+	if info := identity.UserInfo; info != nil {
+		if info.Name != "" {
+			login.DisplayName = info.Name
+		}
+
+		if info.PreferredUsername != "" {
+			login.Name = info.PreferredUsername
+		}
+
+		if info.Email != "" {
+			login.Email = info.Email
+			login.EmailVerified = info.EmailVerified
+		}
+	}
+
+	if identity.Token != nil {
+		login.Tokens = identity.Token.ExternalTokens()
+	}
+
+	return login
+}
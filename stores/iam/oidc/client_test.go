@@ -0,0 +1,162 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	"github.com/gnomego/sdk/stores/iam/oidc"
+	"github.com/gnomego/sdk/stores/iam/oidc/oidctest"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// authorize follows the authorization url like a browser would and returns
+// the state and code from the callback redirect.
+func authorize(t *testing.T, authUrl string) (string, string) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get(authUrl)
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	loc, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid redirect: %v", err)
+	}
+
+	return loc.Query().Get("state"), loc.Query().Get("code")
+}
+
+func TestOidcLogin(t *testing.T) {
+	assert := assert2.New(t)
+	ctx := context.Background()
+
+	op := oidctest.NewProvider("gs", "s3cret")
+	defer op.Close()
+
+	provider, err := oidc.Discover(ctx, op.Issuer, nil)
+	if err != nil {
+		t.Fatalf("failed to discover provider: %v", err)
+	}
+
+	client := oidc.NewClient(provider, "corp", "gs", "s3cret", "http://localhost/callback")
+
+	req := client.NewAuthRequest()
+	state, code := authorize(t, req.Url)
+	assert.Equal(req.State, state)
+
+	_, err = client.CompleteAuth(ctx, req, "wrong-state", code)
+	assert.Error(err)
+
+	identity, err := client.CompleteAuth(ctx, req, state, code)
+	if err != nil {
+		t.Fatalf("failed to complete auth: %v", err)
+	}
+
+	assert.Equal("test-subject", identity.IdToken.Subject)
+	assert.Equal("test@example.com", identity.UserInfo.Email)
+	assert.NotEmpty(identity.Token.RefreshToken)
+
+	// codes are single use
+	_, err = client.CompleteAuth(ctx, req, state, code)
+	assert.Error(err)
+
+	req = client.NewAuthRequest()
+	state, code = authorize(t, req.Url)
+	req.CodeVerifier = "not-the-verifier-that-was-used-for-the-challenge-value"
+	_, err = client.CompleteAuth(ctx, req, state, code)
+	assert.Error(err)
+
+	db, err := gorm.Open(sqlite.Open("file:oidc?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	iamDb := &iam.IamDb{DB: db}
+	assert.NoError(iamDb.MigrateIam())
+
+	store := iam.NewExternalLoginStore(iamDb, []byte("0123456789abcdef0123456789abcdef"), nil, &iam.ExternalLoginOptions{
+		AutoProvision: true,
+	})
+
+	user, created, err := store.SignIn(client.ExternalLogin(identity))
+	if err != nil {
+		t.Fatalf("failed to sign in: %v", err)
+	}
+
+	assert.True(created)
+	assert.Equal("test", user.Name)
+
+	logins, err := store.GetLogins(user.Id)
+	assert.NoError(err)
+	assert.Len(logins, 1)
+	assert.Equal("corp", logins[0].Provider)
+	assert.Equal("test-subject", logins[0].Key)
+
+	err = store.RefreshTokens(user.Id, "corp", client.TokenRefresher(ctx))
+	assert.NoError(err)
+
+	access, err := store.GetToken(user.Id, "corp", iam.AccessTokenName)
+	assert.NoError(err)
+	assert.NotEqual(identity.Token.AccessToken, access.Value)
+}
+
+func TestVerifyIdToken(t *testing.T) {
+	assert := assert2.New(t)
+	ctx := context.Background()
+
+	op := oidctest.NewProvider("gs", "s3cret")
+	defer op.Close()
+
+	provider, err := oidc.NewProvider(op.Metadata(), nil)
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	client := oidc.NewClient(provider, "corp", "gs", "s3cret", "http://localhost/callback")
+
+	raw, err := op.IdToken(op.User, "gs", "n1", time.Now().Add(time.Minute))
+	assert.NoError(err)
+
+	token, err := client.VerifyIdToken(ctx, raw, "n1")
+	assert.NoError(err)
+	assert.Equal(op.User.Email, token.Email)
+
+	_, err = client.VerifyIdToken(ctx, raw, "n2")
+	assert.Error(err)
+
+	_, err = client.VerifyIdToken(ctx, raw[:len(raw)-4]+"AAAA", "n1")
+	assert.Error(err)
+
+	other, err := op.IdToken(op.User, "someone-else", "n1", time.Now().Add(time.Minute))
+	assert.NoError(err)
+	_, err = client.VerifyIdToken(ctx, other, "n1")
+	assert.Error(err)
+
+	expired, err := op.IdToken(op.User, "gs", "n1", time.Now().Add(-time.Hour))
+	assert.NoError(err)
+	_, err = client.VerifyIdToken(ctx, expired, "n1")
+	assert.Error(err)
+
+	// unknown key ids do not refetch the key set on every token
+	assert.Equal(1, op.JwksRequests())
+	for _, kid := range []string{"rotated", "made-up", "another"} {
+		forged, err := oidc.SignJWT(op.Key, "RS256", kid, oidc.IdToken{Issuer: op.Issuer, Audience: oidc.Audience{"gs"}})
+		assert.NoError(err)
+		_, err = client.VerifyIdToken(ctx, forged, "n1")
+		assert.ErrorContains(err, "no signing key")
+	}
+
+	assert.Equal(1, op.JwksRequests())
+}
@@ -0,0 +1,97 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ProviderMetadata is the subset of the OpenID Provider configuration
+// document that the client uses.
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint,omitempty"`
+	JwksUri                           string   `json:"jwks_uri"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported,omitempty"`
+	ClaimsSupported                   []string `json:"claims_supported,omitempty"`
+}
+
+type Provider struct {
+	Metadata ProviderMetadata
+	client   *http.Client
+	keys     *remoteKeySet
+}
+
+// Discover fetches the provider configuration from the issuer's well-known
+// endpoint. The issuer in the document must match the requested issuer.
+func Discover(ctx context.Context, issuer string, client *http.Client) (*Provider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	issuer = strings.TrimSuffix(issuer, "/")
+	url := issuer + "/.well-known/openid-configuration"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery failed with status %d", res.StatusCode)
+	}
+
+	metadata := ProviderMetadata{}
+	err = json.Unmarshal(body, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid discovery document: %w", err)
+	}
+
+	if strings.TrimSuffix(metadata.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc: issuer %q does not match %q", metadata.Issuer, issuer)
+	}
+
+	return NewProvider(metadata, client)
+}
+
+// NewProvider creates a provider from metadata that was obtained without
+// discovery, for example from configuration.
+func NewProvider(metadata ProviderMetadata, client *http.Client) (*Provider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JwksUri == "" {
+		return nil, fmt.Errorf("oidc: provider metadata is missing required endpoints")
+	}
+
+	return &Provider{
+		Metadata: metadata,
+		client:   client,
+		keys:     newRemoteKeySet(metadata.JwksUri, client),
+	}, nil
+}
@@ -0,0 +1,143 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Audience accepts both the string and array forms of the "aud" claim.
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+
+	*a = Audience(list)
+	return nil
+}
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+
+	return json.Marshal([]string(a))
+}
+
+type IdToken struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          Audience `json:"aud"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	AuthTime          int64    `json:"auth_time,omitempty"`
+	Nonce             string   `json:"nonce,omitempty"`
+	AuthorizedParty   string   `json:"azp,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	EmailVerified     bool     `json:"email_verified,omitempty"`
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Picture           string   `json:"picture,omitempty"`
+
+	Raw    string                 `json:"-"`
+	Claims map[string]interface{} `json:"-"`
+}
+
+func (t *IdToken) ExpiresAt() time.Time {
+	return time.Unix(t.Expiry, 0)
+}
+
+// clockSkew is the leeway allowed between the provider's clock and ours.
+const clockSkew = 2 * time.Minute
+
+// VerifyIdToken checks the signature of raw against the provider's keys and
+// validates the issuer, audience, expiry and, when given, the nonce.
+func (c *Client) VerifyIdToken(ctx context.Context, raw string, nonce string) (*IdToken, error) {
+	token, err := parseJWS(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := c.Provider.Metadata.IdTokenSigningAlgValuesSupported
+	if len(allowed) == 0 {
+		allowed = []string{"RS256"}
+	}
+
+	if token.header.Alg == "none" || !slices.Contains(allowed, token.header.Alg) {
+		return nil, fmt.Errorf("oidc: id token alg %q is not allowed", token.header.Alg)
+	}
+
+	jwk, err := c.Provider.keys.key(ctx, token.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if jwk.Alg != "" && jwk.Alg != token.header.Alg {
+		return nil, errors.New("oidc: id token alg does not match signing key")
+	}
+
+	key, err := jwk.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(token.header.Alg, key, token.signingInput, token.signature)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid id token signature: %w", err)
+	}
+
+	idToken := &IdToken{Raw: raw}
+	err = json.Unmarshal(token.payload, idToken)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid id token claims: %w", err)
+	}
+
+	err = json.Unmarshal(token.payload, &idToken.Claims)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid id token claims: %w", err)
+	}
+
+	if idToken.Issuer != c.Provider.Metadata.Issuer {
+		return nil, fmt.Errorf("oidc: id token issuer %q does not match", idToken.Issuer)
+	}
+
+	if !slices.Contains(idToken.Audience, c.ClientId) {
+		return nil, errors.New("oidc: id token was not issued for this client")
+	}
+
+	if len(idToken.Audience) > 1 && idToken.AuthorizedParty != c.ClientId {
+		return nil, errors.New("oidc: id token azp does not match this client")
+	}
+
+	now := c.Now()
+	if idToken.Expiry == 0 || now.Add(-clockSkew).After(idToken.ExpiresAt()) {
+		return nil, errors.New("oidc: id token is expired")
+	}
+
+	if idToken.IssuedAt != 0 && time.Unix(idToken.IssuedAt, 0).After(now.Add(clockSkew)) {
+		return nil, errors.New("oidc: id token was issued in the future")
+	}
+
+	if nonce != "" && idToken.Nonce != nonce {
+		return nil, errors.New("oidc: id token nonce does not match")
+	}
+
+	if idToken.Subject == "" {
+		return nil, errors.New("oidc: id token has no subject")
+	}
+
+	return idToken, nil
+}
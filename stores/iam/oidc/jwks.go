@@ -0,0 +1,237 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// NewJSONWebKey describes an RSA or ECDSA public key as a JWK.
+func NewJSONWebKey(key crypto.PublicKey, kid string, alg string) (JSONWebKey, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: alg,
+			N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return JSONWebKey{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Alg: alg,
+			Crv: k.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, size))),
+		}, nil
+	default:
+		return JSONWebKey{}, fmt.Errorf("oidc: unsupported key type %T", key)
+	}
+}
+
+func (k *JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: invalid rsa modulus: %w", err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: invalid rsa exponent: %w", err)
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("oidc: unsupported curve %q", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: invalid ec x: %w", err)
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: invalid ec y: %w", err)
+		}
+
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("oidc: ec key is not on curve %s", k.Crv)
+		}
+
+		return key, nil
+	default:
+		return nil, fmt.Errorf("oidc: unsupported key type %q", k.Kty)
+	}
+}
+
+// keyRefreshInterval is the shortest time between two fetches of a key set,
+// so tokens with made up key ids cannot make every verification call the
+// provider.
+const keyRefreshInterval = time.Minute
+
+// remoteKeySet caches the provider's signing keys and refetches them when a
+// token refers to a key id it has not seen, which is how providers rotate.
+type remoteKeySet struct {
+	url    string
+	client *http.Client
+	now    func() time.Time
+
+	mu        sync.Mutex
+	keys      []JSONWebKey
+	fetchedAt time.Time
+	// inflight is the fetch in progress; callers that need it wait for it
+	// instead of starting their own.
+	inflight *keyFetch
+}
+
+type keyFetch struct {
+	done chan struct{}
+	keys []JSONWebKey
+	err  error
+}
+
+func newRemoteKeySet(url string, client *http.Client) *remoteKeySet {
+	return &remoteKeySet{
+		url:    url,
+		client: client,
+		now:    time.Now,
+	}
+}
+
+func (r *remoteKeySet) key(ctx context.Context, kid string) (*JSONWebKey, error) {
+	r.mu.Lock()
+	if k := findKey(r.keys, kid); k != nil {
+		r.mu.Unlock()
+		return k, nil
+	}
+
+	call := r.inflight
+	if call == nil {
+		if !r.fetchedAt.IsZero() && r.now().Sub(r.fetchedAt) < keyRefreshInterval {
+			r.mu.Unlock()
+			return nil, fmt.Errorf("oidc: no signing key found for kid %q", kid)
+		}
+
+		call = &keyFetch{done: make(chan struct{})}
+		r.inflight = call
+		r.fetchedAt = r.now()
+		r.mu.Unlock()
+
+		call.keys, call.err = r.fetch(ctx)
+
+		r.mu.Lock()
+		if call.err == nil {
+			r.keys = call.keys
+		}
+		r.inflight = nil
+		r.mu.Unlock()
+		close(call.done)
+	} else {
+		r.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	if k := findKey(call.keys, kid); k != nil {
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("oidc: no signing key found for kid %q", kid)
+}
+
+func (r *remoteKeySet) fetch(ctx context.Context) ([]JSONWebKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: jwks request failed with status %d", res.StatusCode)
+	}
+
+	set := JSONWebKeySet{}
+	err = json.NewDecoder(res.Body).Decode(&set)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid jwks document: %w", err)
+	}
+
+	return set.Keys, nil
+}
+
+func findKey(keys []JSONWebKey, kid string) *JSONWebKey {
+	for i := range keys {
+		if keys[i].Use != "" && keys[i].Use != "sig" {
+			continue
+		}
+
+		if kid == "" || keys[i].Kid == kid {
+			return &keys[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type jws struct {
+	header       jwtHeader
+	payload      []byte
+	signingInput string
+	signature    []byte
+}
+
+func parseJWS(raw string) (*jws, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: token is not a compact jws")
+	}
+
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid token header: %w", err)
+	}
+
+	header := jwtHeader{}
+	err = json.Unmarshal(h, &header)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid token header: %w", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid token payload: %w", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid token signature: %w", err)
+	}
+
+	return &jws{
+		header:       header,
+		payload:      payload,
+		signingInput: parts[0] + "." + parts[1],
+		signature:    sig,
+	}, nil
+}
+
+func algHash(alg string) (crypto.Hash, func() hash.Hash, error) {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, sha256.New, nil
+	case "384":
+		return crypto.SHA384, sha512.New384, nil
+	case "512":
+		return crypto.SHA512, sha512.New, nil
+	default:
+		return 0, nil, fmt.Errorf("oidc: unsupported alg %q", alg)
+	}
+}
+
+// verifySignature checks a JWS signature for the RS, PS and ES families. The
+// "none" algorithm and HMAC algorithms are always rejected.
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("oidc: unsupported alg %q", alg)
+	}
+
+	h, newHash, err := algHash(alg)
+	if err != nil {
+		return err
+	}
+
+	hasher := newHash()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("oidc: key does not match alg")
+		}
+
+		return rsa.VerifyPKCS1v15(k, h, digest, sig)
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("oidc: key does not match alg")
+		}
+
+		return rsa.VerifyPSS(k, h, digest, sig, nil)
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("oidc: key does not match alg")
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("oidc: invalid ecdsa signature length")
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("oidc: invalid ecdsa signature")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("oidc: unsupported alg %q", alg)
+	}
+}
+
+// SignJWT signs claims as a compact JWS with an RSA or ECDSA private key. It
+// is used by the test provider and by servers that issue tokens.
+func SignJWT(key crypto.Signer, alg string, kid string, claims interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	if len(alg) != 5 {
+		return "", fmt.Errorf("oidc: unsupported alg %q", alg)
+	}
+
+	h, newHash, err := algHash(alg)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := newHash()
+	hasher.Write([]byte(input))
+	digest := hasher.Sum(nil)
+
+	var sig []byte
+	switch alg[:2] {
+	case "RS":
+		sig, err = key.Sign(rand.Reader, digest, h)
+	case "PS":
+		sig, err = key.Sign(rand.Reader, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: h})
+	case "ES":
+		k, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return "", errors.New("oidc: key does not match alg")
+		}
+
+		r, s, e := ecdsa.Sign(rand.Reader, k, digest)
+		if e != nil {
+			return "", e
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	default:
+		return "", fmt.Errorf("oidc: unsupported alg %q", alg)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
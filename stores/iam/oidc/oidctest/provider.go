@@ -0,0 +1,320 @@
+// Package oidctest runs an in-process OpenID Connect provider on an
+// httptest.Server so login flows can be tested without network access.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gnomego/sdk/stores/iam/oidc"
+)
+
+type User struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+type authCode struct {
+	clientId      string
+	redirectUri   string
+	nonce         string
+	challenge     string
+	challengeType string
+	user          User
+}
+
+// Provider signs in every authorization request as User without showing a
+// login page, and redirects straight back to the client.
+type Provider struct {
+	Server       *httptest.Server
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	User         User
+	Key          *rsa.PrivateKey
+	KeyId        string
+	TokenTTL     time.Duration
+
+	mu            sync.Mutex
+	codes         map[string]authCode
+	accessTokens  map[string]User
+	refreshTokens map[string]User
+	jwksRequests  int
+}
+
+func NewProvider(clientId string, clientSecret string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	p := &Provider{
+		ClientId:      clientId,
+		ClientSecret:  clientSecret,
+		Key:           key,
+		KeyId:         uniuri.NewLen(8),
+		TokenTTL:      time.Hour,
+		codes:         map[string]authCode{},
+		accessTokens:  map[string]User{},
+		refreshTokens: map[string]User{},
+		User: User{
+			Subject:           "test-subject",
+			Email:             "test@example.com",
+			EmailVerified:     true,
+			Name:              "Test User",
+			PreferredUsername: "test",
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/userinfo", p.userinfo)
+
+	p.Server = httptest.NewServer(mux)
+	p.Issuer = p.Server.URL
+
+	return p
+}
+
+func (p *Provider) Close() {
+	p.Server.Close()
+}
+
+func (p *Provider) Metadata() oidc.ProviderMetadata {
+	return oidc.ProviderMetadata{
+		Issuer:                            p.Issuer,
+		AuthorizationEndpoint:             p.Issuer + "/authorize",
+		TokenEndpoint:                     p.Issuer + "/token",
+		UserInfoEndpoint:                  p.Issuer + "/userinfo",
+		JwksUri:                           p.Issuer + "/jwks",
+		ScopesSupported:                   []string{"openid", "profile", "email"},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	}
+}
+
+// IdToken signs an id token for user, letting tests craft tokens directly.
+func (p *Provider) IdToken(user User, audience string, nonce string, expiry time.Time) (string, error) {
+	claims := oidc.IdToken{
+		Issuer:            p.Issuer,
+		Subject:           user.Subject,
+		Audience:          oidc.Audience{audience},
+		Expiry:            expiry.Unix(),
+		IssuedAt:          time.Now().Unix(),
+		Nonce:             nonce,
+		Email:             user.Email,
+		EmailVerified:     user.EmailVerified,
+		Name:              user.Name,
+		PreferredUsername: user.PreferredUsername,
+	}
+
+	return oidc.SignJWT(p.Key, "RS256", p.KeyId, claims)
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, p.Metadata())
+}
+
+// JwksRequests is how often the key set was fetched.
+func (p *Provider) JwksRequests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jwksRequests
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.jwksRequests++
+	p.mu.Unlock()
+
+	jwk, err := oidc.NewJSONWebKey(&p.Key.PublicKey, p.KeyId, "RS256")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, http.StatusOK, oidc.JSONWebKeySet{Keys: []oidc.JSONWebKey{jwk}})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != p.ClientId || q.Get("response_type") != "code" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := uniuri.NewLen(32)
+
+	p.mu.Lock()
+	p.codes[code] = authCode{
+		clientId:      p.ClientId,
+		redirectUri:   redirect.String(),
+		nonce:         q.Get("nonce"),
+		challenge:     q.Get("code_challenge"),
+		challengeType: q.Get("code_challenge_method"),
+		user:          p.User,
+	}
+	p.mu.Unlock()
+
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", q.Get("state"))
+	redirect.RawQuery = values.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.authenticateClient(r) {
+		writeJson(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		p.mu.Lock()
+		code, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.mu.Unlock()
+
+		if !ok || code.redirectUri != r.PostForm.Get("redirect_uri") {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		if code.challenge != "" {
+			verifier := r.PostForm.Get("code_verifier")
+			if code.challengeType != "S256" || oidc.CodeChallenge(verifier) != code.challenge {
+				writeJson(w, http.StatusBadRequest, map[string]string{
+					"error":             "invalid_grant",
+					"error_description": "code verifier does not match",
+				})
+				return
+			}
+		}
+
+		p.issue(w, code.user, code.nonce, true)
+	case "refresh_token":
+		p.mu.Lock()
+		user, ok := p.refreshTokens[r.PostForm.Get("refresh_token")]
+		p.mu.Unlock()
+
+		if !ok {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		p.issue(w, user, "", false)
+	default:
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+	}
+}
+
+func (p *Provider) authenticateClient(r *http.Request) bool {
+	err := r.ParseForm()
+	if err != nil {
+		return false
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	if id != p.ClientId {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(p.ClientSecret)) == 1
+}
+
+func (p *Provider) issue(w http.ResponseWriter, user User, nonce string, withRefresh bool) {
+	access := uniuri.NewLen(32)
+	res := map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   int64(p.TokenTTL.Seconds()),
+	}
+
+	idToken, err := p.IdToken(user, p.ClientId, nonce, time.Now().Add(p.TokenTTL))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res["id_token"] = idToken
+
+	p.mu.Lock()
+	p.accessTokens[access] = user
+	if withRefresh {
+		refresh := uniuri.NewLen(32)
+		p.refreshTokens[refresh] = user
+		res["refresh_token"] = refresh
+	}
+	p.mu.Unlock()
+
+	writeJson(w, http.StatusOK, res)
+}
+
+func (p *Provider) userinfo(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	p.mu.Lock()
+	user, found := p.accessTokens[token]
+	p.mu.Unlock()
+
+	if !ok || !found {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"sub":                user.Subject,
+		"email":              user.Email,
+		"email_verified":     user.EmailVerified,
+		"name":               user.Name,
+		"preferred_username": user.PreferredUsername,
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
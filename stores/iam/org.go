@@ -3,6 +3,7 @@ package iam
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/gobuffalo/flect"
@@ -10,13 +11,38 @@ import (
 	"gorm.io/gorm"
 )
 
+// Join policies decide what happens when someone signs up with an email
+// address on one of the org's verified domains.
+const (
+	// OrgJoinPolicyNone ignores the org's domains.
+	OrgJoinPolicyNone = "none"
+	// OrgJoinPolicyAuto adds the user to the org once their email is verified.
+	OrgJoinPolicyAuto = "auto"
+	// OrgJoinPolicyApproval files a join request for an org admin to approve.
+	OrgJoinPolicyApproval = "approval"
+	// OrgJoinPolicyBlock refuses self sign-up; users must be invited.
+	OrgJoinPolicyBlock = "block"
+)
+
 type OrgTable struct {
-	Id            int32          `gorm:"column:id;primaryKey,autoIncrement"`
-	Uid           uuid.UUID      `gorm:"column:uid;type:uuid;index:ix_orgs_uid,unique"`
-	Name          string         `gorm:"column:name;size:64,index:ix_orgs_name,unique"`
-	NameFormatted sql.NullString `gorm:"column:name_formatted;size:64"`
-	Slug          string         `gorm:"column:slug;size:64,index:ix_orgs_slug,unique"`
-	Domains       []OrgDomain    `gorm:"foreignKey:OrgId;references:Id"`
+	Id               int32          `gorm:"column:id;primaryKey,autoIncrement"`
+	Uid              uuid.UUID      `gorm:"column:uid;type:uuid;index:ix_orgs_uid,unique"`
+	Name             string         `gorm:"column:name;size:64,index:ix_orgs_name,unique"`
+	NameFormatted    sql.NullString `gorm:"column:name_formatted;size:64"`
+	Slug             string         `gorm:"column:slug;size:64,index:ix_orgs_slug,unique"`
+	ConcurrencyStamp string         `gorm:"column:concurrency_stamp;size:128"`
+	JoinPolicy       string         `gorm:"column:join_policy;size:16"`
+	ParentId         sql.NullInt32  `gorm:"column:parent_id;index:ix_orgs_parent_id"`
+	// Path lists the ids from the root org down to this one, like /1/4/9/,
+	// so a whole subtree can be found with a prefix match.
+	Path      string         `gorm:"column:path;size:512;index:ix_orgs_path"`
+	Parent    *OrgTable      `gorm:"foreignKey:ParentId;references:Id"`
+	DeletedAt gorm.DeletedAt `gorm:"column:deleted_at;index:ix_orgs_deleted_at"`
+	Domains   []OrgDomain    `gorm:"foreignKey:OrgId;references:Id"`
+
+	// stamp is the concurrency stamp stored when the org was last read or
+	// written.
+	stamp string
 }
 
 func (OrgTable) TableName() string {
@@ -30,7 +56,6 @@ func (org *OrgTable) SetName(name string) *OrgTable {
 	org.Name = n
 
 	if (!org.NameFormatted.Valid && name != n) || org.NameFormatted.String != name {
-		println("setting name formatted", name, n)
 		org.NameFormatted = sql.NullString{
 			String: name,
 			Valid:  true,
@@ -98,6 +123,14 @@ func (org *OrgTable) SetDomains(domains []string) *OrgTable {
 	return org
 }
 
+func (org *OrgTable) GetJoinPolicy() string {
+	if org.JoinPolicy == "" {
+		return OrgJoinPolicyNone
+	}
+
+	return org.JoinPolicy
+}
+
 func (org *OrgTable) ToOrgPair() OrgPair {
 	return OrgPair{
 		Id:   org.Uid.String(),
@@ -116,11 +149,19 @@ func (org *OrgTable) ToOrg() Org {
 		n = org.NameFormatted.String
 	}
 
+	parentId := ""
+	if org.Parent != nil {
+		parentId = org.Parent.Uid.String()
+	}
+
 	return Org{
-		Id:      org.Uid.String(),
-		Name:    n,
-		Slug:    org.Slug,
-		Domains: domains,
+		Id:               org.Uid.String(),
+		ParentId:         parentId,
+		Name:             n,
+		Slug:             org.Slug,
+		Domains:          domains,
+		JoinPolicy:       org.GetJoinPolicy(),
+		ConcurrencyStamp: org.ConcurrencyStamp,
 	}
 }
 
@@ -131,7 +172,7 @@ func (org *Org) ToOrgTable(table *OrgTable) (*OrgTable, error) {
 	if org.Id != "" {
 		id2, err := uuid.Parse(org.Id)
 		if err != nil {
-			return nil, fmt.Errorf("id must be a valid UUID")
+			return nil, ErrInvalidId
 		}
 
 		id = id2
@@ -147,10 +188,17 @@ func (org *Org) ToOrgTable(table *OrgTable) (*OrgTable, error) {
 		table.SetSlug(org.Slug)
 	}
 
+	if org.JoinPolicy != "" {
+		table.JoinPolicy = org.JoinPolicy
+	}
+
 	if org.Domains != nil && len(org.Domains) > 0 {
 		for _, domain := range org.Domains {
-			d := strings.TrimSpace(domain)
-			d = strings.ToLower(d)
+			d, err := NormalizeDomain(domain)
+			if err != nil {
+				return nil, err
+			}
+
 			table.Domains = append(table.Domains, OrgDomain{Domain: d})
 		}
 	}
@@ -160,6 +208,75 @@ func (org *Org) ToOrgTable(table *OrgTable) (*OrgTable, error) {
 
 func (org *OrgTable) BeforeCreate(db *gorm.DB) error {
 	org.Uid = uuid.New()
+	if org.ConcurrencyStamp == "" {
+		org.ConcurrencyStamp = uuid.NewString()
+	}
+
+	return nil
+}
+
+func (org *OrgTable) AfterFind(tx *gorm.DB) error {
+	org.stamp = org.ConcurrencyStamp
+	return nil
+}
+
+func (org *OrgTable) AfterCreate(tx *gorm.DB) error {
+	org.stamp = org.ConcurrencyStamp
+	if org.Path != "" {
+		return nil
+	}
+
+	parentPath := "/"
+	if org.ParentId.Valid {
+		parent := OrgTable{}
+		res := tx.Session(&gorm.Session{NewDB: true}).Select("id", "path").Limit(1).Find(&parent, "id = ?", org.ParentId.Int32)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return &NotFoundError{Entity: "org", Message: "parent org not found"}
+		}
+
+		parentPath = parent.GetPath()
+	}
+
+	org.Path = fmt.Sprintf("%s%d/", parentPath, org.Id)
+	return tx.Session(&gorm.Session{NewDB: true}).Model(org).UpdateColumn("path", org.Path).Error
+}
+
+// GetPath returns the materialized path of the org. Orgs created before
+// orgs had parents have no stored path and are roots.
+func (org *OrgTable) GetPath() string {
+	if org.Path == "" {
+		return fmt.Sprintf("/%d/", org.Id)
+	}
+
+	return org.Path
+}
+
+// AncestorIds returns the ids of the org's ancestors, starting at the root.
+func (org *OrgTable) AncestorIds() []int32 {
+	ids := pathIds(org.GetPath())
+	return ids[:len(ids)-1]
+}
+
+func pathIds(path string) []int32 {
+	ids := []int32{}
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		id, err := strconv.ParseInt(part, 10, 32)
+		if err == nil {
+			ids = append(ids, int32(id))
+		}
+	}
+
+	return ids
+}
+
+func (org *OrgTable) AfterUpdate(tx *gorm.DB) error {
+	if writesStamp(tx.Statement) {
+		org.stamp = org.ConcurrencyStamp
+	}
 
 	return nil
 }
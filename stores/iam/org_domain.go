@@ -1,11 +1,113 @@
 package iam
 
+import (
+	"database/sql"
+	"net"
+	"strings"
+
+	"github.com/dchest/uniuri"
+	"gorm.io/gorm"
+)
+
+const (
+	DomainPending  = "pending"
+	DomainVerified = "verified"
+	DomainFailed   = "failed"
+)
+
+const (
+	DomainVerifiedByDns  = "dns"
+	DomainVerifiedByHttp = "http"
+)
+
+// OrgDomain is an email domain claimed by an org. Several orgs may claim the
+// same domain, but only the one that proves control of it is verified.
 type OrgDomain struct {
 	Id     int32  `gorm:"column:id;primaryKey;autoIncrement"`
-	OrgId  int32  `gorm:"column:org_id"`
-	Domain string `gorm:"column:domain;size:128;index:ix_org_domains_domain,unique"`
+	OrgId  int32  `gorm:"column:org_id;index:ix_org_domains_org_id_domain,unique,priority:1"`
+	Domain string `gorm:"column:domain;size:128;index:ix_org_domains_org_id_domain,unique,priority:2;index:ix_org_domains_domain"`
+	// IncludeSubdomains makes the domain also match any subdomain of it, so
+	// acme.com covers eng.acme.com.
+	IncludeSubdomains bool `gorm:"column:include_subdomains"`
+	// Status is one of DomainPending, DomainVerified or DomainFailed.
+	Status string `gorm:"column:status;size:16"`
+	// ChallengeToken must be published in DNS or over HTTP to prove control
+	// of the domain.
+	ChallengeToken string `gorm:"column:challenge_token;size:64"`
+	VerifiedBy     string `gorm:"column:verified_by;size:8"`
+	// VerifiedAt is set once the org proved that it controls the domain.
+	VerifiedAt    sql.NullTime `gorm:"column:verified_at"`
+	LastCheckedAt sql.NullTime `gorm:"column:last_checked_at"`
+	// FailedChecks counts the consecutive failed checks since the last
+	// successful one.
+	FailedChecks int32 `gorm:"column:failed_checks"`
 }
 
 func (OrgDomain) TableName() string {
 	return "org_domains"
 }
+
+func (d *OrgDomain) BeforeCreate(tx *gorm.DB) error {
+	if d.Status == "" {
+		d.Status = DomainPending
+	}
+
+	if d.ChallengeToken == "" {
+		d.ChallengeToken = uniuri.NewLen(32)
+	}
+
+	return nil
+}
+
+func (d *OrgDomain) IsVerified() bool {
+	return d.VerifiedAt.Valid
+}
+
+// Matches reports whether the domain of an email address belongs to d.
+func (d *OrgDomain) Matches(domain string) bool {
+	if domain == d.Domain {
+		return true
+	}
+
+	return d.IncludeSubdomains && len(domain) > len(d.Domain) &&
+		domain[len(domain)-len(d.Domain)-1:] == "."+d.Domain
+}
+
+// NormalizeDomain lowercases a domain and checks that it is a fully
+// qualified host name: at least two labels of letters, digits and inner
+// hyphens and a top level label that is not a number. IP addresses, ports,
+// paths and schemes are rejected, since domains end up in URLs the verifier
+// fetches.
+func NormalizeDomain(domain string) (string, error) {
+	d := strings.TrimSpace(domain)
+	d = strings.ToLower(d)
+	d = strings.TrimSuffix(d, ".")
+
+	invalid := invalidField("domain", "fqdn", "domain must be a host name like example.com")
+	if d == "" || len(d) > 128 || net.ParseIP(d) != nil {
+		return "", invalid
+	}
+
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 {
+		return "", invalid
+	}
+
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", invalid
+		}
+
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return "", invalid
+			}
+		}
+	}
+
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", invalid
+	}
+
+	return d, nil
+}
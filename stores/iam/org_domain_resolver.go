@@ -0,0 +1,255 @@
+package iam
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrSignUpBlocked    = errors.New("sign-up is disabled for this email domain; ask your organization for an invitation")
+	ErrEmailNotVerified = errors.New("the email address must be verified first")
+)
+
+const (
+	DomainAssignNone            = "none"
+	DomainAssignJoined          = "joined"
+	DomainAssignPendingApproval = "pending_approval"
+)
+
+type DomainResolverOptions struct {
+	// AllowUnverifiedDomains lets domains an org has not verified take part
+	// in matching. Without verification any org could claim any domain, so
+	// this is only meant for development.
+	AllowUnverifiedDomains bool
+}
+
+func DefaultDomainResolverOptions() DomainResolverOptions {
+	return DomainResolverOptions{}
+}
+
+// DomainMatch is the org whose domain covers an email address.
+type DomainMatch struct {
+	Org    *OrgTable
+	Domain *OrgDomain
+}
+
+// DomainAssignment is the outcome of OrgDomainResolver.Assign. Member is set
+// when the user joined the org and Request when approval is pending.
+type DomainAssignment struct {
+	Status  string
+	Org     *OrgTable
+	Member  *OrgMemberTable
+	Request *OrgJoinRequestTable
+}
+
+// OrgDomainResolver maps email addresses to orgs through the orgs' domains
+// and applies each org's join policy to new users.
+type OrgDomainResolver struct {
+	db      *IamDb
+	Options DomainResolverOptions
+	Members *MembershipStore
+}
+
+func NewOrgDomainResolver(db *IamDb, options *DomainResolverOptions) *OrgDomainResolver {
+	o := DefaultDomainResolverOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &OrgDomainResolver{
+		db:      db,
+		Options: o,
+		Members: NewMembershipStore(db, nil),
+	}
+}
+
+// WithTx returns a copy of the resolver that works in the transaction of tx,
+// see IamDb.WithTx.
+func (r *OrgDomainResolver) WithTx(tx *IamDb) *OrgDomainResolver {
+	c := *r
+	c.db = tx
+
+	if r.Members != nil {
+		c.Members = r.Members.WithTx(tx)
+	}
+
+	return &c
+}
+
+// WithContext returns a copy of the resolver whose queries use ctx.
+func (r *OrgDomainResolver) WithContext(ctx context.Context) *OrgDomainResolver {
+	return r.WithTx(r.db.WithContext(ctx))
+}
+
+// Resolve returns the org that owns the domain of email, or nil. An exact
+// domain wins over a parent domain that includes subdomains, and a closer
+// parent wins over a more distant one.
+func (r *OrgDomainResolver) Resolve(email string) (*DomainMatch, error) {
+	domain := emailDomain(email)
+	if domain == "" {
+		return nil, nil
+	}
+
+	candidates := []string{domain}
+	for d := domain; strings.Contains(d, "."); {
+		d = d[strings.Index(d, ".")+1:]
+		candidates = append(candidates, d)
+	}
+
+	q := r.db.Model(&OrgDomain{}).
+		Joins("JOIN orgs ON orgs.id = org_domains.org_id AND orgs.deleted_at IS NULL").
+		Where("org_domains.domain IN ?", candidates)
+	if !r.Options.AllowUnverifiedDomains {
+		q = q.Where("org_domains.verified_at IS NOT NULL")
+	}
+
+	domains := []OrgDomain{}
+	err := q.Find(&domains).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var best *OrgDomain
+	for i := range domains {
+		d := &domains[i]
+		if d.Matches(domain) && (best == nil || len(d.Domain) > len(best.Domain)) {
+			best = d
+		}
+	}
+
+	if best == nil {
+		return nil, nil
+	}
+
+	org := &OrgTable{}
+	err = r.db.Where("id = ?", best.OrgId).First(org).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &DomainMatch{Org: org, Domain: best}, nil
+}
+
+// CheckSignUp returns ErrSignUpBlocked when email belongs to an org that
+// only admits invited users.
+func (r *OrgDomainResolver) CheckSignUp(email string) error {
+	match, err := r.Resolve(email)
+	if err != nil {
+		return err
+	}
+
+	if match != nil && match.Org.GetJoinPolicy() == OrgJoinPolicyBlock {
+		return ErrSignUpBlocked
+	}
+
+	return nil
+}
+
+// Assign applies the join policy of the org matching the user's email. It is
+// meant to run once the email is verified, since until then anyone could
+// claim an address at the org's domain.
+func (r *OrgDomainResolver) Assign(userId int32) (*DomainAssignment, error) {
+	user, err := r.db.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	match, err := r.Resolve(user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DomainAssignment{Status: DomainAssignNone}
+	if match == nil {
+		return result, nil
+	}
+
+	result.Org = match.Org
+
+	switch match.Org.GetJoinPolicy() {
+	case OrgJoinPolicyAuto:
+		member, err := r.Members.AddMember(match.Org.Id, user.Id, OrgMemberRoleMember)
+		if errors.Is(err, ErrAlreadyMember) {
+			member, err = r.Members.GetMember(match.Org.Id, user.Id)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		result.Status = DomainAssignJoined
+		result.Member = member
+	case OrgJoinPolicyApproval:
+		request, err := r.Members.RequestToJoin(match.Org.Id, user.Id)
+		if errors.Is(err, ErrAlreadyMember) {
+			member, err := r.Members.GetMember(match.Org.Id, user.Id)
+			if err != nil {
+				return nil, err
+			}
+
+			result.Status = DomainAssignJoined
+			result.Member = member
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		result.Status = DomainAssignPendingApproval
+		result.Request = request
+	}
+
+	return result, nil
+}
+
+// SetJoinPolicy changes the join policy of the org with the given id.
+func (r *OrgDomainResolver) SetJoinPolicy(orgId int32, policy string) error {
+	switch policy {
+	case OrgJoinPolicyNone, OrgJoinPolicyAuto, OrgJoinPolicyApproval, OrgJoinPolicyBlock:
+	default:
+		return invalidField("joinPolicy", "oneof", "join policy must be none, auto, approval or block")
+	}
+
+	return r.db.Model(&OrgTable{}).Where("id = ?", orgId).Updates(map[string]interface{}{
+		"join_policy":       policy,
+		"concurrency_stamp": uuid.NewString(),
+	}).Error
+}
+
+// SetIncludeSubdomains controls whether the org's domain also matches its
+// subdomains.
+func (r *OrgDomainResolver) SetIncludeSubdomains(orgId int32, domain string, include bool) error {
+	d := strings.TrimSpace(domain)
+	d = strings.ToLower(d)
+
+	res := r.db.Model(&OrgDomain{}).
+		Where("org_id = ? AND domain = ?", orgId, d).
+		Update("include_subdomains", include)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return notFound("org domain")
+	}
+
+	return nil
+}
+
+func emailDomain(email string) string {
+	e := strings.TrimSpace(email)
+	e = strings.ToLower(e)
+
+	at := strings.LastIndex(e, "@")
+	if at < 0 {
+		return ""
+	}
+
+	return strings.TrimSuffix(e[at+1:], ".")
+}
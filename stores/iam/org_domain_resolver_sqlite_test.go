@@ -0,0 +1,94 @@
+package iam_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestOrgDomainResolver(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+	acme := newTestOrg(t, db, "Acme")
+	labs := newTestOrg(t, db, "Acme Labs")
+	closed := newTestOrg(t, db, "Closed")
+
+	orgs := iam.NewOrgStore(db.DB, nil)
+	assert.NoError(orgs.AddDomain(acme.Uid.String(), "acme.test"))
+	assert.NoError(orgs.AddDomain(labs.Uid.String(), "labs.acme.test"))
+	assert.NoError(orgs.AddDomain(closed.Uid.String(), "closed.test"))
+
+	resolver := iam.NewOrgDomainResolver(db, nil)
+
+	// unverified domains are ignored
+	match, err := resolver.Resolve("ann@acme.test")
+	assert.NoError(err)
+	assert.Nil(match)
+
+	assert.NoError(db.Model(&iam.OrgDomain{}).Where("1 = 1").Update("verified_at", time.Now()).Error)
+
+	match, err = resolver.Resolve(" Ann@ACME.test ")
+	assert.NoError(err)
+	assert.Equal(acme.Id, match.Org.Id)
+
+	match, _ = resolver.Resolve("ann@eng.acme.test")
+	assert.Nil(match)
+
+	assert.NoError(resolver.SetIncludeSubdomains(acme.Id, "acme.test", true))
+	match, _ = resolver.Resolve("ann@eng.acme.test")
+	assert.Equal(acme.Id, match.Org.Id)
+
+	// the closest domain wins
+	match, _ = resolver.Resolve("ann@labs.acme.test")
+	assert.Equal(labs.Id, match.Org.Id)
+	match, _ = resolver.Resolve("ann@notacme.test")
+	assert.Nil(match)
+
+	assert.NoError(resolver.SetJoinPolicy(closed.Id, iam.OrgJoinPolicyBlock))
+	assert.ErrorIs(resolver.CheckSignUp("zed@closed.test"), iam.ErrSignUpBlocked)
+	assert.NoError(resolver.CheckSignUp("zed@acme.test"))
+
+	assert.NoError(resolver.SetJoinPolicy(acme.Id, iam.OrgJoinPolicyAuto))
+	assert.NoError(resolver.SetJoinPolicy(labs.Id, iam.OrgJoinPolicyApproval))
+
+	ann, _ := db.NewUser("ann", "ann@eng.acme.test")
+	_, err = resolver.Assign(ann.Id)
+	assert.ErrorIs(err, iam.ErrEmailNotVerified)
+
+	ann.EmailVerified = true
+	assert.NoError(ann.Save(db))
+	result, err := resolver.Assign(ann.Id)
+	assert.NoError(err)
+	assert.Equal(iam.DomainAssignJoined, result.Status)
+	assert.Equal(acme.Id, result.Member.OrgId)
+
+	bob, _ := db.NewUser("bob", "bob@labs.acme.test")
+	bob.EmailVerified = true
+	assert.NoError(bob.Save(db))
+	result, err = resolver.Assign(bob.Id)
+	assert.NoError(err)
+	assert.Equal(iam.DomainAssignPendingApproval, result.Status)
+
+	again, err := resolver.Assign(bob.Id)
+	assert.NoError(err)
+	assert.Equal(result.Request.Id, again.Request.Id)
+
+	members := resolver.Members
+	requests, err := members.PendingJoinRequests(labs.Id)
+	assert.NoError(err)
+	assert.Len(requests, 1)
+	assert.Equal("bob", requests[0].User.Name)
+
+	approver := sql.NullInt32{Int32: ann.Id, Valid: true}
+	member, err := members.ApproveJoinRequest(requests[0].Id, approver)
+	assert.NoError(err)
+	assert.Equal(labs.Id, member.OrgId)
+	assert.ErrorIs(members.RejectJoinRequest(requests[0].Id, approver), iam.ErrJoinRequestInvalid)
+
+	result, err = resolver.Assign(bob.Id)
+	assert.NoError(err)
+	assert.Equal(iam.DomainAssignJoined, result.Status)
+}
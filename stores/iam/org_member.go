@@ -0,0 +1,86 @@
+package iam
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	OrgMemberRoleOwner  = "owner"
+	OrgMemberRoleAdmin  = "admin"
+	OrgMemberRoleMember = "member"
+)
+
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationDeclined = "declined"
+	InvitationRevoked  = "revoked"
+)
+
+// OrgMemberTable links a user to an org they belong to. A user can be a
+// member of any number of orgs; UserTable.OrgId only records the primary one.
+type OrgMemberTable struct {
+	Id       int32      `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	OrgId    int32      `gorm:"column:org_id;index:ix_org_members_org_id_user_id,unique,priority:1" json:"organizationId"`
+	UserId   int32      `gorm:"column:user_id;index:ix_org_members_org_id_user_id,unique,priority:2;index:ix_org_members_user_id" json:"userId"`
+	Role     string     `gorm:"column:role;size:32" json:"role"`
+	JoinedAt time.Time  `gorm:"column:joined_at" json:"joinedAt"`
+	User     *UserTable `gorm:"foreignKey:UserId;references:Id" json:"user,omitempty"`
+	Org      *OrgTable  `gorm:"foreignKey:OrgId;references:Id" json:"organization,omitempty"`
+}
+
+func (OrgMemberTable) TableName() string {
+	return "org_members"
+}
+
+// OrgInvitationTable is an invitation for an email address to join an org.
+// Only the hash of the invitation token is stored.
+type OrgInvitationTable struct {
+	Id          int32         `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid         uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_org_invitations_uid,unique" json:"uid"`
+	OrgId       int32         `gorm:"column:org_id;index:ix_org_invitations_org_id_email,priority:1" json:"organizationId"`
+	Email       string        `gorm:"column:email;size:128;index:ix_org_invitations_org_id_email,priority:2" json:"email"`
+	Role        string        `gorm:"column:role;size:32" json:"role"`
+	Status      string        `gorm:"column:status;size:16" json:"status"`
+	TokenHash   string        `gorm:"column:token_hash;size:128;index:ix_org_invitations_token_hash" json:"-"`
+	InvitedBy   sql.NullInt32 `gorm:"column:invited_by" json:"invitedBy"`
+	SentCount   int32         `gorm:"column:sent_count" json:"sentCount"`
+	LastSentAt  time.Time     `gorm:"column:last_sent_at" json:"lastSentAt"`
+	ExpiresAt   time.Time     `gorm:"column:expires_at" json:"expiresAt"`
+	RespondedAt sql.NullTime  `gorm:"column:responded_at" json:"respondedAt"`
+	CreatedAt   time.Time     `gorm:"column:created_at" json:"created_at"`
+}
+
+func (OrgInvitationTable) TableName() string {
+	return "org_invitations"
+}
+
+func (i *OrgInvitationTable) IsPendingAt(now time.Time) bool {
+	return i.Status == InvitationPending && now.Before(i.ExpiresAt)
+}
+
+const (
+	JoinRequestPending  = "pending"
+	JoinRequestApproved = "approved"
+	JoinRequestRejected = "rejected"
+)
+
+// OrgJoinRequestTable is a request by a user to join an org, waiting for an
+// org admin to approve or reject it.
+type OrgJoinRequestTable struct {
+	Id          int32         `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	OrgId       int32         `gorm:"column:org_id;index:ix_org_join_requests_org_id_status,priority:1" json:"organizationId"`
+	UserId      int32         `gorm:"column:user_id;index:ix_org_join_requests_user_id" json:"userId"`
+	Status      string        `gorm:"column:status;size:16;index:ix_org_join_requests_org_id_status,priority:2" json:"status"`
+	RespondedBy sql.NullInt32 `gorm:"column:responded_by" json:"respondedBy"`
+	RespondedAt sql.NullTime  `gorm:"column:responded_at" json:"respondedAt"`
+	CreatedAt   time.Time     `gorm:"column:created_at" json:"created_at"`
+	User        *UserTable    `gorm:"foreignKey:UserId;references:Id" json:"user,omitempty"`
+}
+
+func (OrgJoinRequestTable) TableName() string {
+	return "org_join_requests"
+}
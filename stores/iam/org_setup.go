@@ -0,0 +1,68 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+)
+
+// OrgAdmin is the first user of a new org.
+type OrgAdmin struct {
+	Name  string
+	Email string
+	// Password may be empty for admins who sign in with an external login.
+	Password string
+}
+
+// CreateOrgWithAdmin creates the org, its admin user and the named org roles
+// in one transaction. The admin becomes an owner of the org and is assigned
+// every role. When a step fails nothing is created.
+func (db *IamDb) CreateOrgWithAdmin(ctx context.Context, org *Org, admin OrgAdmin, roles ...string) (*UserTable, error) {
+	var user *UserTable
+	err := db.WithTx(ctx, func(tx *IamDb) error {
+		orgs := NewOrgStore(tx.DB, nil)
+		err := orgs.Create(org)
+		if err != nil {
+			return err
+		}
+
+		table, err := orgs.findTable(tx.DB, org.Id)
+		if err != nil {
+			return err
+		}
+
+		if admin.Password != "" {
+			user, err = tx.NewUserWithPassword(admin.Name, admin.Email, admin.Password)
+		} else {
+			user, err = tx.NewUser(admin.Name, admin.Email)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = NewMembershipStore(tx, nil).AddMember(table.Id, user.Id, OrgMemberRoleOwner)
+		if err != nil {
+			return err
+		}
+
+		orgId := sql.NullInt32{Int32: table.Id, Valid: true}
+		for _, name := range roles {
+			role, err := tx.NewRole(name, "", orgId)
+			if err != nil {
+				return err
+			}
+
+			err = tx.AssignRole(user.Id, role.Id)
+			if err != nil {
+				return err
+			}
+		}
+
+		user.OrgId = orgId
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,71 @@
+package iam_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestCreateOrgWithAdmin(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+	ctx := context.Background()
+
+	org := &iam.Org{Name: "Initech", Domains: []string{"initech.test"}}
+	admin, err := db.CreateOrgWithAdmin(ctx, org, iam.OrgAdmin{Name: "bill", Email: "bill@initech.test", Password: "Secr3t!pass"}, "admin", "billing")
+	assert.NoError(err)
+	assert.True(admin.OrgId.Valid)
+
+	roles, err := db.GetUserRoles(admin.Id, admin.OrgId)
+	assert.NoError(err)
+	assert.Len(roles, 2)
+
+	member, err := iam.NewMembershipStore(db, nil).GetMember(admin.OrgId.Int32, admin.Id)
+	assert.NoError(err)
+	assert.Equal(iam.OrgMemberRoleOwner, member.Role)
+
+	// the admin name is taken, so neither the org nor its roles are created
+	_, err = db.CreateOrgWithAdmin(ctx, &iam.Org{Name: "Initrode"}, iam.OrgAdmin{Name: "bill", Email: "bill@initrode.test"}, "admin")
+	assert.Error(err)
+
+	orgs := iam.NewOrgStore(db.DB, nil)
+	count, err := orgs.CountAll()
+	assert.NoError(err)
+	assert.Equal(int64(1), count)
+
+	var roleCount int64
+	assert.NoError(db.Model(&iam.RoleTable{}).Count(&roleCount).Error)
+	assert.Equal(int64(2), roleCount)
+
+	// stores moved onto the transaction roll back together
+	members := iam.NewMembershipStore(db, nil)
+	failed := errors.New("stop")
+	err = db.WithTx(ctx, func(tx *iam.IamDb) error {
+		user, err := tx.NewUser("milton", "milton@initech.test")
+		if err != nil {
+			return err
+		}
+
+		_, err = members.WithTx(tx).AddMember(admin.OrgId.Int32, user.Id, iam.OrgMemberRoleMember)
+		if err != nil {
+			return err
+		}
+
+		return failed
+	})
+	assert.ErrorIs(err, failed)
+
+	users, err := members.GetMembers(admin.OrgId.Int32)
+	assert.NoError(err)
+	assert.Len(users, 1)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = orgs.WithContext(cancelled).CountAll()
+	assert.ErrorIs(err, context.Canceled)
+	_, err = db.CreateOrgWithAdmin(cancelled, &iam.Org{Name: "Chotchkie's"}, iam.OrgAdmin{Name: "joanna", Email: "joanna@test.org"})
+	assert.ErrorIs(err, context.Canceled)
+}
@@ -1,8 +1,8 @@
 package iam
 
 import (
-	"errors"
-	"fmt"
+	"context"
+	"database/sql"
 	"slices"
 	"strings"
 
@@ -11,6 +11,9 @@ import (
 	"gorm.io/gorm"
 )
 
+// ErrOrgDeleted is returned when saving an org that was soft deleted.
+var ErrOrgDeleted error = &ConflictError{Entity: "org", Message: "the org has been deleted; restore it first"}
+
 type OrgPair struct {
 	Id   string `json:"id"`
 	Name string `json:"name"`
@@ -21,14 +24,22 @@ type Org struct {
 	Name    string   `json:"name" validate:"required,max=64"`
 	Slug    string   `json:"slug" validate:"max=64"`
 	Domains []string `json:"domains"`
+	// ParentId is the id of the parent org, or empty for a root org. It is
+	// used by Create; use Move to change it later.
+	ParentId string `json:"parentId,omitempty"`
+	// JoinPolicy is one of the OrgJoinPolicy values. Empty leaves it as is.
+	JoinPolicy string `json:"joinPolicy" validate:"omitempty,oneof=none auto approval block"`
+	// ConcurrencyStamp is the stamp the org was read with. Save rejects the
+	// org with ErrConcurrencyConflict when it no longer matches.
+	ConcurrencyStamp string `json:"concurrencyStamp"`
 }
 
 func (org *Org) Validate(v *validator.Validate) error {
 	if v == nil {
-		return validator.New(validator.WithRequiredStructEnabled()).Struct(org)
+		return toValidationError(validator.New(validator.WithRequiredStructEnabled()).Struct(org))
 	}
 
-	return v.Struct(org)
+	return toValidationError(v.Struct(org))
 }
 
 type OrgStore struct {
@@ -47,12 +58,29 @@ func NewOrgStore(db *gorm.DB, v *validator.Validate) *OrgStore {
 	}
 }
 
+// WithTx returns a copy of the store that works in the transaction of tx,
+// see IamDb.WithTx.
+func (store *OrgStore) WithTx(tx *IamDb) *OrgStore {
+	c := *store
+	c.db = tx.DB
+	return &c
+}
+
+// WithContext returns a copy of the store whose queries use ctx.
+func (store *OrgStore) WithContext(ctx context.Context) *OrgStore {
+	c := *store
+	c.db = store.db.WithContext(ctx)
+	return &c
+}
+
+// DeleteByUid soft deletes the org. It stays restorable with RestoreByUid
+// until a Purger removes it along with its domains and roles.
 func (store *OrgStore) DeleteByUid(id string) (int64, error) {
 
 	err := uuid.Validate(id)
 
 	if err != nil {
-		return 0, fmt.Errorf("id must be a valid UUID")
+		return 0, ErrInvalidId
 	}
 
 	res := store.db.Delete(&OrgTable{}, "uid = ?", id)
@@ -63,6 +91,7 @@ func (store *OrgStore) DeleteByUid(id string) (int64, error) {
 	return res.RowsAffected, nil
 }
 
+// DeleteById soft deletes the org, like DeleteByUid.
 func (store *OrgStore) DeleteById(id int32) (int64, error) {
 
 	res := store.db.Delete(&OrgTable{}, "id = ?", id)
@@ -73,16 +102,69 @@ func (store *OrgStore) DeleteById(id int32) (int64, error) {
 	return res.RowsAffected, nil
 }
 
+// RestoreByUid undoes a soft delete. It returns zero when the org is not
+// deleted or has already been purged.
+func (store *OrgStore) RestoreByUid(id string) (int64, error) {
+
+	err := uuid.Validate(id)
+
+	if err != nil {
+		return 0, ErrInvalidId
+	}
+
+	res := store.db.Unscoped().Model(&OrgTable{}).
+		Where("uid = ? AND deleted_at IS NOT NULL", id).
+		Updates(map[string]interface{}{
+			"deleted_at":        nil,
+			"concurrency_stamp": uuid.NewString(),
+		})
+	if res.Error != nil {
+		return 0, res.Error
+	}
+
+	return res.RowsAffected, nil
+}
+
+// Deleted returns the soft deleted orgs that can still be restored.
+func (store *OrgStore) Deleted() ([]Org, error) {
+	tables := []OrgTable{}
+	res := store.db.Unscoped().Where("deleted_at IS NOT NULL").Order("deleted_at DESC").Find(&tables)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	orgs := make([]Org, 0)
+	for _, table := range tables {
+		orgs = append(orgs, table.ToOrg())
+	}
+
+	return orgs, nil
+}
+
+// Create validates the org with the store's validator and inserts it. It
+// returns a ValidationError for invalid orgs and a ConflictError when the
+// slug is taken.
 func (store *OrgStore) Create(org *Org) error {
+	err := org.Validate(store.Validator)
+	if err != nil {
+		return err
+	}
 
 	table := OrgTable{}
-	_, err := org.ToOrgTable(&table)
+	_, err = org.ToOrgTable(&table)
 	if err != nil {
 		return err
 	}
 
-	println(table.Name)
-	println(table.Slug)
+	if org.ParentId != "" {
+		parent, err := store.findTable(store.db, org.ParentId)
+		if err != nil {
+			return err
+		}
+
+		table.ParentId = sql.NullInt32{Int32: parent.Id, Valid: true}
+	}
+
 	err = store.db.Create(&table).Error
 	if err != nil {
 		return err
@@ -103,18 +185,23 @@ func (store *OrgStore) CountAll() (int64, error) {
 	return count, nil
 }
 
+// UpdateName sets the org's name without checking its concurrency stamp:
+// it writes that one column, so it cannot overwrite other changes, and the
+// last name written wins. The stamp is rotated, so a Save based on an
+// earlier read still fails with ErrConcurrencyConflict.
 func (store *OrgStore) UpdateName(uid string, name string) error {
 
 	id, err := uuid.Parse(uid)
 	if err != nil {
-		return fmt.Errorf("id must be a valid UUID")
+		return ErrInvalidId
 	}
 
 	n := strings.TrimSpace(name)
 	n = strings.ToLower(n)
 
 	values := map[string]interface{}{
-		"name": n,
+		"name":              n,
+		"concurrency_stamp": uuid.NewString(),
 	}
 
 	if n != name {
@@ -130,14 +217,19 @@ func (store *OrgStore) UpdateName(uid string, name string) error {
 	return nil
 }
 
+// UpdateSlug sets the org's slug; like UpdateName it only writes that
+// column and rotates the stamp without checking it.
 func (store *OrgStore) UpdateSlug(uid string, slug string) error {
 
 	id, err := uuid.Parse(uid)
 	if err != nil {
-		return fmt.Errorf("id must be a valid UUID")
+		return ErrInvalidId
 	}
 
-	res := store.db.Model(&OrgTable{}).Where("uid = ?", id).Update("slug", slug)
+	res := store.db.Model(&OrgTable{}).Where("uid = ?", id).Updates(map[string]interface{}{
+		"slug":              slug,
+		"concurrency_stamp": uuid.NewString(),
+	})
 	if res.Error != nil {
 		return res.Error
 	}
@@ -145,10 +237,13 @@ func (store *OrgStore) UpdateSlug(uid string, slug string) error {
 	return nil
 }
 
+// AddDomain adds the domain to the org. Like Save, it fails with
+// ErrConcurrencyConflict when the org changes between reading and writing
+// it, and rotates the org's stamp.
 func (store *OrgStore) AddDomain(uid string, domain string) error {
 	id, err := uuid.Parse(uid)
 	if err != nil {
-		return fmt.Errorf("id must be a valid UUID")
+		return ErrInvalidId
 	}
 
 	table := OrgTable{}
@@ -158,11 +253,13 @@ func (store *OrgStore) AddDomain(uid string, domain string) error {
 	}
 
 	if r.RowsAffected == 0 {
-		return errors.New("org not found")
+		return notFound("org")
 	}
 
-	d := strings.TrimSpace(domain)
-	d = strings.ToLower(d)
+	d, err := NormalizeDomain(domain)
+	if err != nil {
+		return err
+	}
 
 	if len(table.Domains) > 0 {
 		for _, domain := range table.Domains {
@@ -172,19 +269,24 @@ func (store *OrgStore) AddDomain(uid string, domain string) error {
 		}
 	}
 
-	table.Domains = append(table.Domains, OrgDomain{Domain: d})
-	err = store.db.Save(&table).Error
-	if err != nil {
-		return err
-	}
+	expected := table.stamp
+	table.ConcurrencyStamp = uuid.NewString()
+	return store.db.Transaction(func(tx *gorm.DB) error {
+		err := updateChecked(tx, &table, table.Id, expected)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return tx.Create(&OrgDomain{OrgId: table.Id, Domain: d}).Error
+	})
 }
 
+// RemoveDomain removes the domain from the org, checking and rotating the
+// stamp like AddDomain.
 func (store *OrgStore) RemoveDomain(uid string, domain string) error {
 	id, err := uuid.Parse(uid)
 	if err != nil {
-		return fmt.Errorf("id must be a valid UUID")
+		return ErrInvalidId
 	}
 
 	table := OrgTable{}
@@ -194,51 +296,137 @@ func (store *OrgStore) RemoveDomain(uid string, domain string) error {
 	}
 
 	if r.RowsAffected == 0 {
-		return errors.New("org not found")
+		return notFound("org")
 	}
 
 	d := strings.TrimSpace(domain)
 	d = strings.ToLower(d)
 
 	found := false
-	if len(table.Domains) > 0 {
-		for i, domain := range table.Domains {
-			if domain.Domain == d {
-				table.Domains = append(table.Domains[:i], table.Domains[i+1:]...)
-				found = true
-				break
-			}
+	for _, domain := range table.Domains {
+		if domain.Domain == d {
+			found = true
+			break
 		}
 	}
 
-	if found {
-		err = store.db.Save(&table).Error
+	if !found {
+		return nil
+	}
+
+	expected := table.stamp
+	table.ConcurrencyStamp = uuid.NewString()
+	return store.db.Transaction(func(tx *gorm.DB) error {
+		err := updateChecked(tx, &table, table.Id, expected)
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		return tx.Where("org_id = ? AND domain = ?", table.Id, d).Delete(&OrgDomain{}).Error
+	})
 }
 
+// Save updates the org with org.Id, or creates it when it does not exist.
+// The update only succeeds while the stored stamp matches org.ConcurrencyStamp
+// (or, when that is empty, the stamp read at the start of Save). Domains are
+// replaced with org.Domains unless it is nil. A soft deleted org must be
+// restored before it can be saved.
 func (store *OrgStore) Save(org *Org) error {
+	err := org.Validate(store.Validator)
+	if err != nil {
+		return err
+	}
+
 	table := OrgTable{}
-	res := store.db.Find(&table, "uid = ?", org.Id)
+	res := store.db.Unscoped().Find(&table, "uid = ?", org.Id)
 	if res.Error != nil {
 		return res.Error
 	}
 
-	_, err := org.ToOrgTable(&table)
+	if res.RowsAffected == 0 {
+		return store.Create(org)
+	}
+
+	if table.DeletedAt.Valid {
+		return ErrOrgDeleted
+	}
+
+	expected := table.stamp
+	if org.ConcurrencyStamp != "" {
+		expected = org.ConcurrencyStamp
+	}
+
+	_, err = org.ToOrgTable(&table)
 	if err != nil {
 		return err
 	}
 
-	err = store.db.Save(&table).Error
+	table.ConcurrencyStamp = uuid.NewString()
+	err = store.db.Transaction(func(tx *gorm.DB) error {
+		err := updateChecked(tx, &table, table.Id, expected)
+		if err != nil {
+			return err
+		}
+
+		if org.Domains == nil {
+			return nil
+		}
+
+		return replaceOrgDomains(tx, table.Id, org.Domains)
+	})
 	if err != nil {
 		return err
 	}
 
 	org.Id = table.Uid.String()
+	org.ConcurrencyStamp = table.ConcurrencyStamp
+
+	return nil
+}
+
+func replaceOrgDomains(tx *gorm.DB, orgId int32, domains []string) error {
+	wanted := []string{}
+	for _, domain := range domains {
+		if strings.TrimSpace(domain) == "" {
+			continue
+		}
+
+		d, err := NormalizeDomain(domain)
+		if err != nil {
+			return err
+		}
+
+		if !slices.Contains(wanted, d) {
+			wanted = append(wanted, d)
+		}
+	}
+
+	q := tx.Where("org_id = ?", orgId)
+	if len(wanted) > 0 {
+		q = q.Where("domain NOT IN ?", wanted)
+	}
+
+	err := q.Delete(&OrgDomain{}).Error
+	if err != nil {
+		return err
+	}
+
+	existing := []string{}
+	err = tx.Model(&OrgDomain{}).Where("org_id = ?", orgId).Pluck("domain", &existing).Error
+	if err != nil {
+		return err
+	}
+
+	for _, d := range wanted {
+		if slices.Contains(existing, d) {
+			continue
+		}
+
+		err = tx.Create(&OrgDomain{OrgId: orgId, Domain: d}).Error
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -258,9 +446,47 @@ func (store *OrgStore) AllPairs() ([]OrgPair, error) {
 	return orgs, nil
 }
 
+// OrgPager sorts org lists on name or slug; ties are broken by id. Lists
+// are filtered with OrgFilter.
+var OrgPager = Pager{
+	Fields: map[string]string{
+		"name": "name",
+		"slug": "slug",
+	},
+	Default: []SortField{{Field: "name"}},
+	Filter:  &OrgFilter,
+}
+
+// List returns a page of orgs sorted by q.Sort. Pass the Next cursor of a
+// page to get the one after it.
+func (store *OrgStore) List(q *PageQuery, expand ...string) (*PageResult[Org], error) {
+	tx := store.db
+	if slices.Contains(expand, "domains") {
+		tx = tx.Preload("Domains")
+	}
+
+	page, err := Paginate[OrgTable](tx, &OrgPager, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return MapPage(page, func(table OrgTable) Org { return table.ToOrg() }), nil
+}
+
+// ListPairs returns a page of org ids and names sorted by q.Sort.
+func (store *OrgStore) ListPairs(q *PageQuery) (*PageResult[OrgPair], error) {
+	page, err := Paginate[OrgTable](store.db, &OrgPager, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return MapPage(page, func(table OrgTable) OrgPair { return table.ToOrgPair() }), nil
+}
+
+// Deprecated: offset pages shift as orgs are added or removed; use ListPairs.
 func (store *OrgStore) PagePairs(page int, size int) ([]OrgPair, error) {
 	tables := []OrgTable{}
-	res := store.db.Offset(page * size).Limit(size).Find(&tables)
+	res := store.db.Order("id").Offset(page * size).Limit(size).Find(&tables)
 	if res.Error != nil {
 		return nil, res.Error
 	}
@@ -296,16 +522,17 @@ func (store *OrgStore) All(expand ...string) ([]Org, error) {
 	return orgs, nil
 }
 
+// Deprecated: offset pages shift as orgs are added or removed; use List.
 func (store *OrgStore) Page(page int, size int, expand bool) ([]Org, error) {
 	tables := []OrgTable{}
 
 	if expand {
-		res := store.db.Joins("Domain").Offset(page * size).Limit(size).Find(&tables)
+		res := store.db.Joins("Domain").Order("orgs.id").Offset(page * size).Limit(size).Find(&tables)
 		if res.Error != nil {
 			return nil, res.Error
 		}
 	} else {
-		res := store.db.Offset(page * size).Limit(size).Find(&tables)
+		res := store.db.Order("id").Offset(page * size).Limit(size).Find(&tables)
 		if res.Error != nil {
 			return nil, res.Error
 		}
@@ -324,28 +551,28 @@ func (store *OrgStore) FindByUid(id string, expand ...string) (*Org, error) {
 	err := uuid.Validate(id)
 
 	if err != nil {
-		return nil, fmt.Errorf("id must be a valid UUID")
+		return nil, ErrInvalidId
 	}
 
 	table := OrgTable{}
 	if len(expand) > 0 && slices.Contains(expand, "domains") {
-		res := store.db.Model(&OrgTable{}).Preload("Domains").First(&table, "uid = ?", id)
+		res := store.db.Model(&OrgTable{}).Preload("Domains").Preload("Parent").First(&table, "uid = ?", id)
 		if res.Error != nil {
 			return nil, res.Error
 		}
 
 		if res.RowsAffected == 0 {
-			return nil, errors.New("org not found")
+			return nil, notFound("org")
 		}
 
 	} else {
-		res := store.db.First(&table, "uid = ?", id)
+		res := store.db.Preload("Parent").First(&table, "uid = ?", id)
 		if res.Error != nil {
 			return nil, res.Error
 		}
 
 		if res.RowsAffected == 0 {
-			return nil, errors.New("org not found")
+			return nil, notFound("org")
 		}
 	}
 
@@ -358,23 +585,23 @@ func (store *OrgStore) FindById(id int32, expand ...string) (*Org, error) {
 
 	table := OrgTable{}
 	if len(expand) > 0 && slices.Contains(expand, "domains") {
-		res := store.db.Model(&OrgTable{}).Preload("Domains").First(&table, "id = ?", id)
+		res := store.db.Model(&OrgTable{}).Preload("Domains").Preload("Parent").First(&table, "id = ?", id)
 		if res.Error != nil {
 			return nil, res.Error
 		}
 
 		if res.RowsAffected == 0 {
-			return nil, errors.New("org not found")
+			return nil, notFound("org")
 		}
 
 	} else {
-		res := store.db.First(&table, "id = ?", id)
+		res := store.db.Preload("Parent").First(&table, "id = ?", id)
 		if res.Error != nil {
 			return nil, res.Error
 		}
 
 		if res.RowsAffected == 0 {
-			return nil, errors.New("org not found")
+			return nil, notFound("org")
 		}
 	}
 
@@ -387,23 +614,23 @@ func (store *OrgStore) FindBySlug(slug string, expand ...string) (*Org, error) {
 
 	table := OrgTable{}
 	if len(expand) > 0 && slices.Contains(expand, "domains") {
-		res := store.db.Model(&OrgTable{}).Preload("Domains").First(&table, "slug = ?", slug)
+		res := store.db.Model(&OrgTable{}).Preload("Domains").Preload("Parent").First(&table, "slug = ?", slug)
 		if res.Error != nil {
 			return nil, res.Error
 		}
 
 		if res.RowsAffected == 0 {
-			return nil, errors.New("org not found")
+			return nil, notFound("org")
 		}
 
 	} else {
-		res := store.db.First(&table, "slug = ?", slug)
+		res := store.db.Preload("Parent").First(&table, "slug = ?", slug)
 		if res.Error != nil {
 			return nil, res.Error
 		}
 
 		if res.RowsAffected == 0 {
-			return nil, errors.New("org not found")
+			return nil, notFound("org")
 		}
 	}
 
@@ -418,23 +645,23 @@ func (store *OrgStore) FindByName(name string, expand ...string) (*Org, error) {
 	name = strings.ToLower(name)
 	table := OrgTable{}
 	if len(expand) > 0 && slices.Contains(expand, "domains") {
-		res := store.db.Model(&OrgTable{}).Preload("Domains").First(&table, "name = ?", name)
+		res := store.db.Model(&OrgTable{}).Preload("Domains").Preload("Parent").First(&table, "name = ?", name)
 		if res.Error != nil {
 			return nil, res.Error
 		}
 
 		if res.RowsAffected == 0 {
-			return nil, errors.New("org not found")
+			return nil, notFound("org")
 		}
 
 	} else {
-		res := store.db.First(&table, "name = ?", name)
+		res := store.db.Preload("Parent").First(&table, "name = ?", name)
 		if res.Error != nil {
 			return nil, res.Error
 		}
 
 		if res.RowsAffected == 0 {
-			return nil, errors.New("org not found")
+			return nil, notFound("org")
 		}
 	}
 
@@ -0,0 +1,183 @@
+package iam
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrOrgCycle = errors.New("an org cannot be moved below itself or one of its descendants")
+
+// Move makes the org a child of parentUid, or a root org when parentUid is
+// empty. The org's whole subtree moves with it. Both orgs are locked while
+// the move runs, and on databases without row locks the move fails with
+// ErrConcurrencyConflict when either org moved since it was read, so two
+// concurrent moves cannot make a cycle.
+func (store *OrgStore) Move(uid string, parentUid string) error {
+	return store.db.Transaction(func(tx *gorm.DB) error {
+		org, err := store.findTable(tx.Clauses(clause.Locking{Strength: "UPDATE"}), uid)
+		if err != nil {
+			return err
+		}
+
+		var parent *OrgTable
+		parentId := sql.NullInt32{}
+		parentPath := "/"
+		if parentUid != "" {
+			parent, err = store.findTable(tx.Clauses(clause.Locking{Strength: "UPDATE"}), parentUid)
+			if err != nil {
+				return err
+			}
+
+			if strings.HasPrefix(parent.GetPath(), org.GetPath()) {
+				return ErrOrgCycle
+			}
+
+			parentId = sql.NullInt32{Int32: parent.Id, Valid: true}
+			parentPath = parent.GetPath()
+		}
+
+		oldPath := org.GetPath()
+		newPath := fmt.Sprintf("%s%d/", parentPath, org.Id)
+
+		q := tx.Model(&OrgTable{}).Where("id = ? AND COALESCE(path, '') = ?", org.Id, org.Path)
+		if parent != nil {
+			q = q.Where("EXISTS (SELECT 1 FROM orgs WHERE id = ? AND COALESCE(path, '') = ?)", parent.Id, parent.Path)
+		}
+
+		res := q.Updates(map[string]interface{}{
+			"parent_id":         parentId,
+			"path":              newPath,
+			"concurrency_stamp": uuid.NewString(),
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return ErrConcurrencyConflict
+		}
+
+		// deleted descendants move too so that they can still be restored
+		return tx.Unscoped().Model(&OrgTable{}).
+			Where("path LIKE ? AND id <> ?", oldPath+"%", org.Id).
+			UpdateColumn("path", gorm.Expr("? || SUBSTR(path, ?)", newPath, len(oldPath)+1)).Error
+	})
+}
+
+// Children returns the direct children of the org.
+func (store *OrgStore) Children(uid string) ([]Org, error) {
+	org, err := store.findTable(store.db, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := []OrgTable{}
+	err = store.db.Where("parent_id = ?", org.Id).Order("name").Find(&tables).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return toOrgsWithParent(tables, org), nil
+}
+
+// Descendants returns every org below the org, parents before their
+// children.
+func (store *OrgStore) Descendants(uid string) ([]Org, error) {
+	org, err := store.findTable(store.db, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := []OrgTable{}
+	err = store.db.Preload("Parent").
+		Where("path LIKE ? AND id <> ?", org.GetPath()+"%", org.Id).
+		Order("path").
+		Find(&tables).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return toOrgsWithParent(tables, nil), nil
+}
+
+// Ancestors returns the orgs above the org, starting at the root.
+func (store *OrgStore) Ancestors(uid string) ([]Org, error) {
+	org, err := store.findTable(store.db, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := org.AncestorIds()
+	if len(ids) == 0 {
+		return []Org{}, nil
+	}
+
+	tables := []OrgTable{}
+	err = store.db.Unscoped().Preload("Parent").Where("id IN ?", ids).Find(&tables).Error
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(tables, func(a, b OrgTable) int {
+		return len(a.GetPath()) - len(b.GetPath())
+	})
+
+	return toOrgsWithParent(tables, nil), nil
+}
+
+func (store *OrgStore) findTable(tx *gorm.DB, uid string) (*OrgTable, error) {
+	id, err := uuid.Parse(uid)
+	if err != nil {
+		return nil, ErrInvalidId
+	}
+
+	table := &OrgTable{}
+	res := tx.Where("uid = ?", id).Limit(1).Find(table)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, notFound("org")
+	}
+
+	return table, nil
+}
+
+func toOrgsWithParent(tables []OrgTable, parent *OrgTable) []Org {
+	orgs := make([]Org, 0, len(tables))
+	for _, table := range tables {
+		if parent != nil {
+			table.Parent = parent
+		}
+
+		orgs = append(orgs, table.ToOrg())
+	}
+
+	return orgs
+}
+
+// orgLineage returns the id of the org followed by the ids of its ancestors,
+// nearest first.
+func orgLineage(tx *gorm.DB, orgId int32) ([]int32, error) {
+	org := OrgTable{}
+	res := tx.Select("id", "path").Limit(1).Find(&org, "id = ?", orgId)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return []int32{orgId}, nil
+	}
+
+	ids := pathIds(org.GetPath())
+	slices.Reverse(ids)
+	return ids, nil
+}
@@ -0,0 +1,153 @@
+package iam_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestOrgTree(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+	store := iam.NewOrgStore(db.DB, nil)
+
+	umbrella := &iam.Org{Name: "Umbrella"}
+	assert.NoError(store.Create(umbrella))
+	research := &iam.Org{Name: "Research", ParentId: umbrella.Id}
+	assert.NoError(store.Create(research))
+	labs := &iam.Org{Name: "Labs", ParentId: research.Id}
+	assert.NoError(store.Create(labs))
+	security := &iam.Org{Name: "Security", ParentId: umbrella.Id}
+	assert.NoError(store.Create(security))
+
+	found, err := store.FindByUid(labs.Id)
+	assert.NoError(err)
+	assert.Equal(research.Id, found.ParentId)
+
+	names := func(orgs []iam.Org) []string {
+		n := []string{}
+		for _, o := range orgs {
+			n = append(n, o.Name)
+		}
+		return n
+	}
+
+	children, err := store.Children(umbrella.Id)
+	assert.NoError(err)
+	assert.Equal([]string{"Research", "Security"}, names(children))
+
+	descendants, err := store.Descendants(umbrella.Id)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"Research", "Labs", "Security"}, names(descendants))
+
+	ancestors, err := store.Ancestors(labs.Id)
+	assert.NoError(err)
+	assert.Equal([]string{"Umbrella", "Research"}, names(ancestors))
+
+	assert.ErrorIs(store.Move(research.Id, labs.Id), iam.ErrOrgCycle)
+	assert.ErrorIs(store.Move(research.Id, research.Id), iam.ErrOrgCycle)
+
+	assert.NoError(store.Move(research.Id, security.Id))
+	ancestors, _ = store.Ancestors(labs.Id)
+	assert.Equal([]string{"Umbrella", "Security", "Research"}, names(ancestors))
+
+	assert.NoError(store.Move(security.Id, ""))
+	ancestors, _ = store.Ancestors(labs.Id)
+	assert.Equal([]string{"Security", "Research"}, names(ancestors))
+	descendants, _ = store.Descendants(umbrella.Id)
+	assert.Empty(descendants)
+
+	// roles and admin rights held in a parent org carry down to its children
+	securityOrg := iam.OrgTable{}
+	labsOrg := iam.OrgTable{}
+	assert.NoError(db.First(&securityOrg, "uid = ?", security.Id).Error)
+	assert.NoError(db.First(&labsOrg, "uid = ?", labs.Id).Error)
+
+	user, _ := db.NewUser("wes", "wes@test.org")
+	role, err := db.NewRole("auditor", "", sql.NullInt32{Int32: securityOrg.Id, Valid: true})
+	assert.NoError(err)
+	assert.NoError(db.AssignRole(user.Id, role.Id))
+
+	ok, err := db.UserHasRole(user.Id, sql.NullInt32{Int32: labsOrg.Id, Valid: true}, "auditor")
+	assert.NoError(err)
+	assert.True(ok)
+
+	umbrellaOrg := iam.OrgTable{}
+	assert.NoError(db.First(&umbrellaOrg, "uid = ?", umbrella.Id).Error)
+	ok, _ = db.UserHasRole(user.Id, sql.NullInt32{Int32: umbrellaOrg.Id, Valid: true}, "auditor")
+	assert.False(ok)
+
+	members := iam.NewMembershipStore(db, nil)
+	_, err = members.AddMember(securityOrg.Id, user.Id, iam.OrgMemberRoleAdmin)
+	assert.NoError(err)
+	_, err = members.AddMember(labsOrg.Id, user.Id, iam.OrgMemberRoleMember)
+	assert.NoError(err)
+
+	role2, err := members.EffectiveRole(labsOrg.Id, user.Id)
+	assert.NoError(err)
+	assert.Equal(iam.OrgMemberRoleAdmin, role2)
+	role2, _ = members.EffectiveRole(umbrellaOrg.Id, user.Id)
+	assert.Equal("", role2)
+
+	// purging a middle org moves its children up
+	_, err = store.DeleteByUid(research.Id)
+	assert.NoError(err)
+	purger := iam.NewPurger(db, nil)
+	purger.Now = func() time.Time { return time.Now().Add(31 * 24 * time.Hour) }
+	_, err = purger.PurgeOrgs()
+	assert.NoError(err)
+
+	ancestors, _ = store.Ancestors(labs.Id)
+	assert.Equal([]string{"Security"}, names(ancestors))
+	found, _ = store.FindByUid(labs.Id)
+	assert.Equal(security.Id, found.ParentId)
+}
+
+func TestOrgTreeConcurrentMoves(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+	store := iam.NewOrgStore(db.DB, nil)
+
+	alpha := &iam.Org{Name: "Alpha"}
+	assert.NoError(store.Create(alpha))
+	beta := &iam.Org{Name: "Beta"}
+	assert.NoError(store.Create(beta))
+
+	// race moves beta below alpha once the move of alpha below beta has
+	// read both orgs; sqlite has no row locks to hold it back
+	reads := 0
+	var race func(tx *gorm.DB)
+	err := db.Callback().Query().After("gorm:query").Register("test:race", func(tx *gorm.DB) {
+		if tx.Statement.Table != "orgs" || race == nil {
+			return
+		}
+
+		reads++
+		if reads == 2 {
+			r := race
+			race = nil
+			r(tx)
+		}
+	})
+	assert.NoError(err)
+
+	race = func(tx *gorm.DB) {
+		other := iam.NewOrgStore(tx.Session(&gorm.Session{NewDB: true}), nil)
+		assert.NoError(other.Move(beta.Id, alpha.Id))
+	}
+	assert.ErrorIs(store.Move(alpha.Id, beta.Id), iam.ErrConcurrencyConflict)
+
+	// alpha did not end up below beta, its own child at that point
+	ancestors, err := store.Ancestors(alpha.Id)
+	assert.NoError(err)
+	assert.Empty(ancestors)
+
+	assert.NoError(store.Move(alpha.Id, beta.Id))
+	ancestors, err = store.Ancestors(alpha.Id)
+	assert.NoError(err)
+	assert.Len(ancestors, 1)
+}
@@ -0,0 +1,318 @@
+package iam
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+var ErrInvalidCursor error = invalidField("cursor", "cursor", "the cursor is not valid for this list or sort")
+
+// SortField is one column of a sort, by its api name.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// PageQuery asks for one page of a list.
+type PageQuery struct {
+	// Size is the number of items; zero uses the pager default.
+	Size int
+	// Cursor is the Next cursor of the previous page, or empty for the first.
+	Cursor string
+	// Sort is a comma separated list of api field names, each optionally
+	// prefixed with - for descending, e.g. "name,-createdAt".
+	Sort string
+	// Filters are filter expressions, see Filter, on the fields of the
+	// pager's Filter. Each is parsed on its own and all must match.
+	Filters []string
+	// Total also counts every item of the list.
+	Total bool
+}
+
+// PageResult is one page of a list. Next is empty on the last page.
+type PageResult[T any] struct {
+	Items []T
+	Next  string
+	// Total is set when the query asked for it.
+	Total *int64
+}
+
+// Pager describes how a list may be sorted and pages it by keyset, so pages
+// stay stable while rows are inserted or deleted and deep pages cost the
+// same as the first one.
+type Pager struct {
+	// Fields maps the api field names that may be sorted on to columns. Sort
+	// columns should not be nullable; rows with nulls are skipped.
+	Fields map[string]string
+	// Default is the sort when the query has none.
+	Default []SortField
+	// Key is the unique column appended to every sort so that the order is
+	// total. It defaults to id.
+	Key string
+	// Filter lists the fields a query may filter on; nil allows no filter.
+	Filter      *Filter
+	DefaultSize int
+	MaxSize     int
+}
+
+type pageCursor struct {
+	Sort   string            `json:"s"`
+	Values []json.RawMessage `json:"v"`
+}
+
+// ParseSort parses a sort like "name,-createdAt" against the pager fields.
+func (p *Pager) ParseSort(sort string) ([]SortField, error) {
+	fields := []SortField{}
+	for _, part := range strings.Split(sort, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		f := SortField{Field: part}
+		if strings.HasPrefix(part, "-") {
+			f = SortField{Field: part[1:], Desc: true}
+		} else if strings.HasPrefix(part, "+") {
+			f.Field = part[1:]
+		}
+
+		if _, ok := p.Fields[f.Field]; !ok {
+			return nil, invalidField("sort", "oneof", fmt.Sprintf("cannot sort on %q", f.Field))
+		}
+
+		fields = append(fields, f)
+	}
+
+	if len(fields) == 0 {
+		return p.Default, nil
+	}
+
+	return fields, nil
+}
+
+type pageColumn struct {
+	column string
+	desc   bool
+}
+
+func (p *Pager) columns(sort []SortField) []pageColumn {
+	key := p.Key
+	if key == "" {
+		key = "id"
+	}
+
+	columns := []pageColumn{}
+	for _, f := range sort {
+		column := p.Fields[f.Field]
+		columns = append(columns, pageColumn{column: column, desc: f.Desc})
+		if column == key {
+			return columns
+		}
+	}
+
+	return append(columns, pageColumn{column: key})
+}
+
+func (p *Pager) size(size int) int {
+	limit := p.MaxSize
+	if limit <= 0 {
+		limit = 500
+	}
+
+	if size <= 0 {
+		size = p.DefaultSize
+		if size <= 0 {
+			size = 50
+		}
+	}
+
+	if size > limit {
+		return limit
+	}
+
+	return size
+}
+
+// Paginate runs the query tx, which may already be filtered, for the page q
+// asks for. T is the model of the query.
+func Paginate[T any](tx *gorm.DB, p *Pager, q *PageQuery) (*PageResult[T], error) {
+	if q == nil {
+		q = &PageQuery{}
+	}
+
+	sort, err := p.ParseSort(q.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, filter := range q.Filters {
+		if p.Filter == nil {
+			return nil, invalidField("filter", "none", "the list cannot be filtered")
+		}
+
+		tx, err = p.Filter.Apply(tx, filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	columns := p.columns(sort)
+	signature := sortSignature(columns)
+
+	stmt := &gorm.Statement{DB: tx}
+	err = stmt.Parse(new(T))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]*schema.Field, 0, len(columns))
+	for _, c := range columns {
+		f := stmt.Schema.LookUpField(c.column)
+		if f == nil {
+			return nil, fmt.Errorf("%s has no column %s", stmt.Schema.Table, c.column)
+		}
+
+		fields = append(fields, f)
+	}
+
+	result := &PageResult[T]{Items: []T{}}
+	if q.Total {
+		var total int64
+		err = tx.Session(&gorm.Session{}).Model(new(T)).Count(&total).Error
+		if err != nil {
+			return nil, err
+		}
+
+		result.Total = &total
+	}
+
+	query := tx.Session(&gorm.Session{}).Model(new(T))
+	if q.Cursor != "" {
+		values, err := decodeCursor(q.Cursor, signature, fields)
+		if err != nil {
+			return nil, err
+		}
+
+		query = query.Where(keysetAfter(columns, values))
+	}
+
+	for _, c := range columns {
+		query = query.Order(clause.OrderByColumn{Column: clause.Column{Table: clause.CurrentTable, Name: c.column}, Desc: c.desc})
+	}
+
+	size := p.size(q.Size)
+	err = query.Limit(size + 1).Find(&result.Items).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Items) > size {
+		result.Items = result.Items[:size]
+		last := reflect.ValueOf(&result.Items[size-1]).Elem()
+		result.Next, err = encodeCursor(stmt, signature, fields, last)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// MapPage converts the items of a page, e.g. tables to api models.
+func MapPage[T any, R any](page *PageResult[T], fn func(T) R) *PageResult[R] {
+	items := make([]R, 0, len(page.Items))
+	for _, item := range page.Items {
+		items = append(items, fn(item))
+	}
+
+	return &PageResult[R]{Items: items, Next: page.Next, Total: page.Total}
+}
+
+func sortSignature(columns []pageColumn) string {
+	parts := make([]string, 0, len(columns))
+	for _, c := range columns {
+		if c.desc {
+			parts = append(parts, "-"+c.column)
+		} else {
+			parts = append(parts, c.column)
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// keysetAfter builds (a > ?) OR (a = ? AND b > ?) OR ..., flipping the
+// comparison for descending columns.
+func keysetAfter(columns []pageColumn, values []interface{}) clause.Expression {
+	or := []clause.Expression{}
+	for i, c := range columns {
+		and := []clause.Expression{}
+		for j := 0; j < i; j++ {
+			and = append(and, clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: columns[j].column}, Value: values[j]})
+		}
+
+		column := clause.Column{Table: clause.CurrentTable, Name: c.column}
+		if c.desc {
+			and = append(and, clause.Lt{Column: column, Value: values[i]})
+		} else {
+			and = append(and, clause.Gt{Column: column, Value: values[i]})
+		}
+
+		or = append(or, clause.And(and...))
+	}
+
+	return clause.Or(or...)
+}
+
+func encodeCursor(stmt *gorm.Statement, signature string, fields []*schema.Field, row reflect.Value) (string, error) {
+	cursor := pageCursor{Sort: signature}
+	for _, f := range fields {
+		value, _ := f.ValueOf(stmt.Context, row)
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+
+		cursor.Values = append(cursor.Values, raw)
+	}
+
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(s string, signature string, fields []*schema.Field) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	cursor := pageCursor{}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || cursor.Sort != signature || len(cursor.Values) != len(fields) {
+		return nil, ErrInvalidCursor
+	}
+
+	values := make([]interface{}, 0, len(fields))
+	for i, f := range fields {
+		value := reflect.New(f.FieldType)
+		err = json.Unmarshal(cursor.Values[i], value.Interface())
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+
+		values = append(values, value.Elem().Interface())
+	}
+
+	return values, nil
+}
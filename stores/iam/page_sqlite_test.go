@@ -0,0 +1,81 @@
+package iam_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestOrgStoreList(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+	store := iam.NewOrgStore(db.DB, nil)
+
+	for _, name := range []string{"Echo", "Alpha", "Delta", "Bravo", "Foxtrot", "Charlie", "Golf"} {
+		err := store.Create(&iam.Org{Name: name, Domains: []string{name + ".test"}})
+		if err != nil {
+			t.Fatalf("failed to create org: %v", err)
+		}
+	}
+
+	page, err := store.List(&iam.PageQuery{Size: 3, Total: true}, "domains")
+	assert.NoError(err)
+	assert.Equal(int64(7), *page.Total)
+	assert.Equal([]string{"alpha", "bravo", "charlie"}, orgNames(page.Items))
+	assert.Len(page.Items[0].Domains, 1)
+	assert.NotEmpty(page.Next)
+
+	// rows added before the cursor do not shift the next page
+	assert.NoError(store.Create(&iam.Org{Name: "Able"}))
+
+	page, err = store.List(&iam.PageQuery{Size: 3, Cursor: page.Next})
+	assert.NoError(err)
+	assert.Nil(page.Total)
+	assert.Equal([]string{"delta", "echo", "foxtrot"}, orgNames(page.Items))
+
+	page, err = store.List(&iam.PageQuery{Size: 3, Cursor: page.Next})
+	assert.NoError(err)
+	assert.Equal([]string{"golf"}, orgNames(page.Items))
+	assert.Empty(page.Next)
+
+	pairs, err := store.ListPairs(&iam.PageQuery{Size: 4, Sort: "-name"})
+	assert.NoError(err)
+	assert.Equal("golf", pairNames(pairs.Items)[0])
+	assert.Len(pairs.Items, 4)
+
+	pairs, err = store.ListPairs(&iam.PageQuery{Size: 4, Sort: "-name", Cursor: pairs.Next})
+	assert.NoError(err)
+	assert.Equal([]string{"charlie", "bravo", "alpha", "able"}, pairNames(pairs.Items))
+	assert.Empty(pairs.Next)
+
+	// only whitelisted fields sort, and a cursor is bound to its sort
+	_, err = store.List(&iam.PageQuery{Sort: "path"})
+	assert.ErrorIs(err, iam.ErrValidation)
+
+	first, err := store.ListPairs(&iam.PageQuery{Size: 1})
+	assert.NoError(err)
+	_, err = store.ListPairs(&iam.PageQuery{Size: 1, Sort: "slug", Cursor: first.Next})
+	assert.ErrorIs(err, iam.ErrInvalidCursor)
+	_, err = store.ListPairs(&iam.PageQuery{Cursor: "not a cursor"})
+	assert.ErrorIs(err, iam.ErrInvalidCursor)
+}
+
+func orgNames(orgs []iam.Org) []string {
+	names := []string{}
+	for _, o := range orgs {
+		names = append(names, strings.ToLower(o.Name))
+	}
+
+	return names
+}
+
+func pairNames(pairs []iam.OrgPair) []string {
+	names := []string{}
+	for _, p := range pairs {
+		names = append(names, strings.ToLower(p.Name))
+	}
+
+	return names
+}
@@ -0,0 +1,171 @@
+package iam
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password policy violation codes.
+const (
+	PasswordTooShort         = "password_too_short"
+	PasswordTooLong          = "password_too_long"
+	PasswordRequiresUpper    = "password_requires_upper"
+	PasswordRequiresLower    = "password_requires_lower"
+	PasswordRequiresDigit    = "password_requires_digit"
+	PasswordRequiresSymbol   = "password_requires_symbol"
+	PasswordContainsUserInfo = "password_contains_user_info"
+	PasswordReused           = "password_reused"
+	PasswordBreached         = "password_breached"
+)
+
+// MaxPasswordBytes is the most bcrypt hashes; it ignores anything after, so
+// longer passwords are rejected whatever the policy's MaxLength.
+const MaxPasswordBytes = 72
+
+// PasswordViolation is one rule a password broke. Param holds the rule's
+// setting, such as the minimum length, for use in translated messages.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
+}
+
+// PasswordPolicyError lists every rule a password broke.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+
+	return "password does not meet the policy: " + strings.Join(messages, "; ")
+}
+
+func (e *PasswordPolicyError) Has(code string) bool {
+	for _, v := range e.Violations {
+		if v.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// HistoryCount rejects the last N passwords. Zero allows reuse.
+	HistoryCount int
+	// MaxAge is how long a password lasts before the user must change it.
+	// Zero means passwords do not expire.
+	MaxAge time.Duration
+	// DisallowUserInfo rejects passwords containing the user's name or the
+	// local part of their email.
+	DisallowUserInfo bool
+	// Breached, when set, rejects passwords known from public breaches.
+	Breached BreachedPasswordChecker
+}
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        128,
+		RequireUpper:     true,
+		RequireLower:     true,
+		RequireDigit:     true,
+		HistoryCount:     5,
+		DisallowUserInfo: true,
+	}
+}
+
+// Check applies the rules that only need the password and the user. user may
+// be nil for a user that does not exist yet.
+func (p *PasswordPolicy) Check(password string, user *UserTable) []PasswordViolation {
+	violations := []PasswordViolation{}
+	add := func(code string, param string, format string, args ...interface{}) {
+		violations = append(violations, PasswordViolation{Code: code, Message: fmt.Sprintf(format, args...), Param: param})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		add(PasswordTooShort, fmt.Sprint(p.MinLength), "password must be at least %d characters", p.MinLength)
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add(PasswordTooLong, fmt.Sprint(p.MaxLength), "password must be at most %d characters", p.MaxLength)
+	} else if len(password) > MaxPasswordBytes {
+		add(PasswordTooLong, fmt.Sprint(MaxPasswordBytes), "password must be at most %d bytes", MaxPasswordBytes)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireUpper && !upper {
+		add(PasswordRequiresUpper, "", "password must contain an uppercase letter")
+	}
+
+	if p.RequireLower && !lower {
+		add(PasswordRequiresLower, "", "password must contain a lowercase letter")
+	}
+
+	if p.RequireDigit && !digit {
+		add(PasswordRequiresDigit, "", "password must contain a digit")
+	}
+
+	if p.RequireSymbol && !symbol {
+		add(PasswordRequiresSymbol, "", "password must contain a symbol")
+	}
+
+	if p.DisallowUserInfo && user != nil && containsUserInfo(password, user) {
+		add(PasswordContainsUserInfo, "", "password must not contain your name or email")
+	}
+
+	return violations
+}
+
+// IsExpired reports whether the password is older than MaxAge.
+func (p *PasswordPolicy) IsExpired(pw *UserPasswordTable, now time.Time) bool {
+	if p.MaxAge <= 0 || pw == nil {
+		return false
+	}
+
+	return !now.Before(pw.LastChangedAt().Add(p.MaxAge))
+}
+
+func containsUserInfo(password string, user *UserTable) bool {
+	lower := strings.ToLower(password)
+	parts := []string{user.Name}
+	if local, _, ok := strings.Cut(user.Email, "@"); ok {
+		parts = append(parts, local)
+	}
+
+	for _, part := range parts {
+		// very short names would reject too many passwords
+		if utf8.RuneCountInString(part) >= 3 && strings.Contains(lower, strings.ToLower(part)) {
+			return true
+		}
+	}
+
+	return false
+}
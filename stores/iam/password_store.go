@@ -0,0 +1,231 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrPasswordMismatch = errors.New("the current password is incorrect")
+
+// PasswordStore sets user passwords through a PasswordPolicy and keeps the
+// history the policy needs.
+type PasswordStore struct {
+	db     *IamDb
+	Policy PasswordPolicy
+	Now    func() time.Time
+}
+
+func NewPasswordStore(db *IamDb, policy *PasswordPolicy) *PasswordStore {
+	p := DefaultPasswordPolicy()
+	if policy != nil {
+		p = *policy
+	}
+
+	return &PasswordStore{
+		db:     db,
+		Policy: p,
+		Now:    time.Now,
+	}
+}
+
+// WithTx returns a copy of the store that works in the transaction of tx,
+// see IamDb.WithTx.
+func (s *PasswordStore) WithTx(tx *IamDb) *PasswordStore {
+	c := *s
+	c.db = tx
+	return &c
+}
+
+// WithContext returns a copy of the store whose queries use ctx.
+func (s *PasswordStore) WithContext(ctx context.Context) *PasswordStore {
+	return s.WithTx(s.db.WithContext(ctx))
+}
+
+// Validate checks the password against every rule of the policy. Violations
+// are returned as a *PasswordPolicyError; other errors come from the database
+// or the breached password checker.
+func (s *PasswordStore) Validate(user *UserTable, password string) error {
+	return s.validate(s.db.DB, user, password)
+}
+
+// SetPassword validates and sets the user's password, creating the password
+// row for users that had none.
+func (s *PasswordStore) SetPassword(user *UserTable, password string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return s.setPassword(tx, user, password)
+	})
+}
+
+// ChangePassword sets a new password after checking the current one.
+func (s *PasswordStore) ChangePassword(userId int32, current string, password string) (*UserTable, error) {
+	user := &UserTable{}
+	err := s.db.Preload("Password").Where("id = ?", userId).First(user).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Password == nil || user.Password.ValidatePassword(current) != nil {
+		return nil, ErrPasswordMismatch
+	}
+
+	err = s.SetPassword(user, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// IsExpired reports whether the user must change their password.
+func (s *PasswordStore) IsExpired(user *UserTable) bool {
+	return s.Policy.IsExpired(user.Password, s.Now())
+}
+
+func (s *PasswordStore) validate(tx *gorm.DB, user *UserTable, password string) error {
+	violations := s.Policy.Check(password, user)
+
+	if s.Policy.HistoryCount > 0 && user != nil && user.Id != 0 {
+		reused, err := s.isReused(tx, user, password)
+		if err != nil {
+			return err
+		}
+
+		if reused {
+			violations = append(violations, PasswordViolation{
+				Code:    PasswordReused,
+				Message: "password was used recently",
+				Param:   strconv.Itoa(s.Policy.HistoryCount),
+			})
+		}
+	}
+
+	if s.Policy.Breached != nil {
+		breached, err := s.Policy.Breached.IsBreached(password)
+		if err != nil {
+			return err
+		}
+
+		if breached {
+			violations = append(violations, PasswordViolation{
+				Code:    PasswordBreached,
+				Message: "password has appeared in a data breach",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+func (s *PasswordStore) setPassword(tx *gorm.DB, user *UserTable, password string) error {
+	err := s.validate(tx, user, password)
+	if err != nil {
+		return err
+	}
+
+	now := s.Now()
+	created := user.Password == nil
+	if created {
+		user.Password = &UserPasswordTable{
+			UserId:    user.Id,
+			Uid:       uuid.New(),
+			CreatedAt: now,
+		}
+	}
+
+	previous := user.Password.Password
+	err = user.Password.SetPassword(password)
+	if err != nil {
+		return err
+	}
+
+	pw := user.Password
+	pw.Reset()
+	pw.ChangedAt = sql.NullTime{Time: now, Valid: true}
+	pw.UpdatedAt = sql.NullTime{Time: now, Valid: true}
+	if user.Status == UserStatusPasswordLocked {
+		user.Status = UserStatusActive
+		err = tx.Model(user).Select("status").Updates(user).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if created {
+		err = tx.Create(pw).Error
+	} else {
+		err = tx.Model(&UserPasswordTable{}).
+			Where("user_id = ?", user.Id).
+			Select("password", "is_locked", "locked_at", "failed_attempts", "last_failed_at", "security_stamp", "changed_at", "updated_at").
+			Updates(pw).Error
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// the current hash is one of the last N, so the history holds N-1
+	size := s.Policy.HistoryCount - 1
+	if previous == "" || size <= 0 {
+		return nil
+	}
+
+	err = tx.Create(&UserPasswordHistoryTable{
+		UserId:    user.Id,
+		Password:  previous,
+		CreatedAt: now,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	keep := tx.Model(&UserPasswordHistoryTable{}).
+		Select("id").
+		Where("user_id = ?", user.Id).
+		Order("id DESC").
+		Limit(size)
+
+	return tx.Where("user_id = ? AND id NOT IN (?)", user.Id, keep).
+		Delete(&UserPasswordHistoryTable{}).Error
+}
+
+// isReused compares the password with the current hash and the hashes in
+// the history. The current password counts as one of the last N.
+func (s *PasswordStore) isReused(tx *gorm.DB, user *UserTable, password string) (bool, error) {
+	if user.Password != nil && user.Password.Password != "" {
+		if ValidateSecret(password, user.Password.Password) == nil {
+			return true, nil
+		}
+	}
+
+	size := s.Policy.HistoryCount - 1
+	if size <= 0 {
+		return false, nil
+	}
+
+	history := []UserPasswordHistoryTable{}
+	err := tx.Where("user_id = ?", user.Id).
+		Order("id DESC").
+		Limit(size).
+		Find(&history).Error
+	if err != nil {
+		return false, err
+	}
+
+	for _, h := range history {
+		if ValidateSecret(password, h.Password) == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,111 @@
+package iam_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	assert := assert2.New(t)
+	policy := iam.DefaultPasswordPolicy()
+	user := &iam.UserTable{Name: "leon", Email: "leon.smith@test.org"}
+
+	violations := policy.Check("short", user)
+	codes := []string{}
+	for _, v := range violations {
+		codes = append(codes, v.Code)
+	}
+
+	assert.ElementsMatch([]string{iam.PasswordTooShort, iam.PasswordRequiresUpper, iam.PasswordRequiresDigit}, codes)
+	assert.Equal("8", violations[0].Param)
+
+	violations = policy.Check("Leon.Smith2024", user)
+	assert.Len(violations, 1)
+	assert.Equal(iam.PasswordContainsUserInfo, violations[0].Code)
+
+	assert.Empty(policy.Check("  Correct Horse 9  ", user))
+
+	// bcrypt ignores everything past 72 bytes, so the policy does too
+	for _, long := range []string{"Aa1" + strings.Repeat("x", 97), "Aa1" + strings.Repeat("ü", 40)} {
+		violations = policy.Check(long, user)
+		assert.Len(violations, 1)
+		assert.Equal(iam.PasswordTooLong, violations[0].Code)
+		assert.Equal("72", violations[0].Param)
+	}
+
+	policy.MaxAge = 24 * time.Hour
+	pw := &iam.UserPasswordTable{CreatedAt: time.Now().Add(-48 * time.Hour)}
+	assert.True(policy.IsExpired(pw, time.Now()))
+}
+
+func TestRangeFileChecker(t *testing.T) {
+	assert := assert2.New(t)
+
+	sum := sha1.Sum([]byte("Password1"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	checker := &iam.RangeFileChecker{FS: fstest.MapFS{
+		hash[:5] + ".txt": {Data: []byte("0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n" + hash[5:] + ":9\r\n")},
+	}}
+
+	breached, err := checker.IsBreached("Password1")
+	assert.NoError(err)
+	assert.True(breached)
+
+	breached, err = checker.IsBreached("Zebra!Lantern42")
+	assert.NoError(err)
+	assert.False(breached)
+
+	checker.MinCount = 10
+	breached, _ = checker.IsBreached("Password1")
+	assert.False(breached)
+}
+
+func TestPasswordStore(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUserWithPassword("mona", "mona@test.org", " Secr3t!pass ")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	// whitespace is kept as part of the password
+	assert.NoError(user.Password.ValidatePassword(" Secr3t!pass "))
+
+	policy := iam.DefaultPasswordPolicy()
+	policy.HistoryCount = 2
+	store := iam.NewPasswordStore(db, &policy)
+
+	_, err = store.ChangePassword(user.Id, "wrong", "N3w!password")
+	assert.ErrorIs(err, iam.ErrPasswordMismatch)
+
+	_, err = store.ChangePassword(user.Id, " Secr3t!pass ", "weak")
+	policyErr := &iam.PasswordPolicyError{}
+	assert.True(errors.As(err, &policyErr))
+	assert.True(policyErr.Has(iam.PasswordTooShort))
+
+	user, err = store.ChangePassword(user.Id, " Secr3t!pass ", "N3w!password")
+	assert.NoError(err)
+
+	_, err = store.ChangePassword(user.Id, "N3w!password", " Secr3t!pass ")
+	assert.True(errors.As(err, &policyErr))
+	assert.True(policyErr.Has(iam.PasswordReused))
+
+	_, err = store.ChangePassword(user.Id, "N3w!password", "Th1rd!password")
+	assert.NoError(err)
+
+	// only the last two passwords are remembered
+	_, err = store.ChangePassword(user.Id, "Th1rd!password", " Secr3t!pass ")
+	assert.NoError(err)
+
+	assert.False(store.IsExpired(user))
+}
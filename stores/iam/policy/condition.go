@@ -0,0 +1,284 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// truth is the result of a condition. A comparison with an attribute that
+// is not set is indeterminate rather than false, so that ne, not_in and not
+// cannot turn a missing attribute into a match.
+type truth int
+
+const (
+	truthFalse truth = iota
+	truthTrue
+	truthIndeterminate
+)
+
+// eval reports whether the condition holds and, when it does not, which
+// comparison failed or could not be made.
+func (c *Condition) eval(attrs Attributes) (truth, string) {
+	switch {
+	case len(c.All) > 0:
+		result, why := truthTrue, ""
+		for i := range c.All {
+			t, w := c.All[i].eval(attrs)
+			if t == truthFalse {
+				return truthFalse, w
+			}
+
+			if t == truthIndeterminate && result == truthTrue {
+				result, why = truthIndeterminate, w
+			}
+		}
+
+		return result, why
+	case len(c.Any) > 0:
+		result := truthFalse
+		reasons := []string{}
+		for i := range c.Any {
+			t, why := c.Any[i].eval(attrs)
+			if t == truthTrue {
+				return truthTrue, ""
+			}
+
+			if t == truthIndeterminate {
+				result = truthIndeterminate
+			}
+
+			reasons = append(reasons, why)
+		}
+
+		return result, "none of: " + strings.Join(reasons, "; ")
+	case c.Not != nil:
+		t, why := c.Not.eval(attrs)
+		switch t {
+		case truthTrue:
+			return truthFalse, "not: " + c.Not.String() + " holds"
+		case truthIndeterminate:
+			return truthIndeterminate, "not: " + why
+		}
+
+		return truthTrue, ""
+	}
+
+	actual, found := attrs.lookup(c.Attr)
+	if c.Op == OpExists {
+		want := true
+		if b, ok := c.Value.(bool); ok {
+			want = b
+		}
+
+		if found != want {
+			return truthFalse, fmt.Sprintf("%s: exists is %t", c.String(), found)
+		}
+
+		return truthTrue, ""
+	}
+
+	if !found {
+		return truthIndeterminate, fmt.Sprintf("%s: %s is not set", c.String(), c.Attr)
+	}
+
+	expected := c.Value
+	if c.Ref != "" {
+		v, ok := attrs.lookup(c.Ref)
+		if !ok {
+			return truthIndeterminate, fmt.Sprintf("%s: %s is not set", c.String(), c.Ref)
+		}
+
+		expected = v
+	}
+
+	if compare(c.Op, actual, expected) {
+		return truthTrue, ""
+	}
+
+	return truthFalse, fmt.Sprintf("%s: %s is %s", c.String(), c.Attr, format(actual))
+}
+
+func (c *Condition) String() string {
+	switch {
+	case len(c.All) > 0:
+		return fmt.Sprintf("all(%d)", len(c.All))
+	case len(c.Any) > 0:
+		return fmt.Sprintf("any(%d)", len(c.Any))
+	case c.Not != nil:
+		return "not(" + c.Not.String() + ")"
+	case c.Ref != "":
+		return fmt.Sprintf("%s %s %s", c.Attr, c.Op, c.Ref)
+	case c.Op == OpExists:
+		return fmt.Sprintf("%s %s", c.Attr, c.Op)
+	default:
+		return fmt.Sprintf("%s %s %s", c.Attr, c.Op, format(c.Value))
+	}
+}
+
+func compare(op string, actual interface{}, expected interface{}) bool {
+	switch op {
+	case OpEq:
+		return equal(actual, expected)
+	case OpNe:
+		return !equal(actual, expected)
+	case OpGt, OpGte, OpLt, OpLte:
+		n := order(actual, expected)
+		if n == nil {
+			return false
+		}
+
+		switch op {
+		case OpGt:
+			return *n > 0
+		case OpGte:
+			return *n >= 0
+		case OpLt:
+			return *n < 0
+		default:
+			return *n <= 0
+		}
+	case OpIn:
+		return containsValue(expected, actual)
+	case OpNotIn:
+		return !containsValue(expected, actual)
+	case OpContains:
+		if s, ok := actual.(string); ok {
+			return strings.Contains(s, toString(expected))
+		}
+
+		return containsValue(actual, expected)
+	case OpStartsWith:
+		return strings.HasPrefix(toString(actual), toString(expected))
+	}
+
+	return false
+}
+
+func equal(a interface{}, b interface{}) bool {
+	x, okA := toNumber(a)
+	y, okB := toNumber(b)
+	if okA && okB {
+		return x == y
+	}
+
+	return toString(a) == toString(b)
+}
+
+// order compares two numbers, or two strings when either is not a number.
+func order(a interface{}, b interface{}) *int {
+	n := 0
+	x, okA := toNumber(a)
+	y, okB := toNumber(b)
+	if okA && okB {
+		switch {
+		case x < y:
+			n = -1
+		case x > y:
+			n = 1
+		}
+
+		return &n
+	}
+
+	if isList(a) || isList(b) {
+		return nil
+	}
+
+	n = strings.Compare(toString(a), toString(b))
+	return &n
+}
+
+func containsValue(list interface{}, value interface{}) bool {
+	items, ok := toList(list)
+	if !ok {
+		return false
+	}
+
+	for _, item := range items {
+		if equal(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isList(v interface{}) bool {
+	_, ok := toList(v)
+	return ok
+}
+
+func toList(v interface{}) ([]interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+
+	items := make([]interface{}, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+
+	return items, true
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case fmt.Stringer:
+		return s.String()
+	}
+
+	if n, ok := toNumber(v); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+
+	return fmt.Sprint(v)
+}
+
+func format(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,210 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Decision is the outcome of evaluating a request. Explain lists every
+// policy with whether it applied and why its condition did or did not hold.
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+	// PolicyId is the policy that decided the request, if any.
+	PolicyId string        `json:"policyId,omitempty"`
+	Explain  []Explanation `json:"explain"`
+}
+
+type Explanation struct {
+	PolicyId string `json:"policyId"`
+	Effect   Effect `json:"effect"`
+	// Applies is true when the policy covers the action and resource.
+	Applies bool `json:"applies"`
+	// Matched is true when the policy applies and its condition holds, or
+	// for deny policies when it cannot be decided.
+	Matched bool `json:"matched"`
+	// Indeterminate is true when the condition needs an attribute the
+	// request does not have.
+	Indeterminate bool   `json:"indeterminate,omitempty"`
+	Detail        string `json:"detail,omitempty"`
+}
+
+// Engine evaluates requests against a set of policies. A matching deny
+// policy always wins; otherwise a matching allow policy allows the request;
+// a request no policy allows is denied. A condition that needs a missing
+// attribute is indeterminate: it matches for deny policies and not for
+// allow policies, so leaving out an attribute never lifts a deny. An Engine
+// is safe for concurrent use.
+type Engine struct {
+	mu       sync.RWMutex
+	policies []Policy
+	// Now and Location fill in the env.time, env.hour and env.weekday
+	// attributes when the request does not set them.
+	Now      func() time.Time
+	Location *time.Location
+}
+
+func NewEngine(policies ...Policy) (*Engine, error) {
+	e := &Engine{
+		Now:      time.Now,
+		Location: time.Local,
+	}
+
+	err := e.SetPolicies(policies)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// SetPolicies replaces the policies of the engine. Nothing changes when one
+// of them is invalid.
+func (e *Engine) SetPolicies(policies []Policy) error {
+	ids := []string{}
+	for i := range policies {
+		err := policies[i].Validate()
+		if err != nil {
+			return err
+		}
+
+		if slices.Contains(ids, policies[i].Id) {
+			return fmt.Errorf("policy %s is defined twice", policies[i].Id)
+		}
+
+		ids = append(ids, policies[i].Id)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.policies = slices.Clone(policies)
+	return nil
+}
+
+func (e *Engine) Policies() []Policy {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return slices.Clone(e.policies)
+}
+
+func (e *Engine) IsAllowed(req *Request) bool {
+	return e.Evaluate(req).Allowed
+}
+
+func (e *Engine) Evaluate(req *Request) *Decision {
+	e.mu.RLock()
+	policies := e.policies
+	e.mu.RUnlock()
+
+	attrs := e.attributes(req)
+	decision := &Decision{
+		Reason:  "no policy allows " + req.Action + " on " + req.Resource.Type,
+		Explain: make([]Explanation, 0, len(policies)),
+	}
+
+	allowedBy := ""
+	deniedBy := ""
+	for _, p := range policies {
+		x := Explanation{PolicyId: p.Id, Effect: p.Effect}
+
+		x.Applies = matchAny(p.Actions, req.Action) && (len(p.Resources) == 0 || matchAny(p.Resources, req.Resource.Type))
+		if !x.Applies {
+			x.Detail = "action or resource does not match"
+			decision.Explain = append(decision.Explain, x)
+			continue
+		}
+
+		x.Matched = true
+		if p.Condition != nil {
+			var t truth
+			t, x.Detail = p.Condition.eval(attrs)
+			x.Indeterminate = t == truthIndeterminate
+			x.Matched = t == truthTrue || (x.Indeterminate && p.Effect == Deny)
+		}
+
+		if x.Matched {
+			if p.Effect == Deny && deniedBy == "" {
+				deniedBy = p.Id
+			}
+
+			if p.Effect == Allow && allowedBy == "" {
+				allowedBy = p.Id
+			}
+		}
+
+		decision.Explain = append(decision.Explain, x)
+	}
+
+	switch {
+	case deniedBy != "":
+		decision.PolicyId = deniedBy
+		decision.Reason = "denied by policy " + deniedBy
+	case allowedBy != "":
+		decision.Allowed = true
+		decision.PolicyId = allowedBy
+		decision.Reason = "allowed by policy " + allowedBy
+	}
+
+	return decision
+}
+
+func (e *Engine) attributes(req *Request) Attributes {
+	resource := Attributes{}
+	for k, v := range req.Resource.Attributes {
+		resource[k] = v
+	}
+	resource["type"] = req.Resource.Type
+	resource["id"] = req.Resource.Id
+
+	env := Attributes{}
+	for k, v := range req.Environment {
+		env[k] = v
+	}
+
+	now := e.Now()
+	if e.Location != nil {
+		now = now.In(e.Location)
+	}
+
+	if _, ok := env["time"]; !ok {
+		env["time"] = now.Format(time.RFC3339)
+	}
+
+	if _, ok := env["hour"]; !ok {
+		env["hour"] = now.Hour()
+	}
+
+	if _, ok := env["weekday"]; !ok {
+		env["weekday"] = int(now.Weekday())
+	}
+
+	subject := req.Subject
+	if subject == nil {
+		subject = Attributes{}
+	}
+
+	return Attributes{
+		"subject":  subject,
+		"action":   req.Action,
+		"resource": resource,
+		"env":      env,
+	}
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == value {
+			return true
+		}
+
+		ok, err := path.Match(pattern, value)
+		if err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
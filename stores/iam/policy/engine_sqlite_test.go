@@ -0,0 +1,200 @@
+package policy_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	"github.com/gnomego/sdk/stores/iam/policy"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// editOwnDuringBusinessHours lets members edit documents they own within
+// their org on weekdays from 9 to 17.
+const editOwnDuringBusinessHours = `{
+	"id": "edit-own-business-hours",
+	"effect": "allow",
+	"actions": ["document:edit", "document:read"],
+	"resources": ["document"],
+	"condition": {"all": [
+		{"attr": "subject.member_role", "op": "in", "value": ["member", "admin", "owner"]},
+		{"attr": "resource.owner_id", "op": "eq", "ref": "subject.id"},
+		{"attr": "resource.org_id", "op": "eq", "ref": "subject.org_id"},
+		{"attr": "env.weekday", "op": "in", "value": [1, 2, 3, 4, 5]},
+		{"attr": "env.hour", "op": "gte", "value": 9},
+		{"attr": "env.hour", "op": "lt", "value": 17}
+	]}
+}`
+
+func TestEngine(t *testing.T) {
+	assert := assert2.New(t)
+
+	allow := policy.Policy{}
+	assert.NoError(json.Unmarshal([]byte(editOwnDuringBusinessHours), &allow))
+
+	engine, err := policy.NewEngine(allow, policy.Policy{
+		Id:      "no-contractor-deletes",
+		Effect:  policy.Deny,
+		Actions: []string{"document:*"},
+		Condition: &policy.Condition{
+			Attr: "subject.claims.employment", Op: policy.OpContains, Value: "contractor",
+		},
+	})
+	assert.NoError(err)
+
+	// a Tuesday
+	engine.Now = func() time.Time { return time.Date(2024, 5, 14, 10, 30, 0, 0, time.UTC) }
+	engine.Location = time.UTC
+
+	subject := policy.Attributes{
+		"id":          int32(7),
+		"org_id":      int32(3),
+		"member_role": "member",
+		"claims":      map[string][]string{"employment": {"staff"}},
+	}
+	req := &policy.Request{
+		Subject:  subject,
+		Action:   "document:edit",
+		Resource: policy.Resource{Type: "document", Id: "42", Attributes: policy.Attributes{"owner_id": 7, "org_id": 3}},
+	}
+
+	decision := engine.Evaluate(req)
+	assert.True(decision.Allowed)
+	assert.Equal("edit-own-business-hours", decision.PolicyId)
+	assert.Len(decision.Explain, 2)
+
+	engine.Now = func() time.Time { return time.Date(2024, 5, 14, 18, 0, 0, 0, time.UTC) }
+	decision = engine.Evaluate(req)
+	assert.False(decision.Allowed)
+	assert.Equal("env.hour lt 17: env.hour is 18", decision.Explain[0].Detail)
+
+	engine.Now = func() time.Time { return time.Date(2024, 5, 14, 10, 30, 0, 0, time.UTC) }
+	req.Resource.Attributes["owner_id"] = 8
+	decision = engine.Evaluate(req)
+	assert.False(decision.Allowed)
+	assert.Equal("resource.owner_id eq subject.id: resource.owner_id is 8", decision.Explain[0].Detail)
+	assert.Equal("no policy allows document:edit on document", decision.Reason)
+
+	// deny wins over allow
+	req.Resource.Attributes["owner_id"] = 7
+	subject["claims"] = map[string][]string{"employment": {"staff", "contractor"}}
+	decision = engine.Evaluate(req)
+	assert.False(decision.Allowed)
+	assert.Equal("no-contractor-deletes", decision.PolicyId)
+
+	// a missing attribute is indeterminate: it fails allow policies and
+	// matches deny policies, however the condition is negated
+	for _, condition := range []policy.Condition{
+		{Attr: "subject.claims.employment", Op: policy.OpContains, Value: "contractor"},
+		{Attr: "resource.classification", Op: policy.OpNe, Value: "internal"},
+		{Attr: "resource.classification", Op: policy.OpNotIn, Value: []string{"internal"}},
+		{Not: &policy.Condition{Attr: "resource.classification", Op: policy.OpEq, Value: "internal"}},
+		{Any: []policy.Condition{
+			{Attr: "resource.classification", Op: policy.OpEq, Value: "secret"},
+			{Attr: "subject.id", Op: policy.OpEq, Value: 0},
+		}},
+	} {
+		assert.NoError(engine.SetPolicies([]policy.Policy{allow, {
+			Id: "deny", Effect: policy.Deny, Actions: []string{"document:*"}, Condition: &condition,
+		}}))
+
+		subject["claims"] = map[string][]string{}
+		delete(req.Resource.Attributes, "classification")
+		decision = engine.Evaluate(req)
+		assert.False(decision.Allowed, condition.String())
+		assert.Equal("deny", decision.PolicyId, condition.String())
+		assert.True(decision.Explain[1].Indeterminate)
+
+		subject["claims"] = map[string][]string{"employment": {"staff"}}
+		req.Resource.Attributes["classification"] = "internal"
+		assert.True(engine.IsAllowed(req), condition.String())
+	}
+
+	delete(subject, "member_role")
+	decision = engine.Evaluate(req)
+	assert.False(decision.Allowed)
+	assert.True(decision.Explain[0].Indeterminate)
+	assert.False(decision.Explain[0].Matched)
+	assert.Equal("subject.member_role in [\"member\",\"admin\",\"owner\"]: subject.member_role is not set", decision.Explain[0].Detail)
+
+	req.Action = "invoice:pay"
+	decision = engine.Evaluate(req)
+	assert.False(decision.Allowed)
+	assert.False(decision.Explain[0].Applies)
+
+	_, err = policy.NewEngine(policy.Policy{Id: "bad", Effect: "maybe", Actions: []string{"*"}})
+	assert.Error(err)
+	_, err = policy.NewEngine(policy.Policy{Id: "bad", Effect: policy.Allow, Actions: []string{"*"},
+		Condition: &policy.Condition{Attr: "subject.id", Op: "like"}})
+	assert.Error(err)
+}
+
+func TestStoreAndSubject(t *testing.T) {
+	assert := assert2.New(t)
+
+	gdb, err := gorm.Open(sqlite.Open("file:policy_store?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	db := &iam.IamDb{DB: gdb}
+	assert.NoError(db.MigrateIam())
+
+	store := policy.NewStore(db)
+	allow := policy.Policy{}
+	assert.NoError(json.Unmarshal([]byte(editOwnDuringBusinessHours), &allow))
+	assert.NoError(store.Save(&allow, true))
+	assert.NoError(store.Save(&policy.Policy{Id: "everything", Effect: policy.Allow, Actions: []string{"*"}}, false))
+	assert.Error(store.Save(&policy.Policy{Id: "broken", Effect: policy.Allow}, true))
+
+	// saving again replaces the policy
+	allow.Description = "members edit their own documents"
+	assert.NoError(store.Save(&allow, true))
+
+	stored, err := store.Get(allow.Id)
+	assert.NoError(err)
+	assert.Equal("members edit their own documents", stored.Description)
+	assert.Len(stored.Condition.All, 6)
+
+	all, err := store.List(false)
+	assert.NoError(err)
+	assert.Len(all, 2)
+
+	engine, err := policy.NewEngine()
+	assert.NoError(err)
+	assert.NoError(store.Load(engine))
+	assert.Len(engine.Policies(), 1)
+
+	org := &iam.OrgTable{}
+	org.SetName("Policy Org")
+	assert.NoError(db.Create(org).Error)
+
+	user, err := db.NewUser("pia", "pia@test.org")
+	assert.NoError(err)
+	_, err = db.AddUserClaim(user.Id, "employment", "staff")
+	assert.NoError(err)
+	_, err = iam.NewMembershipStore(db, nil).AddMember(org.Id, user.Id, iam.OrgMemberRoleMember)
+	assert.NoError(err)
+
+	subject, err := policy.Subject(db, user.Id, sql.NullInt32{})
+	assert.NoError(err)
+	assert.Equal(org.Id, subject["org_id"])
+	assert.Equal("member", subject["member_role"])
+
+	engine.Now = func() time.Time { return time.Date(2024, 5, 13, 9, 0, 0, 0, time.UTC) }
+	engine.Location = time.UTC
+	assert.True(engine.IsAllowed(&policy.Request{
+		Subject:  subject,
+		Action:   "document:read",
+		Resource: policy.Resource{Type: "document", Attributes: policy.Attributes{"owner_id": user.Id, "org_id": org.Id}},
+	}))
+
+	assert.NoError(store.Delete(allow.Id))
+	missing, err := store.Get(allow.Id)
+	assert.NoError(err)
+	assert.Nil(missing)
+}
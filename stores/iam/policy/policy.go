@@ -0,0 +1,118 @@
+// Package policy evaluates attribute based access control policies against
+// the subject, action, resource and environment of a request.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// Condition operators. Attr is compared with Value, or with the attribute
+// named by Ref when Ref is set.
+const (
+	OpEq         = "eq"
+	OpNe         = "ne"
+	OpGt         = "gt"
+	OpGte        = "gte"
+	OpLt         = "lt"
+	OpLte        = "lte"
+	OpIn         = "in"
+	OpNotIn      = "not_in"
+	OpContains   = "contains"
+	OpStartsWith = "starts_with"
+	OpExists     = "exists"
+)
+
+var operators = []string{OpEq, OpNe, OpGt, OpGte, OpLt, OpLte, OpIn, OpNotIn, OpContains, OpStartsWith, OpExists}
+
+// Policy allows or denies Actions on Resources when its Condition holds.
+// Actions and Resources are glob patterns, so document:* matches every
+// document action and * matches anything; empty Resources match every
+// resource. A policy without a condition applies whenever its actions and
+// resources match.
+type Policy struct {
+	Id          string     `json:"id"`
+	Description string     `json:"description,omitempty"`
+	Effect      Effect     `json:"effect"`
+	Actions     []string   `json:"actions"`
+	Resources   []string   `json:"resources"`
+	Condition   *Condition `json:"condition,omitempty"`
+}
+
+// Condition is either a comparison of an attribute or a combination of
+// other conditions with All, Any or Not. Attributes are addressed by path,
+// e.g. subject.id, subject.claims.department, resource.owner_id or env.hour.
+type Condition struct {
+	All []Condition `json:"all,omitempty"`
+	Any []Condition `json:"any,omitempty"`
+	Not *Condition  `json:"not,omitempty"`
+
+	Attr  string      `json:"attr,omitempty"`
+	Op    string      `json:"op,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+	Ref   string      `json:"ref,omitempty"`
+}
+
+func (p *Policy) Validate() error {
+	if p.Id == "" {
+		return errors.New("policy id is required")
+	}
+
+	if p.Effect != Allow && p.Effect != Deny {
+		return fmt.Errorf("policy %s: effect must be allow or deny", p.Id)
+	}
+
+	if len(p.Actions) == 0 {
+		return fmt.Errorf("policy %s: at least one action is required", p.Id)
+	}
+
+	if p.Condition == nil {
+		return nil
+	}
+
+	err := p.Condition.validate()
+	if err != nil {
+		return fmt.Errorf("policy %s: %w", p.Id, err)
+	}
+
+	return nil
+}
+
+func (c *Condition) validate() error {
+	switch {
+	case len(c.All) > 0:
+		for i := range c.All {
+			err := c.All[i].validate()
+			if err != nil {
+				return err
+			}
+		}
+	case len(c.Any) > 0:
+		for i := range c.Any {
+			err := c.Any[i].validate()
+			if err != nil {
+				return err
+			}
+		}
+	case c.Not != nil:
+		return c.Not.validate()
+	default:
+		if c.Attr == "" {
+			return errors.New("condition needs all, any, not or attr")
+		}
+
+		if !slices.Contains(operators, c.Op) {
+			return fmt.Errorf("unknown operator %q", c.Op)
+		}
+	}
+
+	return nil
+}
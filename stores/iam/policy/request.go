@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"strings"
+)
+
+// Attributes are the named values a condition can refer to. Values may be
+// strings, numbers, booleans, slices or nested Attributes.
+type Attributes map[string]interface{}
+
+type Resource struct {
+	Type       string
+	Id         string
+	Attributes Attributes
+}
+
+// Request is a single access decision to make: may Subject perform Action on
+// Resource in Environment.
+type Request struct {
+	Subject     Attributes
+	Action      string
+	Resource    Resource
+	Environment Attributes
+}
+
+// lookup resolves an attribute path like subject.claims.department.
+func (a Attributes) lookup(path string) (interface{}, bool) {
+	var current interface{} = a
+	for _, part := range strings.Split(path, ".") {
+		switch m := current.(type) {
+		case Attributes:
+			v, ok := m[part]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		case map[string]interface{}:
+			v, ok := m[part]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		case map[string][]string:
+			v, ok := m[part]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		case map[string]string:
+			v, ok := m[part]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
@@ -0,0 +1,174 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	"gorm.io/gorm/clause"
+)
+
+// Store keeps policies in the access_policies table.
+type Store struct {
+	db *iam.IamDb
+}
+
+func NewStore(db *iam.IamDb) *Store {
+	return &Store{db: db}
+}
+
+// WithTx returns a copy of the store that works in the transaction of tx,
+// see iam.IamDb.WithTx.
+func (s *Store) WithTx(tx *iam.IamDb) *Store {
+	return &Store{db: tx}
+}
+
+// WithContext returns a copy of the store whose queries use ctx.
+func (s *Store) WithContext(ctx context.Context) *Store {
+	return &Store{db: s.db.WithContext(ctx)}
+}
+
+// Save creates or replaces the policy with p.Id. Disabled policies are kept
+// but not loaded into engines.
+func (s *Store) Save(p *Policy, enabled bool) error {
+	err := p.Validate()
+	if err != nil {
+		return err
+	}
+
+	doc, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	row := &iam.AccessPolicyTable{
+		Name:        p.Id,
+		Description: p.Description,
+		Document:    string(doc),
+		Enabled:     enabled,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   sql.NullTime{Time: time.Now(), Valid: true},
+	}
+
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"description", "document", "enabled", "updated_at"}),
+	}).Create(row).Error
+}
+
+func (s *Store) Delete(id string) error {
+	return s.db.Where("name = ?", id).Delete(&iam.AccessPolicyTable{}).Error
+}
+
+// Get returns nil when there is no policy with the id.
+func (s *Store) Get(id string) (*Policy, error) {
+	row := &iam.AccessPolicyTable{}
+	res := s.db.Where("name = ?", id).Limit(1).Find(row)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return decode(row)
+}
+
+// List returns the stored policies, or only the enabled ones.
+func (s *Store) List(enabledOnly bool) ([]Policy, error) {
+	rows := []iam.AccessPolicyTable{}
+	tx := s.db.Order("name")
+	if enabledOnly {
+		tx = tx.Where("enabled = ?", true)
+	}
+
+	err := tx.Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]Policy, 0, len(rows))
+	for i := range rows {
+		p, err := decode(&rows[i])
+		if err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, *p)
+	}
+
+	return policies, nil
+}
+
+// Load replaces the policies of the engine with the enabled stored ones.
+func (s *Store) Load(e *Engine) error {
+	policies, err := s.List(true)
+	if err != nil {
+		return err
+	}
+
+	return e.SetPolicies(policies)
+}
+
+// Subject builds the subject attributes of a user: id, uid, name, email,
+// email_verified, org_id, roles, claims (name to values) and, within an org,
+// member_role.
+func Subject(db *iam.IamDb, userId int32, orgId sql.NullInt32) (Attributes, error) {
+	user, err := db.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !orgId.Valid {
+		orgId = user.OrgId
+	}
+
+	auth, err := db.GetUserAuthorization(userId, orgId)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string][]string{}
+	for _, c := range auth.Claims {
+		claims[c.Name] = append(claims[c.Name], c.Value)
+	}
+
+	subject := Attributes{
+		"id":             user.Id,
+		"uid":            user.Uid.String(),
+		"name":           user.Name,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"roles":          auth.Roles,
+		"claims":         claims,
+	}
+
+	if orgId.Valid {
+		subject["org_id"] = orgId.Int32
+
+		role, err := iam.NewMembershipStore(db, nil).EffectiveRole(orgId.Int32, userId)
+		if err != nil {
+			return nil, err
+		}
+
+		if role != "" {
+			subject["member_role"] = role
+		}
+	}
+
+	return subject, nil
+}
+
+func decode(row *iam.AccessPolicyTable) (*Policy, error) {
+	p := &Policy{}
+	err := json.Unmarshal([]byte(row.Document), p)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Id = row.Name
+	return p, nil
+}
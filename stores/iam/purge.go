@@ -0,0 +1,296 @@
+package iam
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type PurgeOptions struct {
+	// Retention is how long soft deleted orgs and users are kept, and can be
+	// restored, before they are removed for good.
+	Retention time.Duration
+}
+
+func DefaultPurgeOptions() PurgeOptions {
+	return PurgeOptions{
+		Retention: 30 * 24 * time.Hour,
+	}
+}
+
+type PurgeResult struct {
+	Orgs  int64 `json:"orgs"`
+	Users int64 `json:"users"`
+}
+
+// Purger permanently removes orgs and users that were soft deleted longer
+// than the retention period ago, together with the rows that belong to them.
+// It is meant to run as a periodic job.
+type Purger struct {
+	db      *IamDb
+	Options PurgeOptions
+	Now     func() time.Time
+}
+
+func NewPurger(db *IamDb, options *PurgeOptions) *Purger {
+	o := DefaultPurgeOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &Purger{
+		db:      db,
+		Options: o,
+		Now:     time.Now,
+	}
+}
+
+// WithTx returns a copy of the purger that works in the transaction of tx,
+// see IamDb.WithTx.
+func (p *Purger) WithTx(tx *IamDb) *Purger {
+	c := *p
+	c.db = tx
+	return &c
+}
+
+// WithContext returns a copy of the purger whose queries use ctx.
+func (p *Purger) WithContext(ctx context.Context) *Purger {
+	return p.WithTx(p.db.WithContext(ctx))
+}
+
+// userOwnedTables are removed together with a purged user.
+var userOwnedTables = []interface{}{
+	&UserPasswordTable{},
+	&UserPasswordHistoryTable{},
+	&UserClaimTable{},
+	&UserLoginProviderTable{},
+	&UserLoginTokenTable{},
+	&UserApiKeyTable{},
+	&UserRoleTable{},
+	&UserSessionTable{},
+	&UserTokenTable{},
+	&UserAuthenticatorTable{},
+	&UserRecoveryCodeTable{},
+	&UserRememberedDeviceTable{},
+	&UserCredentialTable{},
+	&OAuthTokenTable{},
+	&OrgMemberTable{},
+	&OrgJoinRequestTable{},
+}
+
+func (p *Purger) Purge() (*PurgeResult, error) {
+	orgs, err := p.PurgeOrgs()
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := p.PurgeUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PurgeResult{Orgs: orgs, Users: users}, nil
+}
+
+// PurgeOrgs removes expired orgs with their domains, memberships,
+// invitations, join requests, roles and the assignments of those roles, and
+// the api keys and OAuth clients scoped to them. Access policies that compare
+// an org_id with a purged org are disabled, so they cannot apply to an org
+// that gets the id later. Users that belonged to a purged org are kept but no
+// longer point at it, and child orgs move up to the purged org's parent.
+func (p *Purger) PurgeOrgs() (int64, error) {
+	var count int64
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		ids := []int32{}
+		err := tx.Unscoped().Model(&OrgTable{}).
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", p.cutoff()).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		roleIds := []int32{}
+		err = tx.Model(&RoleTable{}).Where("org_id IN ?", ids).Pluck("id", &roleIds).Error
+		if err != nil {
+			return err
+		}
+
+		if len(roleIds) > 0 {
+			err = tx.Where("role_id IN ?", roleIds).Delete(&UserRoleTable{}).Error
+			if err != nil {
+				return err
+			}
+
+			err = tx.Where("role_id IN ?", roleIds).Delete(&RoleClaimTable{}).Error
+			if err != nil {
+				return err
+			}
+
+			err = tx.Where("id IN ?", roleIds).Delete(&RoleTable{}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Unscoped().Model(&UserTable{}).Where("organization_id IN ?", ids).Updates(map[string]interface{}{
+			"organization_id":   nil,
+			"concurrency_stamp": uuid.NewString(),
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("org_id IN ?", ids).Delete(&OrgMemberTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("org_id IN ?", ids).Delete(&OrgInvitationTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("org_id IN ?", ids).Delete(&OrgJoinRequestTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("org_id IN ?", ids).Delete(&OrgDomain{}).Error
+		if err != nil {
+			return err
+		}
+
+		// an api key without its org would work in every org, so it goes
+		err = tx.Where("org_id IN ?", ids).Delete(&UserApiKeyTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("client_id IN (?)", tx.Model(&OAuthClientTable{}).Select("id").Where("org_id IN ?", ids)).
+			Delete(&OAuthTokenTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("org_id IN ?", ids).Delete(&OAuthClientTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = p.disableOrgPolicies(tx, ids)
+		if err != nil {
+			return err
+		}
+
+		err = detachChildOrgs(tx, ids)
+		if err != nil {
+			return err
+		}
+
+		res := tx.Unscoped().Where("id IN ?", ids).Delete(&OrgTable{})
+		count = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// PurgeUsers removes expired users and everything that belongs to them.
+func (p *Purger) PurgeUsers() (int64, error) {
+	var count int64
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		ids := []int32{}
+		err := tx.Unscoped().Model(&UserTable{}).
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", p.cutoff()).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		for _, table := range userOwnedTables {
+			err = tx.Where("user_id IN ?", ids).Delete(table).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		res := tx.Unscoped().Where("id IN ?", ids).Delete(&UserTable{})
+		count = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// disableOrgPolicies disables the enabled access policies that refer to one
+// of the orgs.
+func (p *Purger) disableOrgPolicies(tx *gorm.DB, orgIds []int32) error {
+	policies := []AccessPolicyTable{}
+	err := tx.Where("enabled = ?", true).Find(&policies).Error
+	if err != nil {
+		return err
+	}
+
+	ids := []int32{}
+	for _, policy := range policies {
+		if policy.referencesOrg(orgIds) {
+			ids = append(ids, policy.Id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return tx.Model(&AccessPolicyTable{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+		"enabled":    false,
+		"updated_at": p.Now(),
+	}).Error
+}
+
+func detachChildOrgs(tx *gorm.DB, ids []int32) error {
+	orgs := []OrgTable{}
+	err := tx.Unscoped().Select("id", "parent_id", "path").Where("id IN ?", ids).Find(&orgs).Error
+	if err != nil {
+		return err
+	}
+
+	// deepest first, so a child whose parent and grandparent are both purged
+	// ends up below the nearest surviving ancestor
+	slices.SortFunc(orgs, func(a, b OrgTable) int {
+		return len(b.GetPath()) - len(a.GetPath())
+	})
+
+	for _, org := range orgs {
+		err = tx.Unscoped().Model(&OrgTable{}).
+			Where("parent_id = ?", org.Id).
+			UpdateColumn("parent_id", org.ParentId).Error
+		if err != nil {
+			return err
+		}
+
+		segment := fmt.Sprintf("/%d/", org.Id)
+		err = tx.Unscoped().Model(&OrgTable{}).
+			Where("path LIKE ?", "%"+segment+"%").
+			UpdateColumn("path", gorm.Expr("REPLACE(path, ?, '/')", segment)).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Purger) cutoff() time.Time {
+	return p.Now().Add(-p.Options.Retention)
+}
@@ -0,0 +1,164 @@
+package iam_test
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	store := iam.NewOrgStore(db.DB, nil)
+	org := &iam.Org{Name: "Globex", Domains: []string{"globex.test"}}
+	assert.NoError(store.Create(org))
+
+	n, err := store.DeleteByUid(org.Id)
+	assert.NoError(err)
+	assert.Equal(int64(1), n)
+
+	_, err = store.FindByUid(org.Id)
+	assert.ErrorIs(err, gorm.ErrRecordNotFound)
+	count, _ := store.CountAll()
+	assert.Equal(int64(0), count)
+
+	deleted, err := store.Deleted()
+	assert.NoError(err)
+	assert.Len(deleted, 1)
+
+	err = store.Save(&iam.Org{Id: org.Id, Name: "Globex"})
+	assert.ErrorIs(err, iam.ErrOrgDeleted)
+	assert.ErrorIs(err, iam.ErrConflict)
+
+	n, err = store.RestoreByUid(org.Id)
+	assert.NoError(err)
+	assert.Equal(int64(1), n)
+
+	restored, err := store.FindByUid(org.Id, "domains")
+	assert.NoError(err)
+	assert.Equal([]string{"globex.test"}, restored.Domains)
+
+	user, err := db.NewUserWithPassword("otto", "otto@test.org", "Secr3t!pass")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	assert.NoError(db.DeleteUser(user.Id))
+	_, err = db.GetUserById(user.Id)
+	assert.ErrorIs(err, gorm.ErrRecordNotFound)
+	assert.ErrorIs(db.DeleteUser(user.Id), gorm.ErrRecordNotFound)
+
+	res, err := iam.NewSignInManager(db, nil).PasswordSignIn("otto", "Secr3t!pass", nil)
+	assert.NoError(err)
+	assert.False(res.Succeeded())
+
+	assert.NoError(db.RestoreUser(user.Id))
+	restoredUser, err := db.GetUserById(user.Id)
+	assert.NoError(err)
+	assert.NotEqual(user.ConcurrencyStamp, restoredUser.ConcurrencyStamp)
+	assert.ErrorIs(db.RestoreUser(user.Id), gorm.ErrRecordNotFound)
+}
+
+func TestPurger(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	store := iam.NewOrgStore(db.DB, nil)
+	org := &iam.Org{Name: "Initech", Domains: []string{"initech.test"}}
+	assert.NoError(store.Create(org))
+	table := iam.OrgTable{}
+	assert.NoError(db.First(&table, "uid = ?", org.Id).Error)
+
+	member, err := db.NewUser("peter", "peter@initech.test")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	member.OrgId = sql.NullInt32{Int32: table.Id, Valid: true}
+	assert.NoError(member.Save(db))
+
+	role, err := db.NewRole("manager", "", sql.NullInt32{Int32: table.Id, Valid: true})
+	assert.NoError(err)
+	_, err = db.AddRoleClaim(role.Id, "reports", "approve")
+	assert.NoError(err)
+	assert.NoError(db.AssignRole(member.Id, role.Id))
+
+	leaver, err := db.NewUserWithPassword("milton", "milton@initech.test", "Secr3t!pass")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	_, err = db.AddUserClaim(leaver.Id, "desk", "basement")
+	assert.NoError(err)
+
+	orgId := sql.NullInt32{Int32: table.Id, Valid: true}
+	_, _, err = iam.NewApiKeyStore(db, nil).Create(&iam.NewApiKey{UserId: member.Id, Name: "ci", OrgId: orgId})
+	assert.NoError(err)
+	_, _, err = db.RegisterOAuthClient(&iam.NewOAuthClient{Name: "tps", OrgId: orgId, RedirectUris: []string{"http://localhost/cb"}})
+	assert.NoError(err)
+
+	scoped := fmt.Sprintf(`{"id":"initech","effect":"allow","actions":["*"],"condition":{"all":[{"attr":"subject.org_id","op":"in","value":[%d]}]}}`, table.Id)
+	other := fmt.Sprintf(`{"id":"other","effect":"allow","actions":["*"],"condition":{"attr":"subject.org_id","op":"eq","value":%d}}`, table.Id+1)
+	assert.NoError(db.Create(&iam.AccessPolicyTable{Name: "initech", Document: scoped, Enabled: true}).Error)
+	assert.NoError(db.Create(&iam.AccessPolicyTable{Name: "other", Document: other, Enabled: true}).Error)
+
+	ok, err := db.UserHasRole(member.Id, orgId, "manager")
+	assert.NoError(err)
+	assert.True(ok)
+
+	_, err = store.DeleteByUid(org.Id)
+	assert.NoError(err)
+	assert.NoError(db.DeleteUser(leaver.Id))
+
+	// the roles of a deleted org stop applying right away
+	ok, err = db.UserHasRole(member.Id, orgId, "manager")
+	assert.NoError(err)
+	assert.False(ok)
+
+	purger := iam.NewPurger(db, nil)
+
+	// nothing is old enough yet
+	result, err := purger.Purge()
+	assert.NoError(err)
+	assert.Equal(iam.PurgeResult{}, *result)
+
+	purger.Now = func() time.Time { return time.Now().Add(31 * 24 * time.Hour) }
+	result, err = purger.Purge()
+	assert.NoError(err)
+	assert.Equal(iam.PurgeResult{Orgs: 1, Users: 1}, *result)
+
+	n, err := store.RestoreByUid(org.Id)
+	assert.NoError(err)
+	assert.Equal(int64(0), n)
+	assert.ErrorIs(db.RestoreUser(leaver.Id), gorm.ErrRecordNotFound)
+
+	var left int64
+	db.Model(&iam.OrgDomain{}).Count(&left)
+	assert.Equal(int64(0), left)
+	db.Model(&iam.RoleTable{}).Count(&left)
+	assert.Equal(int64(0), left)
+	db.Model(&iam.RoleClaimTable{}).Count(&left)
+	assert.Equal(int64(0), left)
+	db.Model(&iam.UserRoleTable{}).Count(&left)
+	assert.Equal(int64(0), left)
+	db.Model(&iam.UserClaimTable{}).Count(&left)
+	assert.Equal(int64(0), left)
+	db.Model(&iam.UserPasswordTable{}).Count(&left)
+	assert.Equal(int64(0), left)
+	db.Model(&iam.UserApiKeyTable{}).Count(&left)
+	assert.Equal(int64(0), left)
+	db.Model(&iam.OAuthClientTable{}).Count(&left)
+	assert.Equal(int64(0), left)
+
+	enabled := []string{}
+	assert.NoError(db.Model(&iam.AccessPolicyTable{}).Where("enabled = ?", true).Pluck("name", &enabled).Error)
+	assert.Equal([]string{"other"}, enabled)
+
+	kept, err := db.GetUserById(member.Id)
+	assert.NoError(err)
+	assert.False(kept.OrgId.Valid)
+}
@@ -2,17 +2,26 @@ package iam
 
 import (
 	"database/sql"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type RoleTable struct {
 	Id          int32         `gorm:"column:id;primary_key;auto_increment" json:"id"`
 	Uid         uuid.UUID     `gorm:"column:uid;type:uuid;;index:ix_roles_uid,unique" json:"uid"`
-	OrgId       sql.NullInt32 `gorm:"column:org_id" json:"organizationId"`
-	Name        string        `gorm:"column:name;size:64;index:ix_roles_name,unique" json:"name"`
+	OrgId       sql.NullInt32 `gorm:"column:org_id;index:ix_roles_name,unique,priority:1" json:"organizationId"`
+	Name        string        `gorm:"column:name;size:64;index:ix_roles_name,unique,priority:2" json:"name"`
 	Description string        `gorm:"column:description;size:256" json:"description"`
-	Org         *OrgTable     `gorm:"foreignKey:OrgId;references:Id" json:"organization"`
+	// ConcurrencyStamp changes on every write to the role or its claims.
+	ConcurrencyStamp string           `gorm:"column:concurrency_stamp;size:128" json:"concurrencyStamp"`
+	Org              *OrgTable        `gorm:"foreignKey:OrgId;references:Id" json:"organization"`
+	Claims           []RoleClaimTable `gorm:"foreignKey:RoleId;references:Id" json:"claims"`
+
+	stamp string
 }
 
 func (RoleTable) TableName() string {
@@ -20,10 +29,10 @@ func (RoleTable) TableName() string {
 }
 
 type RoleClaimTable struct {
-	Id        int32        `gorm:"column:id;primary_key,auto_increment" json:"id"`
+	Id        int32        `gorm:"column:id;primary_key;auto_increment" json:"id"`
 	Uid       uuid.UUID    `gorm:"column:uid;type:uuid;index:ix_role_claims_uid,unique" json:"uid"`
-	RoleId    int32        `gorm:"column:role_id;index:ix_role_claims_role_id,unique" json:"roleId"`
-	Name      string       `gorm:"column:name;size:64,index:ix_role_claims_name,unique" json:"name"`
+	RoleId    int32        `gorm:"column:role_id;index:ix_role_claims_role_id" json:"roleId"`
+	Name      string       `gorm:"column:name;size:64;index:ix_role_claims_name" json:"name"`
 	Value     string       `gorm:"column:value;size:128" json:"value"`
 	CreatedAt sql.NullTime `gorm:"column:created_at" json:"created_at"`
 }
@@ -31,3 +40,138 @@ type RoleClaimTable struct {
 func (RoleClaimTable) TableName() string {
 	return "role_claims"
 }
+
+func (db *IamDb) NewRole(name string, description string, orgId sql.NullInt32) (*RoleTable, error) {
+	n := strings.TrimSpace(name)
+	n = strings.ToLower(n)
+
+	if n == "" {
+		return nil, invalidField("name", "required", "role name is required")
+	}
+
+	var count int64
+	tx := db.DB.Model(&RoleTable{}).Where("name = ?", n)
+	if orgId.Valid {
+		tx = tx.Where("org_id = ?", orgId.Int32)
+	} else {
+		tx = tx.Where("org_id IS NULL")
+	}
+
+	tx.Count(&count)
+	if count > 0 {
+		return nil, &ConflictError{Entity: "role", Fields: []string{"name"}}
+	}
+
+	role := RoleTable{
+		Uid:              uuid.New(),
+		OrgId:            orgId,
+		Name:             n,
+		Description:      description,
+		ConcurrencyStamp: uuid.NewString(),
+	}
+
+	err := db.Save(&role).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// Save updates the role when the stored concurrency stamp is still the one
+// the role was read with, and returns ErrConcurrencyConflict otherwise.
+func (role *RoleTable) Save(db *IamDb) error {
+	n := strings.TrimSpace(role.Name)
+	n = strings.ToLower(n)
+	if n == "" {
+		return invalidField("name", "required", "role name is required")
+	}
+
+	role.Name = n
+	if role.Id == 0 {
+		if role.ConcurrencyStamp == "" {
+			role.ConcurrencyStamp = uuid.NewString()
+		}
+
+		return db.Omit(clause.Associations).Create(role).Error
+	}
+
+	expected := role.stamp
+	role.ConcurrencyStamp = uuid.NewString()
+	err := updateChecked(db.DB, role, role.Id, expected)
+	if err != nil {
+		role.ConcurrencyStamp = expected
+		return err
+	}
+
+	return nil
+}
+
+func (role *RoleTable) AfterFind(tx *gorm.DB) error {
+	role.stamp = role.ConcurrencyStamp
+	return nil
+}
+
+func (role *RoleTable) AfterCreate(tx *gorm.DB) error {
+	role.stamp = role.ConcurrencyStamp
+	return nil
+}
+
+func (role *RoleTable) AfterUpdate(tx *gorm.DB) error {
+	if writesStamp(tx.Statement) {
+		role.stamp = role.ConcurrencyStamp
+	}
+
+	return nil
+}
+
+func (db *IamDb) GetRoleById(id int32) (*RoleTable, error) {
+	var role RoleTable
+	err := db.DB.Where("id = ?", id).First(&role).Error
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (db *IamDb) AddRoleClaim(roleId int32, name string, value string) (*RoleClaimTable, error) {
+	claim := RoleClaimTable{
+		Uid:       uuid.New(),
+		RoleId:    roleId,
+		Name:      strings.TrimSpace(name),
+		Value:     value,
+		CreatedAt: sql.NullTime{Time: time.Now(), Valid: true},
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Save(&claim).Error
+		if err != nil {
+			return err
+		}
+
+		return touchRole(tx, roleId)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &claim, nil
+}
+
+func (db *IamDb) RemoveRoleClaim(roleId int32, name string, value string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("role_id = ? AND name = ? AND value = ?", roleId, strings.TrimSpace(name), value).
+			Delete(&RoleClaimTable{}).Error
+		if err != nil {
+			return err
+		}
+
+		return touchRole(tx, roleId)
+	})
+}
+
+// touchRole moves the role to a new stamp so editors holding the old one
+// see the claim change as a conflict.
+func touchRole(tx *gorm.DB, roleId int32) error {
+	return tx.Model(&RoleTable{}).Where("id = ?", roleId).Update("concurrency_stamp", uuid.NewString()).Error
+}
@@ -0,0 +1,310 @@
+package iam
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	SessionRevokedByUser      = "signed_out"
+	SessionRevokedAll         = "signed_out_everywhere"
+	SessionRevokedReuse       = "refresh_token_reused"
+	SessionRevokedStampChange = "account_changed"
+)
+
+var (
+	ErrSessionInvalid      = errors.New("session is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used; the session has been revoked")
+	ErrSessionStampChanged = errors.New("account changed; the session has been revoked")
+)
+
+type SessionInfo struct {
+	Device    string
+	Ip        string
+	UserAgent string
+}
+
+type SessionOptions struct {
+	// Lifetime is how long a session lasts without being refreshed.
+	Lifetime time.Duration
+	// MaxLifetime caps the total age of a session regardless of refreshes.
+	// Zero means no cap.
+	MaxLifetime time.Duration
+}
+
+func DefaultSessionOptions() SessionOptions {
+	return SessionOptions{
+		Lifetime:    14 * 24 * time.Hour,
+		MaxLifetime: 90 * 24 * time.Hour,
+	}
+}
+
+type SessionStore struct {
+	db      *IamDb
+	Options SessionOptions
+	Now     func() time.Time
+}
+
+func NewSessionStore(db *IamDb, options *SessionOptions) *SessionStore {
+	o := DefaultSessionOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &SessionStore{
+		db:      db,
+		Options: o,
+		Now:     time.Now,
+	}
+}
+
+// WithTx returns a copy of the store that works in the transaction of tx,
+// see IamDb.WithTx.
+func (s *SessionStore) WithTx(tx *IamDb) *SessionStore {
+	c := *s
+	c.db = tx
+	return &c
+}
+
+// WithContext returns a copy of the store whose queries use ctx.
+func (s *SessionStore) WithContext(ctx context.Context) *SessionStore {
+	return s.WithTx(s.db.WithContext(ctx))
+}
+
+// Create starts a session for the user and returns its first refresh token.
+func (s *SessionStore) Create(userId int32, info *SessionInfo) (string, *UserSessionTable, error) {
+	concurrency, security, err := s.stamps(s.db.DB, userId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := s.Now()
+	session := &UserSessionTable{
+		Uid:              uuid.New(),
+		UserId:           userId,
+		ConcurrencyStamp: concurrency,
+		SecurityStamp:    security,
+		CreatedAt:        now,
+	}
+
+	session.setInfo(info)
+	token := s.rotate(session, now)
+
+	err = s.db.Create(session).Error
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, session, nil
+}
+
+// Refresh exchanges the refresh token for a new one. Presenting a token that
+// has already been exchanged revokes the whole session, as does a change to
+// the user's concurrency or security stamp since the session was created.
+func (s *SessionStore) Refresh(token string, info *SessionInfo) (string, *UserSessionTable, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	uid, err := uuid.Parse(id)
+	if !ok || err != nil || secret == "" {
+		return "", nil, ErrSessionInvalid
+	}
+
+	var next string
+	var cause error
+	session := &UserSessionTable{}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("uid = ?", uid).Limit(1).Find(session)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		now := s.Now()
+		if res.RowsAffected == 0 || !session.IsActiveAt(now) {
+			return ErrSessionInvalid
+		}
+
+		hash := hashApiKeySecret(secret)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(session.TokenHash)) != 1 {
+			cause = ErrRefreshTokenReused
+			return s.revoke(tx, session, SessionRevokedReuse)
+		}
+
+		concurrency, security, err := s.stamps(tx, session.UserId)
+		if err != nil {
+			return err
+		}
+
+		if concurrency != session.ConcurrencyStamp || security != session.SecurityStamp {
+			cause = ErrSessionStampChanged
+			return s.revoke(tx, session, SessionRevokedStampChange)
+		}
+
+		session.setInfo(info)
+		next = s.rotate(session, now)
+
+		res = tx.Model(session).
+			Where("token_hash = ?", hash).
+			Select("token_hash", "generation", "device", "ip", "user_agent", "last_seen_at", "expires_at").
+			Updates(session)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			// another request rotated the token first
+			cause = ErrSessionInvalid
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if cause != nil {
+		return "", nil, cause
+	}
+
+	return next, session, nil
+}
+
+// ListActive returns the user's sessions that can still be refreshed.
+// Sessions made stale by a stamp change are revoked along the way.
+func (s *SessionStore) ListActive(userId int32) ([]UserSessionTable, error) {
+	err := s.RevokeStale(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []UserSessionTable{}
+	err = s.db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userId, s.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (s *SessionStore) Revoke(uid uuid.UUID) error {
+	res := s.db.Model(&UserSessionTable{}).
+		Where("uid = ? AND revoked_at IS NULL", uid).
+		Updates(map[string]interface{}{
+			"revoked_at":     s.Now(),
+			"revoked_reason": SessionRevokedByUser,
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrSessionInvalid
+	}
+
+	return nil
+}
+
+// RevokeAll signs the user out everywhere. Pass the current session's uid in
+// except to keep that one.
+func (s *SessionStore) RevokeAll(userId int32, except ...uuid.UUID) (int64, error) {
+	q := s.db.Model(&UserSessionTable{}).Where("user_id = ? AND revoked_at IS NULL", userId)
+	if len(except) > 0 {
+		q = q.Where("uid NOT IN ?", except)
+	}
+
+	res := q.Updates(map[string]interface{}{
+		"revoked_at":     s.Now(),
+		"revoked_reason": SessionRevokedAll,
+	})
+
+	return res.RowsAffected, res.Error
+}
+
+// RevokeStale revokes the user's sessions that were issued before the user's
+// concurrency or security stamp last changed.
+func (s *SessionStore) RevokeStale(userId int32) error {
+	concurrency, security, err := s.stamps(s.db.DB, userId)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Model(&UserSessionTable{}).
+		Where("user_id = ? AND revoked_at IS NULL", userId).
+		Where("concurrency_stamp <> ? OR security_stamp <> ?", concurrency, security).
+		Updates(map[string]interface{}{
+			"revoked_at":     s.Now(),
+			"revoked_reason": SessionRevokedStampChange,
+		}).Error
+}
+
+func (s *SessionStore) revoke(tx *gorm.DB, session *UserSessionTable, reason string) error {
+	now := s.Now()
+	session.RevokedAt = sql.NullTime{Time: now, Valid: true}
+	session.RevokedReason = sql.NullString{String: reason, Valid: true}
+
+	return tx.Model(session).
+		Select("revoked_at", "revoked_reason").
+		Updates(session).Error
+}
+
+// rotate generates the next refresh token for the session and extends its
+// expiry, bounded by MaxLifetime.
+func (s *SessionStore) rotate(session *UserSessionTable, now time.Time) string {
+	secret := uniuri.NewLen(48)
+	session.TokenHash = hashApiKeySecret(secret)
+	session.Generation++
+	session.LastSeenAt = now
+	session.ExpiresAt = now.Add(s.Options.Lifetime)
+
+	if s.Options.MaxLifetime > 0 {
+		limit := session.CreatedAt.Add(s.Options.MaxLifetime)
+		if session.ExpiresAt.After(limit) {
+			session.ExpiresAt = limit
+		}
+	}
+
+	return session.Uid.String() + "." + secret
+}
+
+func (s *SessionStore) stamps(tx *gorm.DB, userId int32) (string, string, error) {
+	user := UserTable{}
+	err := tx.Model(&UserTable{}).Select("id", "concurrency_stamp").Where("id = ?", userId).First(&user).Error
+	if err != nil {
+		return "", "", err
+	}
+
+	pw := UserPasswordTable{}
+	err = tx.Model(&UserPasswordTable{}).Select("security_stamp").Where("user_id = ?", userId).Limit(1).Find(&pw).Error
+	if err != nil {
+		return "", "", err
+	}
+
+	return user.ConcurrencyStamp, pw.SecurityStamp, nil
+}
+
+func (session *UserSessionTable) setInfo(info *SessionInfo) {
+	if info == nil {
+		return
+	}
+
+	if info.Device != "" {
+		session.Device = sql.NullString{String: info.Device, Valid: true}
+	}
+
+	if info.Ip != "" {
+		session.Ip = sql.NullString{String: info.Ip, Valid: true}
+	}
+
+	if info.UserAgent != "" {
+		session.UserAgent = sql.NullString{String: info.UserAgent, Valid: true}
+	}
+}
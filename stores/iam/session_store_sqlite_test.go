@@ -0,0 +1,69 @@
+package iam_test
+
+import (
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestSessionStore(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUserWithPassword("heidi", "heidi@test.org", "Secr3t!pass")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	store := iam.NewSessionStore(db, nil)
+
+	token, session, err := store.Create(user.Id, &iam.SessionInfo{Device: "laptop", Ip: "10.0.0.1", UserAgent: "test"})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	assert.NotContains(session.TokenHash, token)
+
+	next, session, err := store.Refresh(token, &iam.SessionInfo{Ip: "10.0.0.2"})
+	assert.NoError(err)
+	assert.NotEqual(token, next)
+	assert.Equal("10.0.0.2", session.Ip.String)
+	assert.Equal(int32(2), session.Generation)
+
+	_, _, err = store.Refresh(token, nil)
+	assert.ErrorIs(err, iam.ErrRefreshTokenReused)
+
+	_, _, err = store.Refresh(next, nil)
+	assert.ErrorIs(err, iam.ErrSessionInvalid)
+
+	phone, _, err := store.Create(user.Id, &iam.SessionInfo{Device: "phone"})
+	assert.NoError(err)
+	_, current, err := store.Create(user.Id, &iam.SessionInfo{Device: "desktop"})
+	assert.NoError(err)
+
+	sessions, err := store.ListActive(user.Id)
+	assert.NoError(err)
+	assert.Len(sessions, 2)
+
+	count, err := store.RevokeAll(user.Id, current.Uid)
+	assert.NoError(err)
+	assert.Equal(int64(1), count)
+
+	_, _, err = store.Refresh(phone, nil)
+	assert.ErrorIs(err, iam.ErrSessionInvalid)
+
+	tablet, _, err := store.Create(user.Id, &iam.SessionInfo{Device: "tablet"})
+	assert.NoError(err)
+
+	user.Password.SetPassword("N3w!password")
+	assert.NoError(db.Model(&iam.UserPasswordTable{}).Where("user_id = ?", user.Id).
+		Update("security_stamp", user.Password.SecurityStamp).Error)
+
+	_, _, err = store.Refresh(tablet, nil)
+	assert.ErrorIs(err, iam.ErrSessionStampChanged)
+
+	sessions, err = store.ListActive(user.Id)
+	assert.NoError(err)
+	assert.Len(sessions, 0)
+}
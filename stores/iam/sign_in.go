@@ -0,0 +1,536 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"gorm.io/gorm"
+)
+
+type SignInStatus int
+
+const (
+	SignInFailed SignInStatus = iota
+	SignInSucceeded
+	SignInLockedOut
+	SignInNotAllowed
+	SignInRequiresTwoFactor
+)
+
+func (s SignInStatus) String() string {
+	switch s {
+	case SignInSucceeded:
+		return "succeeded"
+	case SignInLockedOut:
+		return "locked_out"
+	case SignInNotAllowed:
+		return "not_allowed"
+	case SignInRequiresTwoFactor:
+		return "requires_two_factor"
+	default:
+		return "failed"
+	}
+}
+
+type SignInResult struct {
+	Status SignInStatus
+	User   *UserTable
+	// Ticket is set when the sign in requires the second factor and must be
+	// passed to TwoFactorSignIn. It expires after TwoFactorTicketLifetime and
+	// is spent by the first successful TwoFactorSignIn.
+	Ticket string
+}
+
+func (r *SignInResult) Succeeded() bool {
+	return r.Status == SignInSucceeded
+}
+
+func (r *SignInResult) IsLockedOut() bool {
+	return r.Status == SignInLockedOut
+}
+
+func (r *SignInResult) IsNotAllowed() bool {
+	return r.Status == SignInNotAllowed
+}
+
+func (r *SignInResult) RequiresTwoFactor() bool {
+	return r.Status == SignInRequiresTwoFactor
+}
+
+type SignInOptions struct {
+	// MaxFailedAttempts is the number of consecutive failures before the
+	// password is locked. Zero disables lockout.
+	MaxFailedAttempts int32
+	// LockoutDuration is how long a lockout lasts before it is lifted on the
+	// next attempt. Zero keeps the password locked until an admin unlocks it.
+	LockoutDuration       time.Duration
+	RequireConfirmedEmail bool
+	// TwoFactorRequired is consulted after a valid password. Returning true
+	// ends the sign in with SignInRequiresTwoFactor.
+	TwoFactorRequired func(user *UserTable) (bool, error)
+	// TwoFactorTicketLifetime is how long the ticket of a sign in that
+	// requires the second factor stays valid. Zero uses the default.
+	TwoFactorTicketLifetime time.Duration
+	// VerifyTwoFactor checks the code given in TwoFactorSignIn.
+	VerifyTwoFactor func(user *UserTable, code string) (bool, error)
+	// IsDeviceRemembered lets PasswordSignInFromDevice skip the second factor
+	// for a device the user chose to remember.
+	IsDeviceRemembered func(user *UserTable, token string) (bool, error)
+}
+
+func DefaultSignInOptions() SignInOptions {
+	return SignInOptions{
+		MaxFailedAttempts:       5,
+		LockoutDuration:         15 * time.Minute,
+		TwoFactorTicketLifetime: 5 * time.Minute,
+	}
+}
+
+type SignInManager struct {
+	db      *IamDb
+	Options SignInOptions
+	Now     func() time.Time
+	// Audit, when set, records every sign in as a login.<status> event, or
+	// login.two_factor.<status> for TwoFactorSignIn.
+	Audit *AuditLog
+}
+
+func NewSignInManager(db *IamDb, options *SignInOptions) *SignInManager {
+	o := DefaultSignInOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &SignInManager{
+		db:      db,
+		Options: o,
+		Now:     time.Now,
+	}
+}
+
+// WithTx returns a copy of the manager that works in the transaction of tx,
+// see IamDb.WithTx.
+func (m *SignInManager) WithTx(tx *IamDb) *SignInManager {
+	c := *m
+	c.db = tx
+	return &c
+}
+
+// WithContext returns a copy of the manager whose queries use ctx.
+func (m *SignInManager) WithContext(ctx context.Context) *SignInManager {
+	return m.WithTx(m.db.WithContext(ctx))
+}
+
+// PasswordSignIn verifies the password of the user with the given name or
+// email and applies the lockout policy. Unknown users and wrong passwords are
+// both reported as SignInFailed and take as long to check; error is only set
+// when the database fails.
+func (m *SignInManager) PasswordSignIn(nameOrEmail string, password string, ip *string) (*SignInResult, error) {
+	return m.PasswordSignInFromDevice(nameOrEmail, password, "", ip)
+}
+
+// PasswordSignInFromDevice is PasswordSignIn for a client that presents a
+// remembered device token, which may stand in for the second factor.
+func (m *SignInManager) PasswordSignInFromDevice(nameOrEmail string, password string, deviceToken string, ip *string) (*SignInResult, error) {
+	n := strings.TrimSpace(nameOrEmail)
+	n = strings.ToLower(n)
+	result, err := m.passwordSignIn(n, password, deviceToken, ip)
+	return m.audit("login", n, ip, result, err)
+}
+
+func (m *SignInManager) passwordSignIn(n string, password string, deviceToken string, ip *string) (*SignInResult, error) {
+
+	user := UserTable{}
+	res := m.db.DB.Preload("Password").Where("name = ? OR email = ?", n, n).Limit(1).Find(&user)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 || user.Password == nil {
+		err := validateDummyPassword(password)
+		if err != nil {
+			return nil, err
+		}
+
+		return &SignInResult{Status: SignInFailed}, nil
+	}
+
+	return m.checkPasswordSignIn(&user, password, deviceToken, ip)
+}
+
+// dummyPassword is checked for users that do not exist or have no password,
+// so that a failed sign in takes as long whether or not the account exists.
+// It is hashed on first use, and again when SecretHashCost changes.
+var dummyPassword struct {
+	sync.Mutex
+	cost int
+	hash string
+}
+
+func validateDummyPassword(password string) error {
+	dummyPassword.Lock()
+	if dummyPassword.hash == "" || dummyPassword.cost != SecretHashCost {
+		hash, err := HashSecret(uniuri.NewLen(32))
+		if err != nil {
+			dummyPassword.Unlock()
+			return err
+		}
+
+		dummyPassword.hash = hash
+		dummyPassword.cost = SecretHashCost
+	}
+
+	pw := &UserPasswordTable{Password: dummyPassword.hash}
+	dummyPassword.Unlock()
+
+	_ = pw.ValidatePassword(password)
+	return nil
+}
+
+func (m *SignInManager) CheckPasswordSignIn(user *UserTable, password string, ip *string) (*SignInResult, error) {
+	result, err := m.checkPasswordSignIn(user, password, "", ip)
+	return m.audit("login", user.Name, ip, result, err)
+}
+
+// TwoFactorSignIn completes a sign in that ended with SignInRequiresTwoFactor,
+// given the Ticket of its result. Wrong codes count towards the same lockout
+// as wrong passwords; an unknown, expired or spent ticket is SignInFailed.
+func (m *SignInManager) TwoFactorSignIn(ticket string, code string, ip *string) (*SignInResult, error) {
+	result, err := m.twoFactorSignIn(ticket, code, ip)
+	return m.audit("login.two_factor", "", ip, result, err)
+}
+
+func (m *SignInManager) twoFactorSignIn(ticket string, code string, ip *string) (*SignInResult, error) {
+	if m.Options.VerifyTwoFactor == nil {
+		return nil, errors.New("no two factor verifier is configured")
+	}
+
+	row := UserTokenTable{}
+	res := m.db.DB.
+		Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+			hashUserToken(TokenPurposeTwoFactor, ticket), TokenPurposeTwoFactor, m.Now()).
+		Limit(1).Find(&row)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return &SignInResult{Status: SignInFailed}, nil
+	}
+
+	user := UserTable{}
+	res = m.db.DB.Preload("Password").Where("id = ?", row.UserId).Limit(1).Find(&user)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 || user.Password == nil {
+		return &SignInResult{Status: SignInFailed}, nil
+	}
+
+	result, ok := m.preCheck(&user)
+	if !ok {
+		return result, nil
+	}
+
+	valid, err := m.Options.VerifyTwoFactor(&user, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if !valid {
+		return m.fail(&user)
+	}
+
+	// spend the ticket; a concurrent sign in that got here first wins
+	res = m.db.DB.Model(&row).Where("used_at IS NULL").Update("used_at", m.Now())
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return &SignInResult{Status: SignInFailed, User: &user}, nil
+	}
+
+	return m.succeed(&user, ip)
+}
+
+func (m *SignInManager) checkPasswordSignIn(user *UserTable, password string, deviceToken string, ip *string) (*SignInResult, error) {
+	result, ok := m.preCheck(user)
+	if !ok {
+		return result, nil
+	}
+
+	err := user.Password.ValidatePassword(password)
+	if err != nil {
+		return m.fail(user)
+	}
+
+	// The failure count is only cleared once every factor has passed, so
+	// alternating passwords and codes cannot dodge the lockout.
+	if m.Options.TwoFactorRequired != nil {
+		required, err := m.Options.TwoFactorRequired(user)
+		if err != nil {
+			return nil, err
+		}
+
+		if required && deviceToken != "" && m.Options.IsDeviceRemembered != nil {
+			remembered, err := m.Options.IsDeviceRemembered(user, deviceToken)
+			if err != nil {
+				return nil, err
+			}
+
+			required = !remembered
+		}
+
+		if required {
+			err = m.db.Transaction(func(tx *gorm.DB) error {
+				return m.clearExpiredLock(tx, user.Id)
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			result.Ticket, err = m.twoFactorTicket(user)
+			if err != nil {
+				return nil, err
+			}
+
+			result.Status = SignInRequiresTwoFactor
+			return result, nil
+		}
+	}
+
+	return m.succeed(user, ip)
+}
+
+// twoFactorTicket issues the ticket that binds TwoFactorSignIn to a sign in
+// whose password was verified. Earlier tickets of the user are discarded.
+func (m *SignInManager) twoFactorTicket(user *UserTable) (string, error) {
+	lifetime := m.Options.TwoFactorTicketLifetime
+	if lifetime <= 0 {
+		lifetime = DefaultSignInOptions().TwoFactorTicketLifetime
+	}
+
+	tokens := &UserTokenStore{db: m.db, Now: m.Now}
+	return tokens.generate(user.Id, TokenPurposeTwoFactor, "", uniuri.NewLen(48), lifetime)
+}
+
+// preCheck applies the account status and lockout rules that come before any
+// credential check. ok is false when the sign in must stop with result.
+func (m *SignInManager) preCheck(user *UserTable) (*SignInResult, bool) {
+	result := &SignInResult{Status: SignInFailed, User: user}
+
+	if user.Password == nil {
+		return result, false
+	}
+
+	if user.Status == UserStatusInactive || user.Status == UserStatusBanned {
+		result.Status = SignInNotAllowed
+		return result, false
+	}
+
+	if m.Options.RequireConfirmedEmail && !user.EmailVerified {
+		result.Status = SignInNotAllowed
+		return result, false
+	}
+
+	pw := user.Password
+	if pw.IsLocked {
+		if !m.canUnlock(pw, m.Now()) {
+			result.Status = SignInLockedOut
+			return result, false
+		}
+
+		user.UnlockPassword()
+		pw.Reset()
+	}
+
+	return result, true
+}
+
+// fail counts a failed attempt in the database, so parallel attempts cannot
+// overwrite each other's count, and locks the password once the stored count
+// reaches MaxFailedAttempts.
+func (m *SignInManager) fail(user *UserTable) (*SignInResult, error) {
+	result := &SignInResult{Status: SignInFailed, User: user}
+	now := m.Now()
+	pw := user.Password
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		err := m.clearExpiredLock(tx, user.Id)
+		if err != nil {
+			return err
+		}
+
+		res := tx.Model(&UserPasswordTable{}).
+			Where("user_id = ?", user.Id).
+			Updates(map[string]interface{}{
+				"failed_attempts": gorm.Expr("failed_attempts + 1"),
+				"last_failed_at":  now,
+				"updated_at":      now,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return notFound("user password")
+		}
+
+		stored := UserPasswordTable{}
+		err = tx.Select("failed_attempts", "is_locked", "locked_at").Where("user_id = ?", user.Id).First(&stored).Error
+		if err != nil {
+			return err
+		}
+
+		pw.FailureCount = stored.FailureCount
+		pw.LastFailureAt = sql.NullTime{Time: now, Valid: true}
+		if stored.IsLocked {
+			// another attempt locked it first
+			pw.IsLocked = true
+			pw.LockedAt = stored.LockedAt
+			result.Status = SignInLockedOut
+			return nil
+		}
+
+		if m.Options.MaxFailedAttempts <= 0 || stored.FailureCount < m.Options.MaxFailedAttempts {
+			return nil
+		}
+
+		user.LockPassword()
+		pw.LockedAt = sql.NullTime{Time: now, Valid: true}
+		result.Status = SignInLockedOut
+
+		err = tx.Model(&UserPasswordTable{}).
+			Where("user_id = ? AND is_locked = ?", user.Id, false).
+			Updates(map[string]interface{}{"is_locked": true, "locked_at": now}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&UserTable{}).
+			Where("id = ? AND status = ?", user.Id, UserStatusActive).
+			Update("status", UserStatusPasswordLocked).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// clearExpiredLock lifts a lockout whose duration has passed, together
+// with the failures that led to it.
+func (m *SignInManager) clearExpiredLock(tx *gorm.DB, userId int32) error {
+	if m.Options.LockoutDuration <= 0 {
+		return nil
+	}
+
+	res := tx.Model(&UserPasswordTable{}).
+		Where("user_id = ? AND is_locked = ? AND locked_at <= ?", userId, true, m.Now().Add(-m.Options.LockoutDuration)).
+		Updates(map[string]interface{}{
+			"is_locked":       false,
+			"locked_at":       nil,
+			"failed_attempts": 0,
+			"last_failed_at":  nil,
+		})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return res.Error
+	}
+
+	return tx.Model(&UserTable{}).
+		Where("id = ? AND status = ?", userId, UserStatusPasswordLocked).
+		Update("status", UserStatusActive).Error
+}
+
+func (m *SignInManager) succeed(user *UserTable, ip *string) (*SignInResult, error) {
+	user.Password.Reset()
+	user.SetLastLogin(ip)
+	err := m.save(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignInResult{Status: SignInSucceeded, User: user}, nil
+}
+
+// audit records the outcome of a sign in. login names the user when the
+// sign in did not get as far as finding one.
+func (m *SignInManager) audit(action string, login string, ip *string, result *SignInResult, err error) (*SignInResult, error) {
+	if err != nil || m.Audit == nil {
+		return result, err
+	}
+
+	e := &AuditEventTable{
+		Action:     action + "." + result.Status.String(),
+		TargetType: "users",
+		TargetId:   login,
+	}
+
+	if result.User != nil {
+		e.TargetId = strconv.Itoa(int(result.User.Id))
+		e.OrgId = result.User.OrgId
+		if result.Succeeded() {
+			e.ActorId = sql.NullInt32{Int32: result.User.Id, Valid: true}
+		}
+	}
+
+	if ip != nil {
+		e.Ip = *ip
+	}
+
+	err = m.Audit.Record(m.db.Statement.Context, e)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// canUnlock reports whether a lockout applied by the sign in manager has
+// expired. Locks without a LockedAt time were applied by an admin.
+func (m *SignInManager) canUnlock(pw *UserPasswordTable, now time.Time) bool {
+	if m.Options.LockoutDuration <= 0 || !pw.LockedAt.Valid {
+		return false
+	}
+
+	return !pw.LockedAt.Time.Add(m.Options.LockoutDuration).After(now)
+}
+
+func (m *SignInManager) save(user *UserTable) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		// only the columns sign in owns, so concurrent profile edits survive
+		columns := []string{"status", "last_login_at", "last_login_ip"}
+		if user.ConcurrencyStamp != user.stamp {
+			columns = append(columns, "concurrency_stamp")
+		}
+
+		err := tx.Model(user).Select(columns).Updates(user).Error
+		if err != nil {
+			return err
+		}
+
+		pw := user.Password
+		pw.UpdatedAt = sql.NullTime{Time: m.Now(), Valid: true}
+		res := tx.Model(&UserPasswordTable{}).
+			Where("user_id = ?", user.Id).
+			Select("is_locked", "locked_at", "failed_attempts", "last_failed_at", "updated_at").
+			Updates(pw)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return notFound("user password")
+		}
+
+		return nil
+	})
+}
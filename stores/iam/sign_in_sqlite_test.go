@@ -0,0 +1,116 @@
+package iam_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestPasswordSignIn(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	_, err := db.NewUserWithPassword("carol", "carol@test.org", "Secr3t!pass")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	now := time.Now()
+	manager := iam.NewSignInManager(db, &iam.SignInOptions{
+		MaxFailedAttempts: 2,
+		LockoutDuration:   time.Minute,
+	})
+	manager.Now = func() time.Time { return now }
+
+	ip := "10.0.0.1"
+	res, err := manager.PasswordSignIn("Carol@Test.org", "Secr3t!pass", &ip)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+
+	user, err := db.GetUserById(res.User.Id)
+	assert.NoError(err)
+	assert.Equal(ip, user.LastLoginIp.String)
+	assert.True(user.LastLoginAt.Valid)
+
+	res, err = manager.PasswordSignIn("nobody", "Secr3t!pass", nil)
+	assert.NoError(err)
+	assert.Equal(iam.SignInFailed, res.Status)
+
+	res, err = manager.PasswordSignIn("carol", "wrong", nil)
+	assert.NoError(err)
+	assert.Equal(iam.SignInFailed, res.Status)
+
+	res, err = manager.PasswordSignIn("carol", "wrong", nil)
+	assert.NoError(err)
+	assert.True(res.IsLockedOut())
+
+	res, err = manager.PasswordSignIn("carol", "Secr3t!pass", nil)
+	assert.NoError(err)
+	assert.True(res.IsLockedOut())
+
+	now = now.Add(2 * time.Minute)
+	res, err = manager.PasswordSignIn("carol", "Secr3t!pass", nil)
+	assert.NoError(err)
+	assert.True(res.Succeeded())
+	assert.Equal(int32(0), res.User.Password.FailureCount)
+	assert.False(res.User.Password.IsLocked)
+
+	manager.Options.TwoFactorRequired = func(user *iam.UserTable) (bool, error) {
+		return true, nil
+	}
+
+	res, err = manager.PasswordSignIn("carol", "Secr3t!pass", nil)
+	assert.NoError(err)
+	assert.True(res.RequiresTwoFactor())
+	assert.NotEmpty(res.Ticket)
+
+	manager.Options.TwoFactorRequired = nil
+	res.User.SetInactive()
+	assert.NoError(db.Save(res.User).Error)
+
+	res, err = manager.PasswordSignIn("carol", "Secr3t!pass", nil)
+	assert.NoError(err)
+	assert.True(res.IsNotAllowed())
+}
+
+func TestPasswordSignInLockout(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUserWithPassword("dan", "dan@test.org", "Secr3t!pass")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	manager := iam.NewSignInManager(db, &iam.SignInOptions{MaxFailedAttempts: 5})
+	sessions := iam.NewSessionStore(db, nil)
+	token, _, err := sessions.Create(user.Id, nil)
+	assert.NoError(err)
+
+	// failures made in parallel all count: race adds them between the
+	// sign in reading the user and counting its own failure
+	race := true
+	err = db.Callback().Query().After("gorm:query").Register("test:race", func(tx *gorm.DB) {
+		if tx.Statement.Table == "users" && race {
+			race = false
+			assert.NoError(db.Exec("UPDATE user_passwords SET failed_attempts = failed_attempts + 4 WHERE user_id = ?", user.Id).Error)
+		}
+	})
+	assert.NoError(err)
+
+	res, err := manager.PasswordSignIn("dan", "wrong", nil)
+	assert.NoError(err)
+	assert.True(res.IsLockedOut())
+	assert.Equal(int32(5), res.User.Password.FailureCount)
+
+	res, err = manager.PasswordSignIn("dan", "Secr3t!pass", nil)
+	assert.NoError(err)
+	assert.True(res.IsLockedOut())
+
+	// a lockout does not sign the user out
+	_, _, err = sessions.Refresh(token, nil)
+	assert.NoError(err)
+}
@@ -2,18 +2,25 @@ package iam
 
 import (
 	"database/sql"
-	"fmt"
 	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	UserStatusInactive       int8 = 0
+	UserStatusActive         int8 = 1
+	UserStatusPasswordLocked int8 = 2
+	UserStatusBanned         int8 = 3
 )
 
 type UserTable struct {
 	Id                  int32              `gorm:"column:id;primary_key;auto_increment" json:"id"`
 	Uid                 uuid.UUID          `gorm:"column:uid;type:uuid;index:ix_users_uid,unique" json:"uid"`
-	OrgId               sql.NullInt32      `gorm:"column:organization_id," json:"organizationId"`
+	OrgId               sql.NullInt32      `gorm:"column:organization_id" json:"organizationId"`
 	Name                string             `gorm:"column:name;size:64;index:ix_users_name,unique" json:"name" validate:"required"`
 	NameFormatted       sql.NullString     `gorm:"column:name_formatted;size:64" json:"name_formatted"`
 	Email               string             `gorm:"column:email;size:128;index:ix_users_email,unique" json:"email" validate:"required,email"`
@@ -28,10 +35,15 @@ type UserTable struct {
 	ConcurrencyStamp    string             `gorm:"column:concurrency_stamp;size:128" json:"concurrencyStamp"`
 	CreatedAt           time.Time          `gorm:"column:created_at" json:"created_at"`
 	UpdatedAt           sql.NullTime       `gorm:"column:updated_at" json:"updated_at"`
-	Organization        *OrgTable          `gorm:"foreignKey:OrganizationId" json:"organization"`
+	DeletedAt           gorm.DeletedAt     `gorm:"column:deleted_at;index:ix_users_deleted_at" json:"deletedAt"`
+	Organization        *OrgTable          `gorm:"foreignKey:OrgId;references:Id" json:"organization"`
 	Password            *UserPasswordTable `gorm:"foreignKey:UserId;references:Id" json:"password"`
 	Claims              []UserClaimTable   `gorm:"foreignKey:UserId;references:Id" json:"claims"`
 	ApiKeys             []UserApiKeyTable  `gorm:"foreignKey:UserId;references:Id" json:"apiKeys"`
+
+	// stamp is the concurrency stamp stored when the user was last read or
+	// written; Save requires the row to still carry it.
+	stamp string
 }
 
 func (UserTable) TableName() string {
@@ -76,7 +88,7 @@ func (db *IamDb) newUser(name string, email string) (*UserTable, error) {
 
 	db.DB.Model(&UserTable{}).Where("email = ?", e).Or("name = ?", n).Count(&count)
 	if count > 0 {
-		return nil, fmt.Errorf("a user with the email or name already exists")
+		return nil, &ConflictError{Entity: "user", Fields: []string{"email", "name"}}
 	}
 
 	user := UserTable{}
@@ -109,14 +121,54 @@ func (db *IamDb) NewUser(name string, email string) (*UserTable, error) {
 	return user, nil
 }
 
+// Save creates the user, or updates it when the stored concurrency stamp is
+// still the one the user was read with. Otherwise nothing is written and
+// ErrConcurrencyConflict is returned. Updates do not write associations.
 func (user *UserTable) Save(db *IamDb) error {
 	err := user.Validate()
 	if err != nil {
 		return err
 	}
 
-	err = db.DB.Save(&user).Error
-	return err
+	if user.Id == 0 {
+		if user.ConcurrencyStamp == "" {
+			user.ConcurrencyStamp = uuid.NewString()
+		}
+
+		return db.DB.Save(user).Error
+	}
+
+	expected := user.stamp
+	if user.ConcurrencyStamp == expected {
+		user.ConcurrencyStamp = uuid.NewString()
+	}
+
+	user.UpdatedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	err = updateChecked(db.DB, user, user.Id, expected)
+	if err != nil {
+		user.ConcurrencyStamp = expected
+		return err
+	}
+
+	return nil
+}
+
+func (user *UserTable) AfterFind(tx *gorm.DB) error {
+	user.stamp = user.ConcurrencyStamp
+	return nil
+}
+
+func (user *UserTable) AfterCreate(tx *gorm.DB) error {
+	user.stamp = user.ConcurrencyStamp
+	return nil
+}
+
+func (user *UserTable) AfterUpdate(tx *gorm.DB) error {
+	if writesStamp(tx.Statement) {
+		user.stamp = user.ConcurrencyStamp
+	}
+
+	return nil
 }
 
 func (user *UserTable) Validate() error {
@@ -125,17 +177,17 @@ func (user *UserTable) Validate() error {
 	}
 
 	validate := validator.New(validator.WithRequiredStructEnabled())
-	err := validate.Struct(*user)
-	return err
+	return toValidationError(validate.Struct(*user))
 }
 
+// LockPassword marks the password locked. The concurrency stamp is kept, so
+// a lockout, which anyone who knows the name can trigger, does not end the
+// user's sessions.
 func (user *UserTable) LockPassword() *UserTable {
 	if user.Status == 2 {
 		return user
 	}
 
-	user.ConcurrencyStamp = uuid.NewString()
-
 	if user.Password != nil {
 		user.Password.IsLocked = true
 	}
@@ -149,8 +201,6 @@ func (user *UserTable) UnlockPassword() *UserTable {
 		return user
 	}
 
-	user.ConcurrencyStamp = uuid.NewString()
-
 	if user.Password != nil {
 		user.Password.IsLocked = false
 	}
@@ -165,7 +215,8 @@ func (user *UserTable) SetLastLogin(ip *string) *UserTable {
 		user.LastLoginIp = sql.NullString{String: *ip, Valid: true}
 	}
 
-	user.ConcurrencyStamp = uuid.NewString()
+	// signing in is not a change to the account, so the stamp is left alone
+	// to keep the user's other sessions alive
 	return user
 }
 
@@ -186,7 +237,6 @@ func (user *UserTable) SetEmail(email string) *UserTable {
 
 	if user.Email != slug {
 		user.Email = slug
-		println("setting email", slug)
 		user.ConcurrencyStamp = uuid.NewString()
 	}
 
@@ -206,7 +256,6 @@ func (user *UserTable) SetName(name string) *UserTable {
 
 	if user.Name != slug {
 		user.Name = slug
-		println("setting name", slug)
 		user.ConcurrencyStamp = uuid.NewString()
 	}
 
@@ -235,3 +284,43 @@ func (db *IamDb) GetUserById(id int32) (*UserTable, error) {
 	}
 	return &user, nil
 }
+
+// DeleteUser soft deletes the user. The row is hidden from every query until
+// RestoreUser brings it back or a Purger removes it. The concurrency stamp
+// is rotated so sessions issued before the deletion stay dead after a
+// restore.
+func (db *IamDb) DeleteUser(id int32) error {
+	res := db.DB.Model(&UserTable{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"deleted_at":        time.Now(),
+		"concurrency_stamp": uuid.NewString(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return notFound("user")
+	}
+
+	return nil
+}
+
+// RestoreUser undoes DeleteUser. It returns a NotFoundError when the
+// user is not deleted or has already been purged.
+func (db *IamDb) RestoreUser(id int32) error {
+	res := db.DB.Unscoped().Model(&UserTable{}).
+		Where("id = ? AND deleted_at IS NOT NULL", id).
+		Updates(map[string]interface{}{
+			"deleted_at":        nil,
+			"concurrency_stamp": uuid.NewString(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return notFound("user")
+	}
+
+	return nil
+}
@@ -1,69 +1,62 @@
 package iam
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/dchest/uniuri"
 	"github.com/google/uuid"
 )
 
+const (
+	apiKeyPrefixLen = 12
+	apiKeySecretLen = 40
+)
+
+var apiKeyChars = []byte("abcdefghijklmnopqrstuvwxyz0123456789")
+
+// UserApiKeyTable stores api keys in the form "<prefix>.<secret>". The prefix
+// is public and indexed so a key can be found without scanning the table; only
+// a SHA-256 hash of the high entropy secret is stored.
 type UserApiKeyTable struct {
-	Id            int32        `gorm:"column:id;primary_key;auto_increment" json:"id"`
-	Uid           uuid.UUID    `gorm:"column:uid;type:uuid;index:ix_user_api_keys_uid,unique" json:"uid"`
-	UserId        int32        `gorm:"column:user_id;index:ix_user_api_keys_user_id" json:"userId"`
-	Key           string       `gorm:"column:key;size:2048" json:"key"`
-	IsLocked      bool         `gorm:"column:is_locked" json:"isLocked"`
-	LockedAt      sql.NullTime `gorm:"column:locked_at" json:"lockedAt"`
-	FailureCount  int32        `gorm:"column:failed_attempts" json:"failedAttempts"`
-	LastFailureAt sql.NullTime `gorm:"column:last_failed_at" json:"lastFailedAt"`
-	ExpiresAt     sql.NullTime `gorm:"column:expires_at" json:"expiresAt"`
-	CreatedAt     time.Time    `gorm:"column:created_at" json:"created_at"`
-	UpdatedAt     sql.NullTime `gorm:"column:updated_at" json:"updated_at"`
+	Id            int32         `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid           uuid.UUID     `gorm:"column:uid;type:uuid;index:ix_user_api_keys_uid,unique" json:"uid"`
+	UserId        int32         `gorm:"column:user_id;index:ix_user_api_keys_user_id" json:"userId"`
+	OrgId         sql.NullInt32 `gorm:"column:org_id;index:ix_user_api_keys_org_id" json:"organizationId"`
+	Name          string        `gorm:"column:name;size:64" json:"name"`
+	Description   string        `gorm:"column:description;size:256" json:"description"`
+	Scopes        string        `gorm:"column:scopes;size:1024" json:"scopes"`
+	AllowedCidrs  string        `gorm:"column:allowed_cidrs;size:1024" json:"allowedCidrs"`
+	Prefix        string        `gorm:"column:prefix;size:16;index:ix_user_api_keys_prefix,unique" json:"prefix"`
+	Key           string        `gorm:"column:key;size:2048" json:"-"`
+	IsLocked      bool          `gorm:"column:is_locked" json:"isLocked"`
+	LockedAt      sql.NullTime  `gorm:"column:locked_at" json:"lockedAt"`
+	FailureCount  int32         `gorm:"column:failed_attempts" json:"failedAttempts"`
+	LastFailureAt sql.NullTime  `gorm:"column:last_failed_at" json:"lastFailedAt"`
+	LastUsedAt    sql.NullTime  `gorm:"column:last_used_at" json:"lastUsedAt"`
+	ExpiresAt     sql.NullTime  `gorm:"column:expires_at" json:"expiresAt"`
+	RevokedAt     sql.NullTime  `gorm:"column:revoked_at" json:"revokedAt"`
+	CreatedAt     time.Time     `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt     sql.NullTime  `gorm:"column:updated_at" json:"updated_at"`
 }
 
 func (UserApiKeyTable) TableName() string {
 	return "user_api_keys"
 }
 
+// Generate creates a new prefix and secret for the key and returns the full
+// key. The full key is only available here and must be handed to the caller.
 func (apiKey *UserApiKeyTable) Generate() (string, error) {
-	key := uniuri.NewLenChars(20, []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-=#@~[]|"))
-	valid := false
-	for !valid {
-		upper := false
-		lower := false
-		digit := false
-		special := false
-		for _, r := range key {
-			if unicode.IsDigit(r) {
-				digit = true
-				continue
-			}
-
-			if unicode.IsLetter(r) {
-				if unicode.IsUpper(r) {
-					upper = true
-					continue
-				}
-
-				if unicode.IsLower(r) {
-					lower = true
-					continue
-				}
-			}
-
-			special = true
-		}
-
-		valid = upper && lower && digit && special
-		if valid {
-			break
-		} else {
-			key = uniuri.NewLenChars(20, []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-=#@~[]|"))
-		}
-	}
+	prefix := uniuri.NewLenChars(apiKeyPrefixLen, apiKeyChars)
+	secret := uniuri.NewLenChars(apiKeySecretLen, apiKeyChars)
+	key := prefix + "." + secret
 
 	err := apiKey.SetKey(key)
 	if err != nil {
@@ -74,26 +67,152 @@ func (apiKey *UserApiKeyTable) Generate() (string, error) {
 }
 
 func (apiKey *UserApiKeyTable) SetKey(key string) error {
-	k := key
-	k = strings.TrimSpace(k)
-	hash, err := HashSecret(k)
+	prefix, secret, err := ParseApiKey(key)
 	if err != nil {
 		return err
 	}
-	apiKey.Key = hash
+
+	apiKey.Prefix = prefix
+	apiKey.Key = hashApiKeySecret(secret)
 	return nil
 }
 
+func (apiKey *UserApiKeyTable) ValidateSecret(secret string) bool {
+	hash := hashApiKeySecret(secret)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(apiKey.Key)) == 1
+}
+
 func (apiKey *UserApiKeyTable) IsExpired() bool {
+	return apiKey.isExpiredAt(time.Now())
+}
+
+func (apiKey *UserApiKeyTable) isExpiredAt(now time.Time) bool {
 	if apiKey.ExpiresAt.Valid {
-		return apiKey.ExpiresAt.Time.Before(time.Now())
+		return apiKey.ExpiresAt.Time.Before(now)
 	}
 	return false
 }
 
+func (apiKey *UserApiKeyTable) IsRevoked() bool {
+	return apiKey.RevokedAt.Valid
+}
+
 func (apiKey *UserApiKeyTable) Reset() {
 	apiKey.LockedAt = sql.NullTime{}
 	apiKey.FailureCount = 0
 	apiKey.LastFailureAt = sql.NullTime{}
 	apiKey.IsLocked = false
 }
+
+// GetScopes returns the scopes the key is limited to. An empty list means the
+// key carries the full authority of its user.
+func (apiKey *UserApiKeyTable) GetScopes() []string {
+	return strings.Fields(apiKey.Scopes)
+}
+
+func (apiKey *UserApiKeyTable) SetScopes(scopes []string) *UserApiKeyTable {
+	set := []string{}
+	for _, scope := range scopes {
+		s := strings.TrimSpace(scope)
+		if s != "" && !slices.Contains(set, s) {
+			set = append(set, s)
+		}
+	}
+
+	apiKey.Scopes = strings.Join(set, " ")
+	return apiKey
+}
+
+func (apiKey *UserApiKeyTable) HasScope(scope string) bool {
+	scopes := apiKey.GetScopes()
+	return len(scopes) == 0 || slices.Contains(scopes, scope)
+}
+
+func (apiKey *UserApiKeyTable) GetAllowedCidrs() []string {
+	return strings.Fields(apiKey.AllowedCidrs)
+}
+
+func (apiKey *UserApiKeyTable) SetAllowedCidrs(cidrs []string) error {
+	set := []string{}
+	for _, cidr := range cidrs {
+		c := strings.TrimSpace(cidr)
+		if c == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return invalidField("allowedCidrs", "cidr", fmt.Sprintf("invalid cidr %q", c))
+		}
+
+		set = append(set, prefix.Masked().String())
+	}
+
+	apiKey.AllowedCidrs = strings.Join(set, " ")
+	return nil
+}
+
+// IsIpAllowed reports whether ip falls within one of the key's allowed
+// ranges. Keys without ranges accept any address.
+func (apiKey *UserApiKeyTable) IsIpAllowed(ip string) bool {
+	cidrs := apiKey.GetAllowedCidrs()
+	if len(cidrs) == 0 {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RestrictAuthorization limits auth to the claims covered by the key's
+// scopes. A scope matches a claim by name or by "name:value". Roles are
+// dropped, since a role grants more than the scopes name.
+func (apiKey *UserApiKeyTable) RestrictAuthorization(auth *UserAuthorization) *UserAuthorization {
+	scopes := apiKey.GetScopes()
+	if len(scopes) == 0 || auth == nil {
+		return auth
+	}
+
+	restricted := &UserAuthorization{
+		UserId: auth.UserId,
+		OrgId:  auth.OrgId,
+		Roles:  []string{},
+		Claims: []Claim{},
+	}
+
+	for _, c := range auth.Claims {
+		if slices.Contains(scopes, c.Name) || slices.Contains(scopes, c.Name+":"+c.Value) {
+			restricted.Claims = append(restricted.Claims, c)
+		}
+	}
+
+	return restricted
+}
+
+// ParseApiKey splits a full api key into its public prefix and secret.
+func ParseApiKey(key string) (string, string, error) {
+	k := strings.TrimSpace(key)
+	prefix, secret, ok := strings.Cut(k, ".")
+	if !ok || len(prefix) != apiKeyPrefixLen || secret == "" {
+		return "", "", fmt.Errorf("api key is not in a valid format")
+	}
+
+	return prefix, secret, nil
+}
+
+func hashApiKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
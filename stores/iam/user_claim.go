@@ -1,16 +1,17 @@
 package iam
 
 import (
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type UserClaimTable struct {
-	Id        int32     `gorm:"column:id,primary_key;auto_increment" json:"id"`
+	Id        int32     `gorm:"column:id;primary_key;auto_increment" json:"id"`
 	Uid       uuid.UUID `gorm:"column:uid;type:uuid;index:ix_user_claims_uid,unique" json:"uid"`
-	UserId    int32     `gorm:"column:user_id;index:ix_user_claims_user_id,unique" json:"userId"`
-	Name      string    `gorm:"column:name;size:64,index:ix_user_claims_name,unique" json:"name"`
+	UserId    int32     `gorm:"column:user_id;index:ix_user_claims_user_id" json:"userId"`
+	Name      string    `gorm:"column:name;size:64;index:ix_user_claims_name" json:"name"`
 	Value     string    `gorm:"column:value;size:128" json:"value"`
 	CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
 }
@@ -18,3 +19,25 @@ type UserClaimTable struct {
 func (UserClaimTable) TableName() string {
 	return "user_claims"
 }
+
+func (db *IamDb) AddUserClaim(userId int32, name string, value string) (*UserClaimTable, error) {
+	claim := UserClaimTable{
+		Uid:       uuid.New(),
+		UserId:    userId,
+		Name:      strings.TrimSpace(name),
+		Value:     value,
+		CreatedAt: time.Now(),
+	}
+
+	err := db.Save(&claim).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &claim, nil
+}
+
+func (db *IamDb) RemoveUserClaim(userId int32, name string, value string) error {
+	return db.DB.Where("user_id = ? AND name = ? AND value = ?", userId, strings.TrimSpace(name), value).
+		Delete(&UserClaimTable{}).Error
+}
@@ -0,0 +1,60 @@
+package iam
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserCredentialTable is a WebAuthn credential (passkey or security key)
+// registered by a user. CredentialId is the base64url encoded id chosen by
+// the authenticator and PublicKey holds the COSE encoded key.
+type UserCredentialTable struct {
+	Id              int32     `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid             uuid.UUID `gorm:"column:uid;type:uuid;index:ix_user_credentials_uid,unique" json:"uid"`
+	UserId          int32     `gorm:"column:user_id;index:ix_user_credentials_user_id" json:"userId"`
+	CredentialId    string    `gorm:"column:credential_id;size:1024;index:ix_user_credentials_credential_id,unique" json:"credentialId"`
+	PublicKey       []byte    `gorm:"column:public_key" json:"-"`
+	Algorithm       int32     `gorm:"column:algorithm" json:"algorithm"`
+	SignCount       uint32    `gorm:"column:sign_count" json:"signCount"`
+	Transports      string    `gorm:"column:transports;size:256" json:"-"`
+	Aaguid          uuid.UUID `gorm:"column:aaguid;type:uuid" json:"aaguid"`
+	AttestationType string    `gorm:"column:attestation_type;size:32" json:"attestationType"`
+	BackupEligible  bool      `gorm:"column:backup_eligible" json:"backupEligible"`
+	BackedUp        bool      `gorm:"column:backed_up" json:"backedUp"`
+	// CloneWarning is set when the authenticator reported a sign count that
+	// did not increase, which suggests the credential was copied.
+	CloneWarning bool           `gorm:"column:clone_warning" json:"cloneWarning"`
+	Name         sql.NullString `gorm:"column:name;size:128" json:"name"`
+	CreatedAt    time.Time      `gorm:"column:created_at" json:"created_at"`
+	LastUsedAt   sql.NullTime   `gorm:"column:last_used_at" json:"lastUsedAt"`
+}
+
+func (UserCredentialTable) TableName() string {
+	return "user_credentials"
+}
+
+func (c *UserCredentialTable) GetTransports() []string {
+	return strings.Fields(c.Transports)
+}
+
+func (c *UserCredentialTable) SetTransports(transports []string) *UserCredentialTable {
+	c.Transports = strings.Join(transports, " ")
+	return c
+}
+
+func (db *IamDb) GetUserCredentials(userId int32) ([]UserCredentialTable, error) {
+	credentials := []UserCredentialTable{}
+	err := db.Where("user_id = ?", userId).Order("created_at").Find(&credentials).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func (db *IamDb) RemoveUserCredential(userId int32, uid uuid.UUID) error {
+	return db.Where("user_id = ? AND uid = ?", userId, uid).Delete(&UserCredentialTable{}).Error
+}
@@ -7,9 +7,10 @@ import (
 
 type UserLoginProviderTable struct {
 	UserId            int32          `gorm:"column:user_id;index:ix_user_logins_user_id" json:"userId"`
-	Provider          string         `gorm:"column:provider;size:64;index:ix_user_logins_provider" json:"provider"`
+	Provider          string         `gorm:"column:provider;size:64;index:ix_user_logins_provider_key,unique,priority:1" json:"provider"`
 	ProviderFormatted sql.NullString `gorm:"column:provider_formatted;size:64" json:"providerFormatted"`
-	Key               string         `gorm:"column:key;size:128;index:ix_user_logins_key" json:"key"`
+	Key               string         `gorm:"column:key;size:128;index:ix_user_logins_provider_key,unique,priority:2" json:"key"`
+	DisplayName       sql.NullString `gorm:"column:display_name;size:128" json:"displayName"`
 	CreatedAt         time.Time      `gorm:"column:created_at" json:"created_at"`
 }
 
@@ -17,9 +18,17 @@ func (UserLoginProviderTable) TableName() string {
 	return "user_login_providers"
 }
 
+// UserLoginTokenTable holds tokens issued by an external provider, such as
+// access and refresh tokens. Token values are encrypted at rest.
 type UserLoginTokenTable struct {
-	UserId   int32  `gorm:"column:user_id;index:ix_user_login_tokens_user_id,unique" json:"userId"`
-	Provider string `gorm:"column:provider;size:64,index:ix_user_login_tokens_provider,unique" json:"provider"`
-	Name     string `gorm:"column:name;size:64,index:ix_user_login_tokens_name,unique" json:"name"`
-	Token    string `gorm:"column:token;size:128" json:"token"`
+	UserId    int32        `gorm:"column:user_id;index:ix_user_login_tokens_user_id_provider_name,unique,priority:1" json:"userId"`
+	Provider  string       `gorm:"column:provider;size:64;index:ix_user_login_tokens_user_id_provider_name,unique,priority:2" json:"provider"`
+	Name      string       `gorm:"column:name;size:64;index:ix_user_login_tokens_user_id_provider_name,unique,priority:3" json:"name"`
+	Token     string       `gorm:"column:token;size:8192" json:"-"`
+	ExpiresAt sql.NullTime `gorm:"column:expires_at" json:"expiresAt"`
+	UpdatedAt time.Time    `gorm:"column:updated_at" json:"updated_at"`
+}
+
+func (UserLoginTokenTable) TableName() string {
+	return "user_login_tokens"
 }
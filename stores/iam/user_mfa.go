@@ -0,0 +1,58 @@
+package iam
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserAuthenticatorTable is a user's TOTP authenticator app. The secret is
+// encrypted and the authenticator only counts once ConfirmedAt is set.
+type UserAuthenticatorTable struct {
+	Id           int32        `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid          uuid.UUID    `gorm:"column:uid;type:uuid;index:ix_user_authenticators_uid,unique" json:"uid"`
+	UserId       int32        `gorm:"column:user_id;index:ix_user_authenticators_user_id,unique" json:"userId"`
+	Secret       string       `gorm:"column:secret;size:512" json:"-"`
+	LastUsedStep int64        `gorm:"column:last_used_step" json:"-"`
+	ConfirmedAt  sql.NullTime `gorm:"column:confirmed_at" json:"confirmedAt"`
+	CreatedAt    time.Time    `gorm:"column:created_at" json:"created_at"`
+}
+
+func (UserAuthenticatorTable) TableName() string {
+	return "user_authenticators"
+}
+
+func (a *UserAuthenticatorTable) IsConfirmed() bool {
+	return a.ConfirmedAt.Valid
+}
+
+// UserRecoveryCodeTable is a one time code that stands in for the
+// authenticator. Only the hash of the code is stored.
+type UserRecoveryCodeTable struct {
+	Id        int32        `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	UserId    int32        `gorm:"column:user_id;index:ix_user_recovery_codes_user_id" json:"userId"`
+	CodeHash  string       `gorm:"column:code_hash;size:128" json:"-"`
+	UsedAt    sql.NullTime `gorm:"column:used_at" json:"usedAt"`
+	CreatedAt time.Time    `gorm:"column:created_at" json:"created_at"`
+}
+
+func (UserRecoveryCodeTable) TableName() string {
+	return "user_recovery_codes"
+}
+
+// UserRememberedDeviceTable lets a browser skip the second factor until it
+// expires or the user's security stamp changes.
+type UserRememberedDeviceTable struct {
+	Id            int32     `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid           uuid.UUID `gorm:"column:uid;type:uuid;index:ix_user_remembered_devices_uid,unique" json:"uid"`
+	UserId        int32     `gorm:"column:user_id;index:ix_user_remembered_devices_user_id" json:"userId"`
+	TokenHash     string    `gorm:"column:token_hash;size:128" json:"-"`
+	SecurityStamp string    `gorm:"column:security_stamp;size:128" json:"-"`
+	ExpiresAt     time.Time `gorm:"column:expires_at" json:"expiresAt"`
+	CreatedAt     time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+func (UserRememberedDeviceTable) TableName() string {
+	return "user_remembered_devices"
+}
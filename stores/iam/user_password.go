@@ -17,6 +17,7 @@ type UserPasswordTable struct {
 	FailureCount  int32        `gorm:"column:failed_attempts" json:"failedAttempts"`
 	LastFailureAt sql.NullTime `gorm:"column:last_failed_at" json:"lastFailedAt"`
 	SecurityStamp string       `gorm:"column:security_stamp;size:128" json:"securityStamp"`
+	ChangedAt     sql.NullTime `gorm:"column:changed_at" json:"changedAt"`
 	CreatedAt     time.Time    `gorm:"column:created_at" json:"created_at"`
 	UpdatedAt     sql.NullTime `gorm:"column:updated_at" json:"updated_at"`
 }
@@ -25,17 +26,61 @@ func (UserPasswordTable) TableName() string {
 	return "user_passwords"
 }
 
+// SetPassword hashes the password exactly as given. Apply a PasswordPolicy
+// first through PasswordStore where the password comes from a user.
 func (up *UserPasswordTable) SetPassword(password string) error {
-	p := password
-	p = strings.TrimSpace(p)
-	hash, err := HashSecret(p)
+	hash, err := HashSecret(password)
 	if err != nil {
 		return err
 	}
 	up.Password = hash
+	up.SecurityStamp = uuid.NewString()
+	up.ChangedAt = sql.NullTime{Time: time.Now(), Valid: true}
 	return nil
 }
 
 func (up *UserPasswordTable) ValidatePassword(password string) error {
-	return ValidateSecret(password, up.Password)
+	err := ValidateSecret(password, up.Password)
+	if err == nil {
+		return nil
+	}
+
+	// passwords used to be trimmed before hashing, so a password set with
+	// surrounding spaces was stored without them
+	trimmed := strings.TrimSpace(password)
+	if trimmed != password && ValidateSecret(trimmed, up.Password) == nil {
+		return nil
+	}
+
+	return err
+}
+
+// LastChangedAt is when the password was last set. Rows written before
+// ChangedAt existed fall back to CreatedAt.
+func (up *UserPasswordTable) LastChangedAt() time.Time {
+	if up.ChangedAt.Valid {
+		return up.ChangedAt.Time
+	}
+
+	return up.CreatedAt
+}
+
+func (up *UserPasswordTable) Reset() {
+	up.LockedAt = sql.NullTime{}
+	up.FailureCount = 0
+	up.LastFailureAt = sql.NullTime{}
+	up.IsLocked = false
+}
+
+// UserPasswordHistoryTable keeps the hashes of a user's previous passwords
+// so a PasswordPolicy can reject reuse.
+type UserPasswordHistoryTable struct {
+	Id        int32     `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	UserId    int32     `gorm:"column:user_id;index:ix_user_password_history_user_id" json:"userId"`
+	Password  string    `gorm:"column:password;size:1024" json:"-"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+func (UserPasswordHistoryTable) TableName() string {
+	return "user_password_history"
 }
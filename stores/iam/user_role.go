@@ -1,10 +1,184 @@
 package iam
 
+import (
+	"database/sql"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm/clause"
+)
+
 type UserRoleTable struct {
-	UserId int32 `gorm:"column:user_id;index:ix_users_roles_user_id,unique" json:"userId"`
-	RoleId int32 `gorm:"column:role_id;index:ix_users_roles_role_id,unique" json:"roleId"`
+	UserId int32 `gorm:"column:user_id;primaryKey;index:ix_users_roles_user_id" json:"userId"`
+	RoleId int32 `gorm:"column:role_id;primaryKey;index:ix_users_roles_role_id" json:"roleId"`
 }
 
 func (UserRoleTable) TableName() string {
 	return "users_roles"
 }
+
+type Claim struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// UserAuthorization is the effective set of roles and claims a user holds,
+// either globally or within the org it was resolved for.
+type UserAuthorization struct {
+	UserId int32         `json:"userId"`
+	OrgId  sql.NullInt32 `json:"organizationId"`
+	Roles  []string      `json:"roles"`
+	Claims []Claim       `json:"claims"`
+}
+
+func (a *UserAuthorization) HasRole(name string) bool {
+	n := strings.TrimSpace(name)
+	n = strings.ToLower(n)
+
+	return slices.Contains(a.Roles, n)
+}
+
+// HasClaim reports whether the user holds a claim with the given name. When
+// values are provided, the claim must also match one of them.
+func (a *UserAuthorization) HasClaim(name string, values ...string) bool {
+	for _, c := range a.Claims {
+		if c.Name != name {
+			continue
+		}
+
+		if len(values) == 0 || slices.Contains(values, c.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *UserAuthorization) ClaimValues(name string) []string {
+	values := []string{}
+	for _, c := range a.Claims {
+		if c.Name == name {
+			values = append(values, c.Value)
+		}
+	}
+
+	return values
+}
+
+func (db *IamDb) AssignRole(userId int32, roleId int32) error {
+	return db.DB.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&UserRoleTable{UserId: userId, RoleId: roleId}).Error
+}
+
+func (db *IamDb) UnassignRole(userId int32, roleId int32) error {
+	return db.DB.Where("user_id = ? AND role_id = ?", userId, roleId).
+		Delete(&UserRoleTable{}).Error
+}
+
+// GetUserRoles returns the roles assigned to the user. Global roles are always
+// included; org roles are only included when they belong to orgId or one of
+// its ancestors, so roles held in a parent org carry down to its children.
+// Roles of soft deleted orgs are left out.
+func (db *IamDb) GetUserRoles(userId int32, orgId sql.NullInt32) ([]RoleTable, error) {
+	roles := []RoleTable{}
+
+	tx := db.DB.Model(&RoleTable{}).
+		Joins("JOIN users_roles ON users_roles.role_id = roles.id").
+		Where("users_roles.user_id = ?", userId)
+
+	if orgId.Valid {
+		lineage, err := orgLineage(db.DB, orgId.Int32)
+		if err != nil {
+			return nil, err
+		}
+
+		// roles of a soft deleted org stop applying until it is restored
+		live := db.DB.Model(&OrgTable{}).Select("id").Where("id IN ?", lineage)
+		tx = tx.Where("roles.org_id IS NULL OR roles.org_id IN (?)", live)
+	} else {
+		tx = tx.Where("roles.org_id IS NULL")
+	}
+
+	err := tx.Order("roles.name").Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// GetUserAuthorization merges the user's own claims with the claims of every
+// role that applies to orgId.
+func (db *IamDb) GetUserAuthorization(userId int32, orgId sql.NullInt32) (*UserAuthorization, error) {
+	roles, err := db.GetUserRoles(userId, orgId)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &UserAuthorization{
+		UserId: userId,
+		OrgId:  orgId,
+		Roles:  []string{},
+		Claims: []Claim{},
+	}
+
+	roleIds := []int32{}
+	for _, role := range roles {
+		roleIds = append(roleIds, role.Id)
+		if !slices.Contains(auth.Roles, role.Name) {
+			auth.Roles = append(auth.Roles, role.Name)
+		}
+	}
+
+	userClaims := []UserClaimTable{}
+	err = db.DB.Where("user_id = ?", userId).Find(&userClaims).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range userClaims {
+		auth.addClaim(c.Name, c.Value)
+	}
+
+	if len(roleIds) > 0 {
+		roleClaims := []RoleClaimTable{}
+		err = db.DB.Where("role_id IN ?", roleIds).Find(&roleClaims).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range roleClaims {
+			auth.addClaim(c.Name, c.Value)
+		}
+	}
+
+	return auth, nil
+}
+
+func (db *IamDb) UserHasRole(userId int32, orgId sql.NullInt32, name string) (bool, error) {
+	auth, err := db.GetUserAuthorization(userId, orgId)
+	if err != nil {
+		return false, err
+	}
+
+	return auth.HasRole(name), nil
+}
+
+func (db *IamDb) UserHasClaim(userId int32, orgId sql.NullInt32, name string, values ...string) (bool, error) {
+	auth, err := db.GetUserAuthorization(userId, orgId)
+	if err != nil {
+		return false, err
+	}
+
+	return auth.HasClaim(name, values...), nil
+}
+
+func (a *UserAuthorization) addClaim(name string, value string) {
+	for _, c := range a.Claims {
+		if c.Name == name && c.Value == value {
+			return
+		}
+	}
+
+	a.Claims = append(a.Claims, Claim{Name: name, Value: value})
+}
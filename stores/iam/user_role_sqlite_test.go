@@ -0,0 +1,84 @@
+package iam_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestUserRoles(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	org := &iam.OrgTable{}
+	org.SetName("Role Org")
+	if err := db.Create(org).Error; err != nil {
+		t.Fatalf("failed to create org: %v", err)
+	}
+
+	orgId := sql.NullInt32{Int32: org.Id, Valid: true}
+
+	user, err := db.NewUser("alice", "alice@test.org")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	_, err = db.AddUserClaim(user.Id, "profile", "read")
+	if err != nil {
+		t.Fatalf("failed to add user claim: %v", err)
+	}
+
+	reader, err := db.NewRole("Reader", "global readers", sql.NullInt32{})
+	if err != nil {
+		t.Fatalf("failed to create role: %v", err)
+	}
+
+	admin, err := db.NewRole("admin", "org admins", orgId)
+	if err != nil {
+		t.Fatalf("failed to create role: %v", err)
+	}
+
+	_, err = db.NewRole("admin", "duplicate", orgId)
+	assert.Error(err)
+
+	_, err = db.AddRoleClaim(reader.Id, "artifacts", "read")
+	assert.NoError(err)
+	_, err = db.AddRoleClaim(admin.Id, "artifacts", "write")
+	assert.NoError(err)
+	_, err = db.AddRoleClaim(admin.Id, "artifacts", "read")
+	assert.NoError(err)
+
+	assert.NoError(db.AssignRole(user.Id, reader.Id))
+	assert.NoError(db.AssignRole(user.Id, admin.Id))
+	assert.NoError(db.AssignRole(user.Id, admin.Id))
+
+	roles, err := db.GetUserRoles(user.Id, sql.NullInt32{})
+	assert.NoError(err)
+	assert.Len(roles, 1)
+
+	roles, err = db.GetUserRoles(user.Id, orgId)
+	assert.NoError(err)
+	assert.Len(roles, 2)
+
+	auth, err := db.GetUserAuthorization(user.Id, sql.NullInt32{})
+	assert.NoError(err)
+	assert.True(auth.HasRole("reader"))
+	assert.False(auth.HasRole("admin"))
+	assert.True(auth.HasClaim("profile"))
+	assert.True(auth.HasClaim("artifacts", "read"))
+	assert.False(auth.HasClaim("artifacts", "write"))
+
+	auth, err = db.GetUserAuthorization(user.Id, orgId)
+	assert.NoError(err)
+	assert.True(auth.HasRole("Admin"))
+	assert.True(auth.HasClaim("artifacts", "write"))
+	assert.Len(auth.ClaimValues("artifacts"), 2)
+
+	assert.NoError(db.UnassignRole(user.Id, admin.Id))
+
+	ok, err := db.UserHasClaim(user.Id, orgId, "artifacts", "write")
+	assert.NoError(err)
+	assert.False(ok)
+}
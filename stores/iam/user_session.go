@@ -0,0 +1,37 @@
+package iam
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserSessionTable is a signed in device. The session is continued with an
+// opaque refresh token of the form "<session uid>.<secret>"; only the hash of
+// the current secret is stored and it changes on every refresh.
+type UserSessionTable struct {
+	Id               int32          `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid              uuid.UUID      `gorm:"column:uid;type:uuid;index:ix_user_sessions_uid,unique" json:"uid"`
+	UserId           int32          `gorm:"column:user_id;index:ix_user_sessions_user_id" json:"userId"`
+	TokenHash        string         `gorm:"column:token_hash;size:128" json:"-"`
+	Generation       int32          `gorm:"column:generation" json:"generation"`
+	Device           sql.NullString `gorm:"column:device;size:128" json:"device"`
+	Ip               sql.NullString `gorm:"column:ip;size:45" json:"ip"`
+	UserAgent        sql.NullString `gorm:"column:user_agent;size:512" json:"userAgent"`
+	ConcurrencyStamp string         `gorm:"column:concurrency_stamp;size:128" json:"-"`
+	SecurityStamp    string         `gorm:"column:security_stamp;size:128" json:"-"`
+	CreatedAt        time.Time      `gorm:"column:created_at" json:"created_at"`
+	LastSeenAt       time.Time      `gorm:"column:last_seen_at" json:"lastSeenAt"`
+	ExpiresAt        time.Time      `gorm:"column:expires_at" json:"expiresAt"`
+	RevokedAt        sql.NullTime   `gorm:"column:revoked_at" json:"revokedAt"`
+	RevokedReason    sql.NullString `gorm:"column:revoked_reason;size:64" json:"revokedReason"`
+}
+
+func (UserSessionTable) TableName() string {
+	return "user_sessions"
+}
+
+func (session *UserSessionTable) IsActiveAt(now time.Time) bool {
+	return !session.RevokedAt.Valid && now.Before(session.ExpiresAt)
+}
@@ -19,7 +19,7 @@ func TestIam(t *testing.T) {
 
 	iamDb := iam.IamDb{db}
 
-	err = iamDb.AutoMigrateIam()
+	err = iamDb.MigrateIam()
 	if err != nil {
 		t.Fatalf("failed to migrate database: %v", err)
 	}
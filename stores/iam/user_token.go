@@ -0,0 +1,45 @@
+package iam
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailConfirmation = "email_confirmation"
+	TokenPurposeEmailChange       = "email_change"
+	TokenPurposePhoneConfirmation = "phone_confirmation"
+	// TokenPurposeTwoFactor is the ticket of a sign in that passed the
+	// password and waits for the second factor.
+	TokenPurposeTwoFactor = "two_factor"
+	// TokenPurposeWebAuthnLogin is the challenge of a passkey login. Its
+	// user id is zero for a discoverable login.
+	TokenPurposeWebAuthnLogin = "webauthn_login"
+)
+
+// UserTokenTable is a single use token sent to a user to prove control of
+// an email address or phone number. Value holds the address the token was
+// issued for, so a token cannot be used after the address changes.
+type UserTokenTable struct {
+	Id           int32        `gorm:"column:id;primary_key;auto_increment" json:"id"`
+	Uid          uuid.UUID    `gorm:"column:uid;type:uuid;index:ix_user_tokens_uid,unique" json:"uid"`
+	UserId       int32        `gorm:"column:user_id;index:ix_user_tokens_user_id_purpose,priority:1" json:"userId"`
+	Purpose      string       `gorm:"column:purpose;size:32;index:ix_user_tokens_user_id_purpose,priority:2" json:"purpose"`
+	TokenHash    string       `gorm:"column:token_hash;size:128;index:ix_user_tokens_token_hash" json:"-"`
+	Value        string       `gorm:"column:value;size:128" json:"value"`
+	FailureCount int32        `gorm:"column:failed_attempts" json:"failedAttempts"`
+	ExpiresAt    time.Time    `gorm:"column:expires_at" json:"expiresAt"`
+	UsedAt       sql.NullTime `gorm:"column:used_at" json:"usedAt"`
+	CreatedAt    time.Time    `gorm:"column:created_at" json:"created_at"`
+}
+
+func (UserTokenTable) TableName() string {
+	return "user_tokens"
+}
+
+func (t *UserTokenTable) IsUsableAt(now time.Time) bool {
+	return !t.UsedAt.Valid && now.Before(t.ExpiresAt)
+}
@@ -0,0 +1,321 @@
+package iam
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrTokenInvalid = errors.New("token is invalid, expired or already used")
+
+type UserTokenOptions struct {
+	PasswordResetLifetime     time.Duration
+	EmailConfirmationLifetime time.Duration
+	EmailChangeLifetime       time.Duration
+	PhoneConfirmationLifetime time.Duration
+	// MaxCodeAttempts is how many wrong phone codes are accepted before the
+	// code is discarded.
+	MaxCodeAttempts int32
+}
+
+func DefaultUserTokenOptions() UserTokenOptions {
+	return UserTokenOptions{
+		PasswordResetLifetime:     time.Hour,
+		EmailConfirmationLifetime: 48 * time.Hour,
+		EmailChangeLifetime:       24 * time.Hour,
+		PhoneConfirmationLifetime: 10 * time.Minute,
+		MaxCodeAttempts:           5,
+	}
+}
+
+// UserTokenStore issues and consumes the tokens used for account recovery and
+// for verifying email addresses and phone numbers.
+type UserTokenStore struct {
+	db      *IamDb
+	Options UserTokenOptions
+	// Passwords applies the password policy to ResetPassword.
+	Passwords *PasswordStore
+	Now       func() time.Time
+}
+
+func NewUserTokenStore(db *IamDb, options *UserTokenOptions) *UserTokenStore {
+	o := DefaultUserTokenOptions()
+	if options != nil {
+		o = *options
+	}
+
+	return &UserTokenStore{
+		db:        db,
+		Options:   o,
+		Passwords: NewPasswordStore(db, nil),
+		Now:       time.Now,
+	}
+}
+
+// WithTx returns a copy of the store that works in the transaction of tx,
+// see IamDb.WithTx.
+func (s *UserTokenStore) WithTx(tx *IamDb) *UserTokenStore {
+	c := *s
+	c.db = tx
+
+	if s.Passwords != nil {
+		c.Passwords = s.Passwords.WithTx(tx)
+	}
+
+	return &c
+}
+
+// WithContext returns a copy of the store whose queries use ctx.
+func (s *UserTokenStore) WithContext(ctx context.Context) *UserTokenStore {
+	return s.WithTx(s.db.WithContext(ctx))
+}
+
+func (s *UserTokenStore) GeneratePasswordResetToken(userId int32) (string, error) {
+	return s.generate(userId, TokenPurposePasswordReset, "", uniuri.NewLen(48), s.Options.PasswordResetLifetime)
+}
+
+// ResetPassword consumes the reset token and sets the new password. The
+// security stamp changes, which ends the user's existing sessions.
+func (s *UserTokenStore) ResetPassword(token string, password string) (*UserTable, error) {
+	var user *UserTable
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		row, err := s.consume(tx, 0, TokenPurposePasswordReset, token)
+		if err != nil {
+			return err
+		}
+
+		user = &UserTable{}
+		err = tx.Preload("Password").Where("id = ?", row.UserId).First(user).Error
+		if err != nil {
+			return err
+		}
+
+		return s.Passwords.setPassword(tx, user, password)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *UserTokenStore) GenerateEmailConfirmationToken(userId int32) (string, error) {
+	user, err := s.db.GetUserById(userId)
+	if err != nil {
+		return "", err
+	}
+
+	return s.generate(userId, TokenPurposeEmailConfirmation, user.Email, uniuri.NewLen(48), s.Options.EmailConfirmationLifetime)
+}
+
+// ConfirmEmail marks the email verified, provided the user's email has not
+// changed since the token was issued.
+func (s *UserTokenStore) ConfirmEmail(token string) (*UserTable, error) {
+	return s.consumeAndUpdate(0, TokenPurposeEmailConfirmation, token, func(tx *gorm.DB, user *UserTable, row *UserTokenTable) error {
+		if user.Email != row.Value {
+			return ErrTokenInvalid
+		}
+
+		user.EmailVerified = true
+		return tx.Model(user).Select("email_verified").Updates(user).Error
+	})
+}
+
+// GenerateChangeEmailToken issues a token to be sent to the new address. The
+// email is only changed once the token is consumed.
+func (s *UserTokenStore) GenerateChangeEmailToken(userId int32, email string) (string, error) {
+	e := strings.TrimSpace(email)
+	e = strings.ToLower(e)
+	if e == "" {
+		return "", invalidField("email", "required", "email is required")
+	}
+
+	err := s.ensureEmailAvailable(s.db.DB, userId, e)
+	if err != nil {
+		return "", err
+	}
+
+	return s.generate(userId, TokenPurposeEmailChange, e, uniuri.NewLen(48), s.Options.EmailChangeLifetime)
+}
+
+func (s *UserTokenStore) ChangeEmail(token string) (*UserTable, error) {
+	return s.consumeAndUpdate(0, TokenPurposeEmailChange, token, func(tx *gorm.DB, user *UserTable, row *UserTokenTable) error {
+		err := s.ensureEmailAvailable(tx, user.Id, row.Value)
+		if err != nil {
+			return err
+		}
+
+		user.SetEmail(row.Value)
+		user.EmailVerified = true
+		return tx.Model(user).Select("email", "email_formatted", "email_verified", "concurrency_stamp").Updates(user).Error
+	})
+}
+
+// GeneratePhoneConfirmationCode issues a six digit code for phone. Codes are
+// short, so they are consumed together with the user id and limited to a few
+// attempts.
+func (s *UserTokenStore) GeneratePhoneConfirmationCode(userId int32, phone string) (string, error) {
+	p := strings.TrimSpace(phone)
+	if p == "" {
+		return "", invalidField("phoneNumber", "required", "phone number is required")
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+
+	code := fmt.Sprintf("%06d", n.Int64())
+	return s.generate(userId, TokenPurposePhoneConfirmation, p, code, s.Options.PhoneConfirmationLifetime)
+}
+
+func (s *UserTokenStore) ConfirmPhone(userId int32, code string) (*UserTable, error) {
+	return s.consumeAndUpdate(userId, TokenPurposePhoneConfirmation, code, func(tx *gorm.DB, user *UserTable, row *UserTokenTable) error {
+		user.PhoneNumber = sql.NullString{String: row.Value, Valid: true}
+		user.PhoneNumberVerified = true
+		user.ConcurrencyStamp = uuid.NewString()
+		return tx.Model(user).Select("phone_number", "phone_number_verified", "concurrency_stamp").Updates(user).Error
+	})
+}
+
+// generate stores a new token and discards the user's earlier unused tokens
+// for the same purpose, so only the latest link or code works.
+func (s *UserTokenStore) generate(userId int32, purpose string, value string, token string, lifetime time.Duration) (string, error) {
+	now := s.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&UserTokenTable{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userId, purpose).
+			Update("expires_at", now).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&UserTokenTable{
+			Uid:       uuid.New(),
+			UserId:    userId,
+			Purpose:   purpose,
+			TokenHash: hashUserToken(purpose, token),
+			Value:     value,
+			ExpiresAt: now.Add(lifetime),
+			CreatedAt: now,
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (s *UserTokenStore) consumeAndUpdate(userId int32, purpose string, token string, update func(tx *gorm.DB, user *UserTable, row *UserTokenTable) error) (*UserTable, error) {
+	var user *UserTable
+	var failed error
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		row, err := s.consume(tx, userId, purpose, token)
+		if err != nil {
+			if errors.Is(err, ErrTokenInvalid) && userId != 0 {
+				// keep the failed attempt count
+				failed = err
+				return nil
+			}
+
+			return err
+		}
+
+		user = &UserTable{}
+		err = tx.Where("id = ?", row.UserId).First(user).Error
+		if err != nil {
+			return err
+		}
+
+		return update(tx, user, row)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if failed != nil {
+		return nil, failed
+	}
+
+	return user, nil
+}
+
+// consume marks the token used. When userId is set the token is a short code
+// and a wrong value counts against the user's latest code for the purpose.
+func (s *UserTokenStore) consume(tx *gorm.DB, userId int32, purpose string, token string) (*UserTokenTable, error) {
+	now := s.Now()
+	hash := hashUserToken(purpose, strings.TrimSpace(token))
+
+	row := UserTokenTable{}
+	q := tx.Where("purpose = ? AND used_at IS NULL AND expires_at > ?", purpose, now)
+	if userId != 0 {
+		q = q.Where("user_id = ?", userId).Order("created_at DESC")
+	} else {
+		q = q.Where("token_hash = ?", hash)
+	}
+
+	res := q.Limit(1).Find(&row)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, ErrTokenInvalid
+	}
+
+	if row.TokenHash != hash {
+		row.FailureCount++
+		updates := map[string]interface{}{"failed_attempts": row.FailureCount}
+		if row.FailureCount >= s.Options.MaxCodeAttempts {
+			updates["expires_at"] = now
+		}
+
+		err := tx.Model(&row).Updates(updates).Error
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ErrTokenInvalid
+	}
+
+	res = tx.Model(&row).Where("used_at IS NULL").Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, ErrTokenInvalid
+	}
+
+	return &row, nil
+}
+
+func (s *UserTokenStore) ensureEmailAvailable(tx *gorm.DB, userId int32, email string) error {
+	var count int64
+	err := tx.Model(&UserTable{}).Where("email = ? AND id <> ?", email, userId).Count(&count).Error
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return &ConflictError{Entity: "user", Fields: []string{"email"}}
+	}
+
+	return nil
+}
+
+// hashUserToken binds the hash to the purpose so a token issued for one flow
+// can never be accepted by another.
+func hashUserToken(purpose string, token string) string {
+	return hashApiKeySecret(purpose + ":" + token)
+}
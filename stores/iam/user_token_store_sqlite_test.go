@@ -0,0 +1,104 @@
+package iam_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestUserTokenStore(t *testing.T) {
+	assert := assert2.New(t)
+	db := newIamDb(t)
+
+	user, err := db.NewUserWithPassword("ivan", "ivan@test.org", "Secr3t!pass")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	store := iam.NewUserTokenStore(db, nil)
+	stamp := user.Password.SecurityStamp
+
+	// password reset
+	token, err := store.GeneratePasswordResetToken(user.Id)
+	assert.NoError(err)
+
+	_, err = store.ConfirmEmail(token)
+	assert.ErrorIs(err, iam.ErrTokenInvalid)
+
+	reset, err := store.ResetPassword(token, "N3w!password")
+	assert.NoError(err)
+	assert.NotEqual(stamp, reset.Password.SecurityStamp)
+
+	_, err = store.ResetPassword(token, "An0ther!password")
+	assert.ErrorIs(err, iam.ErrTokenInvalid)
+
+	result, err := iam.NewSignInManager(db, nil).PasswordSignIn("ivan", "N3w!password", nil)
+	assert.NoError(err)
+	assert.True(result.Succeeded())
+
+	// only the latest token works
+	first, _ := store.GeneratePasswordResetToken(user.Id)
+	second, _ := store.GeneratePasswordResetToken(user.Id)
+	_, err = store.ResetPassword(first, "An0ther!password")
+	assert.ErrorIs(err, iam.ErrTokenInvalid)
+	_, err = store.ResetPassword(second, "An0ther!password")
+	assert.NoError(err)
+
+	// expiry
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+	token, _ = store.GenerateEmailConfirmationToken(user.Id)
+	store.Now = func() time.Time { return now.Add(49 * time.Hour) }
+	_, err = store.ConfirmEmail(token)
+	assert.ErrorIs(err, iam.ErrTokenInvalid)
+	store.Now = time.Now
+
+	// email confirmation
+	token, _ = store.GenerateEmailConfirmationToken(user.Id)
+	confirmed, err := store.ConfirmEmail(token)
+	assert.NoError(err)
+	assert.True(confirmed.EmailVerified)
+
+	// email change
+	_, err = db.NewUserWithPassword("judy", "judy@test.org", "Secr3t!pass")
+	assert.NoError(err)
+	_, err = store.GenerateChangeEmailToken(user.Id, "judy@test.org")
+	assert.Error(err)
+
+	token, err = store.GenerateChangeEmailToken(user.Id, "Ivan.New@Test.org")
+	assert.NoError(err)
+	changed, err := store.ChangeEmail(token)
+	assert.NoError(err)
+	assert.Equal("ivan.new@test.org", changed.Email)
+	assert.True(changed.EmailVerified)
+
+	// phone confirmation
+	code, err := store.GeneratePhoneConfirmationCode(user.Id, "+15551234567")
+	assert.NoError(err)
+	assert.Len(code, 6)
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	_, err = store.ConfirmPhone(user.Id, wrong)
+	assert.ErrorIs(err, iam.ErrTokenInvalid)
+
+	phone, err := store.ConfirmPhone(user.Id, code)
+	assert.NoError(err)
+	assert.True(phone.PhoneNumberVerified)
+	assert.Equal("+15551234567", phone.PhoneNumber.String)
+
+	// codes are discarded after too many wrong attempts
+	code, _ = store.GeneratePhoneConfirmationCode(user.Id, "+15557654321")
+	for i := int32(0); i < store.Options.MaxCodeAttempts; i++ {
+		_, err = store.ConfirmPhone(user.Id, wrong)
+		assert.ErrorIs(err, iam.ErrTokenInvalid)
+	}
+
+	_, err = store.ConfirmPhone(user.Id, code)
+	assert.ErrorIs(err, iam.ErrTokenInvalid)
+}
@@ -2,8 +2,12 @@ package iam
 
 import "golang.org/x/crypto/bcrypt"
 
+// SecretHashCost is the bcrypt cost used by HashSecret. Tests may lower it to
+// bcrypt.MinCost to keep hashing fast.
+var SecretHashCost = 14
+
 func HashSecret(secret string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(secret), 14)
+	bytes, err := bcrypt.GenerateFromPassword([]byte(secret), SecretHashCost)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,162 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// Attestation types recorded on a credential.
+const (
+	AttestationNone  = "none"
+	AttestationSelf  = "self"
+	AttestationBasic = "basic"
+)
+
+// idFidoGenCeAaguid is the certificate extension holding the authenticator
+// model's AAGUID.
+var idFidoGenCeAaguid = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// verifyAttestation checks the attestation statement over authData and the
+// client data hash and returns the attestation type.
+func (rp *RelyingParty) verifyAttestation(format string, stmt map[interface{}]interface{}, rawAuthData []byte, authData *AuthenticatorData, clientDataHash []byte) (string, error) {
+	switch format {
+	case "none":
+		if len(stmt) != 0 {
+			return "", errors.New("none attestation must have an empty statement")
+		}
+
+		return AttestationNone, nil
+	case "packed":
+		return rp.verifyPacked(stmt, rawAuthData, authData, clientDataHash)
+	default:
+		return "", fmt.Errorf("unsupported attestation format %q", format)
+	}
+}
+
+func (rp *RelyingParty) verifyPacked(stmt map[interface{}]interface{}, rawAuthData []byte, authData *AuthenticatorData, clientDataHash []byte) (string, error) {
+	alg, ok := cborInt(stmt, "alg")
+	if !ok {
+		return "", errors.New("packed attestation has no algorithm")
+	}
+
+	sig, ok := cborBytes(stmt, "sig")
+	if !ok {
+		return "", errors.New("packed attestation has no signature")
+	}
+
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash...)
+
+	x5c, ok := stmt["x5c"].([]interface{})
+	if !ok {
+		if alg != authData.PublicKey.Algorithm {
+			return "", errors.New("self attestation algorithm does not match the credential")
+		}
+
+		err := authData.PublicKey.Verify(signed, sig)
+		if err != nil {
+			return "", fmt.Errorf("self attestation: %w", err)
+		}
+
+		return AttestationSelf, nil
+	}
+
+	certs := make([]*x509.Certificate, 0, len(x5c))
+	for _, c := range x5c {
+		der, ok := c.([]byte)
+		if !ok {
+			return "", errors.New("x5c entry is not a certificate")
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return "", err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return "", errors.New("x5c is empty")
+	}
+
+	leaf := certs[0]
+	err := certificateAlgorithm(leaf, alg)
+	if err != nil {
+		return "", err
+	}
+
+	err = verifySignature(alg, leaf.PublicKey, signed, sig)
+	if err != nil {
+		return "", fmt.Errorf("packed attestation: %w", err)
+	}
+
+	err = checkAttestationCertificate(leaf, authData)
+	if err != nil {
+		return "", err
+	}
+
+	if rp.Options.AttestationRoots != nil {
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+
+		_, err = leaf.Verify(x509.VerifyOptions{
+			Roots:         rp.Options.AttestationRoots,
+			Intermediates: intermediates,
+			CurrentTime:   rp.Now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return "", fmt.Errorf("attestation certificate is not trusted: %w", err)
+		}
+	}
+
+	return AttestationBasic, nil
+}
+
+// checkAttestationCertificate applies the packed attestation certificate
+// requirements from the WebAuthn specification, section 8.2.1.
+func checkAttestationCertificate(cert *x509.Certificate, authData *AuthenticatorData) error {
+	if cert.Version != 3 {
+		return errors.New("attestation certificate must be version 3")
+	}
+
+	subject := cert.Subject
+	if len(subject.Country) == 0 || len(subject.Organization) == 0 || subject.CommonName == "" {
+		return errors.New("attestation certificate subject is incomplete")
+	}
+
+	if len(subject.OrganizationalUnit) != 1 || subject.OrganizationalUnit[0] != "Authenticator Attestation" {
+		return errors.New("attestation certificate must have OU \"Authenticator Attestation\"")
+	}
+
+	if cert.BasicConstraintsValid && cert.IsCA {
+		return errors.New("attestation certificate must not be a CA")
+	}
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idFidoGenCeAaguid) {
+			continue
+		}
+
+		if ext.Critical {
+			return errors.New("aaguid extension must not be critical")
+		}
+
+		var aaguid []byte
+		_, err := asn1.Unmarshal(ext.Value, &aaguid)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(aaguid, authData.Aaguid[:]) {
+			return errors.New("attestation certificate aaguid does not match the authenticator")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// Authenticator data flags.
+const (
+	FlagUserPresent    = 0x01
+	FlagUserVerified   = 0x04
+	FlagBackupEligible = 0x08
+	FlagBackedUp       = 0x10
+	FlagAttestedData   = 0x40
+	FlagExtensions     = 0x80
+)
+
+// AuthenticatorData is the parsed binary structure signed by the
+// authenticator in both ceremonies.
+type AuthenticatorData struct {
+	RpIdHash  []byte
+	Flags     byte
+	SignCount uint32
+	// set when FlagAttestedData is present
+	Aaguid       uuid.UUID
+	CredentialId []byte
+	PublicKey    *PublicKey
+	// RawPublicKey is the COSE encoding of PublicKey as sent.
+	RawPublicKey []byte
+}
+
+func (d *AuthenticatorData) UserPresent() bool {
+	return d.Flags&FlagUserPresent != 0
+}
+
+func (d *AuthenticatorData) UserVerified() bool {
+	return d.Flags&FlagUserVerified != 0
+}
+
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+
+	d := &AuthenticatorData{
+		RpIdHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rest := data[37:]
+	if d.Flags&FlagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+
+		copy(d.Aaguid[:], rest[:16])
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || n > 1023 || len(rest) < n {
+			return nil, errors.New("credential id is malformed")
+		}
+
+		d.CredentialId = rest[:n]
+		rest = rest[n:]
+
+		key, after, err := ParsePublicKey(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		d.PublicKey = key
+		d.RawPublicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+
+	if d.Flags&FlagExtensions != 0 {
+		_, after, err := decodeCbor(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		rest = after
+	}
+
+	if len(rest) != 0 {
+		return nil, errors.New("authenticator data has trailing bytes")
+	}
+
+	return d, nil
+}
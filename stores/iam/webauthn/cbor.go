@@ -0,0 +1,196 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var errCborTruncated = errors.New("cbor: unexpected end of data")
+
+// maxCborDepth bounds nesting so hostile input cannot exhaust the stack.
+const maxCborDepth = 16
+
+// decodeCbor decodes the first CBOR item in data and returns it with the
+// bytes that follow it. It covers the subset used by WebAuthn: integers,
+// byte and text strings, arrays, maps, booleans, null and floats. Integers
+// decode to int64, maps to map[interface{}]interface{}.
+func decodeCbor(data []byte) (interface{}, []byte, error) {
+	return decodeCborItem(data, 0)
+}
+
+func decodeCborItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCborDepth {
+		return nil, nil, errors.New("cbor: nesting too deep")
+	}
+
+	if len(data) == 0 {
+		return nil, nil, errCborTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		return decodeCborSimple(info, data)
+	}
+
+	arg, data, err := readCborArg(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCborTruncated
+		}
+
+		b := data[:arg]
+		if major == 3 {
+			return string(b), data[arg:], nil
+		}
+
+		return append([]byte{}, b...), data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCborTruncated
+		}
+
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			item, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCborTruncated
+		}
+
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			key, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key %T", key)
+			}
+
+			value, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			m[key] = value
+		}
+
+		return m, data, nil
+	default:
+		// tags are not used by WebAuthn
+		return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+	}
+}
+
+func readCborArg(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, nil, errCborTruncated
+		}
+
+		return uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, nil, errCborTruncated
+		}
+
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, nil, errCborTruncated
+		}
+
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, nil, errCborTruncated
+		}
+
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	default:
+		return 0, nil, errors.New("cbor: indefinite lengths are not supported")
+	}
+}
+
+func decodeCborSimple(info byte, data []byte) (interface{}, []byte, error) {
+	switch info {
+	case 20:
+		return false, data, nil
+	case 21:
+		return true, data, nil
+	case 22, 23:
+		return nil, data, nil
+	case 26:
+		if len(data) < 4 {
+			return nil, nil, errCborTruncated
+		}
+
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+	case 27:
+		if len(data) < 8 {
+			return nil, nil, errCborTruncated
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+}
+
+func cborMap(v interface{}) (map[interface{}]interface{}, bool) {
+	m, ok := v.(map[interface{}]interface{})
+	return m, ok
+}
+
+func cborInt(m map[interface{}]interface{}, key interface{}) (int64, bool) {
+	v, ok := m[key].(int64)
+	return v, ok
+}
+
+func cborBytes(m map[interface{}]interface{}, key interface{}) ([]byte, bool) {
+	v, ok := m[key].([]byte)
+	return v, ok
+}
+
+func cborString(m map[interface{}]interface{}, key interface{}) (string, bool) {
+	v, ok := m[key].(string)
+	return v, ok
+}
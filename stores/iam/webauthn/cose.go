@@ -0,0 +1,192 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers accepted for credentials.
+const (
+	AlgES256 = -7
+	AlgES384 = -35
+	AlgES512 = -36
+	AlgEdDSA = -8
+	AlgPS256 = -37
+	AlgRS256 = -257
+)
+
+const (
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+)
+
+// PublicKey is a credential public key decoded from its COSE form.
+type PublicKey struct {
+	Algorithm int64
+	Key       crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE_Key and returns it with the bytes that follow.
+func ParsePublicKey(data []byte) (*PublicKey, []byte, error) {
+	v, rest, err := decodeCbor(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, ok := cborMap(v)
+	if !ok {
+		return nil, nil, errors.New("public key is not a COSE key")
+	}
+
+	kty, _ := cborInt(m, int64(1))
+	alg, ok := cborInt(m, int64(3))
+	if !ok {
+		return nil, nil, errors.New("public key has no algorithm")
+	}
+
+	key := &PublicKey{Algorithm: alg}
+	switch kty {
+	case coseKtyEC2:
+		crv, _ := cborInt(m, int64(-1))
+		x, okx := cborBytes(m, int64(-2))
+		y, oky := cborBytes(m, int64(-3))
+		if !okx || !oky {
+			return nil, nil, errors.New("EC2 key is missing coordinates")
+		}
+
+		var curve elliptic.Curve
+		switch {
+		case crv == 1 && alg == AlgES256:
+			curve = elliptic.P256()
+		case crv == 2 && alg == AlgES384:
+			curve = elliptic.P384()
+		case crv == 3 && alg == AlgES512:
+			curve = elliptic.P521()
+		default:
+			return nil, nil, fmt.Errorf("unsupported EC2 curve %d for algorithm %d", crv, alg)
+		}
+
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, nil, errors.New("EC2 key is not on its curve")
+		}
+
+		key.Key = pub
+	case coseKtyRSA:
+		if alg != AlgRS256 && alg != AlgPS256 {
+			return nil, nil, fmt.Errorf("unsupported RSA algorithm %d", alg)
+		}
+
+		n, okn := cborBytes(m, int64(-1))
+		e, oke := cborBytes(m, int64(-2))
+		if !okn || !oke || len(e) > 4 {
+			return nil, nil, errors.New("RSA key is malformed")
+		}
+
+		exp := new(big.Int).SetBytes(e)
+		key.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+	case coseKtyOKP:
+		crv, _ := cborInt(m, int64(-1))
+		x, okx := cborBytes(m, int64(-2))
+		if alg != AlgEdDSA || crv != 6 || !okx || len(x) != ed25519.PublicKeySize {
+			return nil, nil, errors.New("unsupported OKP key")
+		}
+
+		key.Key = ed25519.PublicKey(x)
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %d", kty)
+	}
+
+	return key, rest, nil
+}
+
+// Verify checks sig over data with the key's algorithm. ECDSA signatures are
+// ASN.1 encoded as WebAuthn requires.
+func (k *PublicKey) Verify(data []byte, sig []byte) error {
+	return verifySignature(k.Algorithm, k.Key, data, sig)
+}
+
+func verifySignature(alg int64, key crypto.PublicKey, data []byte, sig []byte) error {
+	switch alg {
+	case AlgES256, AlgES384, AlgES512:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match the ECDSA algorithm")
+		}
+
+		h := hashFor(alg)
+		hh := h.New()
+		hh.Write(data)
+		if !ecdsa.VerifyASN1(pub, hh.Sum(nil), sig) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	case AlgRS256, AlgPS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match the RSA algorithm")
+		}
+
+		hh := crypto.SHA256.New()
+		hh.Write(data)
+		if alg == AlgPS256 {
+			return rsa.VerifyPSS(pub, crypto.SHA256, hh.Sum(nil), sig, nil)
+		}
+
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hh.Sum(nil), sig)
+	case AlgEdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key does not match the EdDSA algorithm")
+		}
+
+		if !ed25519.Verify(pub, data, sig) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %d", alg)
+	}
+}
+
+func hashFor(alg int64) crypto.Hash {
+	switch alg {
+	case AlgES384:
+		return crypto.SHA384
+	case AlgES512:
+		return crypto.SHA512
+	default:
+		return crypto.SHA256
+	}
+}
+
+// certificateAlgorithm checks that alg can be used with the public key of the
+// attestation certificate.
+func certificateAlgorithm(cert *x509.Certificate, alg int64) error {
+	switch cert.PublicKeyAlgorithm {
+	case x509.ECDSA:
+		if alg == AlgES256 || alg == AlgES384 || alg == AlgES512 {
+			return nil
+		}
+	case x509.RSA:
+		if alg == AlgRS256 || alg == AlgPS256 {
+			return nil
+		}
+	case x509.Ed25519:
+		if alg == AlgEdDSA {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("attestation algorithm %d does not match the certificate key", alg)
+}
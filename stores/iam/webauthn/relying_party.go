@@ -0,0 +1,606 @@
+// Package webauthn implements the relying party side of the WebAuthn
+// registration and authentication ceremonies for passkeys and security keys.
+// Credentials are stored in iam.UserCredentialTable.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	UserVerificationRequired    = "required"
+	UserVerificationPreferred   = "preferred"
+	UserVerificationDiscouraged = "discouraged"
+)
+
+var (
+	ErrSessionExpired     = errors.New("webauthn: the ceremony has expired")
+	ErrUnknownCredential  = errors.New("webauthn: credential is not registered")
+	ErrCredentialExists   = errors.New("webauthn: credential is already registered")
+	ErrCounterRegression  = errors.New("webauthn: signature counter did not increase; the credential may be cloned")
+	ErrVerificationFailed = errors.New("webauthn: verification failed")
+	ErrUserNotAllowed     = iam.ErrUserNotAllowed
+	ErrUserLockedOut      = errors.New("webauthn: the user is locked out")
+)
+
+var encoding = base64.RawURLEncoding
+
+type Options struct {
+	// RpId is the domain the credentials are scoped to, e.g. "example.com".
+	RpId   string
+	RpName string
+	// Origins lists the origins allowed in client data, e.g.
+	// "https://login.example.com".
+	Origins          []string
+	Timeout          time.Duration
+	UserVerification string
+	// AttestationRoots, when set, are the only trusted roots for packed
+	// attestation certificates. When nil the certificate is checked but its
+	// chain is not.
+	AttestationRoots *x509.CertPool
+}
+
+type RelyingParty struct {
+	db      *iam.IamDb
+	Options Options
+	Now     func() time.Time
+}
+
+func NewRelyingParty(db *iam.IamDb, options *Options) (*RelyingParty, error) {
+	if options == nil || options.RpId == "" || len(options.Origins) == 0 {
+		return nil, errors.New("webauthn: RpId and Origins are required")
+	}
+
+	o := *options
+	if o.RpName == "" {
+		o.RpName = o.RpId
+	}
+
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Minute
+	}
+
+	if o.UserVerification == "" {
+		o.UserVerification = UserVerificationPreferred
+	}
+
+	return &RelyingParty{
+		db:      db,
+		Options: o,
+		Now:     time.Now,
+	}, nil
+}
+
+// Session is the server side state of a ceremony. Keep it somewhere the
+// client cannot change, such as a server session, between Begin and Finish.
+type Session struct {
+	Challenge        string    `json:"challenge"`
+	UserId           int32     `json:"userId"`
+	UserVerification string    `json:"userVerification"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	Id         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type RelyingPartyEntity struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions is passed to navigator.credentials.create as publicKey.
+// Binary values are base64url encoded.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	Rp                     RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions is passed to navigator.credentials.get as publicKey.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RpId             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationResponse is the PublicKeyCredential returned by create with
+// its binary fields base64url encoded.
+type RegistrationResponse struct {
+	Id       string `json:"id"`
+	RawId    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the PublicKeyCredential returned by get with its
+// binary fields base64url encoded.
+type AssertionResponse struct {
+	Id       string `json:"id"`
+	RawId    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// UserHandle is the WebAuthn user id for the user, the bytes of their uid.
+func UserHandle(user *iam.UserTable) []byte {
+	return user.Uid[:]
+}
+
+// BeginRegistration starts registering a new credential for the user.
+// Credentials the user already has are excluded.
+func (rp *RelyingParty) BeginRegistration(userId int32) (*CreationOptions, *Session, error) {
+	user, err := rp.db.GetUserById(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing, err := rp.db.GetUserCredentials(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := rp.newSession(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	display := user.Name
+	if user.EmailFormatted.Valid {
+		display = user.EmailFormatted.String
+	}
+
+	options := &CreationOptions{
+		Challenge: session.Challenge,
+		Rp:        RelyingPartyEntity{Id: rp.Options.RpId, Name: rp.Options.RpName},
+		User: UserEntity{
+			Id:          encoding.EncodeToString(UserHandle(user)),
+			Name:        user.Email,
+			DisplayName: display,
+		},
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgEdDSA},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout:            rp.Options.Timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(existing),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: rp.Options.UserVerification,
+		},
+		Attestation: "direct",
+	}
+
+	return options, session, nil
+}
+
+// FinishRegistration verifies the authenticator's response and stores the
+// new credential under name.
+func (rp *RelyingParty) FinishRegistration(session *Session, response *RegistrationResponse, name string) (*iam.UserCredentialTable, error) {
+	if session == nil || session.UserId == 0 {
+		return nil, ErrVerificationFailed
+	}
+
+	rawClientData, err := rp.verifyClientData(session, response.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+
+	rawAttestation, err := encoding.DecodeString(response.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object is not base64url", ErrVerificationFailed)
+	}
+
+	v, _, err := decodeCbor(rawAttestation)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+
+	obj, ok := cborMap(v)
+	if !ok {
+		return nil, fmt.Errorf("%w: attestation object is not a map", ErrVerificationFailed)
+	}
+
+	format, _ := cborString(obj, "fmt")
+	stmt, _ := cborMap(obj["attStmt"])
+	rawAuthData, ok := cborBytes(obj, "authData")
+	if !ok || stmt == nil {
+		return nil, fmt.Errorf("%w: attestation object is incomplete", ErrVerificationFailed)
+	}
+
+	authData, err := rp.verifyAuthenticatorData(session, rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	if authData.PublicKey == nil {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrVerificationFailed)
+	}
+
+	if response.RawId != "" && response.RawId != encoding.EncodeToString(authData.CredentialId) {
+		return nil, fmt.Errorf("%w: credential id does not match the authenticator data", ErrVerificationFailed)
+	}
+
+	clientDataHash := sha256.Sum256(rawClientData)
+	attestation, err := rp.verifyAttestation(format, stmt, rawAuthData, authData, clientDataHash[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+
+	credential := &iam.UserCredentialTable{
+		Uid:             uuid.New(),
+		UserId:          session.UserId,
+		CredentialId:    encoding.EncodeToString(authData.CredentialId),
+		PublicKey:       authData.RawPublicKey,
+		Algorithm:       int32(authData.PublicKey.Algorithm),
+		SignCount:       authData.SignCount,
+		Aaguid:          authData.Aaguid,
+		AttestationType: attestation,
+		BackupEligible:  authData.Flags&FlagBackupEligible != 0,
+		BackedUp:        authData.Flags&FlagBackedUp != 0,
+		CreatedAt:       rp.Now(),
+	}
+
+	credential.SetTransports(response.Response.Transports)
+	if name != "" {
+		credential.Name = sql.NullString{String: name, Valid: true}
+	}
+
+	err = rp.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&iam.UserCredentialTable{}).Where("credential_id = ?", credential.CredentialId).Count(&count).Error
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return ErrCredentialExists
+		}
+
+		return tx.Create(credential).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return credential, nil
+}
+
+// BeginLogin starts an authentication ceremony. With a user id the
+// user's credentials are offered; with zero the authenticator picks a
+// discoverable credential (passkey) and the user is identified by it. The
+// challenge is also stored in user_tokens, so FinishLogin accepts it once.
+func (rp *RelyingParty) BeginLogin(userId int32) (*RequestOptions, *Session, error) {
+	allowed := []CredentialDescriptor{}
+	if userId != 0 {
+		credentials, err := rp.db.GetUserCredentials(userId)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(credentials) == 0 {
+			return nil, nil, ErrUnknownCredential
+		}
+
+		allowed = descriptors(credentials)
+	}
+
+	session, err := rp.newSession(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = rp.db.Create(&iam.UserTokenTable{
+		Uid:       uuid.New(),
+		UserId:    userId,
+		Purpose:   iam.TokenPurposeWebAuthnLogin,
+		TokenHash: hashChallenge(session.Challenge),
+		ExpiresAt: session.ExpiresAt,
+		CreatedAt: rp.Now(),
+	}).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options := &RequestOptions{
+		Challenge:        session.Challenge,
+		Timeout:          rp.Options.Timeout.Milliseconds(),
+		RpId:             rp.Options.RpId,
+		AllowCredentials: allowed,
+		UserVerification: session.UserVerification,
+	}
+
+	return options, session, nil
+}
+
+// FinishLogin verifies the assertion and returns the signed in user. The
+// session's challenge is spent with the first assertion that verifies; a
+// replay gets ErrSessionExpired. A sign count that fails to increase flags
+// the credential as cloned, and a flagged credential fails every login with
+// ErrCounterRegression until it is removed and registered again. Like a
+// password sign in, it fails for deleted, inactive and banned users and for
+// users locked out by failed attempts until the lock is lifted.
+func (rp *RelyingParty) FinishLogin(session *Session, response *AssertionResponse) (*iam.UserTable, *iam.UserCredentialTable, error) {
+	if session == nil {
+		return nil, nil, ErrVerificationFailed
+	}
+
+	rawId := response.RawId
+	if rawId == "" {
+		rawId = response.Id
+	}
+
+	credential := &iam.UserCredentialTable{}
+	res := rp.db.Where("credential_id = ?", rawId).Limit(1).Find(credential)
+	if res.Error != nil {
+		return nil, nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, nil, ErrUnknownCredential
+	}
+
+	if session.UserId != 0 && credential.UserId != session.UserId {
+		return nil, nil, ErrUnknownCredential
+	}
+
+	user, err := rp.db.GetUserById(credential.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if response.Response.UserHandle != "" {
+		handle, err := encoding.DecodeString(response.Response.UserHandle)
+		if err != nil || !bytes.Equal(handle, UserHandle(user)) {
+			return nil, nil, fmt.Errorf("%w: user handle does not match the credential", ErrVerificationFailed)
+		}
+	} else if session.UserId == 0 {
+		return nil, nil, fmt.Errorf("%w: discoverable login requires a user handle", ErrVerificationFailed)
+	}
+
+	rawClientData, err := rp.verifyClientData(session, response.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawAuthData, err := encoding.DecodeString(response.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: authenticator data is not base64url", ErrVerificationFailed)
+	}
+
+	authData, err := rp.verifyAuthenticatorData(session, rawAuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sig, err := encoding.DecodeString(response.Response.Signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: signature is not base64url", ErrVerificationFailed)
+	}
+
+	key, _, err := ParsePublicKey(credential.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	err = key.Verify(signed, sig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+
+	switch user.Status {
+	case iam.UserStatusInactive, iam.UserStatusBanned:
+		return nil, nil, ErrUserNotAllowed
+	case iam.UserStatusPasswordLocked:
+		return nil, nil, ErrUserLockedOut
+	}
+
+	// cause is returned after the transaction, so that the spent challenge
+	// and a clone warning commit
+	var cause error
+	err = rp.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("purpose = ? AND token_hash = ? AND user_id = ? AND expires_at > ?",
+			iam.TokenPurposeWebAuthnLogin, hashChallenge(session.Challenge), session.UserId, rp.Now()).
+			Delete(&iam.UserTokenTable{})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return ErrSessionExpired
+		}
+
+		if credential.CloneWarning {
+			cause = ErrCounterRegression
+			return nil
+		}
+
+		if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+			cause = ErrCounterRegression
+			credential.CloneWarning = true
+			return tx.Model(credential).Select("clone_warning").Updates(credential).Error
+		}
+
+		previous := credential.SignCount
+		credential.SignCount = authData.SignCount
+		credential.BackedUp = authData.Flags&FlagBackedUp != 0
+		credential.LastUsedAt = sql.NullTime{Time: rp.Now(), Valid: true}
+		res = tx.Model(credential).
+			Where("sign_count = ?", previous).
+			Select("sign_count", "backed_up", "last_used_at").
+			Updates(credential)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 && authData.SignCount != 0 {
+			// another login with this credential moved the counter first
+			cause = ErrCounterRegression
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cause != nil {
+		return nil, nil, cause
+	}
+
+	return user, credential, nil
+}
+
+func (rp *RelyingParty) newSession(userId int32) (*Session, error) {
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		Challenge:        encoding.EncodeToString(challenge),
+		UserId:           userId,
+		UserVerification: rp.Options.UserVerification,
+		ExpiresAt:        rp.Now().Add(rp.Options.Timeout),
+	}, nil
+}
+
+// hashChallenge is how a login challenge is kept in user_tokens.
+func hashChallenge(challenge string) string {
+	sum := sha256.Sum256([]byte(challenge))
+	return encoding.EncodeToString(sum[:])
+}
+
+// verifyClientData checks the type, challenge and origin of the client data
+// and returns its raw bytes for hashing.
+func (rp *RelyingParty) verifyClientData(session *Session, encoded string, ceremony string) ([]byte, error) {
+	if !rp.Now().Before(session.ExpiresAt) {
+		return nil, ErrSessionExpired
+	}
+
+	raw, err := encoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data is not base64url", ErrVerificationFailed)
+	}
+
+	cd := clientData{}
+	err = json.Unmarshal(raw, &cd)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data is not json", ErrVerificationFailed)
+	}
+
+	if cd.Type != ceremony {
+		return nil, fmt.Errorf("%w: unexpected client data type %q", ErrVerificationFailed, cd.Type)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(session.Challenge)) != 1 {
+		return nil, fmt.Errorf("%w: challenge does not match", ErrVerificationFailed)
+	}
+
+	allowed := false
+	for _, o := range rp.Options.Origins {
+		if o == cd.Origin {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return nil, fmt.Errorf("%w: origin %q is not allowed", ErrVerificationFailed, cd.Origin)
+	}
+
+	return raw, nil
+}
+
+func (rp *RelyingParty) verifyAuthenticatorData(session *Session, raw []byte) (*AuthenticatorData, error) {
+	authData, err := ParseAuthenticatorData(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+
+	rpIdHash := sha256.Sum256([]byte(rp.Options.RpId))
+	if !bytes.Equal(authData.RpIdHash, rpIdHash[:]) {
+		return nil, fmt.Errorf("%w: rp id does not match", ErrVerificationFailed)
+	}
+
+	if !authData.UserPresent() {
+		return nil, fmt.Errorf("%w: user was not present", ErrVerificationFailed)
+	}
+
+	if session.UserVerification == UserVerificationRequired && !authData.UserVerified() {
+		return nil, fmt.Errorf("%w: user was not verified", ErrVerificationFailed)
+	}
+
+	return authData, nil
+}
+
+func descriptors(credentials []iam.UserCredentialTable) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, 0, len(credentials))
+	for _, c := range credentials {
+		list = append(list, CredentialDescriptor{
+			Type:       "public-key",
+			Id:         c.CredentialId,
+			Transports: c.GetTransports(),
+		})
+	}
+
+	return list
+}
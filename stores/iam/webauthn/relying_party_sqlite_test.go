@@ -0,0 +1,193 @@
+package webauthn_test
+
+import (
+	"testing"
+
+	"github.com/gnomego/sdk/stores/iam"
+	"github.com/gnomego/sdk/stores/iam/webauthn"
+	"github.com/gnomego/sdk/stores/iam/webauthn/webauthntest"
+	assert2 "github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const origin = "https://login.example.com"
+
+func newRelyingParty(t *testing.T, name string) (*webauthn.RelyingParty, *iam.IamDb, *iam.UserTable) {
+	db, err := gorm.Open(sqlite.Open("file:"+name+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	iamDb := &iam.IamDb{DB: db}
+	err = iamDb.MigrateIam()
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	user, err := iamDb.NewUser(name, name+"@example.com")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	rp, err := webauthn.NewRelyingParty(iamDb, &webauthn.Options{
+		RpId:    "example.com",
+		Origins: []string{origin},
+	})
+	if err != nil {
+		t.Fatalf("failed to create relying party: %v", err)
+	}
+
+	return rp, iamDb, user
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	assert := assert2.New(t)
+	rp, db, user := newRelyingParty(t, "passkey")
+	authenticator := webauthntest.NewAuthenticator("none")
+
+	options, session, err := rp.BeginRegistration(user.Id)
+	assert.NoError(err)
+
+	response, err := webauthntest.NewAuthenticator("none").Create(options, "https://evil.example.org")
+	assert.NoError(err)
+	_, err = rp.FinishRegistration(session, response, "laptop")
+	assert.ErrorIs(err, webauthn.ErrVerificationFailed)
+
+	response, err = authenticator.Create(options, origin)
+	assert.NoError(err)
+	credential, err := rp.FinishRegistration(session, response, "laptop")
+	assert.NoError(err)
+	assert.Equal(webauthn.AttestationNone, credential.AttestationType)
+	assert.Equal([]string{"internal"}, credential.GetTransports())
+
+	_, err = rp.FinishRegistration(session, response, "laptop")
+	assert.ErrorIs(err, webauthn.ErrCredentialExists)
+
+	// discoverable login
+	request, session, err := rp.BeginLogin(0)
+	assert.NoError(err)
+
+	assertion, err := authenticator.Get(request, origin)
+	assert.NoError(err)
+
+	signedIn, used, err := rp.FinishLogin(session, assertion)
+	assert.NoError(err)
+	assert.Equal(user.Id, signedIn.Id)
+	assert.Equal(uint32(1), used.SignCount)
+	assert.True(used.LastUsedAt.Valid)
+
+	// the challenge is spent, so the assertion cannot be replayed
+	_, _, err = rp.FinishLogin(session, assertion)
+	assert.ErrorIs(err, webauthn.ErrSessionExpired)
+
+	// nor can a challenge the server did not issue be used
+	forged := *session
+	forged.Challenge = "forged"
+	request.Challenge = forged.Challenge
+	assertion, err = authenticator.Get(request, origin)
+	assert.NoError(err)
+	_, _, err = rp.FinishLogin(&forged, assertion)
+	assert.ErrorIs(err, webauthn.ErrSessionExpired)
+
+	// the challenge cannot be reused for a different assertion
+	other, _, err := rp.BeginLogin(user.Id)
+	assert.NoError(err)
+	assertion, err = authenticator.Get(other, origin)
+	assert.NoError(err)
+	_, _, err = rp.FinishLogin(session, assertion)
+	assert.ErrorIs(err, webauthn.ErrVerificationFailed)
+
+	// a cloned authenticator replays an old counter
+	request, session, err = rp.BeginLogin(user.Id)
+	assert.NoError(err)
+	authenticator.SetCounter(credential.CredentialId, 0)
+	assertion, err = authenticator.Get(request, origin)
+	assert.NoError(err)
+
+	_, _, err = rp.FinishLogin(session, assertion)
+	assert.ErrorIs(err, webauthn.ErrCounterRegression)
+
+	credentials, err := db.GetUserCredentials(user.Id)
+	assert.NoError(err)
+	assert.True(credentials[0].CloneWarning)
+
+	// a flagged credential stays blocked, even with a good counter
+	request, session, err = rp.BeginLogin(user.Id)
+	assert.NoError(err)
+	authenticator.SetCounter(credential.CredentialId, 100)
+	assertion, err = authenticator.Get(request, origin)
+	assert.NoError(err)
+	_, _, err = rp.FinishLogin(session, assertion)
+	assert.ErrorIs(err, webauthn.ErrCounterRegression)
+
+	// the passkey does not get past the status of the user
+	stored, err := db.GetUserById(user.Id)
+	assert.NoError(err)
+	for _, status := range []struct {
+		update func() *iam.UserTable
+		err    error
+	}{
+		{stored.SetInactive, webauthn.ErrUserNotAllowed},
+		{stored.LockPassword, webauthn.ErrUserLockedOut},
+	} {
+		assert.NoError(status.update().Save(db))
+		request, session, err = rp.BeginLogin(user.Id)
+		assert.NoError(err)
+		assertion, err = authenticator.Get(request, origin)
+		assert.NoError(err)
+		_, _, err = rp.FinishLogin(session, assertion)
+		assert.ErrorIs(err, status.err)
+		stored.SetActive()
+	}
+
+	assert.NoError(stored.Save(db))
+	assert.NoError(db.DeleteUser(user.Id))
+	request, session, err = rp.BeginLogin(0)
+	assert.NoError(err)
+	assertion, err = authenticator.Get(request, origin)
+	assert.NoError(err)
+	_, _, err = rp.FinishLogin(session, assertion)
+	assert.ErrorIs(err, iam.ErrNotFound)
+}
+
+func TestPackedAttestation(t *testing.T) {
+	assert := assert2.New(t)
+	rp, _, user := newRelyingParty(t, "packed")
+
+	self := webauthntest.NewAuthenticator("packed")
+	options, session, err := rp.BeginRegistration(user.Id)
+	assert.NoError(err)
+	response, err := self.Create(options, origin)
+	assert.NoError(err)
+	credential, err := rp.FinishRegistration(session, response, "")
+	assert.NoError(err)
+	assert.Equal(webauthn.AttestationSelf, credential.AttestationType)
+
+	authenticator, roots, err := webauthntest.NewPackedAuthenticator()
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	rp.Options.AttestationRoots = roots
+	options, session, err = rp.BeginRegistration(user.Id)
+	assert.NoError(err)
+	assert.Len(options.ExcludeCredentials, 1)
+
+	response, err = authenticator.Create(options, origin)
+	assert.NoError(err)
+	credential, err = rp.FinishRegistration(session, response, "key")
+	assert.NoError(err)
+	assert.Equal(webauthn.AttestationBasic, credential.AttestationType)
+	assert.Equal(authenticator.Aaguid, credential.Aaguid)
+
+	// an untrusted attestation root is rejected
+	other, _, err := webauthntest.NewPackedAuthenticator()
+	assert.NoError(err)
+	options, session, err = rp.BeginRegistration(user.Id)
+	assert.NoError(err)
+	response, err = other.Create(options, origin)
+	assert.NoError(err)
+	_, err = rp.FinishRegistration(session, response, "")
+	assert.ErrorIs(err, webauthn.ErrVerificationFailed)
+}
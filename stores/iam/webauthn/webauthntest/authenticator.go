@@ -0,0 +1,306 @@
+// Package webauthntest provides a software authenticator so WebAuthn
+// ceremonies can be tested without a browser or security key.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/gnomego/sdk/stores/iam/webauthn"
+	"github.com/google/uuid"
+)
+
+var encoding = base64.RawURLEncoding
+
+type credential struct {
+	id         []byte
+	key        *ecdsa.PrivateKey
+	rpId       string
+	userHandle []byte
+	counter    uint32
+}
+
+// Authenticator is an ES256 platform authenticator that always reports the
+// user present and verified. Format selects the attestation: "none" or
+// "packed". Packed uses self attestation unless AttestationKey is set.
+type Authenticator struct {
+	Aaguid          uuid.UUID
+	Format          string
+	AttestationKey  *ecdsa.PrivateKey
+	AttestationCert []byte
+
+	credentials map[string]*credential
+}
+
+func NewAuthenticator(format string) *Authenticator {
+	return &Authenticator{
+		Aaguid:      uuid.New(),
+		Format:      format,
+		credentials: map[string]*credential{},
+	}
+}
+
+// NewPackedAuthenticator returns an authenticator with a packed attestation
+// certificate and the pool holding the root that issued it.
+func NewPackedAuthenticator() (*Authenticator, *x509.CertPool, error) {
+	a := NewAuthenticator("packed")
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "webauthntest root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	rootDer, err := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rootCert, err := x509.ParseCertificate(rootDer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a.AttestationKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aaguid, err := asn1.Marshal(a.Aaguid[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{
+			Country:            []string{"US"},
+			Organization:       []string{"webauthntest"},
+			OrganizationalUnit: []string{"Authenticator Attestation"},
+			CommonName:         "webauthntest authenticator",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}, Value: aaguid},
+		},
+	}
+
+	a.AttestationCert, err = x509.CreateCertificate(rand.Reader, leaf, rootCert, &a.AttestationKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(rootCert)
+	return a, pool, nil
+}
+
+// Create answers navigator.credentials.create for origin.
+func (a *Authenticator) Create(options *webauthn.CreationOptions, origin string) (*webauthn.RegistrationResponse, error) {
+	for _, c := range options.ExcludeCredentials {
+		if _, ok := a.credentials[c.Id]; ok {
+			return nil, errors.New("authenticator already holds an excluded credential")
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 32)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := encoding.DecodeString(options.User.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &credential{id: id, key: key, rpId: options.Rp.Id, userHandle: handle}
+	a.credentials[encoding.EncodeToString(id)] = c
+
+	clientData, err := clientDataJSON("webauthn.create", options.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	authData := a.authenticatorData(c, true)
+	stmt, err := a.attestationStatement(authData, clientData, key)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := encodeCbor(cborMap{
+		{"fmt", a.Format},
+		{"attStmt", stmt},
+		{"authData", authData},
+	})
+
+	res := &webauthn.RegistrationResponse{
+		Id:    encoding.EncodeToString(id),
+		RawId: encoding.EncodeToString(id),
+		Type:  "public-key",
+	}
+
+	res.Response.ClientDataJSON = encoding.EncodeToString(clientData)
+	res.Response.AttestationObject = encoding.EncodeToString(obj)
+	res.Response.Transports = []string{"internal"}
+	return res, nil
+}
+
+// Get answers navigator.credentials.get for origin.
+func (a *Authenticator) Get(options *webauthn.RequestOptions, origin string) (*webauthn.AssertionResponse, error) {
+	var c *credential
+	if len(options.AllowCredentials) == 0 {
+		for _, candidate := range a.credentials {
+			if candidate.rpId == options.RpId {
+				c = candidate
+				break
+			}
+		}
+	} else {
+		for _, d := range options.AllowCredentials {
+			if candidate, ok := a.credentials[d.Id]; ok && candidate.rpId == options.RpId {
+				c = candidate
+				break
+			}
+		}
+	}
+
+	if c == nil {
+		return nil, errors.New("authenticator has no matching credential")
+	}
+
+	c.counter++
+	clientData, err := clientDataJSON("webauthn.get", options.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	authData := a.authenticatorData(c, false)
+	sig, err := sign(c.key, authData, clientData)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &webauthn.AssertionResponse{
+		Id:    encoding.EncodeToString(c.id),
+		RawId: encoding.EncodeToString(c.id),
+		Type:  "public-key",
+	}
+
+	res.Response.ClientDataJSON = encoding.EncodeToString(clientData)
+	res.Response.AuthenticatorData = encoding.EncodeToString(authData)
+	res.Response.Signature = encoding.EncodeToString(sig)
+	res.Response.UserHandle = encoding.EncodeToString(c.userHandle)
+	return res, nil
+}
+
+// SetCounter overwrites the sign counter of a credential, as a cloned
+// authenticator would.
+func (a *Authenticator) SetCounter(credentialId string, counter uint32) {
+	if c, ok := a.credentials[credentialId]; ok {
+		c.counter = counter
+	}
+}
+
+func (a *Authenticator) authenticatorData(c *credential, attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(c.rpId))
+	flags := byte(webauthn.FlagUserPresent | webauthn.FlagUserVerified)
+	if attested {
+		flags |= webauthn.FlagAttestedData
+	}
+
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, c.counter)
+
+	if attested {
+		data = append(data, a.Aaguid[:]...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(c.id)))
+		data = append(data, c.id...)
+		data = append(data, encodeCbor(cborMap{
+			{1, 2},
+			{3, webauthn.AlgES256},
+			{-1, 1},
+			{-2, pad(c.key.X.Bytes(), 32)},
+			{-3, pad(c.key.Y.Bytes(), 32)},
+		})...)
+	}
+
+	return data
+}
+
+func (a *Authenticator) attestationStatement(authData []byte, clientData []byte, key *ecdsa.PrivateKey) (cborMap, error) {
+	switch a.Format {
+	case "none":
+		return cborMap{}, nil
+	case "packed":
+		signer := key
+		if a.AttestationKey != nil {
+			signer = a.AttestationKey
+		}
+
+		sig, err := sign(signer, authData, clientData)
+		if err != nil {
+			return nil, err
+		}
+
+		stmt := cborMap{{"alg", webauthn.AlgES256}, {"sig", sig}}
+		if a.AttestationKey != nil {
+			stmt = append(stmt, cborPair{"x5c", []interface{}{a.AttestationCert}})
+		}
+
+		return stmt, nil
+	default:
+		return nil, errors.New("unsupported attestation format " + a.Format)
+	}
+}
+
+func sign(key *ecdsa.PrivateKey, authData []byte, clientData []byte) ([]byte, error) {
+	hash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), hash[:]...))
+	return ecdsa.SignASN1(rand.Reader, key, digest[:])
+}
+
+func clientDataJSON(typ string, challenge string, origin string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":        typ,
+		"challenge":   challenge,
+		"origin":      origin,
+		"crossOrigin": false,
+	})
+}
+
+func pad(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+
+	return append(make([]byte, n-len(b)), b...)
+}
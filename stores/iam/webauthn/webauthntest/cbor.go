@@ -0,0 +1,68 @@
+package webauthntest
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+// cborMap keeps its keys in the order given, as authenticators emit them.
+type cborMap []cborPair
+
+func encodeCbor(v interface{}) []byte {
+	switch t := v.(type) {
+	case int:
+		return encodeCborInt(int64(t))
+	case int64:
+		return encodeCborInt(t)
+	case []byte:
+		return append(cborHead(2, uint64(len(t))), t...)
+	case string:
+		return append(cborHead(3, uint64(len(t))), t...)
+	case []interface{}:
+		out := cborHead(4, uint64(len(t)))
+		for _, item := range t {
+			out = append(out, encodeCbor(item)...)
+		}
+
+		return out
+	case cborMap:
+		out := cborHead(5, uint64(len(t)))
+		for _, p := range t {
+			out = append(out, encodeCbor(p.key)...)
+			out = append(out, encodeCbor(p.value)...)
+		}
+
+		return out
+	default:
+		panic(fmt.Sprintf("webauthntest: cannot encode %T", v))
+	}
+}
+
+func encodeCborInt(n int64) []byte {
+	if n < 0 {
+		return cborHead(1, uint64(-1-n))
+	}
+
+	return cborHead(0, uint64(n))
+}
+
+func cborHead(major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return []byte{m | byte(n)}
+	case n <= 0xff:
+		return []byte{m | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{m | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{m | 26}, uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{m | 27}, n)
+	}
+}